@@ -16,9 +16,12 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"os"
 
 	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
 
 	_ "github.com/gardener/machine-controller-manager/pkg/util/client/metrics/prometheus" // for client metric registration
 	"github.com/gardener/machine-controller-manager/pkg/util/provider/app"
@@ -36,6 +39,13 @@ func main() {
 
 	s := options.NewMCServer()
 	s.AddFlags(pflag.CommandLine)
+	clientOptions := core.ClientOptions{}
+	clientOptions.AddFlags(pflag.CommandLine)
+	credentialsOptions := core.CredentialsOptions{}
+	credentialsOptions.AddFlags(pflag.CommandLine)
+	logging.AddFlags(pflag.CommandLine)
+	var healthBindAddress string
+	pflag.CommandLine.StringVar(&healthBindAddress, "provider-health-bind-address", "", "Address to serve the /healthz and /readyz probes of the provider at, which check the provider clusters, empty to disable")
 
 	flag.InitFlags()
 	logs.InitLogs()
@@ -46,7 +56,29 @@ func main() {
 		os.Exit(1)
 	}
 
-	plugin := kubevirt.NewKubevirtPlugin()
+	var cf core.ClientFactory = core.NewCachingClientFactory(clientOptions)
+	faultInjector, err := core.FaultInjectorFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, " %v\n", err)
+		os.Exit(1)
+	}
+	if faultInjector != nil {
+		cf = core.NewFaultInjectingClientFactory(cf, faultInjector)
+	}
+	healthChecker := core.NewHealthChecker(cf)
+	plugin := kubevirt.NewKubevirtPlugin(healthChecker, clientOptions, credentialsOptions)
+
+	if healthBindAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", core.HealthzHandler())
+		mux.Handle("/readyz", core.ReadyzHandler(healthChecker))
+		go func() {
+			if err := http.ListenAndServe(healthBindAddress, mux); err != nil {
+				fmt.Fprintf(os.Stderr, " %v\n", err)
+				os.Exit(1)
+			}
+		}()
+	}
 
 	if err := app.Run(s, plugin); err != nil {
 		fmt.Fprintf(os.Stderr, " %v\n", err)
@@ -0,0 +1,137 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command mcm-kubevirt provides tooling for machine classes of the provider, e.g. to lint provider specs in CI
+// with the same decoding and validation the driver uses.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+// command is a subcommand of mcm-kubevirt that is called with the arguments following its name.
+type command struct {
+	description string
+	run         func(args []string) error
+}
+
+var commands = map[string]command{
+	"render":   {description: "Render the objects CreateMachine would create for a machine class", run: runRender},
+	"validate": {description: "Validate the provider specs of machine classes", run: runValidate},
+}
+
+func main() {
+	if len(os.Args) < 2 || commands[os.Args[1]].run == nil {
+		usage()
+		os.Exit(2)
+	}
+	if err := commands[os.Args[1]].run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: mcm-kubevirt <command> [flags]\n\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].description)
+	}
+}
+
+// document is a YAML document of an input file.
+type document struct {
+	// source identifies the document in messages, i.e. the file and the index of the document in it.
+	source string
+	// name is the name of the machine class, empty for bare provider specs.
+	name string
+	// providerSpec is the provider spec JSON of the document.
+	providerSpec []byte
+}
+
+// readDocuments reads the machine classes or bare provider specs of the given YAML or JSON file, "-" for stdin.
+// Files may contain multiple documents.
+func readDocuments(file string) ([]document, error) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var documents []document
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(r))
+	for i := 0; ; i++ {
+		data, err := reader.Read()
+		if err == io.EOF {
+			return documents, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+
+		doc, err := parseDocument(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s[%d]: %w", file, i, err)
+		}
+		doc.source = fmt.Sprintf("%s[%d]", file, i)
+		documents = append(documents, doc)
+	}
+}
+
+// parseDocument returns the provider spec of the given machine class, or the given document itself if it is not
+// a machine class.
+func parseDocument(data []byte) (document, error) {
+	raw, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return document{}, err
+	}
+	var machineClass struct {
+		Kind     string `json:"kind"`
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		ProviderSpec json.RawMessage `json:"providerSpec"`
+	}
+	if err := json.Unmarshal(raw, &machineClass); err != nil {
+		return document{}, err
+	}
+	if machineClass.Kind != "MachineClass" {
+		return document{providerSpec: raw}, nil
+	}
+	if len(machineClass.ProviderSpec) == 0 {
+		return document{}, fmt.Errorf("machine class %s has no providerSpec", machineClass.Metadata.Name)
+	}
+	return document{name: machineClass.Metadata.Name, providerSpec: machineClass.ProviderSpec}, nil
+}
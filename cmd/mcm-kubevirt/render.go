@@ -0,0 +1,136 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt"
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core/fake"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/validation"
+
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	cdi "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+)
+
+// runRender prints the VirtualMachine, DataVolume and userdata Secret CreateMachine would create for a machine with
+// the given name and the provider spec of the given file. Without a kubeconfig, the objects are rendered offline for
+// an empty provider cluster, otherwise they are validated with server-side dry-run creates in the provider cluster.
+func runRender(args []string) error {
+	fs := pflag.NewFlagSet("render", pflag.ExitOnError)
+	var (
+		file             = fs.StringP("filename", "f", "", "File with machine classes or provider specs, - for stdin")
+		machineClassName = fs.String("machine-class", "", "Name of the machine class to render if the file contains several documents")
+		machineName      = fs.String("machine-name", "machine", "Name of the machine to render")
+		userDataFile     = fs.String("user-data", "", "File with the userData of the machine")
+		kubeconfigFile   = fs.String("kubeconfig", "", "Kubeconfig of the provider cluster to validate the objects with server-side dry-run creates in, rendered offline if not set")
+		serverVersion    = fs.String("server-version", "1.18", "Kubernetes version of the provider cluster to render for offline")
+		output           = fs.StringP("output", "o", "", "File to write the manifests to, stdout if not set")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("no file given, use -f")
+	}
+	if err := cdi.AddToScheme(scheme.Scheme); err != nil {
+		return err
+	}
+
+	doc, err := selectDocument(*file, *machineClassName)
+	if err != nil {
+		return err
+	}
+	providerSpec, err := kubevirt.DecodeProviderSpec(doc.providerSpec)
+	if err != nil {
+		return fmt.Errorf("could not decode provider spec of %s: %w", doc.source, err)
+	}
+	if errs := validation.ValidateKubevirtProviderSpec(providerSpec); len(errs) > 0 {
+		return fmt.Errorf("provider spec of %s is invalid: %v", doc.source, errs.ToAggregate())
+	}
+
+	secret := &corev1.Secret{Data: map[string][]byte{}}
+	if *userDataFile != "" {
+		if secret.Data["userData"], err = ioutil.ReadFile(*userDataFile); err != nil {
+			return err
+		}
+	}
+
+	var plugin *core.PluginSPIImpl
+	if *kubeconfigFile != "" {
+		if secret.Data[api.DefaultKubeconfigKey], err = ioutil.ReadFile(*kubeconfigFile); err != nil {
+			return err
+		}
+		clientOptions := core.ClientOptions{}
+		plugin, err = core.NewPluginSPIImpl(clientOptions, clientOptions)
+	} else {
+		plugin, err = newOfflinePlugin(*serverVersion)
+		// the capacity of the nodes of the provider cluster is unknown offline
+		providerSpec.CapacityCheck = false
+	}
+	if err != nil {
+		return err
+	}
+
+	result, err := plugin.DryRunCreateMachine(context.Background(), *machineName, providerSpec, secret)
+	if err != nil {
+		return fmt.Errorf("could not render machine %s: %w", *machineName, err)
+	}
+	manifests, err := result.Manifests()
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(manifests)
+		return err
+	}
+	return ioutil.WriteFile(*output, manifests, 0600)
+}
+
+// newOfflinePlugin returns a plugin for an empty in-memory provider cluster of the given Kubernetes version.
+func newOfflinePlugin(serverVersion string) (*core.PluginSPIImpl, error) {
+	cf := fake.NewClientFactory(fake.NewClient(), "default", serverVersion)
+	return core.NewPluginSPIImpl(cf, cf)
+}
+
+// selectDocument returns the document of the given file with the machine class of the given name, or the only
+// document of the file if no name is given.
+func selectDocument(file, machineClassName string) (document, error) {
+	documents, err := readDocuments(file)
+	if err != nil {
+		return document{}, err
+	}
+	if machineClassName == "" {
+		if len(documents) != 1 {
+			return document{}, fmt.Errorf("%s contains %d documents, select one with --machine-class", file, len(documents))
+		}
+		return documents[0], nil
+	}
+	for _, doc := range documents {
+		if doc.name == machineClassName {
+			return doc, nil
+		}
+	}
+	return document{}, fmt.Errorf("%s contains no machine class %s", file, machineClassName)
+}
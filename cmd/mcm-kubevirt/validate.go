@@ -0,0 +1,80 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/validation"
+
+	"github.com/spf13/pflag"
+)
+
+// runValidate decodes and validates the provider specs of the given files like the driver does, and prints
+// the field path of every error. It fails if any provider spec is invalid.
+func runValidate(args []string) error {
+	fs := pflag.NewFlagSet("validate", pflag.ExitOnError)
+	files := fs.StringSliceP("filename", "f", nil, "Files with machine classes or provider specs to validate, - for stdin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(*files) == 0 {
+		return errors.New("no files given, use -f")
+	}
+
+	invalid := 0
+	for _, file := range *files {
+		documents, err := readDocuments(file)
+		if err != nil {
+			return err
+		}
+		for _, doc := range documents {
+			if !validateDocument(os.Stdout, doc) {
+				invalid++
+			}
+		}
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d provider specs are invalid", invalid)
+	}
+	return nil
+}
+
+// validateDocument validates the provider spec of the given document and prints the result to the given writer.
+func validateDocument(w io.Writer, doc document) bool {
+	source := doc.source
+	if doc.name != "" {
+		source = fmt.Sprintf("%s (%s)", doc.source, doc.name)
+	}
+
+	providerSpec, err := kubevirt.DecodeProviderSpec(doc.providerSpec)
+	if err != nil {
+		fmt.Fprintf(w, "%s: could not decode provider spec: %v\n", source, err)
+		return false
+	}
+	errs := validation.ValidateKubevirtProviderSpec(providerSpec)
+	if len(errs) == 0 {
+		fmt.Fprintf(w, "%s: valid\n", source)
+		return true
+	}
+	for _, err := range errs {
+		fmt.Fprintf(w, "%s: %v\n", source, err)
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command rbac-generator prints the Role, RoleBinding, ClusterRole and ClusterRoleBinding that grant the provider
+// the minimal permissions it needs in a provider cluster, so that its kubeconfig doesn't need to be cluster-admin.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+
+	"github.com/spf13/pflag"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func main() {
+	var (
+		name           = pflag.String("name", "machine-controller-manager-provider-kubevirt", "Name of the generated roles and bindings")
+		namespace      = pflag.String("namespace", "default", "Namespace of the VMs in the provider cluster")
+		serviceAccount = pflag.String("service-account", "machine-controller-manager-provider-kubevirt", "Service account in the namespace of the VMs the kubeconfig of the provider authenticates as")
+		user           = pflag.String("user", "", "User the kubeconfig of the provider authenticates as, instead of the service account")
+		output         = pflag.String("output", "", "File to write the manifests to, stdout if not set")
+	)
+	pflag.Parse()
+
+	subject := rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: *serviceAccount, Namespace: *namespace}
+	if *user != "" {
+		subject = rbacv1.Subject{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: *user}
+	}
+
+	var manifests bytes.Buffer
+	manifests.WriteString("# Generated by cmd/rbac-generator, do not edit.\n")
+	for _, obj := range core.ProviderClusterRBAC(*name, *namespace, subject) {
+		manifest, err := yaml.Marshal(obj)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to marshal %s: %v\n", obj.GetObjectKind().GroupVersionKind().Kind, err)
+			os.Exit(1)
+		}
+		manifests.WriteString("---\n")
+		manifests.Write(manifest)
+	}
+
+	if *output == "" {
+		os.Stdout.Write(manifests.Bytes())
+		return
+	}
+	if err := ioutil.WriteFile(*output, manifests.Bytes(), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write manifests: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,35 @@
+#!/usr/bin/env bash
+
+# Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+# Tears down the provider cluster of the e2e tests spun up by cluster-up.sh.
+
+set -euo pipefail
+
+E2E_CLUSTER="${E2E_CLUSTER:-kind}"
+E2E_CLUSTER_NAME="${E2E_CLUSTER_NAME:-mcm-provider-kubevirt-e2e}"
+
+case "${E2E_CLUSTER}" in
+kind)
+  kind delete cluster --name "${E2E_CLUSTER_NAME}"
+  ;;
+kubevirtci)
+  make -C "${KUBEVIRTCI_DIR:?KUBEVIRTCI_DIR must point to a checkout of kubevirtci}" cluster-down
+  ;;
+*)
+  echo "unsupported E2E_CLUSTER ${E2E_CLUSTER}, expected kind or kubevirtci" >&2
+  exit 1
+  ;;
+esac
@@ -0,0 +1,67 @@
+#!/usr/bin/env bash
+
+# Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+# Spins up a provider cluster with KubeVirt and CDI for the e2e tests and writes its kubeconfig to E2E_KUBECONFIG.
+# E2E_CLUSTER selects kind (default) or kubevirtci, whose checkout is expected in KUBEVIRTCI_DIR.
+
+set -euo pipefail
+
+E2E_CLUSTER="${E2E_CLUSTER:-kind}"
+E2E_CLUSTER_NAME="${E2E_CLUSTER_NAME:-mcm-provider-kubevirt-e2e}"
+E2E_KUBECONFIG="${E2E_KUBECONFIG:-dev/e2e-kubeconfig.yaml}"
+KUBEVIRT_VERSION="${KUBEVIRT_VERSION:-v0.28.0}"
+CDI_VERSION="${CDI_VERSION:-v1.10.6}"
+
+mkdir -p "$(dirname "${E2E_KUBECONFIG}")"
+
+case "${E2E_CLUSTER}" in
+kind)
+  if ! kind get clusters | grep -qx "${E2E_CLUSTER_NAME}"; then
+    kind create cluster --name "${E2E_CLUSTER_NAME}" --wait 5m
+  fi
+  kind get kubeconfig --name "${E2E_CLUSTER_NAME}" > "${E2E_KUBECONFIG}"
+  ;;
+kubevirtci)
+  KUBEVIRTCI_DIR="${KUBEVIRTCI_DIR:?KUBEVIRTCI_DIR must point to a checkout of kubevirtci}"
+  export KUBEVIRT_PROVIDER="${KUBEVIRT_PROVIDER:-k8s-1.18}"
+  make -C "${KUBEVIRTCI_DIR}" cluster-up
+  cp "$(cd "${KUBEVIRTCI_DIR}" && cluster-up/kubeconfig.sh)" "${E2E_KUBECONFIG}"
+  ;;
+*)
+  echo "unsupported E2E_CLUSTER ${E2E_CLUSTER}, expected kind or kubevirtci" >&2
+  exit 1
+  ;;
+esac
+
+export KUBECONFIG="${E2E_KUBECONFIG}"
+
+echo ">>>>> Installing KubeVirt ${KUBEVIRT_VERSION}"
+kubectl apply -f "https://github.com/kubevirt/kubevirt/releases/download/${KUBEVIRT_VERSION}/kubevirt-operator.yaml"
+# nested virtualization is usually not available in CI, hence VMs are emulated unless E2E_EMULATION is false
+if [[ "${E2E_EMULATION:-true}" == "true" ]]; then
+  kubectl create configmap kubevirt-config -n kubevirt --from-literal debug.useEmulation=true --dry-run -o yaml | kubectl apply -f -
+fi
+kubectl apply -f "https://github.com/kubevirt/kubevirt/releases/download/${KUBEVIRT_VERSION}/kubevirt-cr.yaml"
+
+echo ">>>>> Installing CDI ${CDI_VERSION}"
+kubectl apply -f "https://github.com/kubevirt/containerized-data-importer/releases/download/${CDI_VERSION}/cdi-operator.yaml"
+kubectl apply -f "https://github.com/kubevirt/containerized-data-importer/releases/download/${CDI_VERSION}/cdi-cr.yaml"
+
+echo ">>>>> Waiting for KubeVirt and CDI to become available"
+kubectl wait -n kubevirt kv kubevirt --for condition=Available --timeout 10m
+kubectl wait cdi cdi --for condition=Available --timeout 10m
+
+echo ">>>>> Provider cluster is ready, kubeconfig written to ${E2E_KUBECONFIG}"
@@ -0,0 +1,106 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+
+	clientcmdv1 "k8s.io/client-go/tools/clientcmd/api/v1"
+)
+
+const (
+	// DefaultKubeconfigKey is the key of the credentials secret that contains the kubeconfig of the provider cluster.
+	DefaultKubeconfigKey = "kubeconfig"
+
+	// ServerKey is the key of the credentials secret that contains the URL of the API server of the provider cluster
+	// if the secret contains a bearer token instead of a kubeconfig.
+	ServerKey = "server"
+	// TokenKey is the key of the credentials secret that contains the bearer token for the provider cluster.
+	TokenKey = "token"
+	// CABundleKey is the optional key of the credentials secret that contains the CA bundle of the API server
+	// of the provider cluster.
+	CABundleKey = "ca.crt"
+	// NamespaceKey is the optional key of the credentials secret that contains the namespace of the VMs in the
+	// provider cluster, "default" if not set.
+	NamespaceKey = "namespace"
+	// CredentialsSourceKey is the optional key of the credentials secret that names the external source the kubeconfigs
+	// of the provider clusters are fetched from, e.g. "vault" or "file", instead of being stored in the secret.
+	CredentialsSourceKey = "credentialsSource"
+	// CredentialsPathKey is the key of the credentials secret that contains the location of the kubeconfigs
+	// in the external credentials source.
+	CredentialsPathKey = "credentialsPath"
+
+	// RegistrySourcePrefix is the prefix of source URLs of images that are imported from a container registry.
+	RegistrySourcePrefix = "docker://"
+
+	// DefaultVirtioDriversImage is the default container image with the virtio-win drivers ISO of Windows VMs.
+	DefaultVirtioDriversImage = "kubevirt/virtio-container-disk"
+	// DefaultPreemptiblePriorityClassName is the default PriorityClass of the VM pods of preemptible VMs.
+	DefaultPreemptiblePriorityClassName = "kubevirt-preemptible"
+	// DefaultVMTemplateRootDiskName is the default name of the root disk volume of VM templates.
+	DefaultVMTemplateRootDiskName = "rootdisk"
+)
+
+// GetKubeconfigKey returns the key of the credentials secret that contains the kubeconfig of the provider cluster
+// of the zone of the given provider spec.
+func GetKubeconfigKey(spec *KubeVirtProviderSpec) string {
+	if key, ok := spec.ZoneKubeconfigKeys[spec.Zone]; ok {
+		return key
+	}
+	return DefaultKubeconfigKey
+}
+
+// GetKubeconfig returns the kubeconfig of the provider cluster of the zone of the given provider spec from the given
+// credentials secret data. If the secret doesn't contain a kubeconfig for the default provider cluster, but the URL
+// of its API server and a bearer token, a kubeconfig is built from them, the CA bundle and the namespace.
+func GetKubeconfig(data map[string][]byte, spec *KubeVirtProviderSpec) ([]byte, error) {
+	key := GetKubeconfigKey(spec)
+	if kubeconfig, ok := data[key]; ok {
+		return kubeconfig, nil
+	}
+	if _, ok := data[ServerKey]; key != DefaultKubeconfigKey || !ok {
+		return nil, fmt.Errorf("secret %s is required field", key)
+	}
+	return kubeconfigFromToken(data)
+}
+
+// kubeconfigFromToken builds a kubeconfig from the API server URL, bearer token, CA bundle and namespace
+// in the given credentials secret data.
+func kubeconfigFromToken(data map[string][]byte) ([]byte, error) {
+	server, token := string(data[ServerKey]), string(data[TokenKey])
+	if server == "" {
+		return nil, fmt.Errorf("secret %s must not be empty", ServerKey)
+	}
+	if token == "" {
+		return nil, fmt.Errorf("secret %s is required field if secret %s is set", TokenKey, ServerKey)
+	}
+
+	const name = "provider"
+	config := clientcmdv1.Config{
+		Kind:           "Config",
+		APIVersion:     "v1",
+		Clusters:       []clientcmdv1.NamedCluster{{Name: name, Cluster: clientcmdv1.Cluster{Server: server, CertificateAuthorityData: data[CABundleKey]}}},
+		AuthInfos:      []clientcmdv1.NamedAuthInfo{{Name: name, AuthInfo: clientcmdv1.AuthInfo{Token: token}}},
+		Contexts:       []clientcmdv1.NamedContext{{Name: name, Context: clientcmdv1.Context{Cluster: name, AuthInfo: name, Namespace: string(data[NamespaceKey])}}},
+		CurrentContext: name,
+	}
+	// JSON is valid YAML, so the kubeconfig can be loaded like any other
+	kubeconfig, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("could not build kubeconfig from secret %s and %s: %v", ServerKey, TokenKey, err)
+	}
+	return kubeconfig, nil
+}
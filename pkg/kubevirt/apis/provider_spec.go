@@ -16,24 +16,92 @@ package api
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kubevirtv1 "kubevirt.io/client-go/api/v1"
 )
 
 // KubeVirtProviderSpec is the spec to be used while parsing the calls.
 type KubeVirtProviderSpec struct {
 	// Resources defines requests and limits resources of VMI
+	// Limits may exceed requests, and with OvercommitGuestOverhead the memory overhead of the VM is not requested,
+	// to overcommit the nodes of the provider cluster deliberately. The guest visible memory can be set via Memory.Guest.
 	Resources kubevirtv1.ResourceRequirements `json:"resources"`
-	// SourceURL is the HTTP URL of the source image imported by CDI.
+	// GuaranteedQoS forces the CPU and memory requests of the VMI to equal its limits, so that the virt-launcher pods
+	// of the machines land in the Guaranteed QoS class and are the last to be evicted on the provider cluster.
+	// The requests are raised to the limits if limits are given, and the limits are set to the requests otherwise.
+	// +optional
+	GuaranteedQoS bool `json:"guaranteedQoS,omitempty"`
+	// SourceURL is the HTTP URL of the source image imported by CDI, or the docker:// URL of a container image
+	// in a registry that contains the disk image, e.g. docker://registry.example.com/images/ubuntu:20.04.
 	SourceURL string `json:"sourceURL"`
+	// SourceSecretName is the optional name of a Secret in the namespace of the VM with the credentials CDI uses
+	// to pull the source image from a private HTTP server or registry, in the accessKeyId and secretKey keys.
+	// +optional
+	SourceSecretName string `json:"sourceSecretName,omitempty"`
+	// CacheSourceImage specifies whether the source image is imported only once per machine class into a cache
+	// DataVolume named after the machine class, from which the root disks of all machines of the class are cloned.
+	// Until the cache import has succeeded, root disks are imported from the SourceURL directly.
+	// +optional
+	CacheSourceImage bool `json:"cacheSourceImage,omitempty"`
 	// StorageClassName is the name which CDI uses to in order to create claims.
 	StorageClassName string `json:"storageClassName"`
 	// PVCSize is the size of the PersistentVolumeClaim that is created during the image import by CDI.
 	PVCSize resource.Quantity `json:"pvcSize"`
+	// CapacityCheck specifies whether the allocatable resources of the schedulable nodes of the provider cluster that match
+	// the NodeSelector are checked before creating a VM, to fail fast if no node can fit the resource requests of the VM.
+	// Other scheduling constraints are not considered. Requires permissions to list nodes of the provider cluster.
+	// +optional
+	CapacityCheck bool `json:"capacityCheck,omitempty"`
+	// RootDiskPciAddress is an optional PCI address of the root disk in the guest, e.g. 0000:81:01.0,
+	// to keep device naming stable across reboots and KubeVirt upgrades.
+	// +optional
+	RootDiskPciAddress string `json:"rootDiskPciAddress,omitempty"`
 	// Region is the name of the region for the VM.
 	Region string `json:"region"`
 	// Zone is the name of the zone for the VM.
 	Zone string `json:"zone"`
+	// ZoneKubeconfigKeys is an optional map from zones to keys of the credentials secret that contain the kubeconfig of
+	// the provider cluster of the zone, so that a worker pool can span several provider clusters. If the zone of the
+	// provider spec is not contained, the kubeconfig key of the credentials secret is used.
+	// +optional
+	ZoneKubeconfigKeys map[string]string `json:"zoneKubeconfigKeys,omitempty"`
+	// RegionLabelKey is the optional key of the node label of the provider cluster that holds the region.
+	// Defaults to the standard region label of the Kubernetes version of the provider cluster.
+	// +optional
+	RegionLabelKey string `json:"regionLabelKey,omitempty"`
+	// ZoneLabelKey is the optional key of the node label of the provider cluster that holds the zone.
+	// Defaults to the standard zone label of the Kubernetes version of the provider cluster.
+	// +optional
+	ZoneLabelKey string `json:"zoneLabelKey,omitempty"`
+	// NodeSelector is an optional selector which must match the labels of a node for the VM to be scheduled on it,
+	// e.g. to run worker VMs only on hypervisor nodes with local NVMe disks or GPUs.
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// PriorityClassName is the optional name of the PriorityClass of the VM pod, e.g. so that production worker VMs
+	// preempt best-effort VMs on a contended provider cluster.
+	// +optional
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+	// Preemptible specifies whether the VMs are preemptible, i.e. cheap burst capacity that is the first to go on a contended
+	// provider cluster. Their VM pods get the PriorityClass kubevirt-preemptible unless PriorityClassName is set, a low priority
+	// class that must exist in the provider cluster. Once a VMI of a preemptible VM failed or was evicted, the VM is stopped
+	// instead of being restarted, and its machine is reported as not found, so that the machine controller replaces it.
+	// Preemptible VMs cannot be live migrated.
+	// +optional
+	Preemptible bool `json:"preemptible,omitempty"`
+	// PoolAntiAffinity specifies whether a preferred pod anti-affinity keyed on the machine class label is added
+	// to the VM pod, so that VMs of the same machine class avoid being co-located on one hypervisor node.
+	// +optional
+	PoolAntiAffinity bool `json:"poolAntiAffinity,omitempty"`
+	// Affinity is an optional affinity of the VM pod. Its node affinity is merged with the one generated from
+	// the region and zone, i.e. the generated match expressions are added to all required node selector terms.
+	// +optional
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+	// ReplaceAffinity specifies whether Affinity replaces the affinity generated from the region and zone
+	// instead of being merged with it.
+	// +optional
+	ReplaceAffinity bool `json:"replaceAffinity,omitempty"`
 	// DNSConfig is the DNS configuration of the VM pod.
 	// The parameters specified here will be merged with the generated DNS configuration based on DNSPolicy.
 	// +optional
@@ -46,13 +114,61 @@ type KubeVirtProviderSpec struct {
 	// SSHKeys is an optional list of SSH public keys added to the VM (may already be included in UserData)
 	// +optional
 	SSHKeys []string `json:"sshKeys,omitempty"`
+	// SSHKeysSecretRefs is an optional list of references to keys of Secrets in the namespace of the VM that contain
+	// SSH public keys, one per line. They are resolved when the VM is created and added to the VM along with SSHKeys,
+	// so that keys can be rotated centrally without editing every machine class.
+	// +optional
+	SSHKeysSecretRefs []corev1.SecretKeySelector `json:"sshKeysSecretRefs,omitempty"`
+	// CloudInitDataSource is the cloud-init datasource through which the userData is provided to the VM.
+	// Valid values are 'NoCloud' and 'ConfigDrive', for images that only probe the ConfigDrive datasource. Defaults to 'NoCloud'.
+	// +optional
+	CloudInitDataSource CloudInitDataSource `json:"cloudInitDataSource,omitempty"`
+	// CloudInitSnippets is an optional list of references to keys of ConfigMaps in the namespace of the VM that contain
+	// additional cloud-init user data, e.g. cloud-configs or shell scripts. They are merged with the userData into a
+	// multipart archive and processed by cloud-init after it in the given order.
+	// +optional
+	CloudInitSnippets []corev1.ConfigMapKeySelector `json:"cloudInitSnippets,omitempty"`
+	// RenderUserDataTemplate specifies whether the userData, including SSH keys and cloud-init snippets, is rendered
+	// as a Go template before it is passed to the VM. The template can refer to the machine metadata
+	// {{ .MachineName }}, {{ .Namespace }}, {{ .Region }}, {{ .Zone }} and {{ .MachineClass }}, e.g. to set per-machine hostnames.
+	// +optional
+	RenderUserDataTemplate bool `json:"renderUserDataTemplate,omitempty"`
+	// NodeLabels is an optional map of labels that the kubelet sets on the node when it registers, e.g. topology or GPU type.
+	// They are passed to the kubelet through KUBELET_EXTRA_ARGS in a systemd drop-in, which requires the kubelet unit
+	// of the userData to use it. Labels in the kubernetes.io and k8s.io namespaces are subject to the NodeRestriction
+	// admission plugin. Node annotations cannot be set by the kubelet and are hence not supported.
+	// +optional
+	NodeLabels map[string]string `json:"nodeLabels,omitempty"`
 	// Networks is an optional list of networks for the VM. If any of the networks is specified as "default"
 	// the pod network won't be added, otherwise it will be added as default.
 	// +optional
 	Networks []NetworkSpec `json:"networks,omitempty"`
+	// PodNetwork is an optional configuration of the VM interface attached to the pod network.
+	// It is ignored if any of the networks is specified as "default".
+	// +optional
+	PodNetwork *PodNetworkSpec `json:"podNetwork,omitempty"`
 	// Tags is an optional map of tags that is added to the VM as labels.
 	// +optional
 	Tags map[string]string `json:"tags,omitempty"`
+	// VMAnnotations is an optional map of annotations that is added to the VM. Annotations of the provider take precedence.
+	// +optional
+	VMAnnotations map[string]string `json:"vmAnnotations,omitempty"`
+	// TemplateLabels is an optional map of labels that is added to the VMI template and hence to the virt-launcher pods,
+	// e.g. for monitoring or cost attribution in the provider cluster. Labels of the provider take precedence.
+	// +optional
+	TemplateLabels map[string]string `json:"templateLabels,omitempty"`
+	// TemplateAnnotations is an optional map of annotations that is added to the VMI template and hence to the
+	// virt-launcher pods, e.g. `sidecar.istio.io/inject: "false"` to integrate with service meshes of the provider cluster.
+	// +optional
+	TemplateAnnotations map[string]string `json:"templateAnnotations,omitempty"`
+	// GPUs is an optional list of GPUs exposed by device plugins of the provider cluster that are passed through to the VM.
+	// +optional
+	GPUs []kubevirtv1.GPU `json:"gpus,omitempty"`
+	// ExtendedResources are optional extended resources that the nodes of the machines advertise, e.g. nvidia.com/gpu
+	// for VMs with GPUs, which are part of the node template used by the cluster autoscaler to scale from zero.
+	// Defaults to one nvidia.com/gpu per GPU.
+	// +optional
+	ExtendedResources corev1.ResourceList `json:"extendedResources,omitempty"`
 	// CPU allows specifying the CPU topology of KubeVirt VM.
 	// +optional
 	CPU *kubevirtv1.CPU `json:"cpu,omitempty"`
@@ -63,8 +179,156 @@ type KubeVirtProviderSpec struct {
 	// okd - https://docs.okd.io/3.9/scaling_performance/managing_hugepages.html#huge-pages-prerequisites
 	// +optional
 	Memory *kubevirtv1.Memory `json:"memory,omitempty"`
+	// Features optionally toggles features of the VM domain like ACPI, APIC and SMM, for images that need
+	// specific firmware feature combinations. For Windows VMs, they take precedence over the Windows profile.
+	// +optional
+	Features *kubevirtv1.Features `json:"features,omitempty"`
+	// ReadinessTimeout is an optional duration for which the creation of a machine waits for the import of its root disk
+	// to succeed and for its VM to be running, so that failures surface as machine creation errors.
+	// If not specified, the creation returns as soon as the VM is created.
+	// +optional
+	ReadinessTimeout *metav1.Duration `json:"readinessTimeout,omitempty"`
+	// DeletionTimeout is an optional duration for which the deletion of a machine waits for its VM, VMI and root disk
+	// DataVolume to be gone, so that the machine is not considered deleted while its resources still hold quota.
+	// If not specified, the deletion returns as soon as the deletion of the VM is requested.
+	// +optional
+	DeletionTimeout *metav1.Duration `json:"deletionTimeout,omitempty"`
+	// GracefulShutdownTimeout is an optional duration for which the deletion of a machine waits for the guest to shut down
+	// after its VM was stopped, before the VM is deleted. It is also used as termination grace period of the VMI, after which
+	// the guest is killed. If not specified, the VM is deleted right away and the guest is killed after 30 seconds.
+	// +optional
+	GracefulShutdownTimeout *metav1.Duration `json:"gracefulShutdownTimeout,omitempty"`
+	// ShutdownTimeout is an optional duration for which the deletion of a machine waits for the VMI to be gone after its VM
+	// was stopped, i.e. for the guest to shut down or to be killed after the GracefulShutdownTimeout. The root disk is only
+	// backed up and the VM only deleted once the VMI is gone, otherwise the deletion fails and is retried by the machine controller.
+	// Defaults to the GracefulShutdownTimeout plus 30 seconds. Requires GracefulShutdownTimeout.
+	// +optional
+	ShutdownTimeout *metav1.Duration `json:"shutdownTimeout,omitempty"`
+	// BackupPolicy is an optional policy to back up the root disks of machines before they are deleted,
+	// e.g. to recover from accidental scale-downs.
+	// +optional
+	BackupPolicy *BackupPolicySpec `json:"backupPolicy,omitempty"`
+	// CrashLoopRemediation is an optional policy for VMs whose VMI is recreated repeatedly by KubeVirt, e.g. because
+	// the guest keeps crashing. Such VMs are stopped so that their machines become unhealthy and get replaced.
+	// +optional
+	CrashLoopRemediation *CrashLoopRemediationSpec `json:"crashLoopRemediation,omitempty"`
+	// EvictionStrategy is an optional strategy of the VMI on evictions, e.g. of node drains in the provider cluster.
+	// With LiveMigrate, the VMI is live migrated to another node instead of being stopped.
+	// +optional
+	EvictionStrategy *kubevirtv1.EvictionStrategy `json:"evictionStrategy,omitempty"`
+	// MigrateFromCordonedNodes specifies whether VMIs running on cordoned nodes of the provider cluster are live migrated
+	// to other nodes, e.g. ahead of hypervisor maintenance. VMIs are checked whenever the machines are listed.
+	// +optional
+	MigrateFromCordonedNodes bool `json:"migrateFromCordonedNodes,omitempty"`
+	// Adoption is an optional configuration to adopt pre-existing VMs, e.g. manually provisioned ones, instead of creating
+	// new ones. A VM is adopted if its name equals the machine name and it matches the selector.
+	// +optional
+	Adoption *AdoptionSpec `json:"adoption,omitempty"`
+	// SSHService is an optional configuration of a Service that is created for each VM to expose SSH in the provider cluster,
+	// e.g. to debug machines without console access.
+	// +optional
+	SSHService *SSHServiceSpec `json:"sshService,omitempty"`
+	// NetworkPolicy is an optional configuration of a NetworkPolicy that isolates the virt-launcher pods of the machine class,
+	// e.g. to separate the worker VMs of different shoots on a shared provider cluster. It requires the machine class tag.
+	// +optional
+	NetworkPolicy *NetworkPolicySpec `json:"networkPolicy,omitempty"`
+	// AdditionalVolumes is an optional list of additional volumes attached to the VM as disks,
+	// e.g. ConfigMaps or Secrets that contain bootstrap artifacts like registry CA bundles.
+	// +optional
+	AdditionalVolumes []AdditionalVolumeSpec `json:"additionalVolumes,omitempty"`
+	// Windows is an optional profile for VMs running Windows, e.g. of Windows worker pools. It configures the Hyper-V
+	// enlightenments and clock of the VM, buses and interface models supported by Windows, a CD-ROM with the virtio drivers,
+	// an optional sysprep answer file and a WinRM or SSH bootstrap path. The userData is passed to cloudbase-init via ConfigDrive.
+	// +optional
+	Windows *WindowsSpec `json:"windows,omitempty"`
+	// VMTemplate is an optional reference to an existing VirtualMachine or OpenShift Template, e.g. of the KubeVirt
+	// common-templates, whose VM is cloned as the base of the VMs instead of synthesizing them from scratch. The settings of
+	// the provider spec take precedence, i.e. its root disk, cloud-init disk and additional volumes replace the volumes of the
+	// base with the same name and its cloud-init volumes, and its networks replace the networks of the base if any are specified.
+	// +optional
+	VMTemplate *VMTemplateSpec `json:"vmTemplate,omitempty"`
+}
+
+// VMTemplateSpec references a VirtualMachine or an OpenShift Template that contains a VirtualMachine.
+type VMTemplateSpec struct {
+	// Kind is the kind of the referenced object, VirtualMachine or Template. Defaults to VirtualMachine.
+	// +optional
+	Kind VMTemplateKind `json:"kind,omitempty"`
+	// Name is the name of the referenced object.
+	Name string `json:"name"`
+	// Namespace is the namespace of the referenced object. Defaults to the namespace of the VMs.
+	// Templates in other namespaces, e.g. the openshift namespace of the common-templates, can be read with the
+	// cluster-scoped permissions of the provider. VirtualMachines in other namespaces require additional permissions.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// Parameters are the values of the parameters of a Template. The NAME parameter is set to the machine name.
+	// Parameters without a value and a default must not be required.
+	// +optional
+	Parameters map[string]string `json:"parameters,omitempty"`
+	// RootDiskName is the name of the volume of the base that is replaced by the root disk of the provider spec,
+	// along with its disk and DataVolumeTemplate. Defaults to rootdisk, the root disk of the common-templates.
+	// +optional
+	RootDiskName string `json:"rootDiskName,omitempty"`
+}
+
+// VMTemplateKind is a kind of objects that can be referenced as VM templates.
+type VMTemplateKind string
+
+const (
+	// VMTemplateKindVirtualMachine references a VirtualMachine, whose DataVolumeTemplates are cloned per machine
+	// with the machine name as prefix.
+	VMTemplateKindVirtualMachine VMTemplateKind = "VirtualMachine"
+	// VMTemplateKindTemplate references an OpenShift Template with exactly one VirtualMachine object, which is
+	// processed with the parameters.
+	VMTemplateKindTemplate VMTemplateKind = "Template"
+)
+
+// WindowsSpec contains the configuration of VMs running Windows.
+type WindowsSpec struct {
+	// Sysprep is an optional sysprep answer file that is attached as a CD-ROM, from which Windows setup
+	// reads it on the first boot to specialize the VM.
+	// +optional
+	Sysprep *SysprepSpec `json:"sysprep,omitempty"`
+	// VirtioDriversImage is the container image with the virtio-win drivers ISO that is attached as a CD-ROM,
+	// so that the drivers can be installed by sysprep or the userData. Defaults to kubevirt/virtio-container-disk.
+	// +optional
+	VirtioDriversImage string `json:"virtioDriversImage,omitempty"`
+	// DiskBus is the bus of the root and cloud-init disks. Defaults to sata, which Windows supports without virtio drivers.
+	// Images with the virtio drivers installed should use virtio for better performance.
+	// +optional
+	DiskBus string `json:"diskBus,omitempty"`
+	// InterfaceModel is the model of the network interfaces that don't specify one. Defaults to e1000, which Windows
+	// supports without virtio drivers.
+	// +optional
+	InterfaceModel string `json:"interfaceModel,omitempty"`
+	// Bootstrap is the remote management path that is enabled before the userData runs, WinRM or SSH. Defaults to WinRM.
+	// With SSH, the OpenSSH server is installed and the SSH keys of the provider spec are authorized for the administrators.
+	// +optional
+	Bootstrap WindowsBootstrap `json:"bootstrap,omitempty"`
 }
 
+// SysprepSpec references a sysprep answer file named unattend.xml or autounattend.xml.
+// Exactly one of the sources must be specified.
+type SysprepSpec struct {
+	// ConfigMapName is the name of a ConfigMap in the namespace of the VM that contains the answer file.
+	// +optional
+	ConfigMapName string `json:"configMapName,omitempty"`
+	// SecretName is the name of a Secret in the namespace of the VM that contains the answer file,
+	// e.g. if it contains the administrator password.
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+}
+
+// WindowsBootstrap is a remote management path of Windows VMs.
+type WindowsBootstrap string
+
+const (
+	// WindowsBootstrapWinRM enables WinRM over HTTPS with a self-signed certificate.
+	WindowsBootstrapWinRM WindowsBootstrap = "WinRM"
+	// WindowsBootstrapSSH installs and enables the OpenSSH server.
+	WindowsBootstrapSSH WindowsBootstrap = "SSH"
+)
+
 // NetworkSpec contains information about a network.
 type NetworkSpec struct {
 	// Name is the name (in the format <name> or <namespace>/<name>) of the network.
@@ -72,4 +336,168 @@ type NetworkSpec struct {
 	// Default is whether the network is the default or not.
 	// +optional
 	Default bool `json:"default,omitempty"`
+	// InterfaceSpec is the configuration of the VM interface attached to the network.
+	InterfaceSpec `json:",inline"`
+	// IPAM is an optional static IP address management configuration for the network.
+	// If specified, an IP address is allocated for each machine and configured via cloud-init instead of DHCP.
+	// +optional
+	IPAM *IPAMSpec `json:"ipam,omitempty"`
+}
+
+// IPAMSpec contains the configuration of the static IPv4 address allocation for a network.
+type IPAMSpec struct {
+	// CIDR is the subnet of the network, e.g. 10.0.0.0/24.
+	CIDR string `json:"cidr"`
+	// RangeStart is the first IP address of the subnet that is allocated to machines.
+	// Defaults to the first address of the subnet after the network address.
+	// +optional
+	RangeStart string `json:"rangeStart,omitempty"`
+	// RangeEnd is the last IP address of the subnet that is allocated to machines.
+	// Defaults to the last address of the subnet before the broadcast address.
+	// +optional
+	RangeEnd string `json:"rangeEnd,omitempty"`
+	// Gateway is the optional default gateway of the network. It is never allocated to machines.
+	// +optional
+	Gateway string `json:"gateway,omitempty"`
+	// Nameservers is an optional list of DNS servers configured for the network.
+	// +optional
+	Nameservers []string `json:"nameservers,omitempty"`
+}
+
+// PodNetworkSpec contains the configuration of the VM interface attached to the pod network.
+type PodNetworkSpec struct {
+	// Masquerade specifies whether the interface is connected to the pod network using masquerade instead of bridge.
+	// +optional
+	Masquerade bool `json:"masquerade,omitempty"`
+	// Ports is an optional list of ports that are forwarded to the VM if masquerade is used.
+	// If empty, all ports are forwarded.
+	// +optional
+	Ports []kubevirtv1.Port `json:"ports,omitempty"`
+	// InterfaceSpec is the configuration of the VM interface attached to the pod network.
+	InterfaceSpec `json:",inline"`
+}
+
+// InterfaceSpec contains the configuration of a VM network interface.
+// Its MAC address is allocated by kubemacpool if enabled for the namespace of the VM, or by KubeVirt otherwise,
+// unless a network has an IPAM configuration, for which the MAC addresses of all interfaces are derived from the machine name.
+type InterfaceSpec struct {
+	// DHCPOptions are optional DHCP options, e.g. NTP servers, that KubeVirt offers to the guest on the interface.
+	// They only apply to interfaces with bridge binding on the pod network.
+	// +optional
+	DHCPOptions *kubevirtv1.DHCPOptions `json:"dhcpOptions,omitempty"`
+	// Model is the model of the interface, e.g. e1000e for images without virtio network drivers.
+	// One of: e1000, e1000e, ne2k_pci, pcnet, rtl8139, virtio. Defaults to virtio.
+	// +optional
+	Model string `json:"model,omitempty"`
+	// PciAddress is an optional PCI address of the interface in the guest, e.g. 0000:81:01.0,
+	// to keep device naming stable across reboots and KubeVirt upgrades.
+	// +optional
+	PciAddress string `json:"pciAddress,omitempty"`
+}
+
+// CloudInitDataSource is a cloud-init datasource supported by KubeVirt.
+type CloudInitDataSource string
+
+const (
+	// CloudInitDataSourceNoCloud is the NoCloud cloud-init datasource.
+	CloudInitDataSourceNoCloud CloudInitDataSource = "NoCloud"
+	// CloudInitDataSourceConfigDrive is the ConfigDrive cloud-init datasource.
+	CloudInitDataSourceConfigDrive CloudInitDataSource = "ConfigDrive"
+)
+
+// BackupPolicySpec contains the policy to back up the root disks of machines before they are deleted.
+// The root disk is cloned into a DataVolume named `<machine>-backup-<VM UID>` after the VM has been stopped.
+type BackupPolicySpec struct {
+	// TTL is the duration for which backups are retained before they are deleted.
+	TTL metav1.Duration `json:"ttl"`
+}
+
+// CrashLoopRemediationSpec contains the policy for VMs whose VMI is recreated repeatedly.
+// The restarts are observed by watching the VMIs and whenever the machine status is checked, and reset once a VMI has been
+// running for 10 minutes.
+type CrashLoopRemediationSpec struct {
+	// MaxRestarts is the number of restarts after which the VM is stopped.
+	MaxRestarts int32 `json:"maxRestarts"`
+}
+
+// AdoptionSpec contains the configuration to adopt pre-existing VMs.
+// Adopted VMs get the tags as labels and are deleted along with their machines.
+type AdoptionSpec struct {
+	// Selector is an optional set of labels that VMs must have to be adopted.
+	// +optional
+	Selector map[string]string `json:"selector,omitempty"`
+}
+
+// SSHServiceSpec contains the configuration of the Service that exposes SSH of a VM.
+type SSHServiceSpec struct {
+	// Type is the type of the Service. Valid values are 'ClusterIP', 'NodePort' and 'LoadBalancer'. Defaults to 'ClusterIP'.
+	// +optional
+	Type corev1.ServiceType `json:"type,omitempty"`
+}
+
+// NetworkPolicySpec contains the configuration of the NetworkPolicy named after the machine class that selects the
+// virt-launcher pods of its VMs. Traffic between the pods of all machine classes of the same cluster is always allowed,
+// all other traffic only if it matches one of the rules, e.g. DNS or the API server of the shoot.
+type NetworkPolicySpec struct {
+	// ClusterName identifies the shoot of the machine class, e.g. its technical ID, and must be a valid label value.
+	// It must be the same for all machine classes of the shoot, so that its worker pools can reach each other.
+	ClusterName string `json:"clusterName"`
+	// Ingress is an optional list of rules of the traffic allowed to the virt-launcher pods.
+	// +optional
+	Ingress []networkingv1.NetworkPolicyIngressRule `json:"ingress,omitempty"`
+	// Egress is an optional list of rules of the traffic allowed from the virt-launcher pods.
+	// +optional
+	Egress []networkingv1.NetworkPolicyEgressRule `json:"egress,omitempty"`
+}
+
+// AdditionalVolumeSpec represents an additional volume attached to the VM as a disk.
+// Exactly one of the volume sources must be specified.
+type AdditionalVolumeSpec struct {
+	// Name is the name of the volume and of the disk it is attached as.
+	Name string `json:"name"`
+	// Device specifies how the volume is exposed to the VM, i.e. as a disk, LUN, CD-ROM or floppy device.
+	// LUN devices are only supported for PersistentVolumeClaim volumes. Defaults to a virtio disk.
+	// +optional
+	Device *kubevirtv1.DiskDevice `json:"device,omitempty"`
+	// Serial is the serial number of the disk, which allows identifying it in the guest, e.g. via /dev/disk/by-id.
+	// +optional
+	Serial string `json:"serial,omitempty"`
+	// DedicatedIOThread specifies whether the disk gets an IO thread of its own instead of sharing one.
+	// It is only supported for virtio disks.
+	// +optional
+	DedicatedIOThread *bool `json:"dedicatedIOThread,omitempty"`
+	// ConfigMap is a ConfigMap in the namespace of the VM that is attached as a disk.
+	// +optional
+	ConfigMap *kubevirtv1.ConfigMapVolumeSource `json:"configMap,omitempty"`
+	// Secret is a Secret in the namespace of the VM that is attached as a disk.
+	// +optional
+	Secret *kubevirtv1.SecretVolumeSource `json:"secret,omitempty"`
+	// ServiceAccount is a ServiceAccount in the namespace of the VM whose token is attached as a disk.
+	// At most one ServiceAccount volume can be attached to a VM.
+	// +optional
+	ServiceAccount *kubevirtv1.ServiceAccountVolumeSource `json:"serviceAccount,omitempty"`
+	// HostDisk is a disk image on the local filesystem of the node the VM is running on.
+	// It requires the HostDisk feature gate to be enabled in KubeVirt.
+	// +optional
+	HostDisk *kubevirtv1.HostDisk `json:"hostDisk,omitempty"`
+	// PersistentVolumeClaim is an existing PersistentVolumeClaim in the namespace of the VM.
+	// Block mode claims can be exposed as LUN devices, e.g. for clustered workloads that require SCSI commands.
+	// +optional
+	PersistentVolumeClaim *corev1.PersistentVolumeClaimVolumeSource `json:"persistentVolumeClaim,omitempty"`
+	// ContainerDisk is a disk image in a container image, which is pulled by the node the VM is running on.
+	// Images of private registries are pulled with its ImagePullSecret, a docker config Secret in the namespace of the VM.
+	// The disk is ephemeral, i.e. changes are lost when the VM is restarted.
+	// +optional
+	ContainerDisk *kubevirtv1.ContainerDiskSource `json:"containerDisk,omitempty"`
+}
+
+// NodeTemplate describes the nodes of machines created from a provider spec, so that the cluster autoscaler
+// can scale worker pools from zero.
+type NodeTemplate struct {
+	// Capacity is the capacity of the nodes, i.e. their CPU, memory, ephemeral storage and extended resources.
+	Capacity corev1.ResourceList `json:"capacity"`
+	// Region is the region of the nodes.
+	Region string `json:"region"`
+	// Zone is the zone of the nodes.
+	Zone string `json:"zone"`
 }
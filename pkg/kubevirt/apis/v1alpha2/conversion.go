@@ -0,0 +1,80 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1alpha2
+
+import (
+	"fmt"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ConvertToInternal converts the given v1alpha2 provider spec to the provider spec used by the provider.
+// It fails if root disk settings are set at the top level instead of in RootDisk.
+func ConvertToInternal(in *KubeVirtProviderSpec) (*api.KubeVirtProviderSpec, error) {
+	for _, field := range []struct {
+		name  string
+		isSet bool
+	}{
+		{"sourceURL", in.SourceURL != ""},
+		{"sourceSecretName", in.SourceSecretName != ""},
+		{"cacheSourceImage", in.CacheSourceImage},
+		{"storageClassName", in.StorageClassName != ""},
+		{"pvcSize", !in.PVCSize.IsZero()},
+		{"rootDiskPciAddress", in.RootDiskPciAddress != ""},
+	} {
+		if field.isSet {
+			return nil, fmt.Errorf("field %s is not supported in %s, use the rootDisk section instead", field.name, SchemeGroupVersion)
+		}
+	}
+
+	out := in.KubeVirtProviderSpec
+	out.SourceURL = in.RootDisk.SourceURL
+	out.SourceSecretName = in.RootDisk.SecretName
+	out.CacheSourceImage = in.RootDisk.CacheSourceImage
+	out.StorageClassName = in.RootDisk.StorageClassName
+	out.PVCSize = in.RootDisk.Size
+	out.RootDiskPciAddress = in.RootDisk.PciAddress
+	return &out, nil
+}
+
+// ConvertFromV1alpha1 converts the given v1alpha1 provider spec to a v1alpha2 provider spec.
+// Like ConvertToInternal, it doesn't deep copy maps, slices and pointers of the given provider spec.
+func ConvertFromV1alpha1(in *api.KubeVirtProviderSpec) *KubeVirtProviderSpec {
+	out := &KubeVirtProviderSpec{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: SchemeGroupVersion.String(),
+			Kind:       "KubeVirtProviderSpec",
+		},
+		RootDisk: RootDiskSpec{
+			SourceURL:        in.SourceURL,
+			SecretName:       in.SourceSecretName,
+			CacheSourceImage: in.CacheSourceImage,
+			StorageClassName: in.StorageClassName,
+			Size:             in.PVCSize,
+			PciAddress:       in.RootDiskPciAddress,
+		},
+		KubeVirtProviderSpec: *in,
+	}
+	out.SourceURL = ""
+	out.SourceSecretName = ""
+	out.CacheSourceImage = false
+	out.StorageClassName = ""
+	out.PVCSize = resource.Quantity{}
+	out.RootDiskPciAddress = ""
+	return out
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1alpha2
+
+import (
+	"reflect"
+	"testing"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestConvertToInternal(t *testing.T) {
+	in := &KubeVirtProviderSpec{
+		RootDisk: RootDiskSpec{
+			SourceURL:        "http://image.example.com/image.qcow2",
+			SecretName:       "image-credentials",
+			CacheSourceImage: true,
+			StorageClassName: "standard",
+			Size:             resource.MustParse("10Gi"),
+			PciAddress:       "0000:81:01.0",
+		},
+		KubeVirtProviderSpec: api.KubeVirtProviderSpec{Region: "local"},
+	}
+
+	out, err := ConvertToInternal(in)
+	if err != nil {
+		t.Fatalf("failed to convert provider spec: %v", err)
+	}
+	expected := &api.KubeVirtProviderSpec{
+		Region:             "local",
+		SourceURL:          "http://image.example.com/image.qcow2",
+		SourceSecretName:   "image-credentials",
+		CacheSourceImage:   true,
+		StorageClassName:   "standard",
+		PVCSize:            resource.MustParse("10Gi"),
+		RootDiskPciAddress: "0000:81:01.0",
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("expected provider spec %+v, got %+v", expected, out)
+	}
+
+	in.StorageClassName = "standard"
+	if _, err := ConvertToInternal(in); err == nil {
+		t.Fatal("expected root disk settings at the top level to be rejected")
+	}
+}
+
+func TestConvertFromV1alpha1(t *testing.T) {
+	in := &api.KubeVirtProviderSpec{
+		Region:             "local",
+		SourceURL:          "http://image.example.com/image.qcow2",
+		SourceSecretName:   "image-credentials",
+		CacheSourceImage:   true,
+		StorageClassName:   "standard",
+		PVCSize:            resource.MustParse("10Gi"),
+		RootDiskPciAddress: "0000:81:01.0",
+		Tags:               map[string]string{"mcm.gardener.cloud/machineclass": "test-machine-class"},
+	}
+	expected := *in
+
+	converted := ConvertFromV1alpha1(in)
+	if converted.APIVersion != SchemeGroupVersion.String() || converted.RootDisk.SourceURL != in.SourceURL || converted.SourceURL != "" {
+		t.Fatalf("expected the root disk settings to be moved into the root disk section, got %+v", converted)
+	}
+
+	out, err := ConvertToInternal(converted)
+	if err != nil {
+		t.Fatalf("failed to convert provider spec: %v", err)
+	}
+	if !reflect.DeepEqual(*out, expected) {
+		t.Fatalf("expected provider spec to survive the round trip %+v, got %+v", expected, *out)
+	}
+}
+
+func TestSetDefaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     api.KubeVirtProviderSpec
+		expected api.CloudInitDataSource
+	}{
+		{
+			name:     "Linux",
+			expected: api.CloudInitDataSourceNoCloud,
+		},
+		{
+			name:     "Windows",
+			spec:     api.KubeVirtProviderSpec{Windows: &api.WindowsSpec{}},
+			expected: api.CloudInitDataSourceConfigDrive,
+		},
+		{
+			name:     "explicit datasource",
+			spec:     api.KubeVirtProviderSpec{CloudInitDataSource: api.CloudInitDataSourceConfigDrive},
+			expected: api.CloudInitDataSourceConfigDrive,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec := &KubeVirtProviderSpec{KubeVirtProviderSpec: test.spec}
+			SetDefaults(spec)
+			if spec.CloudInitDataSource != test.expected {
+				t.Fatalf("expected cloud-init datasource %s, got %s", test.expected, spec.CloudInitDataSource)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package v1alpha2 contains version v1alpha2 of the provider spec, which groups the root disk settings
+// into a section of their own, so that disks can evolve independently from the rest of the spec.
+package v1alpha2
+
+import (
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// SchemeGroupVersion is the version of the provider spec represented by this package.
+var SchemeGroupVersion = schema.GroupVersion{Group: api.GroupName, Version: "v1alpha2"}
+
+// KubeVirtProviderSpec is the v1alpha2 provider spec. Apart from the root disk settings, which are part of RootDisk
+// and must not be set at the top level, it has the same fields as the v1alpha1 provider spec.
+type KubeVirtProviderSpec struct {
+	metav1.TypeMeta `json:",inline"`
+	// RootDisk specifies the root disk of the VM.
+	RootDisk RootDiskSpec `json:"rootDisk"`
+
+	api.KubeVirtProviderSpec `json:",inline"`
+}
+
+// RootDiskSpec specifies the root disk of a VM, which is imported by CDI from a source image.
+type RootDiskSpec struct {
+	// SourceURL is the HTTP URL of the source image imported by CDI, or the docker:// URL of a container image
+	// in a registry that contains the disk image.
+	SourceURL string `json:"sourceURL"`
+	// SecretName is the optional name of a Secret in the namespace of the VM with the credentials CDI uses
+	// to pull the source image, in the accessKeyId and secretKey keys.
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+	// CacheSourceImage specifies whether the source image is imported only once per machine class into a cache
+	// DataVolume named after the machine class, from which the root disks of all machines of the class are cloned.
+	// +optional
+	CacheSourceImage bool `json:"cacheSourceImage,omitempty"`
+	// StorageClassName is the name of the storage class of the PersistentVolumeClaim of the root disk.
+	StorageClassName string `json:"storageClassName"`
+	// Size is the size of the PersistentVolumeClaim of the root disk.
+	Size resource.Quantity `json:"size"`
+	// PciAddress is an optional PCI address of the root disk in the guest, e.g. 0000:81:01.0.
+	// +optional
+	PciAddress string `json:"pciAddress,omitempty"`
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package conformance contains a suite that checks that a driver meets the expectations of the machine controller
+// manager on the driver contract, i.e. idempotent creates and deletes, NotFound semantics and machine error codes.
+// It runs against both the fake and the real implementation of the PluginSPI, so that both stay aligned.
+package conformance
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gardener/machine-controller-manager/pkg/apis/machine/v1alpha1"
+	"github.com/gardener/machine-controller-manager/pkg/util/provider/driver"
+	"github.com/gardener/machine-controller-manager/pkg/util/provider/machinecodes/codes"
+	"github.com/gardener/machine-controller-manager/pkg/util/provider/machinecodes/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Suite is the conformance suite of a driver.
+type Suite struct {
+	// NewDriver returns a driver of an empty provider cluster. It is called once per test case.
+	NewDriver func(t *testing.T) driver.Driver
+	// MachineClass is the machine class the machines of the test cases are created with.
+	MachineClass *v1alpha1.MachineClass
+	// Secret is the credentials secret of the machine class.
+	Secret *corev1.Secret
+}
+
+// Run runs the test cases of the suite as subtests of the given test.
+func (s Suite) Run(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		test func(t *testing.T, d driver.Driver)
+	}{
+		{"CreateMachineIsIdempotent", s.testCreateMachineIsIdempotent},
+		{"GetMachineStatusOfCreatedMachine", s.testGetMachineStatusOfCreatedMachine},
+		{"GetMachineStatusOfMissingMachine", s.testGetMachineStatusOfMissingMachine},
+		{"DeleteMachineIsIdempotent", s.testDeleteMachineIsIdempotent},
+		{"ListMachinesOfMachineClass", s.testListMachinesOfMachineClass},
+		{"InvalidProviderSpec", s.testInvalidProviderSpec},
+		{"InvalidSecret", s.testInvalidSecret},
+		{"GetVolumeIDs", s.testGetVolumeIDs},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, s.NewDriver(t))
+		})
+	}
+}
+
+func (s Suite) testCreateMachineIsIdempotent(t *testing.T, d driver.Driver) {
+	first := s.createMachine(t, d, "machine-0")
+	second := s.createMachine(t, d, "machine-0")
+	if first.ProviderID != second.ProviderID {
+		t.Errorf("expected repeated CreateMachine to return provider ID %q, got %q", first.ProviderID, second.ProviderID)
+	}
+}
+
+func (s Suite) testGetMachineStatusOfCreatedMachine(t *testing.T, d driver.Driver) {
+	created := s.createMachine(t, d, "machine-0")
+	response, err := d.GetMachineStatus(context.Background(), &driver.GetMachineStatusRequest{Machine: newMachine("machine-0", created.ProviderID), MachineClass: s.MachineClass, Secret: s.Secret})
+	if err != nil {
+		t.Fatalf("failed to get machine status: %v", err)
+	}
+	if response.ProviderID != created.ProviderID || response.NodeName != "machine-0" {
+		t.Errorf("expected provider ID %q and node name machine-0, got %q and %q", created.ProviderID, response.ProviderID, response.NodeName)
+	}
+}
+
+func (s Suite) testGetMachineStatusOfMissingMachine(t *testing.T, d driver.Driver) {
+	_, err := d.GetMachineStatus(context.Background(), &driver.GetMachineStatusRequest{Machine: newMachine("missing", ""), MachineClass: s.MachineClass, Secret: s.Secret})
+	expectCode(t, err, codes.NotFound)
+}
+
+func (s Suite) testDeleteMachineIsIdempotent(t *testing.T, d driver.Driver) {
+	created := s.createMachine(t, d, "machine-0")
+	machine := newMachine("machine-0", created.ProviderID)
+	for i := 0; i < 2; i++ {
+		if _, err := d.DeleteMachine(context.Background(), &driver.DeleteMachineRequest{Machine: machine, MachineClass: s.MachineClass, Secret: s.Secret}); err != nil {
+			t.Fatalf("failed to delete machine for the %d. time: %v", i+1, err)
+		}
+	}
+	_, err := d.GetMachineStatus(context.Background(), &driver.GetMachineStatusRequest{Machine: machine, MachineClass: s.MachineClass, Secret: s.Secret})
+	expectCode(t, err, codes.NotFound)
+}
+
+func (s Suite) testListMachinesOfMachineClass(t *testing.T, d driver.Driver) {
+	kept := s.createMachine(t, d, "machine-0")
+	deleted := s.createMachine(t, d, "machine-1")
+	if _, err := d.DeleteMachine(context.Background(), &driver.DeleteMachineRequest{Machine: newMachine("machine-1", deleted.ProviderID), MachineClass: s.MachineClass, Secret: s.Secret}); err != nil {
+		t.Fatalf("failed to delete machine: %v", err)
+	}
+
+	response, err := d.ListMachines(context.Background(), &driver.ListMachinesRequest{MachineClass: s.MachineClass, Secret: s.Secret})
+	if err != nil {
+		t.Fatalf("failed to list machines: %v", err)
+	}
+	if len(response.MachineList) != 1 || response.MachineList[kept.ProviderID] != "machine-0" {
+		t.Errorf("expected only machine-0 with provider ID %q to be listed, got %v", kept.ProviderID, response.MachineList)
+	}
+}
+
+func (s Suite) testInvalidProviderSpec(t *testing.T, d driver.Driver) {
+	machineClass := s.MachineClass.DeepCopy()
+	machineClass.ProviderSpec = runtime.RawExtension{Raw: []byte(`{"apiVersion":"unknown/v1"}`)}
+	_, err := d.CreateMachine(context.Background(), &driver.CreateMachineRequest{Machine: newMachine("machine-0", ""), MachineClass: machineClass, Secret: s.Secret})
+	expectCode(t, err, codes.Internal)
+}
+
+func (s Suite) testInvalidSecret(t *testing.T, d driver.Driver) {
+	_, err := d.CreateMachine(context.Background(), &driver.CreateMachineRequest{Machine: newMachine("machine-0", ""), MachineClass: s.MachineClass, Secret: &corev1.Secret{}})
+	expectCode(t, err, codes.Internal)
+}
+
+func (s Suite) testGetVolumeIDs(t *testing.T, d driver.Driver) {
+	response, err := d.GetVolumeIDs(context.Background(), &driver.GetVolumeIDsRequest{PVSpecs: []*corev1.PersistentVolumeSpec{
+		{PersistentVolumeSource: corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{Driver: "csi.kubevirt.io", VolumeHandle: "volume-0"}}},
+		{PersistentVolumeSource: corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{Driver: "other.csi.example.com", VolumeHandle: "volume-1"}}},
+		{PersistentVolumeSource: corev1.PersistentVolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/tmp"}}},
+	}})
+	if err != nil {
+		t.Fatalf("failed to get volume IDs: %v", err)
+	}
+	if len(response.VolumeIDs) != 1 || response.VolumeIDs[0] != "volume-0" {
+		t.Errorf("expected only the volume ID of the KubeVirt CSI volume, got %v", response.VolumeIDs)
+	}
+}
+
+// createMachine creates a machine with the given name and checks the response.
+func (s Suite) createMachine(t *testing.T, d driver.Driver, name string) *driver.CreateMachineResponse {
+	t.Helper()
+	response, err := d.CreateMachine(context.Background(), &driver.CreateMachineRequest{Machine: newMachine(name, ""), MachineClass: s.MachineClass, Secret: s.Secret})
+	if err != nil {
+		t.Fatalf("failed to create machine %s: %v", name, err)
+	}
+	if response.ProviderID == "" || response.NodeName != name {
+		t.Fatalf("expected a provider ID and node name %s, got %+v", name, response)
+	}
+	return response
+}
+
+func newMachine(name, providerID string) *v1alpha1.Machine {
+	return &v1alpha1.Machine{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       v1alpha1.MachineSpec{ProviderID: providerID},
+	}
+}
+
+// expectCode checks that the given error is a machine error with the given code, as the machine controller
+// derives its retry behavior from the code.
+func expectCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("expected an error with code %s", code)
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		t.Fatalf("expected a machine error with code %s, got %v", code, err)
+	}
+	if s.Code() != code {
+		t.Errorf("expected code %s, got %s: %s", code, s.Code(), s.Message())
+	}
+}
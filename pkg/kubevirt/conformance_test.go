@@ -0,0 +1,60 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubevirt
+
+import (
+	"testing"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/conformance"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core/fake"
+
+	"github.com/gardener/machine-controller-manager/pkg/util/provider/driver"
+	"k8s.io/client-go/kubernetes/scheme"
+	cdi "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+)
+
+func TestConformance(t *testing.T) {
+	if err := cdi.AddToScheme(scheme.Scheme); err != nil {
+		t.Fatalf("failed to add CDI to scheme: %v", err)
+	}
+	machineClass, err := fake.NewMachineClass("test-class", fake.NewProviderSpec("test-class"))
+	if err != nil {
+		t.Fatalf("failed to create machine class: %v", err)
+	}
+
+	for name, newSPI := range map[string]func(t *testing.T) PluginSPI{
+		"fake": func(*testing.T) PluginSPI {
+			return fake.NewPluginSPI("default")
+		},
+		"real": func(t *testing.T) PluginSPI {
+			cf := fake.NewClientFactory(fake.NewClient(), "default", "1.18")
+			plugin, err := core.NewPluginSPIImpl(cf, cf)
+			if err != nil {
+				t.Fatalf("failed to create plugin: %v", err)
+			}
+			return plugin
+		},
+	} {
+		newSPI := newSPI
+		t.Run(name, conformance.Suite{
+			NewDriver: func(t *testing.T) driver.Driver {
+				return &MachinePlugin{SPI: newSPI(t)}
+			},
+			MachineClass: machineClass,
+			Secret:       fake.NewSecret(),
+		}.Run)
+	}
+}
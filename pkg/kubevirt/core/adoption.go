@@ -0,0 +1,135 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// adoptVM adopts the pre-existing VM with the given name if it matches the selector of the given adoption spec, by adding
+// the labels of the provider spec, the machine label, the provider ID format annotation and the finalizer to it.
+// It returns the adopted VM, or nil if the VM doesn't exist or is already labelled as a machine, as it is not adopted again then.
+func (p PluginSPIImpl) adoptVM(ctx context.Context, c client.Client, machineName, namespace string, providerSpec *api.KubeVirtProviderSpec) (*kubevirtv1.VirtualMachine, error) {
+	virtualMachine := &kubevirtv1.VirtualMachine{}
+	key := types.NamespacedName{Namespace: namespace, Name: machineName}
+	if err := c.Get(ctx, key, virtualMachine); err != nil {
+		if kerrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get VirtualMachine: %w", err)
+	}
+
+	if _, ok := virtualMachine.Labels[machineLabel]; ok {
+		return nil, nil
+	}
+	if !labels.SelectorFromSet(providerSpec.Adoption.Selector).Matches(labels.Set(virtualMachine.Labels)) {
+		return nil, fmt.Errorf("VirtualMachine %s already exists but doesn't match the adoption selector", machineName)
+	}
+
+	vmLabels := map[string]string{}
+	for k, v := range providerSpec.Tags {
+		vmLabels[k] = v
+	}
+	vmLabels[machineLabel] = machineName
+	if err := applyVM(ctx, c, virtualMachine, adoptionFieldManager, map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      vmLabels,
+			"annotations": map[string]string{providerIDFormatAnnotation: providerIDFormatV2},
+			"finalizers":  []string{vmFinalizer},
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to adopt VirtualMachine %s: %w", machineName, err)
+	}
+
+	logging.FromContext(ctx).V(2).Info("adopted pre-existing VirtualMachine", "vm", machineName)
+	p.recordEvent(ctx, c, virtualMachine, corev1.EventTypeNormal, eventReasonAdopted, "Adopted pre-existing VirtualMachine for machine %s", machineName)
+	return virtualMachine, nil
+}
+
+// labelLegacyVM adds the machine label to the given VM if it was created by a former version of the provider without it,
+// i.e. if it has the labels of the given provider spec, so that it is listed as a managed VM again. VMs are not labelled
+// if adoption is enabled without labels in the provider spec, as pre-existing VMs are adopted by CreateMachine then.
+func labelLegacyVM(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine, providerSpec *api.KubeVirtProviderSpec) error {
+	if _, ok := virtualMachine.Labels[machineLabel]; ok || !isMatchingVM(virtualMachine, providerSpec.Tags) {
+		return nil
+	}
+	if providerSpec.Adoption != nil && len(providerSpec.Tags) == 0 {
+		return nil
+	}
+
+	if err := applyVM(ctx, c, virtualMachine, machineLabelFieldManager, map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]string{machineLabel: virtualMachine.Name},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to add machine label to VirtualMachine %s: %w", virtualMachine.Name, err)
+	}
+	logging.FromContext(ctx).V(2).Info("added machine label to VirtualMachine created by a former version", "vm", virtualMachine.Name)
+	return nil
+}
+
+// labelLegacyVMs adds the machine label to all VMs in the given namespace that were created by a former version of the
+// provider with the labels of the given provider spec, see labelLegacyVM. It returns the labelled VMs, which may not be
+// in the cache of listCachedVMs yet. Nothing is labelled without labels in the provider spec, as legacy VMs can't be told
+// apart from unrelated VMs in the namespace then.
+func labelLegacyVMs(ctx context.Context, c client.Client, namespace string, providerSpec *api.KubeVirtProviderSpec) ([]kubevirtv1.VirtualMachine, error) {
+	if len(providerSpec.Tags) == 0 {
+		return nil, nil
+	}
+
+	requirement, err := labels.NewRequirement(machineLabel, selection.DoesNotExist, nil)
+	if err != nil {
+		return nil, err
+	}
+	virtualMachineList := &kubevirtv1.VirtualMachineList{}
+	if err := c.List(ctx, virtualMachineList, client.InNamespace(namespace), client.MatchingLabelsSelector{
+		Selector: labels.SelectorFromSet(providerSpec.Tags).Add(*requirement),
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list VirtualMachines without machine label: %w", err)
+	}
+
+	for i := range virtualMachineList.Items {
+		if err := labelLegacyVM(ctx, c, &virtualMachineList.Items[i], providerSpec); err != nil {
+			return nil, err
+		}
+	}
+	return virtualMachineList.Items, nil
+}
+
+// appendMissingVMs appends the given VMs to the list unless a VM with the same name is in it already.
+func appendMissingVMs(virtualMachines, additional []kubevirtv1.VirtualMachine) []kubevirtv1.VirtualMachine {
+	names := make(map[string]struct{}, len(virtualMachines))
+	for _, virtualMachine := range virtualMachines {
+		names[virtualMachine.Name] = struct{}{}
+	}
+	for _, virtualMachine := range additional {
+		if _, ok := names[virtualMachine.Name]; !ok {
+			virtualMachines = append(virtualMachines, virtualMachine)
+		}
+	}
+	return virtualMachines
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The field managers of the server-side applies of the provider. Each kind of update has its own field manager, as
+// server-side apply removes the fields a field manager applied before but doesn't apply again.
+const (
+	// runningFieldManager manages the spec.running field of VMs.
+	runningFieldManager = "machine-controller-manager-provider-kubevirt-running"
+	// adoptionFieldManager manages the labels, annotations and finalizer of adopted VMs.
+	adoptionFieldManager = "machine-controller-manager-provider-kubevirt-adoption"
+	// machineLabelFieldManager manages the machine label of VMs created by former versions of the provider.
+	machineLabelFieldManager = "machine-controller-manager-provider-kubevirt-machine-label"
+	// statusFieldManager manages the status annotations of VMs.
+	statusFieldManager = "machine-controller-manager-provider-kubevirt-status"
+	// crashLoopFieldManager manages the annotations of VMs with their last observed VMI and its restarts.
+	crashLoopFieldManager = "machine-controller-manager-provider-kubevirt-crash-loop"
+	// runningVMIFieldManager manages the annotation of preemptible VMs with the UID of their last running VMI.
+	runningVMIFieldManager = "machine-controller-manager-provider-kubevirt-running-vmi"
+)
+
+// applyVM applies the given fields of the given VM with server-side apply as the given field manager, taking over
+// the ownership of the fields from other field managers, and updates the VM from the response. The fields are a partial
+// VM without apiVersion, kind and name, which are added from the VM. Fields managed by other controllers are kept.
+func applyVM(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine, fieldManager string, fields map[string]interface{}) error {
+	patch, err := vmApplyPatch(virtualMachine, fields)
+	if err != nil {
+		return err
+	}
+	return c.Patch(ctx, virtualMachine, client.ConstantPatch(types.ApplyPatchType, patch), client.FieldOwner(fieldManager), client.ForceOwnership)
+}
+
+// runningFields returns the fields of VMs that set their spec.running field to the given value.
+func runningFields(running bool) map[string]interface{} {
+	return map[string]interface{}{
+		"spec": map[string]interface{}{"running": running},
+	}
+}
+
+// statusFields returns the fields of VMs that record the given status and status message in their annotations.
+func statusFields(status, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				statusAnnotation:        status,
+				statusMessageAnnotation: message,
+			},
+		},
+	}
+}
+
+// runningVMIFields returns the fields of VMs that record the given UID of their running VMI in their annotations.
+func runningVMIFields(uid string) map[string]interface{} {
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				runningVMIAnnotation: uid,
+			},
+		},
+	}
+}
+
+// vmApplyPatch returns the server-side apply patch of the given fields of the given VM.
+func vmApplyPatch(virtualMachine *kubevirtv1.VirtualMachine, fields map[string]interface{}) ([]byte, error) {
+	metadata, _ := fields["metadata"].(map[string]interface{})
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	metadata["name"] = virtualMachine.Name
+	metadata["namespace"] = virtualMachine.Namespace
+
+	applied := map[string]interface{}{
+		"apiVersion": kubevirtv1.VirtualMachineGroupVersionKind.GroupVersion().String(),
+		"kind":       kubevirtv1.VirtualMachineGroupVersionKind.Kind,
+	}
+	for k, v := range fields {
+		applied[k] = v
+	}
+	applied["metadata"] = metadata
+
+	patch, err := json.Marshal(applied)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal apply patch of VirtualMachine %s: %w", virtualMachine.Name, err)
+	}
+	return patch, nil
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	cdi "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// backupLabel is the label added to the root disk backup DataVolumes, with the machine name as value.
+	backupLabel = "kubevirt.provider.extensions.gardener.cloud/backup"
+	// backupExpirationAnnotation is the annotation on root disk backup DataVolumes that contains the time
+	// in RFC 3339 format after which they are deleted.
+	backupExpirationAnnotation = "kubevirt.provider.extensions.gardener.cloud/backup-expiration"
+	// backupSourceUIDAnnotation is the annotation on root disk backup DataVolumes that contains the UID of the backed up VM.
+	backupSourceUIDAnnotation = "kubevirt.provider.extensions.gardener.cloud/backup-source-uid"
+)
+
+// backupDataVolumeName returns the name of the DataVolume that contains the backup of the root disk of the given VM.
+// It contains the UID of the VM, so that it neither matches the backups of previous VMs of the same machine
+// nor the root disk DataVolumes of other machines.
+func backupDataVolumeName(virtualMachine *kubevirtv1.VirtualMachine) string {
+	return fmt.Sprintf("%s-backup-%s", virtualMachine.Name, virtualMachine.UID)
+}
+
+// backupRootDisk backs up the root disk of the given VM into a DataVolume that outlives the VM, so that it can be restored
+// after the machine is deleted. The VM is stopped first so that the backup is consistent. It returns an error as long as
+// the backup is in progress, so that the deletion of the machine is retried until the backup has completed.
+// Failed backups don't block the deletion.
+func (p PluginSPIImpl) backupRootDisk(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine, backupPolicy *api.BackupPolicySpec) error {
+	key := types.NamespacedName{Namespace: virtualMachine.Namespace, Name: backupDataVolumeName(virtualMachine)}
+
+	dataVolume := &cdi.DataVolume{}
+	if err := c.Get(ctx, key, dataVolume); err != nil {
+		if !kerrors.IsNotFound(err) {
+			return fmt.Errorf("failed to get backup DataVolume: %w", err)
+		}
+
+		// The guest must be shut down before the root disk is cloned, so that the backup is consistent
+		if err := p.setVMStopped(ctx, c, virtualMachine); err != nil {
+			return err
+		}
+		gone, err := p.isVMIGone(ctx, c, virtualMachine)
+		if err != nil {
+			return err
+		}
+		if !gone {
+			return fmt.Errorf("waiting for VirtualMachine %s to shut down before its root disk is backed up", virtualMachine.Name)
+		}
+		return p.createBackupDataVolume(ctx, c, virtualMachine, backupPolicy)
+	}
+	if uid := dataVolume.Annotations[backupSourceUIDAnnotation]; uid != string(virtualMachine.UID) {
+		return fmt.Errorf("backup DataVolume %s doesn't belong to VirtualMachine %s with UID %s, but to UID %q", dataVolume.Name, virtualMachine.Name, virtualMachine.UID, uid)
+	}
+
+	switch dataVolume.Status.Phase {
+	case cdi.Succeeded:
+		return nil
+	case cdi.Failed:
+		logging.FromContext(ctx).Info("backup of root disk failed, deleting VirtualMachine without backup", "vm", virtualMachine.Name)
+		return nil
+	default:
+		return fmt.Errorf("waiting for backup of root disk of VirtualMachine %s, DataVolume phase: %q", virtualMachine.Name, dataVolume.Status.Phase)
+	}
+}
+
+// createBackupDataVolume creates the DataVolume that clones the root disk of the given VM. It is not owned by the VM.
+func (p PluginSPIImpl) createBackupDataVolume(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine, backupPolicy *api.BackupPolicySpec) error {
+	pvc := &corev1.PersistentVolumeClaim{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: virtualMachine.Namespace, Name: virtualMachine.Name}, pvc); err != nil {
+		return fmt.Errorf("failed to get root disk PersistentVolumeClaim: %w", err)
+	}
+
+	dataVolume := &cdi.DataVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      backupDataVolumeName(virtualMachine),
+			Namespace: virtualMachine.Namespace,
+			Labels: map[string]string{
+				backupLabel: virtualMachine.Name,
+			},
+			Annotations: map[string]string{
+				backupExpirationAnnotation: time.Now().Add(backupPolicy.TTL.Duration).UTC().Format(time.RFC3339),
+				backupSourceUIDAnnotation:  string(virtualMachine.UID),
+			},
+		},
+		Spec: cdi.DataVolumeSpec{
+			PVC: &corev1.PersistentVolumeClaimSpec{
+				StorageClassName: pvc.Spec.StorageClassName,
+				AccessModes:      pvc.Spec.AccessModes,
+				VolumeMode:       pvc.Spec.VolumeMode,
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceStorage: pvc.Spec.Resources.Requests[corev1.ResourceStorage],
+					},
+				},
+			},
+			Source: cdi.DataVolumeSource{
+				PVC: &cdi.DataVolumeSourcePVC{
+					Name:      pvc.Name,
+					Namespace: pvc.Namespace,
+				},
+			},
+		},
+	}
+
+	logging.FromContext(ctx).V(2).Info("backing up root disk", "vm", virtualMachine.Name, "dataVolume", dataVolume.Name)
+	if err := c.Create(ctx, dataVolume); err != nil {
+		return fmt.Errorf("failed to create backup DataVolume: %w", err)
+	}
+	return fmt.Errorf("waiting for backup of root disk of VirtualMachine %s", virtualMachine.Name)
+}
+
+// deleteExpiredBackups deletes the root disk backup DataVolumes in the given namespace whose TTL expired.
+func (p PluginSPIImpl) deleteExpiredBackups(ctx context.Context, c client.Client, namespace string) error {
+	hasBackupLabel, err := hasLabel(backupLabel)
+	if err != nil {
+		return err
+	}
+
+	dataVolumeList := &cdi.DataVolumeList{}
+	if err := c.List(ctx, dataVolumeList, client.InNamespace(namespace), hasBackupLabel); err != nil {
+		return fmt.Errorf("failed to list backup DataVolumes: %w", err)
+	}
+
+	now := time.Now()
+	for i := range dataVolumeList.Items {
+		dataVolume := &dataVolumeList.Items[i]
+		expiration, err := time.Parse(time.RFC3339, dataVolume.Annotations[backupExpirationAnnotation])
+		if err != nil {
+			logging.FromContext(ctx).Error(err, "could not parse expiration of backup DataVolume", "dataVolume", dataVolume.Name)
+			continue
+		}
+		if now.Before(expiration) {
+			continue
+		}
+
+		logging.FromContext(ctx).V(2).Info("deleting expired backup DataVolume", "dataVolume", dataVolume.Name)
+		if err := client.IgnoreNotFound(c.Delete(ctx, dataVolume)); err != nil {
+			return fmt.Errorf("failed to delete expired backup DataVolume %s: %w", dataVolume.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	clouderrors "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/errors"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// checkCapacity checks whether any schedulable node matching the node selector of the given provider spec
+// has enough allocatable resources for the resource requests of the VM, and returns an InsufficientCapacityError otherwise.
+// The check is skipped if listing nodes is forbidden.
+func (p PluginSPIImpl) checkCapacity(ctx context.Context, c client.Client, providerSpec *api.KubeVirtProviderSpec) error {
+	requests := buildResources(providerSpec).Requests
+	if len(requests) == 0 {
+		return nil
+	}
+
+	nodeList := &corev1.NodeList{}
+	if err := c.List(ctx, nodeList, client.MatchingLabels(providerSpec.NodeSelector)); err != nil {
+		if kerrors.IsForbidden(err) {
+			logging.FromContext(ctx).Error(err, "skipping capacity check, listing nodes is forbidden")
+			return nil
+		}
+		return fmt.Errorf("failed to list nodes: %w", err)
+	}
+
+	for _, node := range nodeList.Items {
+		if !node.Spec.Unschedulable && fitsResources(node.Status.Allocatable, requests) {
+			return nil
+		}
+	}
+	return &clouderrors.InsufficientCapacityError{Requests: formatResourceList(requests)}
+}
+
+// fitsResources returns whether all given requests fit into the given allocatable resources.
+func fitsResources(allocatable, requests corev1.ResourceList) bool {
+	for name, request := range requests {
+		quantity, ok := allocatable[name]
+		if !ok || quantity.Cmp(request) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func formatResourceList(resources corev1.ResourceList) string {
+	var pairs []string
+	for name, quantity := range resources {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, quantity.String()))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
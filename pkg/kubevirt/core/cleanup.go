@@ -0,0 +1,222 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	cdi "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// machineLabel is the label added to the VMs managed by the provider, as well as to the userdata secrets and root disk
+	// DataVolumes created for them, with the machine name as value. It identifies the latter as orphaned once the VM
+	// of the machine is gone, even if their owner references were removed.
+	machineLabel = "kubevirt.provider.extensions.gardener.cloud/machine"
+	// orphanCleanupDelay is the minimum age of userdata secrets and DataVolumes without VMs before they are deleted,
+	// so that the ones created right before the VM of a machine being created are kept.
+	orphanCleanupDelay = 10 * time.Minute
+)
+
+// cleanupOrphans deletes the userdata secrets and root disk DataVolumes in the given namespace whose VMs don't exist anymore,
+// as well as the NetworkPolicies of machine classes without VMs. The VMs are listed from the VMLister if there is one.
+// Image cache and backup DataVolumes are not labelled per machine and hence never considered orphaned,
+// but expired backups are deleted as well.
+func (p PluginSPIImpl) cleanupOrphans(ctx context.Context, c client.Client, secret *corev1.Secret, providerSpec *api.KubeVirtProviderSpec, namespace string) error {
+	virtualMachineList, err := p.listCachedVMs(ctx, c, secret, providerSpec, namespace, nil)
+	if err != nil {
+		return err
+	}
+
+	hasMachineLabel, err := hasLabel(machineLabel)
+	if err != nil {
+		return err
+	}
+
+	machineNames, machineClassNames := sets.NewString(), sets.NewString()
+	for _, virtualMachine := range virtualMachineList.Items {
+		machineNames.Insert(virtualMachine.Name)
+		machineClassNames.Insert(virtualMachine.Labels[machineClassLabel])
+	}
+
+	secretList := &corev1.SecretList{}
+	if err := c.List(ctx, secretList, client.InNamespace(namespace), hasMachineLabel); err != nil {
+		return fmt.Errorf("failed to list secrets: %w", err)
+	}
+	for i := range secretList.Items {
+		secret := &secretList.Items[i]
+		orphaned, err := p.isOrphaned(ctx, c, secret, machineNames)
+		if err != nil {
+			return err
+		}
+		if !orphaned {
+			continue
+		}
+
+		logging.FromContext(ctx).V(2).Info("deleting orphaned userdata secret", "secret", secret.Name)
+		if err := client.IgnoreNotFound(c.Delete(ctx, secret)); err != nil {
+			return fmt.Errorf("failed to delete orphaned userdata secret %s: %w", secret.Name, err)
+		}
+	}
+
+	dataVolumeList := &cdi.DataVolumeList{}
+	if err := c.List(ctx, dataVolumeList, client.InNamespace(namespace), hasMachineLabel); err != nil {
+		return fmt.Errorf("failed to list DataVolumes: %w", err)
+	}
+	for i := range dataVolumeList.Items {
+		dataVolume := &dataVolumeList.Items[i]
+		orphaned, err := p.isOrphaned(ctx, c, dataVolume, machineNames)
+		if err != nil {
+			return err
+		}
+		if !orphaned {
+			continue
+		}
+
+		logging.FromContext(ctx).V(2).Info("deleting orphaned DataVolume", "dataVolume", dataVolume.Name)
+		if err := client.IgnoreNotFound(c.Delete(ctx, dataVolume)); err != nil {
+			return fmt.Errorf("failed to delete orphaned DataVolume %s: %w", dataVolume.Name, err)
+		}
+	}
+
+	if err := p.cleanupNetworkPolicies(ctx, c, namespace, machineClassNames); err != nil {
+		return err
+	}
+	return p.deleteExpiredBackups(ctx, c, namespace)
+}
+
+// isOrphaned returns whether the VM of the machine of the given object is gone. Objects of the given machine names
+// or younger than the orphan cleanup delay are never considered orphaned, and the VM is checked once more right before,
+// as it could have been created after the given machine names were listed.
+func (p PluginSPIImpl) isOrphaned(ctx context.Context, c client.Client, obj metav1.Object, machineNames sets.String) (bool, error) {
+	machineName := obj.GetLabels()[machineLabel]
+	if machineNames.Has(machineName) || time.Since(obj.GetCreationTimestamp().Time) < orphanCleanupDelay {
+		return false, nil
+	}
+
+	key := types.NamespacedName{Namespace: obj.GetNamespace(), Name: machineName}
+	if err := c.Get(ctx, key, &kubevirtv1.VirtualMachine{}); err != nil {
+		if kerrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, fmt.Errorf("failed to get VirtualMachine: %w", err)
+	}
+	return false, nil
+}
+
+// hasLabel returns a list option that selects the objects with the given label, regardless of its value.
+func hasLabel(key string) (client.ListOption, error) {
+	requirement, err := labels.NewRequirement(key, selection.Exists, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.MatchingLabelsSelector{Selector: labels.NewSelector().Add(*requirement)}, nil
+}
+
+// waitForVMDeleted waits until the VM with the given name, its VMI and its root disk DataVolume are gone,
+// so that the resources, e.g. the quota of its PersistentVolumeClaim, are released. It fails after the given timeout.
+func (p PluginSPIImpl) waitForVMDeleted(ctx context.Context, c client.Client, machineName, namespace string, timeout time.Duration) error {
+	key := types.NamespacedName{Namespace: namespace, Name: machineName}
+
+	var remaining []string
+	err := wait.PollImmediate(pollInterval, timeout, func() (bool, error) {
+		remaining = nil
+		for _, resource := range []struct {
+			kind string
+			obj  runtime.Object
+		}{
+			{"VirtualMachine", &kubevirtv1.VirtualMachine{}},
+			{"VirtualMachineInstance", &kubevirtv1.VirtualMachineInstance{}},
+			{"DataVolume", &cdi.DataVolume{}},
+		} {
+			if err := c.Get(ctx, key, resource.obj); err != nil {
+				if kerrors.IsNotFound(err) {
+					continue
+				}
+				return false, fmt.Errorf("failed to get %s: %w", resource.kind, err)
+			}
+			remaining = append(remaining, resource.kind)
+		}
+		return len(remaining) == 0, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return fmt.Errorf("VirtualMachine %s is not deleted after %s, remaining: %v", machineName, timeout, remaining)
+	}
+	return err
+}
+
+// stopVM stops the given VM, which makes KubeVirt shut down the guest through ACPI, and waits until its VMI is gone.
+// It fails after the given timeout.
+func (p PluginSPIImpl) stopVM(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine, timeout time.Duration) error {
+	if err := p.setVMStopped(ctx, c, virtualMachine); err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx).V(2).Info("waiting for VirtualMachine to shut down", "vm", virtualMachine.Name)
+	return wait.PollImmediate(pollInterval, timeout, func() (bool, error) {
+		return p.isVMIGone(ctx, c, virtualMachine)
+	})
+}
+
+// getShutdownTimeout returns the duration for which the deletion of a machine waits for its VMI to be gone after its VM
+// was stopped, which defaults to the graceful shutdown timeout plus the time KubeVirt needs to kill the guest.
+func getShutdownTimeout(providerSpec *api.KubeVirtProviderSpec) time.Duration {
+	if providerSpec.ShutdownTimeout != nil {
+		return providerSpec.ShutdownTimeout.Duration
+	}
+	return providerSpec.GracefulShutdownTimeout.Duration + 30*time.Second
+}
+
+// setVMStopped sets the spec.running field of the given VM to false, unless it is already.
+func (p PluginSPIImpl) setVMStopped(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine) error {
+	if err := c.Get(ctx, types.NamespacedName{Namespace: virtualMachine.Namespace, Name: virtualMachine.Name}, virtualMachine); err != nil {
+		return fmt.Errorf("failed to stop VirtualMachine: %w", err)
+	}
+	if virtualMachine.Spec.Running != nil && !*virtualMachine.Spec.Running {
+		return nil
+	}
+	if err := applyVM(ctx, c, virtualMachine, runningFieldManager, runningFields(false)); err != nil {
+		return fmt.Errorf("failed to stop VirtualMachine: %w", err)
+	}
+	p.recordEvent(ctx, c, virtualMachine, corev1.EventTypeNormal, eventReasonShuttingDown, "Stopped VirtualMachine to shut down its guest before deletion")
+	return nil
+}
+
+// isVMIGone returns whether the VMI of the given VM doesn't exist.
+func (p PluginSPIImpl) isVMIGone(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine) (bool, error) {
+	if err := c.Get(ctx, types.NamespacedName{Namespace: virtualMachine.Namespace, Name: virtualMachine.Name}, &kubevirtv1.VirtualMachineInstance{}); err != nil {
+		if kerrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, fmt.Errorf("failed to get VirtualMachineInstance: %w", err)
+	}
+	return false, nil
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"crypto/sha256"
+	stderrors "errors"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// clientCacheTTL is the duration after which cached clients that were not used are evicted, e.g. after kubeconfig rotations.
+	clientCacheTTL = time.Hour
+	// serverVersionCacheTTL is the duration after which cached server versions are fetched again, e.g. after cluster upgrades.
+	serverVersionCacheTTL = 10 * time.Minute
+)
+
+// cacheInvalidator is implemented by the factories that cache per kubeconfig.
+type cacheInvalidator interface {
+	// Invalidate drops the cached entry for the kubeconfig saved in the "kubeconfig" field of the given secret.
+	Invalidate(secret *corev1.Secret)
+}
+
+// invalidateOnUnauthorized drops the entries for the kubeconfig saved in the "kubeconfig" field of the given secret
+// from the given factories if they cache per kubeconfig and the given error is an Unauthorized API error,
+// as the credentials or the certificates of the provider cluster may have changed. It returns whether it did.
+func invalidateOnUnauthorized(err error, secret *corev1.Secret, factories ...interface{}) bool {
+	var apiStatus kerrors.APIStatus
+	if !stderrors.As(err, &apiStatus) || !kerrors.IsUnauthorized(&kerrors.StatusError{ErrStatus: apiStatus.Status()}) {
+		return false
+	}
+	for _, factory := range factories {
+		if invalidator, ok := factory.(cacheInvalidator); ok {
+			invalidator.Invalidate(secret)
+		}
+	}
+	return true
+}
+
+type cachedClient struct {
+	client    client.Client
+	namespace string
+	lastUsed  time.Time
+}
+
+// cachingClientFactory is a ClientFactory that caches the clients created by another ClientFactory,
+// keyed by a hash of the kubeconfig, so that clients and their REST mappings are reused across calls.
+type cachingClientFactory struct {
+	cf      ClientFactory
+	mutex   sync.Mutex
+	clients map[[sha256.Size]byte]*cachedClient
+}
+
+// NewCachingClientFactory returns a ClientFactory that caches the clients created by the given ClientFactory
+// per kubeconfig. It is safe for concurrent use.
+func NewCachingClientFactory(cf ClientFactory) ClientFactory {
+	return &cachingClientFactory{
+		cf:      cf,
+		clients: map[[sha256.Size]byte]*cachedClient{},
+	}
+}
+
+// GetClient returns the cached client for the kubeconfig saved in the "kubeconfig" field of the given secret,
+// or creates and caches one if there is none.
+func (f *cachingClientFactory) GetClient(secret *corev1.Secret) (client.Client, string, error) {
+	key := sha256.Sum256(secret.Data["kubeconfig"])
+	now := time.Now()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for k, cached := range f.clients {
+		if now.Sub(cached.lastUsed) > clientCacheTTL {
+			delete(f.clients, k)
+		}
+	}
+
+	if cached, ok := f.clients[key]; ok {
+		cached.lastUsed = now
+		return cached.client, cached.namespace, nil
+	}
+
+	c, namespace, err := f.cf.GetClient(secret)
+	if err != nil {
+		return nil, "", err
+	}
+	f.clients[key] = &cachedClient{client: c, namespace: namespace, lastUsed: now}
+	return c, namespace, nil
+}
+
+// Invalidate drops the cached client for the kubeconfig saved in the "kubeconfig" field of the given secret.
+func (f *cachingClientFactory) Invalidate(secret *corev1.Secret) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.clients, sha256.Sum256(secret.Data["kubeconfig"]))
+}
+
+type cachedServerVersion struct {
+	serverVersion string
+	fetched       time.Time
+}
+
+// cachingServerVersionFactory is a ServerVersionFactory that caches the server versions got by another
+// ServerVersionFactory for serverVersionCacheTTL, keyed by a hash of the kubeconfig, to avoid a discovery call
+// on every machine creation.
+type cachingServerVersionFactory struct {
+	svf            ServerVersionFactory
+	mutex          sync.Mutex
+	serverVersions map[[sha256.Size]byte]cachedServerVersion
+}
+
+// NewCachingServerVersionFactory returns a ServerVersionFactory that caches the server versions got by the given
+// ServerVersionFactory per kubeconfig. It is safe for concurrent use.
+func NewCachingServerVersionFactory(svf ServerVersionFactory) ServerVersionFactory {
+	return &cachingServerVersionFactory{
+		svf:            svf,
+		serverVersions: map[[sha256.Size]byte]cachedServerVersion{},
+	}
+}
+
+// GetServerVersion returns the cached server version for the kubeconfig saved in the "kubeconfig" field of the given secret,
+// or gets and caches it if there is none or it expired.
+func (f *cachingServerVersionFactory) GetServerVersion(secret *corev1.Secret) (string, error) {
+	key := sha256.Sum256(secret.Data["kubeconfig"])
+	now := time.Now()
+
+	f.mutex.Lock()
+	cached, ok := f.serverVersions[key]
+	f.mutex.Unlock()
+	if ok && now.Sub(cached.fetched) <= serverVersionCacheTTL {
+		return cached.serverVersion, nil
+	}
+
+	serverVersion, err := f.svf.GetServerVersion(secret)
+	if err != nil {
+		return "", err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for k, cached := range f.serverVersions {
+		if now.Sub(cached.fetched) > serverVersionCacheTTL {
+			delete(f.serverVersions, k)
+		}
+	}
+	f.serverVersions[key] = cachedServerVersion{serverVersion: serverVersion, fetched: now}
+	return serverVersion, nil
+}
+
+// Invalidate drops the cached server version for the kubeconfig saved in the "kubeconfig" field of the given secret.
+func (f *cachingServerVersionFactory) Invalidate(secret *corev1.Secret) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.serverVersions, sha256.Sum256(secret.Data["kubeconfig"]))
+}
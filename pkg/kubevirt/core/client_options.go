@@ -0,0 +1,143 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ClientOptions are the options of the clients of provider clusters. Zero values leave the defaults of client-go in place.
+// ClientOptions implements both ClientFactory and ServerVersionFactory.
+type ClientOptions struct {
+	// QPS is the maximum number of queries per second to the API server of a provider cluster.
+	QPS float32
+	// Burst is the maximum burst of queries to the API server of a provider cluster.
+	Burst int
+	// Timeout is the timeout of single requests to the API server of a provider cluster.
+	Timeout time.Duration
+	// ExecPluginDirs are the directories exec auth plugins of kubeconfigs are looked up in. If empty, commands of
+	// exec auth plugins are looked up in the PATH, otherwise they have to be located in one of the directories.
+	ExecPluginDirs []string
+}
+
+// AddFlags adds the flags of the client options to the given flag set.
+func (o *ClientOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.Float32Var(&o.QPS, "provider-client-qps", o.QPS, "Maximum queries per second to the API servers of provider clusters, 0 for the client-go default (5)")
+	fs.IntVar(&o.Burst, "provider-client-burst", o.Burst, "Maximum burst of queries to the API servers of provider clusters, 0 for the client-go default (10)")
+	fs.DurationVar(&o.Timeout, "provider-client-timeout", o.Timeout, "Timeout of requests to the API servers of provider clusters, 0 for no timeout")
+	fs.StringSliceVar(&o.ExecPluginDirs, "provider-exec-plugin-dir", o.ExecPluginDirs, "Directories to look up the exec auth plugins of provider kubeconfigs in, the PATH if not set")
+}
+
+// GetClient creates a client from the kubeconfig saved in the "kubeconfig" field of the given secret.
+// It also returns the namespace of the kubeconfig's current context.
+func (o ClientOptions) GetClient(secret *corev1.Secret) (client.Client, string, error) {
+	config, namespace, err := o.getRESTConfig(secret)
+	if err != nil {
+		return nil, "", err
+	}
+	c, err := client.New(config, client.Options{})
+	if err != nil {
+		return nil, "", fmt.Errorf("could not create client from REST config: %w", err)
+	}
+	return c, namespace, nil
+}
+
+// GetServerVersion gets the server version from the kubeconfig saved in the "kubeconfig" field of the given secret.
+func (o ClientOptions) GetServerVersion(secret *corev1.Secret) (string, error) {
+	config, _, err := o.getRESTConfig(secret)
+	if err != nil {
+		return "", err
+	}
+	cs, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return "", fmt.Errorf("could not create clientset from REST config: %w", err)
+	}
+	versionInfo, err := cs.ServerVersion()
+	if err != nil {
+		return "", fmt.Errorf("could not get server version: %w", err)
+	}
+	return versionInfo.GitVersion, nil
+}
+
+// getRESTConfig returns the REST config with the client options applied, and the namespace of the current context,
+// of the kubeconfig saved in the "kubeconfig" field of the given secret.
+func (o ClientOptions) getRESTConfig(secret *corev1.Secret) (*rest.Config, string, error) {
+	clientConfig, err := getClientConfig(secret)
+	if err != nil {
+		return nil, "", err
+	}
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", fmt.Errorf("could not get REST config from client config: %w", err)
+	}
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, "", fmt.Errorf("could not get namespace from client config: %w", err)
+	}
+
+	if o.QPS > 0 {
+		config.QPS = o.QPS
+	}
+	if o.Burst > 0 {
+		config.Burst = o.Burst
+	}
+	if o.Timeout > 0 {
+		config.Timeout = o.Timeout
+	}
+	if config.ExecProvider != nil {
+		command, err := o.lookupExecPlugin(config.ExecProvider.Command)
+		if err != nil {
+			return nil, "", err
+		}
+		config.ExecProvider.Command = command
+	}
+	return config, namespace, nil
+}
+
+// lookupExecPlugin returns the path of the given exec auth plugin command within the exec plugin directories.
+// Commands are returned unchanged if no exec plugin directories are configured.
+func (o ClientOptions) lookupExecPlugin(command string) (string, error) {
+	if len(o.ExecPluginDirs) == 0 {
+		return command, nil
+	}
+	if filepath.IsAbs(command) {
+		for _, dir := range o.ExecPluginDirs {
+			if rel, err := filepath.Rel(dir, filepath.Clean(command)); err == nil && !strings.HasPrefix(rel, "..") {
+				return command, nil
+			}
+		}
+		return "", fmt.Errorf("exec auth plugin %q is not located in any of the exec plugin directories %v", command, o.ExecPluginDirs)
+	}
+	if strings.ContainsRune(command, filepath.Separator) {
+		return "", fmt.Errorf("exec auth plugin %q must either be an absolute path or a command name", command)
+	}
+	for _, dir := range o.ExecPluginDirs {
+		path := filepath.Join(dir, command)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("could not find exec auth plugin %q in the exec plugin directories %v", command, o.ExecPluginDirs)
+}
@@ -0,0 +1,298 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	clouderrors "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/errors"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// cloudConfigMergeType makes cloud-init append lists and merge dictionaries of multiple cloud-config parts
+// recursively, instead of later parts replacing keys, e.g. `write_files` or `runcmd`, of earlier ones.
+const cloudConfigMergeType = "list(append)+dict(no_replace,recurse_list)+str()"
+
+const (
+	// userDataCompressionThreshold is the size in bytes above which userData is compressed. It matches the limit
+	// of common cloud-init datasources, beyond which some images fail to process uncompressed userData.
+	userDataCompressionThreshold = 16 * 1024
+	// maxUserDataSize is the maximum size in bytes of the userData, limited by the size of the Secret it is stored in.
+	maxUserDataSize = corev1.MaxSecretSize
+)
+
+// userDataTemplateData is the machine metadata available to userData templates.
+type userDataTemplateData struct {
+	MachineName  string
+	Namespace    string
+	Region       string
+	Zone         string
+	MachineClass string
+}
+
+// renderUserDataTemplate renders the given userData as a Go template with the metadata of the given machine.
+// Referring to unknown metadata fails the rendering, so that typos don't end up as empty values in the cloud-init config.
+func renderUserDataTemplate(userData, machineName, namespace string, providerSpec *api.KubeVirtProviderSpec) (string, error) {
+	tmpl, err := template.New("userData").Parse(userData)
+	if err != nil {
+		return "", err
+	}
+
+	data := userDataTemplateData{
+		MachineName:  machineName,
+		Namespace:    namespace,
+		Region:       providerSpec.Region,
+		Zone:         providerSpec.Zone,
+		MachineClass: providerSpec.Tags[machineClassLabel],
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
+// userDataSecretName returns the name of the Secret that contains the userData of the VM with the given name.
+func userDataSecretName(machineName string) string {
+	return fmt.Sprintf("userdata-%s", machineName)
+}
+
+// createUserDataSecret creates the Secret with the given userData for the given VM. Stale userdata Secrets of previous VMs
+// with the same name are deleted first, including the ones with the formerly used `userdata-<machine>-<timestamp>` names.
+func (p PluginSPIImpl) createUserDataSecret(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine, userData []byte) error {
+	if err := p.deleteStaleUserDataSecrets(ctx, c, virtualMachine); err != nil {
+		return err
+	}
+
+	userDataSecret := buildUserDataSecret(virtualMachine, userData)
+	if err := c.Create(ctx, userDataSecret); err != nil {
+		if !kerrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create secret for userdata: %w", err)
+		}
+
+		// The Secret already belongs to the given VM, e.g. if a previous create was interrupted.
+		existing := &corev1.Secret{}
+		if err := c.Get(ctx, types.NamespacedName{Namespace: userDataSecret.Namespace, Name: userDataSecret.Name}, existing); err != nil {
+			return fmt.Errorf("failed to get secret for userdata: %w", err)
+		}
+		existing.Data = userDataSecret.Data
+		if existing.Labels == nil {
+			existing.Labels = map[string]string{}
+		}
+		existing.Labels[machineLabel] = virtualMachine.Name
+		if err := c.Update(ctx, existing); err != nil {
+			return fmt.Errorf("failed to update secret for userdata: %w", err)
+		}
+	}
+	return nil
+}
+
+// buildUserDataSecret builds the Secret with the given userData for the given VM, which is owned by the VM.
+func buildUserDataSecret(virtualMachine *kubevirtv1.VirtualMachine, userData []byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      userDataSecretName(virtualMachine.Name),
+			Namespace: virtualMachine.Namespace,
+			Labels: map[string]string{
+				machineLabel: virtualMachine.Name,
+			},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(virtualMachine, kubevirtv1.VirtualMachineGroupVersionKind)},
+		},
+		Data: map[string][]byte{"userdata": userData},
+	}
+}
+
+// deleteStaleUserDataSecrets deletes the userdata Secrets that were created for previous VMs with the name of the given VM.
+// Secrets are only considered stale if they are controlled by a VM with the same name but a different UID, so that the
+// Secrets of other machines whose names happen to match are never deleted.
+func (p PluginSPIImpl) deleteStaleUserDataSecrets(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine) error {
+	secretList := &corev1.SecretList{}
+	if err := c.List(ctx, secretList, client.InNamespace(virtualMachine.Namespace)); err != nil {
+		return fmt.Errorf("failed to list secrets: %w", err)
+	}
+
+	nameRegexp := regexp.MustCompile(fmt.Sprintf(`^%s(-[0-9]+)?$`, regexp.QuoteMeta(userDataSecretName(virtualMachine.Name))))
+	for i := range secretList.Items {
+		secret := &secretList.Items[i]
+		if !nameRegexp.MatchString(secret.Name) {
+			continue
+		}
+
+		owner := metav1.GetControllerOf(secret)
+		if owner == nil || owner.Kind != kubevirtv1.VirtualMachineGroupVersionKind.Kind || owner.Name != virtualMachine.Name || owner.UID == virtualMachine.UID {
+			continue
+		}
+
+		logging.FromContext(ctx).V(2).Info("deleting stale userdata secret", "secret", secret.Name, "vm", virtualMachine.Name)
+		if err := client.IgnoreNotFound(c.Delete(ctx, secret)); err != nil {
+			return fmt.Errorf("failed to delete stale userdata secret %s: %w", secret.Name, err)
+		}
+	}
+	return nil
+}
+
+// prepareUserData returns the userData as it is stored in the userdata Secret. UserData exceeding the compression threshold
+// is gzipped, which cloud-init detects and decompresses transparently. The Secret takes care of the base64 encoding.
+// If the userData exceeds the maximum size even after compression, a UserDataTooLargeError is returned.
+func prepareUserData(userData string) ([]byte, error) {
+	if len(userData) <= userDataCompressionThreshold {
+		return []byte(userData), nil
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write([]byte(userData)); err != nil {
+		return nil, fmt.Errorf("failed to compress userData: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress userData: %w", err)
+	}
+
+	if compressed.Len() > maxUserDataSize {
+		return nil, &clouderrors.UserDataTooLargeError{Size: compressed.Len(), Limit: maxUserDataSize}
+	}
+	return compressed.Bytes(), nil
+}
+
+// getSSHKeys returns the SSH public keys contained in the Secret keys referenced by the given selectors, one per line.
+func (p PluginSPIImpl) getSSHKeys(ctx context.Context, c client.Client, namespace string, selectors []corev1.SecretKeySelector) ([]string, error) {
+	var sshKeys []string
+	for _, selector := range selectors {
+		secret := &corev1.Secret{}
+		if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: selector.Name}, secret); err != nil {
+			return nil, fmt.Errorf("failed to get Secret %s of SSH keys: %w", selector.Name, err)
+		}
+
+		data, ok := secret.Data[selector.Key]
+		if !ok {
+			return nil, fmt.Errorf("Secret %s of SSH keys has no key %s", selector.Name, selector.Key)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				sshKeys = append(sshKeys, line)
+			}
+		}
+	}
+	return sshKeys, nil
+}
+
+// kubeletNodeLabelsDropIn is the path of the kubelet systemd drop-in that passes the node labels to the kubelet.
+const kubeletNodeLabelsDropIn = "/etc/systemd/system/kubelet.service.d/90-node-labels.conf"
+
+// buildNodeLabelsCloudConfig builds a cloud-config that passes the given labels to the kubelet through KUBELET_EXTRA_ARGS,
+// so that they are set on the node when it registers.
+func buildNodeLabelsCloudConfig(nodeLabels map[string]string) string {
+	var labels []string
+	for key, value := range nodeLabels {
+		labels = append(labels, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(labels)
+
+	return fmt.Sprintf(`#cloud-config
+write_files:
+- path: %s
+  permissions: "0644"
+  content: |
+    [Service]
+    Environment="KUBELET_EXTRA_ARGS=--node-labels=%s"
+`, kubeletNodeLabelsDropIn, strings.Join(labels, ","))
+}
+
+// getCloudInitSnippets returns the contents of the cloud-init snippets referenced by the given ConfigMap key selectors.
+func (p PluginSPIImpl) getCloudInitSnippets(ctx context.Context, c client.Client, namespace string, selectors []corev1.ConfigMapKeySelector) ([]string, error) {
+	var snippets []string
+	for _, selector := range selectors {
+		configMap := &corev1.ConfigMap{}
+		if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: selector.Name}, configMap); err != nil {
+			return nil, fmt.Errorf("failed to get ConfigMap %s of cloud-init snippet: %w", selector.Name, err)
+		}
+
+		snippet, ok := configMap.Data[selector.Key]
+		if !ok {
+			return nil, fmt.Errorf("ConfigMap %s of cloud-init snippet has no key %s", selector.Name, selector.Key)
+		}
+		snippets = append(snippets, snippet)
+	}
+	return snippets, nil
+}
+
+// mergeCloudInitSnippets merges the given userData and cloud-init snippets into a multipart MIME archive,
+// which cloud-init processes part by part in the given order.
+func mergeCloudInitSnippets(userData string, snippets []string) (string, error) {
+	var (
+		body   bytes.Buffer
+		writer = multipart.NewWriter(&body)
+	)
+
+	for _, part := range append([]string{userData}, snippets...) {
+		contentType := cloudInitContentType(part)
+
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", fmt.Sprintf("%s; charset=\"utf-8\"", contentType))
+		header.Set("MIME-Version", "1.0")
+		if contentType == "text/cloud-config" {
+			header.Set("Merge-Type", cloudConfigMergeType)
+		}
+
+		partWriter, err := writer.CreatePart(header)
+		if err != nil {
+			return "", err
+		}
+		if _, err := partWriter.Write([]byte(part)); err != nil {
+			return "", err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\nMIME-Version: 1.0\n\n%s", writer.Boundary(), body.String()), nil
+}
+
+// cloudInitContentType returns the MIME type of the given cloud-init user data, based on its first line.
+// PowerShell scripts, e.g. #ps1_sysnative, are shell scripts for cloudbase-init.
+func cloudInitContentType(userData string) string {
+	switch {
+	case strings.HasPrefix(userData, "#cloud-config"):
+		return "text/cloud-config"
+	case strings.HasPrefix(userData, "#cloud-boothook"):
+		return "text/cloud-boothook"
+	case strings.HasPrefix(userData, "#include"):
+		return "text/x-include-url"
+	case strings.HasPrefix(userData, "#!"), strings.HasPrefix(userData, "#ps1"):
+		return "text/x-shellscript"
+	default:
+		return "text/plain"
+	}
+}
@@ -17,20 +17,22 @@ package core
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
-	"time"
 
 	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
 	clouderrors "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/errors"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
 
 	corev1 "k8s.io/api/core/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/util/retry"
-	"k8s.io/klog"
 	utilpointer "k8s.io/utils/pointer"
 	kubevirtv1 "kubevirt.io/client-go/api/v1"
 	cdi "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
@@ -41,6 +43,15 @@ const (
 	// ProviderName specifies the machine controller for kubevirt cloud provider
 	ProviderName      = "kubevirt"
 	machineClassLabel = "mcm.gardener.cloud/machineclass"
+	// vmFinalizer protects VMs from being removed by anything but DeleteMachine, e.g. an accidental `kubectl delete vm`.
+	// KubeVirt still stops the VMI of a VM that is marked for deletion, but the VM and its disks are kept.
+	vmFinalizer = "kubevirt.provider.extensions.gardener.cloud/machine"
+	// providerIDFormatAnnotation is the annotation on VMs that contains the format of their provider ID.
+	providerIDFormatAnnotation = "kubevirt.provider.extensions.gardener.cloud/provider-id-format"
+	// providerIDFormatV2 is the format of provider IDs that contain the namespace, name and UID of VMs.
+	providerIDFormatV2 = "v2"
+	// vmListPageSize is the maximum number of VMs requested at once when listing VMs.
+	vmListPageSize = 500
 )
 
 // ClientFactory creates a client from the kubeconfig saved in the "kubeconfig" field of the given secret.
@@ -73,91 +84,311 @@ func (f ServerVersionFactoryFunc) GetServerVersion(secret *corev1.Secret) (strin
 	return f(secret)
 }
 
+// VMListerFactory creates a VMLister from the kubeconfig saved in the "kubeconfig" field of the given secret.
+type VMListerFactory interface {
+	// GetVMLister returns a VMLister for the namespace of the kubeconfig's current context.
+	GetVMLister(secret *corev1.Secret) (VMLister, error)
+}
+
+// VMLister lists VMs from a local cache instead of the API server.
+type VMLister interface {
+	// ListVMs lists the VMs matching the given selector.
+	ListVMs(selector labels.Selector) ([]kubevirtv1.VirtualMachine, error)
+}
+
 // PluginSPIImpl is the real implementation of PluginSPI interface
 // that makes the calls to the provider SDK
 type PluginSPIImpl struct {
-	cf  ClientFactory
-	svf ServerVersionFactory
+	cf          ClientFactory
+	svf         ServerVersionFactory
+	vmlf        VMListerFactory
+	ipAllocator IPAllocator
+	maintenance *maintenanceLimiter
 }
 
 // NewPluginSPIImpl creates a new PluginSPIImpl with the given ClientFactory and ServerVersionFactory.
 func NewPluginSPIImpl(cf ClientFactory, svf ServerVersionFactory) (*PluginSPIImpl, error) {
 	return &PluginSPIImpl{
-		cf:  cf,
-		svf: svf,
+		cf:          cf,
+		svf:         svf,
+		ipAllocator: NewRangeIPAllocator(),
+		maintenance: newMaintenanceLimiter(maintenanceInterval),
 	}, nil
 }
 
+// SetVMListerFactory sets the VMListerFactory used by ListMachines to list VMs from a cache instead of the API server.
+func (p *PluginSPIImpl) SetVMListerFactory(vmlf VMListerFactory) {
+	p.vmlf = vmlf
+}
+
 // CreateMachine creates a Kubevirt virtual machine with the given name and an associated data volume based on the
 // DataVolumeTemplate, using the given provider spec. It also creates a secret where the userdata(cloud-init) are saved and mounted on the VM.
+// If adoption is enabled, a matching pre-existing VM with the given name is adopted instead.
 func (p PluginSPIImpl) CreateMachine(ctx context.Context, machineName string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (providerID string, err error) {
-	c, namespace, err := p.cf.GetClient(secret)
+	err = p.retryOnUnauthorized(ctx, secret, providerSpec, func() error {
+		providerID, err = p.createMachine(ctx, machineName, providerSpec, secret)
+		return err
+	})
+	return providerID, err
+}
+
+// createMachine implements CreateMachine.
+func (p PluginSPIImpl) createMachine(ctx context.Context, machineName string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (providerID string, err error) {
+	c, namespace, err := p.getClient(secret, providerSpec)
 	if err != nil {
-		return "", fmt.Errorf("failed to create client: %v", err)
+		return "", fmt.Errorf("failed to create client: %w", err)
+	}
+	ctx = withClusterLogger(ctx, namespace, providerSpec)
+
+	if providerSpec.Adoption != nil {
+		adoptedVM, err := p.adoptVM(ctx, c, machineName, namespace, providerSpec)
+		if err != nil {
+			return "", err
+		}
+		if adoptedVM != nil {
+			return getProviderID(adoptedVM), nil
+		}
 	}
 
+	// The VM may have been created by a previous call, whose creation is completed regardless of capacity and quotas
+	existing, err := p.findVM(ctx, c, machineName, namespace)
+	if err != nil {
+		return "", err
+	}
+	if existing == nil {
+		if providerSpec.CapacityCheck {
+			if err := p.checkCapacity(ctx, c, providerSpec); err != nil {
+				return "", err
+			}
+		}
+		if err := p.checkResourceQuotas(ctx, c, namespace, providerSpec); err != nil {
+			return "", err
+		}
+	}
+
+	virtualMachine, userDataBytes, err := p.buildVM(ctx, c, machineName, namespace, providerSpec, secret, existing)
+	if err != nil {
+		return "", err
+	}
+	vmLabels := virtualMachine.Labels
+
+	created := true
+	if err := c.Create(ctx, virtualMachine); err != nil {
+		// The IP addresses allocated for the VM are not in use, unless they were reused from the existing VM
+		if existing == nil {
+			p.releaseIPAddresses(virtualMachine, providerSpec.Networks)
+		}
+		if !kerrors.IsAlreadyExists(err) {
+			return "", fmt.Errorf("failed to create VirtualMachine: %w", err)
+		}
+		created = false
+
+		// The VM was created by a previous call, e.g. one that failed afterwards, hence the remaining steps are completed
+		existing, err := p.getVM(ctx, c, machineName, namespace)
+		if err != nil {
+			return "", err
+		}
+		if !isMatchingVM(existing, vmLabels) {
+			return "", fmt.Errorf("failed to create VirtualMachine: VirtualMachine %s already exists and doesn't belong to the machine class", machineName)
+		}
+		if isPreemptedVM(existing) {
+			return "", &clouderrors.MachinePreemptedError{Name: machineName, Reason: existing.Annotations[statusMessageAnnotation]}
+		}
+		if err := labelLegacyVM(ctx, c, existing, providerSpec); err != nil {
+			return "", err
+		}
+		if existing.Annotations[ipAddressesAnnotation] != virtualMachine.Annotations[ipAddressesAnnotation] {
+			// The userdata must contain the network data of the IP addresses of the existing VM
+			if _, userDataBytes, err = p.buildVM(ctx, c, machineName, namespace, providerSpec, secret, existing); err != nil {
+				return "", err
+			}
+		}
+		logging.FromContext(ctx).V(2).Info("VirtualMachine already exists, completing its creation", "vm", machineName)
+		virtualMachine = existing
+	}
+
+	if created {
+		p.recordEvent(ctx, c, virtualMachine, corev1.EventTypeNormal, eventReasonCreated, "Created VirtualMachine for machine %s", machineName)
+	}
+
+	if err := p.createUserDataSecret(ctx, c, virtualMachine, userDataBytes); err != nil {
+		// The VM would boot without cloud-init, hence it is rolled back if it was created by this call
+		if created {
+			if rollbackErr := p.rollbackVM(ctx, c, virtualMachine); rollbackErr != nil {
+				return "", fmt.Errorf("%w, rolling back VirtualMachine failed: %v", err, rollbackErr)
+			}
+		}
+		return "", err
+	}
+
+	if providerSpec.SSHService != nil {
+		if err := p.createSSHService(ctx, c, virtualMachine, providerSpec.SSHService); err != nil {
+			return "", err
+		}
+	}
+
+	if providerSpec.ReadinessTimeout != nil {
+		if err := p.waitForVMReady(ctx, c, virtualMachine, providerSpec.ReadinessTimeout.Duration); err != nil {
+			return "", err
+		}
+	}
+
+	return getProviderID(virtualMachine), nil
+}
+
+// buildVM builds the VM with the given name for the given provider spec, and the userdata for its userdata Secret.
+// IP addresses are allocated unless the given existing VM, which is nil if there is none, has some already,
+// and the image cache of the machine class is looked up or created in the provider cluster.
+func (p PluginSPIImpl) buildVM(ctx context.Context, c client.Client, machineName, namespace string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret, existing *kubevirtv1.VirtualMachine) (*kubevirtv1.VirtualMachine, []byte, error) {
 	var (
 		terminationGracePeriodSeconds = int64(30)
-		userdataSecretName            = fmt.Sprintf("userdata-%s-%s", machineName, strconv.Itoa(int(time.Now().Unix())))
+		userdataSecretName            = userDataSecretName(machineName)
 	)
 
-	interfaces, networks, networkData := buildNetworks(providerSpec.Networks)
+	if providerSpec.GracefulShutdownTimeout != nil {
+		terminationGracePeriodSeconds = int64(providerSpec.GracefulShutdownTimeout.Duration.Seconds())
+	}
+
+	interfaces, networks, networkData := buildNetworks(providerSpec.Networks, providerSpec.PodNetwork)
+
+	ipAddresses, err := p.allocateIPAddresses(ctx, c, namespace, providerSpec.Networks, existing)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vmAnnotations := map[string]string{}
+	for k, v := range providerSpec.VMAnnotations {
+		vmAnnotations[k] = v
+	}
+	vmAnnotations[providerIDFormatAnnotation] = providerIDFormatV2
+	if providerSpec.CrashLoopRemediation != nil {
+		vmAnnotations[maxRestartsAnnotation] = strconv.Itoa(int(providerSpec.CrashLoopRemediation.MaxRestarts))
+	}
+	if len(ipAddresses) > 0 {
+		networkData = buildStaticNetworkData(machineName, interfaces, networks, providerSpec.Networks, ipAddresses)
+
+		ipAddressesJSON, err := json.Marshal(ipAddresses)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to marshal IP addresses: %w", err)
+		}
+		vmAnnotations[ipAddressesAnnotation] = string(ipAddressesJSON)
+	}
 
-	k8sVersion, err := p.svf.GetServerVersion(secret)
+	k8sVersion, err := p.svf.GetServerVersion(getClusterSecret(secret, providerSpec))
 	if err != nil {
-		return "", fmt.Errorf("failed to get server version: %v", err)
+		return nil, nil, fmt.Errorf("failed to get server version: %w", err)
 	}
 
-	affinity := buildAffinity(providerSpec.Region, providerSpec.Zone, k8sVersion)
+	regionLabel, zoneLabel := getRegionAndZoneLabels(providerSpec, k8sVersion)
+	affinity := mergeAffinity(buildAffinity(providerSpec.Region, providerSpec.Zone, regionLabel, zoneLabel), providerSpec.Affinity, providerSpec.ReplaceAffinity)
+
+	additionalDisks, additionalVolumes := buildAdditionalVolumes(providerSpec.AdditionalVolumes)
 
 	userData := string(secret.Data["userData"])
-	if len(providerSpec.SSHKeys) > 0 {
-		var userSSHKeys []string
-		for _, sshKey := range providerSpec.SSHKeys {
-			userSSHKeys = append(userSSHKeys, strings.TrimSpace(sshKey))
+
+	var userSSHKeys []string
+	for _, sshKey := range providerSpec.SSHKeys {
+		userSSHKeys = append(userSSHKeys, strings.TrimSpace(sshKey))
+	}
+	if len(providerSpec.SSHKeysSecretRefs) > 0 {
+		secretSSHKeys, err := p.getSSHKeys(ctx, c, namespace, providerSpec.SSHKeysSecretRefs)
+		if err != nil {
+			return nil, nil, err
 		}
+		userSSHKeys = append(userSSHKeys, secretSSHKeys...)
+	}
 
+	if len(userSSHKeys) > 0 && providerSpec.Windows == nil {
 		userData, err = addUserSSHKeysToUserData(userData, userSSHKeys)
 		if err != nil {
-			return "", fmt.Errorf("failed to add ssh keys to cloud-init: %v", err)
+			return nil, nil, fmt.Errorf("failed to add ssh keys to cloud-init: %w", err)
 		}
 	}
 
-	var vmLabels = map[string]string{}
-	if len(providerSpec.Tags) > 0 {
-		vmLabels = providerSpec.Tags
+	snippets, err := p.getCloudInitSnippets(ctx, c, namespace, providerSpec.CloudInitSnippets)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(providerSpec.NodeLabels) > 0 {
+		snippets = append(snippets, buildNodeLabelsCloudConfig(providerSpec.NodeLabels))
+	}
+
+	if providerSpec.Windows != nil {
+		// the remote management path is enabled first, so that the VM can be debugged if the userData fails
+		bootstrapScript := buildWindowsBootstrapScript(providerSpec.Windows.Bootstrap, userSSHKeys)
+		userData, err = mergeCloudInitSnippets(bootstrapScript, append([]string{userData}, snippets...))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to merge cloud-init snippets: %w", err)
+		}
+	} else if len(snippets) > 0 {
+		userData, err = mergeCloudInitSnippets(userData, snippets)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to merge cloud-init snippets: %w", err)
+		}
+	}
+
+	if providerSpec.RenderUserDataTemplate {
+		userData, err = renderUserDataTemplate(userData, machineName, namespace, providerSpec)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to render userData template: %w", err)
+		}
+	}
+
+	userDataBytes, err := prepareUserData(userData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vmLabels := map[string]string{}
+	for k, v := range providerSpec.Tags {
+		vmLabels[k] = v
 	}
 	vmLabels["kubevirt.io/vm"] = machineName
+	vmLabels[machineLabel] = machineName
 
 	machineClassName := vmLabels[machineClassLabel]
-	dataVolumeName, err := p.getDataVolume(ctx, c, machineClassName, namespace)
+	dataVolumeName, err := p.getImageCache(ctx, c, machineClassName, namespace, providerSpec)
 	if err != nil {
-		return "", err
+		return nil, nil, err
+	}
+
+	templateLabels := map[string]string{}
+	for k, v := range providerSpec.TemplateLabels {
+		templateLabels[k] = v
+	}
+	templateLabels["kubevirt.io/vm"] = machineName
+	priorityClassName := providerSpec.PriorityClassName
+	if providerSpec.Preemptible {
+		vmLabels[preemptibleLabel] = "true"
+		templateLabels[preemptibleLabel] = "true"
+		if priorityClassName == "" {
+			priorityClassName = api.DefaultPreemptiblePriorityClassName
+		}
+	}
+	if providerSpec.PoolAntiAffinity && machineClassName != "" {
+		templateLabels[machineClassLabel] = machineClassName
+		affinity = addPoolAntiAffinity(affinity, machineClassName)
+	}
+	if providerSpec.NetworkPolicy != nil {
+		if machineClassName == "" {
+			return nil, nil, fmt.Errorf("the NetworkPolicy requires the %s tag", machineClassLabel)
+		}
+		templateLabels[machineClassLabel] = machineClassName
+		templateLabels[networkPolicyClusterLabel] = providerSpec.NetworkPolicy.ClusterName
+		if err := p.ensureNetworkPolicy(ctx, c, machineClassName, namespace, providerSpec.NetworkPolicy); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	dataVolumeTemplate := cdi.DataVolume{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      machineName,
 			Namespace: namespace,
-		},
-		Spec: cdi.DataVolumeSpec{
-			PVC: &corev1.PersistentVolumeClaimSpec{
-				StorageClassName: utilpointer.StringPtr(providerSpec.StorageClassName),
-				AccessModes: []corev1.PersistentVolumeAccessMode{
-					"ReadWriteOnce",
-				},
-				Resources: corev1.ResourceRequirements{
-					Requests: corev1.ResourceList{
-						corev1.ResourceStorage: providerSpec.PVCSize,
-					},
-				},
-			},
-			Source: cdi.DataVolumeSource{
-				HTTP: &cdi.DataVolumeSourceHTTP{
-					URL: providerSpec.SourceURL,
-				},
+			Labels: map[string]string{
+				machineLabel: machineName,
 			},
 		},
+		Spec: buildDataVolumeSpec(providerSpec),
 	}
 
 	if dataVolumeName != "" {
@@ -169,41 +400,52 @@ func (p PluginSPIImpl) CreateMachine(ctx context.Context, machineName string, pr
 		}
 	}
 
+	cloudInitDataSource := providerSpec.CloudInitDataSource
+	if providerSpec.Windows != nil {
+		// cloudbase-init reads the userData from the ConfigDrive
+		cloudInitDataSource = api.CloudInitDataSourceConfigDrive
+	}
+
 	virtualMachine := &kubevirtv1.VirtualMachine{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      machineName,
-			Namespace: namespace,
-			Labels:    vmLabels,
+			Name:        machineName,
+			Namespace:   namespace,
+			Labels:      vmLabels,
+			Annotations: vmAnnotations,
+			Finalizers:  []string{vmFinalizer},
 		},
 		Spec: kubevirtv1.VirtualMachineSpec{
 			Running: utilpointer.BoolPtr(true),
 			Template: &kubevirtv1.VirtualMachineInstanceTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"kubevirt.io/vm": machineName,
-					},
+					Labels:      templateLabels,
+					Annotations: providerSpec.TemplateAnnotations,
 				},
 				Spec: kubevirtv1.VirtualMachineInstanceSpec{
+					PriorityClassName: priorityClassName,
 					Domain: kubevirtv1.DomainSpec{
-						CPU:    providerSpec.CPU,
-						Memory: providerSpec.Memory,
+						CPU:      providerSpec.CPU,
+						Memory:   providerSpec.Memory,
+						Features: providerSpec.Features.DeepCopy(),
 						Devices: kubevirtv1.Devices{
-							Disks: []kubevirtv1.Disk{
+							Disks: append([]kubevirtv1.Disk{
 								{
 									Name:       "datavolumedisk",
-									DiskDevice: kubevirtv1.DiskDevice{Disk: &kubevirtv1.DiskTarget{Bus: "virtio"}},
+									DiskDevice: kubevirtv1.DiskDevice{Disk: &kubevirtv1.DiskTarget{Bus: "virtio", PciAddress: providerSpec.RootDiskPciAddress}},
 								},
 								{
 									Name:       "cloudinitdisk",
 									DiskDevice: kubevirtv1.DiskDevice{Disk: &kubevirtv1.DiskTarget{Bus: "virtio"}},
 								},
-							},
+							}, additionalDisks...),
 							Interfaces: interfaces,
+							GPUs:       providerSpec.GPUs,
 						},
-						Resources: providerSpec.Resources,
+						Resources: buildResources(providerSpec),
 					},
 					TerminationGracePeriodSeconds: &terminationGracePeriodSeconds,
-					Volumes: []kubevirtv1.Volume{
+					EvictionStrategy:              providerSpec.EvictionStrategy,
+					Volumes: append([]kubevirtv1.Volume{
 						{
 							Name: "datavolumedisk",
 							VolumeSource: kubevirtv1.VolumeSource{
@@ -213,21 +455,15 @@ func (p PluginSPIImpl) CreateMachine(ctx context.Context, machineName string, pr
 							},
 						},
 						{
-							Name: "cloudinitdisk",
-							VolumeSource: kubevirtv1.VolumeSource{
-								CloudInitNoCloud: &kubevirtv1.CloudInitNoCloudSource{
-									UserDataSecretRef: &corev1.LocalObjectReference{
-										Name: userdataSecretName,
-									},
-									NetworkData: networkData,
-								},
-							},
+							Name:         "cloudinitdisk",
+							VolumeSource: buildCloudInitVolumeSource(cloudInitDataSource, userdataSecretName, networkData),
 						},
-					},
-					DNSPolicy: providerSpec.DNSPolicy,
-					DNSConfig: providerSpec.DNSConfig,
-					Networks:  networks,
-					Affinity:  affinity,
+					}, additionalVolumes...),
+					DNSPolicy:    providerSpec.DNSPolicy,
+					DNSConfig:    providerSpec.DNSConfig,
+					Networks:     networks,
+					NodeSelector: providerSpec.NodeSelector,
+					Affinity:     affinity,
 				},
 			},
 			DataVolumeTemplates: []cdi.DataVolume{
@@ -236,108 +472,456 @@ func (p PluginSPIImpl) CreateMachine(ctx context.Context, machineName string, pr
 		},
 	}
 
-	if err := c.Create(ctx, virtualMachine); err != nil {
-		return "", fmt.Errorf("failed to create VirtualMachine: %v", err)
+	if providerSpec.VMTemplate != nil {
+		base, err := p.getVMTemplate(ctx, c, machineName, namespace, providerSpec.VMTemplate)
+		if err != nil {
+			return nil, nil, err
+		}
+		rootDiskName := providerSpec.VMTemplate.RootDiskName
+		if rootDiskName == "" {
+			rootDiskName = api.DefaultVMTemplateRootDiskName
+		}
+		useBaseNetworks := len(providerSpec.Networks) == 0 && providerSpec.PodNetwork == nil
+		if err := applyVMTemplate(virtualMachine, base, rootDiskName, useBaseNetworks); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	userDataSecret := &corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:            userdataSecretName,
-			Namespace:       virtualMachine.Namespace,
-			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(virtualMachine, kubevirtv1.VirtualMachineGroupVersionKind)},
-		},
-		Data: map[string][]byte{"userdata": []byte(userData)},
+	if providerSpec.Windows != nil {
+		applyWindowsProfile(&virtualMachine.Spec.Template.Spec, providerSpec.Windows)
 	}
 
-	if err := c.Create(ctx, userDataSecret); err != nil {
-		return "", fmt.Errorf("failed to create secret for userdata: %v", err)
-	}
+	return virtualMachine, userDataBytes, nil
+}
 
-	return encodeProviderID(machineName), nil
+// DeleteMachine deletes the Kubevirt virtual machine with the given name. It is called by the machine controller once the node
+// of the machine has been drained. If a graceful shutdown timeout is specified, the VM is stopped first, and its root disk is only
+// backed up and the VM only deleted once the guest shut down or was killed, so that no data is lost that is still being flushed.
+// If a backup policy is specified, the VM is only deleted once its root disk has been backed up.
+// If a deletion timeout is specified, it waits until the VM, its VMI and its root disk DataVolume are gone.
+func (p PluginSPIImpl) DeleteMachine(ctx context.Context, machineName, providerID string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error) {
+	err = p.retryOnUnauthorized(ctx, secret, providerSpec, func() error {
+		foundProviderID, err = p.deleteMachine(ctx, machineName, providerID, providerSpec, secret)
+		return err
+	})
+	return foundProviderID, err
 }
 
-// DeleteMachine deletes the Kubevirt virtual machine with the given name.
-func (p PluginSPIImpl) DeleteMachine(ctx context.Context, machineName, _ string, _ *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error) {
-	c, namespace, err := p.cf.GetClient(secret)
+// deleteMachine implements DeleteMachine.
+func (p PluginSPIImpl) deleteMachine(ctx context.Context, machineName, _ string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error) {
+	c, namespace, err := p.getClient(secret, providerSpec)
 	if err != nil {
-		return "", fmt.Errorf("failed to create client: %v", err)
+		return "", fmt.Errorf("failed to create client: %w", err)
 	}
+	ctx = withClusterLogger(ctx, namespace, providerSpec)
 
 	virtualMachine, err := p.getVM(ctx, c, machineName, namespace)
 	if err != nil {
 		if clouderrors.IsMachineNotFoundError(err) {
-			klog.V(2).Infof("skip VirtualMachine evicting, VirtualMachine instance %s is not found", machineName)
+			logging.FromContext(ctx).V(2).Info("skip VirtualMachine evicting, VirtualMachine is not found", "vm", machineName)
+			if providerSpec.DeletionTimeout != nil {
+				return "", p.waitForVMDeleted(ctx, c, machineName, namespace, providerSpec.DeletionTimeout.Duration)
+			}
 			return "", nil
 		}
 		return "", err
 	}
 
+	if providerSpec.GracefulShutdownTimeout != nil {
+		if err := p.stopVM(ctx, c, virtualMachine, getShutdownTimeout(providerSpec)); err != nil {
+			return "", fmt.Errorf("VirtualMachine %s did not shut down yet: %w", machineName, err)
+		}
+	}
+
+	if providerSpec.BackupPolicy != nil {
+		if err := p.backupRootDisk(ctx, c, virtualMachine, providerSpec.BackupPolicy); err != nil {
+			return "", err
+		}
+	}
+
+	if err := p.removeVMFinalizer(ctx, c, virtualMachine); err != nil {
+		return "", err
+	}
+
+	p.recordEvent(ctx, c, virtualMachine, corev1.EventTypeNormal, eventReasonDeleting, "Deleting VirtualMachine of machine %s", machineName)
 	if err := client.IgnoreNotFound(c.Delete(ctx, virtualMachine)); err != nil {
-		return "", fmt.Errorf("failed to delete VirtualMachine %v: %v", machineName, err)
+		return "", fmt.Errorf("failed to delete VirtualMachine %v: %w", machineName, err)
 	}
-	return encodeProviderID(virtualMachine.Name), nil
+
+	if providerSpec.DeletionTimeout != nil {
+		if err := p.waitForVMDeleted(ctx, c, machineName, namespace, providerSpec.DeletionTimeout.Duration); err != nil {
+			return "", err
+		}
+	}
+	return getProviderID(virtualMachine), nil
 }
 
 // GetMachineStatus fetches the provider id of the Kubevirt virtual machine with the given name.
-func (p PluginSPIImpl) GetMachineStatus(ctx context.Context, machineName, _ string, _ *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error) {
-	c, namespace, err := p.cf.GetClient(secret)
+// If SSH is exposed through a Service, its address is logged. The status of the VM, e.g. Provisioning while its root disk
+// is imported, Unschedulable or Running, is logged and recorded in annotations of the VM. A failed root disk import is returned as an error.
+func (p PluginSPIImpl) GetMachineStatus(ctx context.Context, machineName, providerID string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error) {
+	err = p.retryOnUnauthorized(ctx, secret, providerSpec, func() error {
+		foundProviderID, err = p.getMachineStatus(ctx, machineName, providerID, providerSpec, secret)
+		return err
+	})
+	return foundProviderID, err
+}
+
+// getMachineStatus implements GetMachineStatus.
+func (p PluginSPIImpl) getMachineStatus(ctx context.Context, machineName, providerID string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error) {
+	c, namespace, err := p.getClient(secret, providerSpec)
 	if err != nil {
-		return "", fmt.Errorf("failed to create client: %v", err)
+		return "", fmt.Errorf("failed to create client: %w", err)
 	}
+	ctx = withClusterLogger(ctx, namespace, providerSpec)
 
 	virtualMachine, err := p.getVM(ctx, c, machineName, namespace)
 	if err != nil {
 		return "", err
 	}
 
-	return encodeProviderID(virtualMachine.Name), nil
+	if err := labelLegacyVM(ctx, c, virtualMachine, providerSpec); err != nil {
+		return "", err
+	}
+
+	if _, _, uid, err := decodeProviderID(providerID); err == nil && uid != "" && uid != virtualMachine.UID {
+		logging.FromContext(ctx).Info("VirtualMachine was recreated, its UID differs from the UID of the provider ID", "vm", machineName, "uid", virtualMachine.UID, "providerID", providerID)
+	}
+
+	if providerSpec.Preemptible {
+		if err := p.checkPreemption(ctx, c, virtualMachine); err != nil {
+			return "", err
+		}
+	}
+
+	if providerSpec.CrashLoopRemediation != nil {
+		if err := p.checkCrashLoop(ctx, c, virtualMachine, providerSpec.CrashLoopRemediation); err != nil {
+			return "", err
+		}
+	}
+
+	if virtualMachine.DeletionTimestamp != nil {
+		logging.FromContext(ctx).Info("VirtualMachine is marked for deletion but was not deleted by the machine controller, it is kept until the machine is deleted", "vm", machineName)
+	}
+
+	if providerSpec.SSHService != nil {
+		address, err := p.getSSHServiceAddress(ctx, c, virtualMachine)
+		if err != nil {
+			return "", err
+		}
+		logging.FromContext(ctx).Info("SSH of VirtualMachine is exposed", "vm", machineName, "address", address)
+	}
+
+	dataVolumeStatus, err := p.getRootDiskStatus(ctx, c, virtualMachine)
+	if err != nil {
+		return "", err
+	}
+
+	status, message, err := p.recordVMStatus(ctx, c, virtualMachine, dataVolumeStatus)
+	if err != nil {
+		return "", err
+	}
+	logging.FromContext(ctx).V(2).Info("VirtualMachine status", "vm", machineName, "status", status, "message", message)
+
+	return getProviderID(virtualMachine), nil
+}
+
+// GetMachineAddresses returns the node addresses of the Kubevirt virtual machine with the given name, i.e. the IP addresses
+// of the interfaces of its virtual machine instance as internal IPs and its hostname. It returns no addresses if the
+// virtual machine instance doesn't exist, e.g. because the VM is stopped.
+func (p PluginSPIImpl) GetMachineAddresses(ctx context.Context, machineName, _ string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (addresses []corev1.NodeAddress, err error) {
+	c, namespace, err := p.getClient(secret, providerSpec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	ctx = withClusterLogger(ctx, namespace, providerSpec)
+
+	virtualMachineInstance := &kubevirtv1.VirtualMachineInstance{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: machineName}, virtualMachineInstance); err != nil {
+		if kerrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get VirtualMachineInstance: %w", err)
+	}
+
+	return buildNodeAddresses(virtualMachineInstance), nil
 }
 
 // ListMachines lists the provider ids of all Kubevirt virtual machines.
+// If a VMListerFactory is set, the VMs are listed from its cache instead of the API server.
 func (p PluginSPIImpl) ListMachines(ctx context.Context, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (providerIDList map[string]string, err error) {
-	c, namespace, err := p.cf.GetClient(secret)
+	err = p.retryOnUnauthorized(ctx, secret, providerSpec, func() error {
+		providerIDList, err = p.listMachines(ctx, providerSpec, secret)
+		return err
+	})
+	return providerIDList, err
+}
+
+// listMachines implements ListMachines.
+func (p PluginSPIImpl) listMachines(ctx context.Context, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (providerIDList map[string]string, err error) {
+	c, namespace, err := p.getClient(secret, providerSpec)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create client: %v", err)
+		return nil, fmt.Errorf("failed to create client: %w", err)
 	}
+	ctx = withClusterLogger(ctx, namespace, providerSpec)
 
 	var vmLabels = map[string]string{}
 	if len(providerSpec.Tags) > 0 {
 		vmLabels = providerSpec.Tags
 	}
 
-	virtualMachineList, err := p.listVMs(ctx, c, namespace, vmLabels)
+	virtualMachineList, err := p.listCachedVMs(ctx, c, secret, providerSpec, namespace, vmLabels)
 	if err != nil {
 		return nil, err
 	}
 
+	// VMs created by former versions of the provider lack the machine label, hence they are labelled here, as GetMachineStatus
+	// is rarely called for running machines. New VMs always get the label, so this only needs to run once per maintenance interval
+	clusterSecret := getClusterSecret(secret, providerSpec)
+	if p.maintenance.allow(clusterSecret, namespace, maintenanceTaskLegacyVMs+"/"+providerSpec.Tags[machineClassLabel]) {
+		legacyVMs, err := labelLegacyVMs(ctx, c, namespace, providerSpec)
+		if err != nil {
+			logging.FromContext(ctx).Error(err, "could not label VirtualMachines created by a former version")
+		}
+		virtualMachineList.Items = appendMissingVMs(virtualMachineList.Items, legacyVMs)
+	}
+
+	recordVMStatusMetrics(providerSpec.Tags[machineClassLabel], virtualMachineList.Items)
+
 	var providerIDs = make(map[string]string, len(virtualMachineList.Items))
 	for _, virtualMachine := range virtualMachineList.Items {
-		providerIDs[encodeProviderID(virtualMachine.Name)] = virtualMachine.Name
+		providerIDs[getProviderID(&virtualMachine)] = virtualMachine.Name
+	}
+
+	// ListMachines is called periodically by the safety controller of MCM, hence orphans are cleaned up
+	// and VMs are migrated away from cordoned nodes here, at most once per maintenance interval
+	if p.maintenance.allow(clusterSecret, namespace, maintenanceTaskCleanup) {
+		if err := p.cleanupOrphans(ctx, c, secret, providerSpec, namespace); err != nil {
+			logging.FromContext(ctx).Error(err, "could not clean up orphaned userdata secrets and DataVolumes")
+		}
+	}
+	if providerSpec.MigrateFromCordonedNodes && p.maintenance.allow(clusterSecret, namespace, maintenanceTaskMigration+"/"+providerSpec.Tags[machineClassLabel]) {
+		if err := p.migrateVMsFromCordonedNodes(ctx, c, virtualMachineList.Items); err != nil {
+			logging.FromContext(ctx).Error(err, "could not migrate VirtualMachines from cordoned nodes")
+		}
 	}
 
 	return providerIDs, nil
 }
 
 // ShutDownMachine shuts down the Kubevirt virtual machine with the given name by setting its spec.running field to false.
-func (p PluginSPIImpl) ShutDownMachine(ctx context.Context, machineName, _ string, _ *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error) {
-	c, namespace, err := p.cf.GetClient(secret)
+func (p PluginSPIImpl) ShutDownMachine(ctx context.Context, machineName, _ string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error) {
+	c, namespace, err := p.getClient(secret, providerSpec)
 	if err != nil {
-		return "", fmt.Errorf("failed to create client: %v", err)
+		return "", fmt.Errorf("failed to create client: %w", err)
 	}
+	ctx = withClusterLogger(ctx, namespace, providerSpec)
+
+	virtualMachine, err := p.getVM(ctx, c, machineName, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	if err := applyVM(ctx, c, virtualMachine, runningFieldManager, runningFields(false)); err != nil {
+		return "", fmt.Errorf("failed to update VirtualMachine running state: %w", err)
+	}
+	p.recordEvent(ctx, c, virtualMachine, corev1.EventTypeNormal, eventReasonShuttingDown, "Stopped VirtualMachine of machine %s", machineName)
+
+	return getProviderID(virtualMachine), nil
+}
+
+// StartMachine starts the Kubevirt virtual machine with the given name by setting its spec.running field to true,
+// e.g. to resume a machine shut down by ShutDownMachine. Starting resets the restarts counted by the crash loop remediation
+// and the running VMI recorded to detect preemptions.
+func (p PluginSPIImpl) StartMachine(ctx context.Context, machineName, _ string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error) {
+	c, namespace, err := p.getClient(secret, providerSpec)
+	if err != nil {
+		return "", fmt.Errorf("failed to create client: %w", err)
+	}
+	ctx = withClusterLogger(ctx, namespace, providerSpec)
+
+	virtualMachine, err := p.getVM(ctx, c, machineName, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	if err := p.resetCrashLoop(ctx, c, virtualMachine); err != nil {
+		return "", err
+	}
+	if err := resetRunningVMI(ctx, c, virtualMachine); err != nil {
+		return "", err
+	}
+
+	if virtualMachine.Spec.Running == nil || !*virtualMachine.Spec.Running {
+		if err := applyVM(ctx, c, virtualMachine, runningFieldManager, runningFields(true)); err != nil {
+			return "", fmt.Errorf("failed to update VirtualMachine running state: %w", err)
+		}
+	}
+
+	return getProviderID(virtualMachine), nil
+}
+
+// RestartMachine restarts the Kubevirt virtual machine with the given name by deleting its virtual machine instance,
+// which KubeVirt recreates for running VMs. The disks of the VM are kept. Stopped VMs cannot be restarted.
+// Deliberate restarts reset the restarts counted by the crash loop remediation, and aren't detected as preemptions.
+func (p PluginSPIImpl) RestartMachine(ctx context.Context, machineName, _ string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error) {
+	c, namespace, err := p.getClient(secret, providerSpec)
+	if err != nil {
+		return "", fmt.Errorf("failed to create client: %w", err)
+	}
+	ctx = withClusterLogger(ctx, namespace, providerSpec)
+
+	virtualMachine, err := p.getVM(ctx, c, machineName, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	if virtualMachine.Spec.Running == nil || !*virtualMachine.Spec.Running {
+		return "", fmt.Errorf("failed to restart VirtualMachine %s: VirtualMachine is stopped", machineName)
+	}
+
+	if err := p.resetCrashLoop(ctx, c, virtualMachine); err != nil {
+		return "", err
+	}
+	if err := resetRunningVMI(ctx, c, virtualMachine); err != nil {
+		return "", err
+	}
+
+	virtualMachineInstance := &kubevirtv1.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      virtualMachine.Name,
+			Namespace: virtualMachine.Namespace,
+		},
+	}
+	if err := client.IgnoreNotFound(c.Delete(ctx, virtualMachineInstance)); err != nil {
+		return "", fmt.Errorf("failed to delete VirtualMachineInstance %s: %w", machineName, err)
+	}
+
+	return getProviderID(virtualMachine), nil
+}
+
+// MigrateMachine live migrates the Kubevirt virtual machine with the given name to another node by creating a migration
+// of its virtual machine instance. It is a no-op if a migration is already in progress.
+func (p PluginSPIImpl) MigrateMachine(ctx context.Context, machineName, _ string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error) {
+	c, namespace, err := p.getClient(secret, providerSpec)
+	if err != nil {
+		return "", fmt.Errorf("failed to create client: %w", err)
+	}
+	ctx = withClusterLogger(ctx, namespace, providerSpec)
+
+	virtualMachine, err := p.getVM(ctx, c, machineName, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := p.migrateVM(ctx, c, virtualMachine); err != nil {
+		return "", err
+	}
+
+	return getProviderID(virtualMachine), nil
+}
+
+// ExpandMachineRootDisk grows the PersistentVolumeClaim of the root disk of the Kubevirt virtual machine with the given name
+// to the pvcSize of the given provider spec. It is a no-op if the claim is already at least that large.
+// The storage class of the claim must allow volume expansion, and the guest only sees the new size after a restart.
+func (p PluginSPIImpl) ExpandMachineRootDisk(ctx context.Context, machineName, _ string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error) {
+	c, namespace, err := p.getClient(secret, providerSpec)
+	if err != nil {
+		return "", fmt.Errorf("failed to create client: %w", err)
+	}
+	ctx = withClusterLogger(ctx, namespace, providerSpec)
 
 	virtualMachine, err := p.getVM(ctx, c, machineName, namespace)
 	if err != nil {
 		return "", err
 	}
 
-	virtualMachine.Spec.Running = utilpointer.BoolPtr(false)
 	if err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
-		return c.Update(ctx, virtualMachine)
+		pvc := &corev1.PersistentVolumeClaim{}
+		if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: virtualMachine.Name}, pvc); err != nil {
+			return err
+		}
+
+		size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+		if size.Cmp(providerSpec.PVCSize) >= 0 {
+			return nil
+		}
+
+		logging.FromContext(ctx).V(2).Info("expanding root disk of VirtualMachine", "vm", machineName, "from", size.String(), "to", providerSpec.PVCSize.String())
+		pvc.Spec.Resources.Requests[corev1.ResourceStorage] = providerSpec.PVCSize
+		return c.Update(ctx, pvc)
 	}); err != nil {
-		return "", fmt.Errorf("failed to update VirtualMachine running state: %v", err)
+		return "", fmt.Errorf("failed to expand root disk PersistentVolumeClaim: %w", err)
+	}
+
+	return getProviderID(virtualMachine), nil
+}
+
+// isMatchingVM returns whether the given VM has all the given labels, except for the machine label
+// that VMs created by former versions of the provider don't have.
+func isMatchingVM(virtualMachine *kubevirtv1.VirtualMachine, vmLabels map[string]string) bool {
+	for key, value := range vmLabels {
+		if key != machineLabel && virtualMachine.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// getClient creates a client for the provider cluster of the zone of the given provider spec.
+func (p PluginSPIImpl) getClient(secret *corev1.Secret, providerSpec *api.KubeVirtProviderSpec) (client.Client, string, error) {
+	return p.cf.GetClient(getClusterSecret(secret, providerSpec))
+}
+
+// retryOnUnauthorized calls the given operation and, if it fails with an Unauthorized error, e.g. because the credentials
+// of the provider cluster were rotated, drops the cached client, server version and VM informer of the provider cluster
+// and calls the operation once more, so that it uses clients rebuilt from the current kubeconfig.
+func (p PluginSPIImpl) retryOnUnauthorized(ctx context.Context, secret *corev1.Secret, providerSpec *api.KubeVirtProviderSpec, operation func() error) error {
+	err := operation()
+	if !invalidateOnUnauthorized(err, getClusterSecret(secret, providerSpec), p.cf, p.svf, p.vmlf) {
+		return err
+	}
+	logging.FromContext(ctx).Info("provider cluster rejected the credentials, retrying with rebuilt clients", "error", err.Error())
+	return operation()
+}
+
+// rollbackVM deletes the given VM, which was created by a CreateMachine call that failed afterwards,
+// together with its root disk DataVolume.
+func (p PluginSPIImpl) rollbackVM(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine) error {
+	logging.FromContext(ctx).V(2).Info("rolling back VirtualMachine", "vm", virtualMachine.Name)
+	p.recordEvent(ctx, c, virtualMachine, corev1.EventTypeWarning, eventReasonRolledBack, "Deleting VirtualMachine, as machine creation failed after it was created")
+	if err := p.removeVMFinalizer(ctx, c, virtualMachine); err != nil {
+		return err
+	}
+	if err := client.IgnoreNotFound(c.Delete(ctx, virtualMachine, client.PropagationPolicy(metav1.DeletePropagationBackground))); err != nil {
+		return fmt.Errorf("failed to delete VirtualMachine: %w", err)
 	}
+	return nil
+}
+
+// removeVMFinalizer removes the finalizer of the provider from the given VM, so that it can be deleted.
+func (p PluginSPIImpl) removeVMFinalizer(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine) error {
+	if err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		if err := c.Get(ctx, types.NamespacedName{Namespace: virtualMachine.Namespace, Name: virtualMachine.Name}, virtualMachine); err != nil {
+			return err
+		}
+
+		var finalizers []string
+		for _, finalizer := range virtualMachine.Finalizers {
+			if finalizer != vmFinalizer {
+				finalizers = append(finalizers, finalizer)
+			}
+		}
+		if len(finalizers) == len(virtualMachine.Finalizers) {
+			return nil
+		}
 
-	return encodeProviderID(virtualMachine.Name), nil
+		virtualMachine.Finalizers = finalizers
+		return c.Update(ctx, virtualMachine)
+	}); client.IgnoreNotFound(err) != nil {
+		return fmt.Errorf("failed to remove finalizer of VirtualMachine %s: %w", virtualMachine.Name, err)
+	}
+	return nil
 }
 
 func (p PluginSPIImpl) getVM(ctx context.Context, c client.Client, machineName, namespace string) (*kubevirtv1.VirtualMachine, error) {
@@ -348,31 +932,75 @@ func (p PluginSPIImpl) getVM(ctx context.Context, c client.Client, machineName,
 				Name: machineName,
 			}
 		}
-		return nil, fmt.Errorf("failed to get VirtualMachine: %v", err)
+		return nil, fmt.Errorf("failed to get VirtualMachine: %w", err)
 	}
 	return virtualMachine, nil
 }
 
-func (p PluginSPIImpl) listVMs(ctx context.Context, c client.Client, namespace string, vmLabels map[string]string) (*kubevirtv1.VirtualMachineList, error) {
-	virtualMachineList := &kubevirtv1.VirtualMachineList{}
-	opts := []client.ListOption{client.InNamespace(namespace)}
-	if len(vmLabels) > 0 {
-		opts = append(opts, client.MatchingLabels(vmLabels))
+// findVM returns the VM with the given name, or nil if it doesn't exist.
+func (p PluginSPIImpl) findVM(ctx context.Context, c client.Client, machineName, namespace string) (*kubevirtv1.VirtualMachine, error) {
+	virtualMachine, err := p.getVM(ctx, c, machineName, namespace)
+	if clouderrors.IsMachineNotFoundError(err) {
+		return nil, nil
+	}
+	return virtualMachine, err
+}
+
+// listCachedVMs lists the VMs from the VMLister if there is one, falling back to listing them from the API server
+// if the lister can't be created or its cache isn't synced yet.
+func (p PluginSPIImpl) listCachedVMs(ctx context.Context, c client.Client, secret *corev1.Secret, providerSpec *api.KubeVirtProviderSpec, namespace string, vmLabels map[string]string) (*kubevirtv1.VirtualMachineList, error) {
+	if p.vmlf == nil {
+		return p.listVMs(ctx, c, namespace, vmLabels)
+	}
+
+	lister, err := p.vmlf.GetVMLister(getClusterSecret(secret, providerSpec))
+	if err != nil {
+		logging.FromContext(ctx).Error(err, "could not create VirtualMachine lister, listing from the API server")
+		return p.listVMs(ctx, c, namespace, vmLabels)
+	}
+	selector, err := managedVMSelector(vmLabels)
+	if err != nil {
+		return nil, err
 	}
-	if err := c.List(ctx, virtualMachineList, opts...); err != nil {
-		return nil, fmt.Errorf("failed to list VirtualMachines: %v", err)
+	virtualMachines, err := lister.ListVMs(selector)
+	if err != nil {
+		logging.FromContext(ctx).V(2).Info("could not list VirtualMachines from cache, listing from the API server", "reason", err.Error())
+		return p.listVMs(ctx, c, namespace, vmLabels)
 	}
-	return virtualMachineList, nil
+	return &kubevirtv1.VirtualMachineList{Items: virtualMachines}, nil
 }
 
-func (p PluginSPIImpl) getDataVolume(ctx context.Context, c client.Client, dataVolumeName, namespace string) (string, error) {
-	dataVolume := &cdi.DataVolume{}
-	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: dataVolumeName}, dataVolume); err != nil {
-		if kerrors.IsNotFound(err) {
-			return "", nil
+// listVMs lists the VMs managed by the provider in the given namespace that have the given labels, in pages
+// of vmListPageSize VMs.
+func (p PluginSPIImpl) listVMs(ctx context.Context, c client.Client, namespace string, vmLabels map[string]string) (*kubevirtv1.VirtualMachineList, error) {
+	selector, err := managedVMSelector(vmLabels)
+	if err != nil {
+		return nil, err
+	}
+
+	virtualMachineList := &kubevirtv1.VirtualMachineList{}
+	continueToken := ""
+	for {
+		page := &kubevirtv1.VirtualMachineList{}
+		if err := c.List(ctx, page, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: selector},
+			client.Limit(vmListPageSize), client.Continue(continueToken)); err != nil {
+			return nil, fmt.Errorf("failed to list VirtualMachines: %w", err)
+		}
+		virtualMachineList.Items = append(virtualMachineList.Items, page.Items...)
+		if page.Continue == "" {
+			return virtualMachineList, nil
 		}
-		return "", fmt.Errorf("failed to get DataVolume: %v", err)
+		continueToken = page.Continue
 	}
+}
 
-	return dataVolume.Name, nil
+// managedVMSelector returns a selector for the VMs managed by the provider, i.e. the VMs with the machine label,
+// that also have the given labels, so that unrelated VMs in the namespace are never touched. VMs created by former
+// versions of the provider get the machine label with the next ListMachines, GetMachineStatus or CreateMachine call.
+func managedVMSelector(vmLabels map[string]string) (labels.Selector, error) {
+	requirement, err := labels.NewRequirement(machineLabel, selection.Exists, nil)
+	if err != nil {
+		return nil, err
+	}
+	return labels.SelectorFromSet(vmLabels).Add(*requirement), nil
 }
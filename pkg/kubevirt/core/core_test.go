@@ -16,18 +16,37 @@ package core
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	clouderrors "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/errors"
 
+	authorizationv1 "k8s.io/api/authorization/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog"
+	utilpointer "k8s.io/utils/pointer"
 	kubevirtv1 "kubevirt.io/client-go/api/v1"
 	cdi "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
@@ -93,19 +112,27 @@ func TestPluginSPIImpl_GetMachineStatus(t *testing.T) {
 			t.Fatalf("failed to create plugin: %v", err)
 		}
 
-		_, err = plugin.CreateMachine(context.Background(), machineName, providerSpec, &corev1.Secret{})
+		createdProviderID, err := plugin.CreateMachine(context.Background(), machineName, providerSpec, &corev1.Secret{})
 		if err != nil {
 			t.Fatalf("failed to create machine: %v", err)
 		}
 
-		providerID, err := plugin.GetMachineStatus(context.Background(), machineName, "", providerSpec, &corev1.Secret{})
+		providerID, err := plugin.GetMachineStatus(context.Background(), machineName, createdProviderID, providerSpec, &corev1.Secret{})
 		if err != nil {
 			t.Fatalf("failed to get machine status: %v", err)
 		}
 
-		if providerID != ProviderName+"://"+machineName {
+		if providerID != createdProviderID || !strings.HasPrefix(providerID, ProviderName+"://"+namespace+"/"+machineName+"/") {
 			t.Fatal("provider id doesn't match the expected value")
 		}
+
+		vm, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace)
+		if err != nil {
+			t.Fatalf("failed to get VM: %v", err)
+		}
+		if status := vm.Annotations[statusAnnotation]; status != vmStatusStarting {
+			t.Fatalf("expected status %s, got %s", vmStatusStarting, status)
+		}
 	})
 }
 
@@ -134,6 +161,62 @@ func TestPluginSPIImpl_ListMachines(t *testing.T) {
 	})
 }
 
+func TestPluginSPIImpl_ListMachinesWithLegacyVM(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	mf := newMockFactory(fakeClient, namespace, serverVersion)
+	plugin, err := NewPluginSPIImpl(mf, mf)
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	spec := *providerSpec
+	spec.Tags = map[string]string{machineClassLabel: "test-machine-class"}
+	providerID, err := plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+	if err != nil {
+		t.Fatalf("failed to create machine: %v", err)
+	}
+
+	// VMs created by former versions of the provider don't have the machine label
+	vm, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace)
+	if err != nil {
+		t.Fatalf("failed to get VM: %v", err)
+	}
+	delete(vm.Labels, machineLabel)
+	if err := fakeClient.Update(context.Background(), vm); err != nil {
+		t.Fatalf("failed to update VM: %v", err)
+	}
+	unrelatedVM := &kubevirtv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Name: "unrelated", Namespace: namespace}}
+	if err := fakeClient.Create(context.Background(), unrelatedVM); err != nil {
+		t.Fatalf("failed to create unrelated VM: %v", err)
+	}
+
+	machineList, err := plugin.ListMachines(context.Background(), &spec, &corev1.Secret{})
+	if err != nil {
+		t.Fatalf("failed to list machines: %v", err)
+	}
+	if !reflect.DeepEqual(machineList, map[string]string{providerID: machineName}) {
+		t.Fatalf("expected VM without machine label to be listed, got %v", machineList)
+	}
+	if vm, err = plugin.getVM(context.Background(), fakeClient, machineName, namespace); err != nil || vm.Labels[machineLabel] != machineName {
+		t.Fatalf("expected VM to be labelled by ListMachines, got %v, %v", vm.Labels, err)
+	}
+	if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: unrelatedVM.Name}, unrelatedVM); err != nil || unrelatedVM.Labels[machineLabel] != "" {
+		t.Fatalf("expected unrelated VM not to be labelled, got %v, %v", unrelatedVM.Labels, err)
+	}
+
+	// GetMachineStatus labels legacy VMs as well, independently of the maintenance interval of ListMachines
+	delete(vm.Labels, machineLabel)
+	if err := fakeClient.Update(context.Background(), vm); err != nil {
+		t.Fatalf("failed to update VM: %v", err)
+	}
+	if _, err := plugin.GetMachineStatus(context.Background(), machineName, providerID, &spec, &corev1.Secret{}); err != nil {
+		t.Fatalf("failed to get machine status: %v", err)
+	}
+	if machineList, err := plugin.ListMachines(context.Background(), &spec, &corev1.Secret{}); err != nil || len(machineList) != 1 {
+		t.Fatalf("expected VM to be labelled and listed, got %v, %v", machineList, err)
+	}
+}
+
 func TestPluginSPIImpl_ShutDownMachine(t *testing.T) {
 	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
 	t.Run("ShutDownMachine", func(t *testing.T) {
@@ -164,6 +247,74 @@ func TestPluginSPIImpl_ShutDownMachine(t *testing.T) {
 	})
 }
 
+func TestPluginSPIImpl_RestartMachine(t *testing.T) {
+	virtualMachineInstance := &kubevirtv1.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{Name: machineName, Namespace: namespace},
+	}
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme, virtualMachineInstance)
+	t.Run("RestartMachine", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		providerID, err := plugin.CreateMachine(context.Background(), machineName, providerSpec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		_, err = plugin.RestartMachine(context.Background(), machineName, providerID, providerSpec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to restart machine: %v", err)
+		}
+
+		err = fakeClient.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: machineName}, virtualMachineInstance)
+		if !kerrors.IsNotFound(err) {
+			t.Fatalf("expected VirtualMachineInstance to be deleted, got %v", err)
+		}
+
+		if _, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace); err != nil {
+			t.Fatalf("VirtualMachine should be kept: %v", err)
+		}
+	})
+}
+
+func TestPluginSPIImpl_StartMachine(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("StartMachine", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		providerID, err := plugin.CreateMachine(context.Background(), machineName, providerSpec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		_, err = plugin.ShutDownMachine(context.Background(), machineName, providerID, providerSpec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to shutdown machine: %v", err)
+		}
+
+		_, err = plugin.StartMachine(context.Background(), machineName, providerID, providerSpec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to start machine: %v", err)
+		}
+
+		vm, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace)
+		if err != nil {
+			t.Fatalf("failed to get VM: %v", err)
+		}
+
+		if !*vm.Spec.Running {
+			t.Fatal("machine is not running")
+		}
+	})
+}
+
 func TestPluginSPIImpl_DeleteMachine(t *testing.T) {
 	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
 	t.Run("DeleteMachine", func(t *testing.T) {
@@ -194,6 +345,206 @@ func TestPluginSPIImpl_DeleteMachine(t *testing.T) {
 	})
 }
 
+func TestPluginSPIImpl_ExpandMachineRootDisk(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("ExpandMachineRootDisk", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		providerID, err := plugin.CreateMachine(context.Background(), machineName, providerSpec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		// CDI creates the claim of the root disk, which the fake client doesn't do.
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: machineName, Namespace: namespace},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceStorage: providerSpec.PVCSize},
+				},
+			},
+		}
+		if err := fakeClient.Create(context.Background(), pvc); err != nil {
+			t.Fatalf("failed to create PVC: %v", err)
+		}
+
+		spec := *providerSpec
+		spec.PVCSize = resource.MustParse("20Gi")
+		_, err = plugin.ExpandMachineRootDisk(context.Background(), machineName, providerID, &spec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to expand machine root disk: %v", err)
+		}
+
+		if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: machineName}, pvc); err != nil {
+			t.Fatalf("failed to get PVC: %v", err)
+		}
+		size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+		if size.Cmp(spec.PVCSize) != 0 {
+			t.Fatalf("expected PVC size %s, got %s", spec.PVCSize.String(), size.String())
+		}
+	})
+}
+
+func TestPluginSPIImpl_CreateMachineWithIPAM(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("CreateMachineWithIPAM", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		spec := *providerSpec
+		spec.Networks = []api.NetworkSpec{
+			{
+				Name: "static-net",
+				IPAM: &api.IPAMSpec{CIDR: "10.0.0.0/24", Gateway: "10.0.0.1"},
+			},
+		}
+
+		var ipAddresses []string
+		for _, name := range []string{machineName, machineName + "-2"} {
+			if _, err := plugin.CreateMachine(context.Background(), name, &spec, &corev1.Secret{}); err != nil {
+				t.Fatalf("failed to create machine: %v", err)
+			}
+
+			vm, err := plugin.getVM(context.Background(), fakeClient, name, namespace)
+			if err != nil {
+				t.Fatalf("failed to get VM: %v", err)
+			}
+			ipAddresses = append(ipAddresses, vm.Annotations[ipAddressesAnnotation])
+
+			// A retried creation must neither change nor burn the IP addresses of the existing VM
+			if _, err := plugin.CreateMachine(context.Background(), name, &spec, &corev1.Secret{}); err != nil {
+				t.Fatalf("failed to create machine again: %v", err)
+			}
+		}
+
+		if ipAddresses[0] != `{"static-net":"10.0.0.2/24"}` || ipAddresses[1] != `{"static-net":"10.0.0.3/24"}` {
+			t.Fatalf("unexpected IP addresses: %v", ipAddresses)
+		}
+	})
+}
+
+func TestPluginSPIImpl_CreateMachineWithImageCache(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("CreateMachineWithImageCache", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		machineClassName := "test-machine-class"
+		spec := *providerSpec
+		spec.CacheSourceImage = true
+		spec.Tags = map[string]string{machineClassLabel: machineClassName}
+
+		_, err = plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		cache := &cdi.DataVolume{}
+		if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: machineClassName}, cache); err != nil {
+			t.Fatalf("failed to get image cache DataVolume: %v", err)
+		}
+		if cache.Spec.Source.HTTP == nil || cache.Spec.Source.HTTP.URL != spec.SourceURL {
+			t.Fatal("image cache DataVolume doesn't import the source URL")
+		}
+
+		vm, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace)
+		if err != nil {
+			t.Fatalf("failed to get VM: %v", err)
+		}
+		if vm.Spec.DataVolumeTemplates[0].Spec.Source.HTTP == nil {
+			t.Fatal("root disk should be imported from the source URL while the image cache is not ready")
+		}
+
+		cache.Status.Phase = cdi.Succeeded
+		if err := fakeClient.Update(context.Background(), cache); err != nil {
+			t.Fatalf("failed to update image cache DataVolume: %v", err)
+		}
+
+		secondMachineName := machineName + "-2"
+		_, err = plugin.CreateMachine(context.Background(), secondMachineName, &spec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		vm, err = plugin.getVM(context.Background(), fakeClient, secondMachineName, namespace)
+		if err != nil {
+			t.Fatalf("failed to get VM: %v", err)
+		}
+		source := vm.Spec.DataVolumeTemplates[0].Spec.Source.PVC
+		if source == nil || source.Name != machineClassName {
+			t.Fatal("root disk should be cloned from the image cache")
+		}
+
+		spec.SourceURL = "http://new-test-image.com"
+		_, err = plugin.CreateMachine(context.Background(), machineName+"-3", &spec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		err = fakeClient.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: machineClassName}, cache)
+		if !kerrors.IsNotFound(err) {
+			t.Fatal("outdated image cache DataVolume should be deleted")
+		}
+	})
+}
+
+func TestPluginSPIImpl_CreateMachineWithSSHService(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("CreateMachineWithSSHService", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		spec := *providerSpec
+		spec.SSHService = &api.SSHServiceSpec{}
+
+		_, err = plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		service := &corev1.Service{}
+		if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: sshServiceName(machineName)}, service); err != nil {
+			t.Fatalf("failed to get SSH Service: %v", err)
+		}
+		if service.Spec.Type != corev1.ServiceTypeClusterIP {
+			t.Fatalf("expected Service type %s, got %s", corev1.ServiceTypeClusterIP, service.Spec.Type)
+		}
+		if service.Spec.Selector["kubevirt.io/vm"] != machineName {
+			t.Fatal("SSH Service doesn't select the VM")
+		}
+
+		service.Spec.ClusterIP = "10.0.0.10"
+		if err := fakeClient.Update(context.Background(), service); err != nil {
+			t.Fatalf("failed to update SSH Service: %v", err)
+		}
+
+		vm, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace)
+		if err != nil {
+			t.Fatalf("failed to get VM: %v", err)
+		}
+		address, err := plugin.getSSHServiceAddress(context.Background(), fakeClient, vm)
+		if err != nil {
+			t.Fatalf("failed to get SSH Service address: %v", err)
+		}
+		if address != "10.0.0.10:22" {
+			t.Fatalf("expected SSH Service address 10.0.0.10:22, got %s", address)
+		}
+	})
+}
+
 type mockFactory struct {
 	client        client.Client
 	namespace     string
@@ -202,7 +553,7 @@ type mockFactory struct {
 
 func newMockFactory(client client.Client, namespace, serverVersion string) *mockFactory {
 	return &mockFactory{
-		client:        client,
+		client:        rbacClient{Client: applyClient{Client: client}, namespace: namespace},
 		namespace:     namespace,
 		serverVersion: serverVersion,
 	}
@@ -215,3 +566,1748 @@ func (cf mockFactory) GetClient(secret *corev1.Secret) (client.Client, string, e
 func (cf mockFactory) GetServerVersion(secret *corev1.Secret) (string, error) {
 	return cf.serverVersion, nil
 }
+
+// rbacClient rejects the calls that are not allowed by the rules of the provider in provider clusters like the API
+// server, so that tests fail if the rules don't cover the client calls of the provider. Calls in other namespaces than
+// the given one are only allowed by the cluster rules.
+type rbacClient struct {
+	client.Client
+	namespace string
+}
+
+func (c rbacClient) authorize(obj runtime.Object, verb, namespace string) error {
+	gvk, err := apiutil.GVKForObject(obj, scheme.Scheme)
+	if err != nil {
+		return err
+	}
+	gvk.Kind = strings.TrimSuffix(gvk.Kind, "List")
+	resource, _ := meta.UnsafeGuessKindToResource(gvk)
+	rules := ProviderClusterClusterRules
+	if namespace == "" || namespace == c.namespace {
+		rules = append(append([]rbacv1.PolicyRule{}, ProviderClusterRules...), ProviderClusterClusterRules...)
+	}
+	for _, rule := range rules {
+		if containsString(rule.APIGroups, resource.Group) && containsString(rule.Resources, resource.Resource) && containsString(rule.Verbs, verb) {
+			return nil
+		}
+	}
+	return kerrors.NewForbidden(resource.GroupResource(), "", fmt.Errorf("%s in namespace %q is not allowed by the provider cluster rules", verb, namespace))
+}
+
+func objectNamespace(obj runtime.Object) string {
+	if accessor, err := meta.Accessor(obj); err == nil {
+		return accessor.GetNamespace()
+	}
+	return ""
+}
+
+func (c rbacClient) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	if err := c.authorize(obj, "get", key.Namespace); err != nil {
+		return err
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func (c rbacClient) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	listOptions := &client.ListOptions{}
+	listOptions.ApplyOptions(opts)
+	if err := c.authorize(list, "list", listOptions.Namespace); err != nil {
+		return err
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+func (c rbacClient) Create(ctx context.Context, obj runtime.Object, opts ...client.CreateOption) error {
+	if err := c.authorize(obj, "create", objectNamespace(obj)); err != nil {
+		return err
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c rbacClient) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	if err := c.authorize(obj, "update", objectNamespace(obj)); err != nil {
+		return err
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func (c rbacClient) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if err := c.authorize(obj, "patch", objectNamespace(obj)); err != nil {
+		return err
+	}
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func (c rbacClient) Delete(ctx context.Context, obj runtime.Object, opts ...client.DeleteOption) error {
+	if err := c.authorize(obj, "delete", objectNamespace(obj)); err != nil {
+		return err
+	}
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// applyClient emulates server-side applies with merge patches, as the fake client doesn't support apply patches.
+// Both are equivalent for the fields the provider applies, except that merge patches replace lists.
+type applyClient struct {
+	client.Client
+}
+
+func (c applyClient) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch.Type() == types.ApplyPatchType {
+		data, err := patch.Data(obj)
+		if err != nil {
+			return err
+		}
+		patch = client.ConstantPatch(types.MergePatchType, data)
+	}
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func TestPluginSPIImpl_CreateMachineWithSSHKeysSecretRefs(t *testing.T) {
+	sshKeysSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "ssh-keys", Namespace: namespace},
+		Data:       map[string][]byte{"authorized_keys": []byte("# team keys\nssh-rsa AAAA first\n\nssh-rsa BBBB second\n")},
+	}
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme, sshKeysSecret)
+	t.Run("CreateMachineWithSSHKeysSecretRefs", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		spec := *providerSpec
+		spec.SSHKeys = []string{"ssh-rsa CCCC inline"}
+		spec.SSHKeysSecretRefs = []corev1.SecretKeySelector{
+			{LocalObjectReference: corev1.LocalObjectReference{Name: sshKeysSecret.Name}, Key: "authorized_keys"},
+		}
+
+		_, err = plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		vm, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace)
+		if err != nil {
+			t.Fatalf("failed to get VM: %v", err)
+		}
+		userDataSecret := &corev1.Secret{}
+		userDataSecretName := vm.Spec.Template.Spec.Volumes[1].CloudInitNoCloud.UserDataSecretRef.Name
+		if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: userDataSecretName}, userDataSecret); err != nil {
+			t.Fatalf("failed to get userdata secret: %v", err)
+		}
+
+		expectedSSHKeys := "ssh_authorized_keys:\n- ssh-rsa CCCC inline\n- ssh-rsa AAAA first\n- ssh-rsa BBBB second\n"
+		if userData := string(userDataSecret.Data["userdata"]); !strings.Contains(userData, expectedSSHKeys) {
+			t.Fatalf("expected userData to contain %q, got %q", expectedSSHKeys, userData)
+		}
+	})
+}
+
+func TestPluginSPIImpl_CreateMachineWithStaleUserDataSecrets(t *testing.T) {
+	newUserDataSecret := func(name, ownerName string, ownerUID types.UID) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				OwnerReferences: []metav1.OwnerReference{
+					*metav1.NewControllerRef(&kubevirtv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Name: ownerName, UID: ownerUID}},
+						kubevirtv1.VirtualMachineGroupVersionKind),
+				},
+			},
+			Data: map[string][]byte{"userdata": []byte("stale")},
+		}
+	}
+
+	var (
+		staleSecret        = newUserDataSecret(userDataSecretName(machineName), machineName, "old-uid")
+		legacySecret       = newUserDataSecret(userDataSecretName(machineName)+"-1600000000", machineName, "old-uid")
+		otherMachineName   = machineName + "-2"
+		otherMachineSecret = newUserDataSecret(userDataSecretName(otherMachineName), otherMachineName, "other-uid")
+	)
+
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme, staleSecret, legacySecret, otherMachineSecret)
+	t.Run("CreateMachineWithStaleUserDataSecrets", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		_, err = plugin.CreateMachine(context.Background(), machineName, providerSpec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		secret := &corev1.Secret{}
+		if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: userDataSecretName(machineName)}, secret); err != nil {
+			t.Fatalf("failed to get userdata secret: %v", err)
+		}
+		if owner := metav1.GetControllerOf(secret); owner == nil || owner.UID == "old-uid" || string(secret.Data["userdata"]) == "stale" {
+			t.Fatal("stale userdata secret was not replaced")
+		}
+
+		err = fakeClient.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: legacySecret.Name}, secret)
+		if !kerrors.IsNotFound(err) {
+			t.Fatalf("expected legacy userdata secret to be deleted, got %v", err)
+		}
+
+		if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: otherMachineSecret.Name}, secret); err != nil {
+			t.Fatalf("userdata secret of other machine should be kept: %v", err)
+		}
+	})
+}
+
+func TestPluginSPIImpl_CreateMachineWithFailedImport(t *testing.T) {
+	dataVolume := &cdi.DataVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: machineName, Namespace: namespace},
+		Status:     cdi.DataVolumeStatus{Phase: cdi.Failed},
+	}
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme, dataVolume)
+	t.Run("CreateMachineWithFailedImport", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		spec := *providerSpec
+		spec.ReadinessTimeout = &metav1.Duration{Duration: time.Minute}
+
+		_, err = plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+		if err == nil || !strings.Contains(err.Error(), "import of DataVolume") {
+			t.Fatalf("expected failed import error, got %v", err)
+		}
+
+		_, err = plugin.GetMachineStatus(context.Background(), machineName, "", &spec, &corev1.Secret{})
+		if err == nil || !strings.Contains(err.Error(), "import of DataVolume") {
+			t.Fatalf("expected failed import error from machine status, got %v", err)
+		}
+	})
+}
+
+func TestPluginSPIImpl_ListMachinesCleansUpOrphans(t *testing.T) {
+	orphanName := machineName + "-orphan"
+	var (
+		orphanSecret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: userDataSecretName(orphanName), Namespace: namespace, Labels: map[string]string{machineLabel: orphanName}},
+		}
+		orphanDataVolume = &cdi.DataVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: orphanName, Namespace: namespace, Labels: map[string]string{machineLabel: orphanName}},
+		}
+		cacheDataVolume = &cdi.DataVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-machine-class", Namespace: namespace, Labels: map[string]string{imageCacheLabel: "true"}},
+		}
+		recentSecret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              userDataSecretName(machineName + "-creating"),
+				Namespace:         namespace,
+				Labels:            map[string]string{machineLabel: machineName + "-creating"},
+				CreationTimestamp: metav1.Now(),
+			},
+		}
+	)
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme, orphanSecret, orphanDataVolume, cacheDataVolume, recentSecret)
+	t.Run("ListMachinesCleansUpOrphans", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		_, err = plugin.CreateMachine(context.Background(), machineName, providerSpec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		_, err = plugin.ListMachines(context.Background(), providerSpec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to list machines: %v", err)
+		}
+
+		if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: orphanSecret.Name}, &corev1.Secret{}); !kerrors.IsNotFound(err) {
+			t.Fatalf("expected orphaned userdata secret to be deleted, got %v", err)
+		}
+		if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: orphanDataVolume.Name}, &cdi.DataVolume{}); !kerrors.IsNotFound(err) {
+			t.Fatalf("expected orphaned DataVolume to be deleted, got %v", err)
+		}
+		if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: cacheDataVolume.Name}, &cdi.DataVolume{}); err != nil {
+			t.Fatalf("image cache DataVolume should be kept: %v", err)
+		}
+		if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: userDataSecretName(machineName)}, &corev1.Secret{}); err != nil {
+			t.Fatalf("userdata secret of existing machine should be kept: %v", err)
+		}
+		if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: recentSecret.Name}, &corev1.Secret{}); err != nil {
+			t.Fatalf("userdata secret of machine being created should be kept: %v", err)
+		}
+	})
+}
+
+func TestPluginSPIImpl_DeleteMachineWithDeletionTimeout(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("DeleteMachineWithDeletionTimeout", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		spec := *providerSpec
+		spec.DeletionTimeout = &metav1.Duration{Duration: time.Minute}
+
+		providerID, err := plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		_, err = plugin.DeleteMachine(context.Background(), machineName, providerID, &spec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to delete machine: %v", err)
+		}
+
+		if _, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace); err == nil {
+			t.Fatal("VirtualMachine should be deleted")
+		}
+	})
+}
+
+func TestPluginSPIImpl_CreateMachineWithFinalizer(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("CreateMachineWithFinalizer", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		_, err = plugin.CreateMachine(context.Background(), machineName, providerSpec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		vm, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace)
+		if err != nil {
+			t.Fatalf("failed to get VM: %v", err)
+		}
+		if len(vm.Finalizers) != 1 || vm.Finalizers[0] != vmFinalizer {
+			t.Fatalf("expected finalizer %s, got %v", vmFinalizer, vm.Finalizers)
+		}
+
+		if err := plugin.removeVMFinalizer(context.Background(), fakeClient, vm); err != nil {
+			t.Fatalf("failed to remove finalizer: %v", err)
+		}
+		vm, err = plugin.getVM(context.Background(), fakeClient, machineName, namespace)
+		if err != nil {
+			t.Fatalf("failed to get VM: %v", err)
+		}
+		if len(vm.Finalizers) != 0 {
+			t.Fatalf("expected no finalizers, got %v", vm.Finalizers)
+		}
+	})
+}
+
+func TestPluginSPIImpl_DeleteMachineWithGracefulShutdown(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("DeleteMachineWithGracefulShutdown", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		spec := *providerSpec
+		spec.GracefulShutdownTimeout = &metav1.Duration{Duration: 2 * time.Minute}
+
+		providerID, err := plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		vm, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace)
+		if err != nil {
+			t.Fatalf("failed to get VM: %v", err)
+		}
+		if gracePeriod := vm.Spec.Template.Spec.TerminationGracePeriodSeconds; gracePeriod == nil || *gracePeriod != 120 {
+			t.Fatalf("expected termination grace period of 120 seconds, got %v", gracePeriod)
+		}
+
+		_, err = plugin.DeleteMachine(context.Background(), machineName, providerID, &spec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to delete machine: %v", err)
+		}
+
+		if _, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace); err == nil {
+			t.Fatal("VirtualMachine should be deleted")
+		}
+	})
+}
+
+func TestPluginSPIImpl_ListMachinesMigratesFromCordonedNodes(t *testing.T) {
+	var (
+		node = &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "cordoned-node"},
+			Spec:       corev1.NodeSpec{Unschedulable: true},
+		}
+		virtualMachineInstance = &kubevirtv1.VirtualMachineInstance{
+			ObjectMeta: metav1.ObjectMeta{Name: machineName, Namespace: namespace},
+			Status: kubevirtv1.VirtualMachineInstanceStatus{
+				Phase:      kubevirtv1.Running,
+				NodeName:   node.Name,
+				Conditions: []kubevirtv1.VirtualMachineInstanceCondition{{Type: kubevirtv1.VirtualMachineInstanceIsMigratable, Status: corev1.ConditionTrue}},
+			},
+		}
+		nonMigratableName                   = "a-" + machineName
+		nonMigratableVirtualMachineInstance = &kubevirtv1.VirtualMachineInstance{
+			ObjectMeta: metav1.ObjectMeta{Name: nonMigratableName, Namespace: namespace},
+			Status: kubevirtv1.VirtualMachineInstanceStatus{
+				Phase:      kubevirtv1.Running,
+				NodeName:   node.Name,
+				Conditions: []kubevirtv1.VirtualMachineInstanceCondition{{Type: kubevirtv1.VirtualMachineInstanceIsMigratable, Status: corev1.ConditionFalse}},
+			},
+		}
+	)
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme, node, virtualMachineInstance, nonMigratableVirtualMachineInstance)
+	t.Run("ListMachinesMigratesFromCordonedNodes", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		// VMs are migrated on every call instead of once per maintenance interval
+		plugin.maintenance = newMaintenanceLimiter(0)
+
+		spec := *providerSpec
+		spec.MigrateFromCordonedNodes = true
+
+		for _, name := range []string{nonMigratableName, machineName} {
+			if _, err := plugin.CreateMachine(context.Background(), name, &spec, &corev1.Secret{}); err != nil {
+				t.Fatalf("failed to create machine %s: %v", name, err)
+			}
+		}
+
+		listMigrations := func() []kubevirtv1.VirtualMachineInstanceMigration {
+			for i := 0; i < 2; i++ {
+				if _, err := plugin.ListMachines(context.Background(), &spec, &corev1.Secret{}); err != nil {
+					t.Fatalf("failed to list machines: %v", err)
+				}
+			}
+			migrationList := &kubevirtv1.VirtualMachineInstanceMigrationList{}
+			if err := fakeClient.List(context.Background(), migrationList, client.InNamespace(namespace)); err != nil {
+				t.Fatalf("failed to list migrations: %v", err)
+			}
+			return migrationList.Items
+		}
+
+		migrations := listMigrations()
+		if len(migrations) != 1 || migrations[0].Spec.VMIName != machineName {
+			t.Fatalf("expected a single migration of the migratable VMI, got %d", len(migrations))
+		}
+
+		// no new migration is created right after the migration failed
+		migration := &migrations[0]
+		migration.CreationTimestamp = metav1.Now()
+		migration.Status.Phase = kubevirtv1.MigrationFailed
+		if err := fakeClient.Update(context.Background(), migration); err != nil {
+			t.Fatalf("failed to update migration: %v", err)
+		}
+		if migrations := listMigrations(); len(migrations) != 1 {
+			t.Fatalf("expected no migration to be created after a failed migration, got %d", len(migrations))
+		}
+	})
+}
+
+func TestPluginSPIImpl_DeleteMachineWithBackupPolicy(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: machineName, Namespace: namespace},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("20Gi")},
+			},
+		},
+	}
+	// the backup of a previous VM of the machine must not be taken for the backup of the current VM
+	previousBackup := &cdi.DataVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        machineName + "-backup-previous",
+			Namespace:   namespace,
+			Labels:      map[string]string{backupLabel: machineName},
+			Annotations: map[string]string{backupSourceUIDAnnotation: "previous"},
+		},
+		Status: cdi.DataVolumeStatus{Phase: cdi.Succeeded},
+	}
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme, pvc, previousBackup)
+	t.Run("DeleteMachineWithBackupPolicy", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		spec := *providerSpec
+		spec.BackupPolicy = &api.BackupPolicySpec{TTL: metav1.Duration{Duration: time.Hour}}
+
+		providerID, err := plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		vm, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace)
+		if err != nil {
+			t.Fatalf("failed to get VM: %v", err)
+		}
+
+		if _, err := plugin.DeleteMachine(context.Background(), machineName, providerID, &spec, &corev1.Secret{}); err == nil {
+			t.Fatal("expected deletion to wait for the backup")
+		}
+
+		backup := &cdi.DataVolume{}
+		backupKey := types.NamespacedName{Namespace: namespace, Name: backupDataVolumeName(vm)}
+		if err := fakeClient.Get(context.Background(), backupKey, backup); err != nil {
+			t.Fatalf("failed to get backup DataVolume: %v", err)
+		}
+		if source := backup.Spec.Source.PVC; source == nil || source.Name != machineName {
+			t.Fatal("backup DataVolume doesn't clone the root disk")
+		}
+		if uid := backup.Annotations[backupSourceUIDAnnotation]; uid != string(vm.UID) {
+			t.Fatalf("expected backup DataVolume of VM with UID %q, got %q", vm.UID, uid)
+		}
+		if size := backup.Spec.PVC.Resources.Requests[corev1.ResourceStorage]; size.Cmp(resource.MustParse("20Gi")) != 0 {
+			t.Fatalf("expected backup size of 20Gi, got %s", size.String())
+		}
+
+		backup.Status.Phase = cdi.Succeeded
+		if err := fakeClient.Update(context.Background(), backup); err != nil {
+			t.Fatalf("failed to update backup DataVolume: %v", err)
+		}
+
+		if _, err := plugin.DeleteMachine(context.Background(), machineName, providerID, &spec, &corev1.Secret{}); err != nil {
+			t.Fatalf("failed to delete machine: %v", err)
+		}
+
+		backup.Annotations[backupExpirationAnnotation] = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+		if err := fakeClient.Update(context.Background(), backup); err != nil {
+			t.Fatalf("failed to update backup DataVolume: %v", err)
+		}
+
+		if _, err := plugin.ListMachines(context.Background(), &spec, &corev1.Secret{}); err != nil {
+			t.Fatalf("failed to list machines: %v", err)
+		}
+		if err := fakeClient.Get(context.Background(), backupKey, backup); !kerrors.IsNotFound(err) {
+			t.Fatalf("expected expired backup DataVolume to be deleted, got %v", err)
+		}
+	})
+}
+
+func TestPluginSPIImpl_GetMachineStatusWithCrashLoopRemediation(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("GetMachineStatusWithCrashLoopRemediation", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		spec := *providerSpec
+		spec.CrashLoopRemediation = &api.CrashLoopRemediationSpec{MaxRestarts: 1}
+
+		providerID, err := plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		recreateVMI := func(uid types.UID) {
+			virtualMachineInstance := &kubevirtv1.VirtualMachineInstance{
+				ObjectMeta: metav1.ObjectMeta{Name: machineName, Namespace: namespace, UID: uid},
+			}
+			if err := client.IgnoreNotFound(fakeClient.Delete(context.Background(), virtualMachineInstance)); err != nil {
+				t.Fatalf("failed to delete VMI: %v", err)
+			}
+			if err := fakeClient.Create(context.Background(), virtualMachineInstance); err != nil {
+				t.Fatalf("failed to create VMI: %v", err)
+			}
+		}
+
+		for _, uid := range []types.UID{"first", "second"} {
+			recreateVMI(uid)
+			if _, err := plugin.GetMachineStatus(context.Background(), machineName, providerID, &spec, &corev1.Secret{}); err != nil {
+				t.Fatalf("failed to get machine status: %v", err)
+			}
+		}
+
+		recreateVMI("third")
+		if _, err := plugin.GetMachineStatus(context.Background(), machineName, providerID, &spec, &corev1.Secret{}); err == nil {
+			t.Fatal("expected crash loop error")
+		}
+
+		vm, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace)
+		if err != nil {
+			t.Fatalf("failed to get VM: %v", err)
+		}
+		if *vm.Spec.Running {
+			t.Fatal("crash-looping machine should be stopped")
+		}
+	})
+}
+
+func TestPluginSPIImpl_CreateMachineWithAdoption(t *testing.T) {
+	virtualMachine := &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{Name: machineName, Namespace: namespace, Labels: map[string]string{"adopt": "true"}},
+	}
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme, virtualMachine)
+	t.Run("CreateMachineWithAdoption", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		spec := *providerSpec
+		spec.Tags = map[string]string{machineClassLabel: "test-machine-class"}
+		spec.Adoption = &api.AdoptionSpec{Selector: map[string]string{"adopt": "true"}}
+
+		providerID, err := plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+		if providerID != encodeProviderID(namespace, machineName, virtualMachine.UID) {
+			t.Fatalf("unexpected provider ID %s", providerID)
+		}
+
+		vm, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace)
+		if err != nil {
+			t.Fatalf("failed to get VM: %v", err)
+		}
+		if vm.Labels[machineClassLabel] != "test-machine-class" || vm.Labels[machineLabel] != machineName {
+			t.Fatalf("adopted VM is missing provider labels: %v", vm.Labels)
+		}
+		if len(vm.Finalizers) != 1 || vm.Finalizers[0] != vmFinalizer {
+			t.Fatalf("expected finalizer %s, got %v", vmFinalizer, vm.Finalizers)
+		}
+
+		err = fakeClient.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: userDataSecretName(machineName)}, &corev1.Secret{})
+		if !kerrors.IsNotFound(err) {
+			t.Fatalf("no userdata secret should be created for adopted VMs, got %v", err)
+		}
+
+		machineList, err := plugin.ListMachines(context.Background(), &spec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to list machines: %v", err)
+		}
+		if len(machineList) != 1 {
+			t.Fatal("adopted machine should be listed")
+		}
+	})
+}
+
+func TestPluginSPIImpl_CreateMachineAlreadyExists(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("CreateMachineAlreadyExists", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		spec := *providerSpec
+		spec.Tags = map[string]string{machineClassLabel: "test-machine-class"}
+
+		providerID, err := plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		secondProviderID, err := plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create existing machine: %v", err)
+		}
+		if secondProviderID != providerID {
+			t.Fatalf("expected provider ID %s, got %s", providerID, secondProviderID)
+		}
+
+		otherSpec := *providerSpec
+		otherSpec.Tags = map[string]string{machineClassLabel: "other-machine-class"}
+		if _, err := plugin.CreateMachine(context.Background(), machineName, &otherSpec, &corev1.Secret{}); err == nil {
+			t.Fatal("expected error for existing machine of another machine class")
+		}
+	})
+}
+
+func TestPluginSPIImpl_CreateMachineWithCapacityCheck(t *testing.T) {
+	newNode := func(name, cpu, memory string, unschedulable bool) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       corev1.NodeSpec{Unschedulable: unschedulable},
+			Status: corev1.NodeStatus{
+				Allocatable: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse(cpu),
+					corev1.ResourceMemory: resource.MustParse(memory),
+				},
+			},
+		}
+	}
+
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme, newNode("small", "1", "2Gi", false), newNode("cordoned", "8", "32Gi", true))
+	t.Run("CreateMachineWithCapacityCheck", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		spec := *providerSpec
+		spec.CapacityCheck = true
+
+		_, err = plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+		if !clouderrors.IsInsufficientCapacityError(err) {
+			t.Fatalf("expected insufficient capacity error, got %v", err)
+		}
+
+		large := newNode("large", "8", "32Gi", false)
+		if err := fakeClient.Create(context.Background(), large); err != nil {
+			t.Fatalf("failed to create node: %v", err)
+		}
+		if _, err := plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{}); err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		// retrying the creation of an existing VM succeeds even if the nodes are full
+		if err := fakeClient.Delete(context.Background(), large); err != nil {
+			t.Fatalf("failed to delete node: %v", err)
+		}
+		if _, err := plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{}); err != nil {
+			t.Fatalf("failed to create existing machine: %v", err)
+		}
+	})
+}
+
+func TestPluginSPIImpl_DeleteMachineWaitsForShutdown(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("DeleteMachineWaitsForShutdown", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		spec := *providerSpec
+		spec.GracefulShutdownTimeout = &metav1.Duration{Duration: time.Minute}
+		spec.ShutdownTimeout = &metav1.Duration{Duration: time.Millisecond}
+
+		providerID, err := plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		virtualMachineInstance := &kubevirtv1.VirtualMachineInstance{ObjectMeta: metav1.ObjectMeta{Name: machineName, Namespace: namespace}}
+		if err := fakeClient.Create(context.Background(), virtualMachineInstance); err != nil {
+			t.Fatalf("failed to create VMI: %v", err)
+		}
+
+		if _, err := plugin.DeleteMachine(context.Background(), machineName, providerID, &spec, &corev1.Secret{}); err == nil {
+			t.Fatal("expected error while the VMI is not gone")
+		}
+		vm, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace)
+		if err != nil {
+			t.Fatalf("VirtualMachine should not be deleted: %v", err)
+		}
+		if vm.Spec.Running == nil || *vm.Spec.Running {
+			t.Fatal("VirtualMachine should be stopped")
+		}
+
+		if err := fakeClient.Delete(context.Background(), virtualMachineInstance); err != nil {
+			t.Fatalf("failed to delete VMI: %v", err)
+		}
+		if _, err := plugin.DeleteMachine(context.Background(), machineName, providerID, &spec, &corev1.Secret{}); err != nil {
+			t.Fatalf("failed to delete machine: %v", err)
+		}
+		if _, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace); err == nil {
+			t.Fatal("VirtualMachine should be deleted")
+		}
+	})
+}
+
+func TestPluginSPIImpl_CreateMachineWithResourceQuota(t *testing.T) {
+	resourceQuota := &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "quota", Namespace: namespace},
+		Status: corev1.ResourceQuotaStatus{
+			Hard: corev1.ResourceList{
+				corev1.ResourceRequestsMemory:       resource.MustParse("8Gi"),
+				"count/virtualmachines.kubevirt.io": resource.MustParse("10"),
+			},
+			Used: corev1.ResourceList{
+				corev1.ResourceRequestsMemory:       resource.MustParse("6Gi"),
+				"count/virtualmachines.kubevirt.io": resource.MustParse("1"),
+			},
+		},
+	}
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme, resourceQuota)
+	t.Run("CreateMachineWithResourceQuota", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		_, err = plugin.CreateMachine(context.Background(), machineName, providerSpec, &corev1.Secret{})
+		if !clouderrors.IsQuotaExceededError(err) {
+			t.Fatalf("expected quota exceeded error, got %v", err)
+		}
+		if _, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace); !clouderrors.IsMachineNotFoundError(err) {
+			t.Fatalf("VirtualMachine should not be created, got %v", err)
+		}
+
+		resourceQuota.Status.Hard[corev1.ResourceRequestsMemory] = resource.MustParse("16Gi")
+		if err := fakeClient.Update(context.Background(), resourceQuota); err != nil {
+			t.Fatalf("failed to update ResourceQuota: %v", err)
+		}
+		if _, err := plugin.CreateMachine(context.Background(), machineName, providerSpec, &corev1.Secret{}); err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+	})
+}
+
+type mockVMLister struct {
+	virtualMachines []kubevirtv1.VirtualMachine
+	err             error
+}
+
+func (l *mockVMLister) GetVMLister(secret *corev1.Secret) (VMLister, error) {
+	return l, nil
+}
+
+func (l *mockVMLister) ListVMs(selector labels.Selector) ([]kubevirtv1.VirtualMachine, error) {
+	return l.virtualMachines, l.err
+}
+
+func TestPluginSPIImpl_ListMachinesFromCache(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("ListMachinesFromCache", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+		lister := &mockVMLister{
+			virtualMachines: []kubevirtv1.VirtualMachine{
+				{ObjectMeta: metav1.ObjectMeta{Name: machineName, Namespace: namespace}},
+			},
+		}
+		plugin.SetVMListerFactory(lister)
+
+		machineList, err := plugin.ListMachines(context.Background(), providerSpec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to list machines: %v", err)
+		}
+		if len(machineList) != 1 {
+			t.Fatalf("expected the cached machine to be listed, got %v", machineList)
+		}
+
+		lister.err = fmt.Errorf("not synced")
+		machineList, err = plugin.ListMachines(context.Background(), providerSpec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to list machines: %v", err)
+		}
+		if len(machineList) != 0 {
+			t.Fatalf("expected machines to be listed from the API server, got %v", machineList)
+		}
+	})
+}
+
+func TestPluginSPIImpl_ListMachinesIgnoresUnmanagedVMs(t *testing.T) {
+	unmanagedVM := &kubevirtv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Name: "unmanaged", Namespace: namespace}}
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme, unmanagedVM)
+	t.Run("ListMachinesIgnoresUnmanagedVMs", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		providerID, err := plugin.CreateMachine(context.Background(), machineName, providerSpec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		machineList, err := plugin.ListMachines(context.Background(), providerSpec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to list machines: %v", err)
+		}
+		if len(machineList) != 1 || machineList[providerID] != machineName {
+			t.Fatalf("expected only the managed machine to be listed, got %v", machineList)
+		}
+	})
+}
+
+type failingSecretCreateClient struct {
+	client.Client
+}
+
+func (c failingSecretCreateClient) Create(ctx context.Context, obj runtime.Object, opts ...client.CreateOption) error {
+	if _, ok := obj.(*corev1.Secret); ok {
+		return kerrors.NewInternalError(fmt.Errorf("secret creation failed"))
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestPluginSPIImpl_CreateMachineRollsBackVM(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("CreateMachineRollsBackVM", func(t *testing.T) {
+		mf := newMockFactory(failingSecretCreateClient{fakeClient}, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		if _, err := plugin.CreateMachine(context.Background(), machineName, providerSpec, &corev1.Secret{}); err == nil {
+			t.Fatal("expected machine creation to fail")
+		}
+		if _, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace); !clouderrors.IsMachineNotFoundError(err) {
+			t.Fatalf("expected VirtualMachine to be rolled back, got %v", err)
+		}
+	})
+}
+
+func TestPluginSPIImpl_MachineLifecycleEvents(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("MachineLifecycleEvents", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		if _, err := plugin.CreateMachine(context.Background(), machineName, providerSpec, &corev1.Secret{}); err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+		if _, err := plugin.DeleteMachine(context.Background(), machineName, "", providerSpec, &corev1.Secret{}); err != nil {
+			t.Fatalf("failed to delete machine: %v", err)
+		}
+
+		eventList := &corev1.EventList{}
+		if err := fakeClient.List(context.Background(), eventList, client.InNamespace(namespace)); err != nil {
+			t.Fatalf("failed to list events: %v", err)
+		}
+		reasons := map[string]bool{}
+		for _, event := range eventList.Items {
+			if event.InvolvedObject.Name != machineName || event.InvolvedObject.Kind != "VirtualMachine" {
+				t.Errorf("unexpected involved object %v", event.InvolvedObject)
+			}
+			reasons[event.Reason] = true
+		}
+		if !reasons[eventReasonCreated] || !reasons[eventReasonDeleting] {
+			t.Fatalf("expected %s and %s events, got %v", eventReasonCreated, eventReasonDeleting, reasons)
+		}
+	})
+}
+
+type accessReviewClient struct {
+	client.Client
+	allowed bool
+}
+
+func (c accessReviewClient) Create(ctx context.Context, obj runtime.Object, opts ...client.CreateOption) error {
+	if review, ok := obj.(*authorizationv1.SelfSubjectAccessReview); ok {
+		review.Status.Allowed = c.allowed
+		return nil
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestHealthChecker(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("HealthChecker", func(t *testing.T) {
+		mf := newMockFactory(accessReviewClient{Client: fakeClient, allowed: true}, namespace, serverVersion)
+		healthChecker := NewHealthChecker(mf)
+		if err := healthChecker.Check(context.Background()); err != nil {
+			t.Fatalf("expected health check to succeed without provider clusters, got %v", err)
+		}
+
+		plugin, err := NewPluginSPIImpl(healthChecker, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+		if _, err := plugin.ListMachines(context.Background(), providerSpec, &corev1.Secret{}); err != nil {
+			t.Fatalf("failed to list machines: %v", err)
+		}
+		if err := healthChecker.Check(context.Background()); err != nil {
+			t.Fatalf("expected health check to succeed, got %v", err)
+		}
+
+		mf.client = accessReviewClient{Client: fakeClient, allowed: false}
+		if err := healthChecker.Check(context.Background()); err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Fatalf("expected health check to fail for missing permissions, got %v", err)
+		}
+
+		// rotated kubeconfigs are not checked anymore
+		healthChecker.Invalidate(&corev1.Secret{})
+		if err := healthChecker.Check(context.Background()); err != nil {
+			t.Fatalf("expected health check to succeed after invalidation, got %v", err)
+		}
+	})
+}
+
+type unauthorizedClient struct {
+	client.Client
+}
+
+func (c unauthorizedClient) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	return kerrors.NewUnauthorized("token expired")
+}
+
+func TestPluginSPIImpl_ListMachinesWithRotatedCredentials(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("ListMachinesWithRotatedCredentials", func(t *testing.T) {
+		calls := 0
+		cf := NewCachingClientFactory(ClientFactoryFunc(func(secret *corev1.Secret) (client.Client, string, error) {
+			calls++
+			if calls == 1 {
+				return unauthorizedClient{fakeClient}, namespace, nil
+			}
+			return fakeClient, namespace, nil
+		}))
+		plugin, err := NewPluginSPIImpl(cf, newMockFactory(fakeClient, namespace, serverVersion))
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		if _, err := plugin.ListMachines(context.Background(), providerSpec, &corev1.Secret{}); err != nil {
+			t.Fatalf("expected machines to be listed with a rebuilt client, got %v", err)
+		}
+		if calls != 2 {
+			t.Fatalf("expected the client to be rebuilt once, got %d clients", calls)
+		}
+	})
+}
+
+func TestPluginSPIImpl_DryRunCreateMachine(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("DryRunCreateMachine", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		result, err := plugin.DryRunCreateMachine(context.Background(), machineName, providerSpec, &corev1.Secret{Data: map[string][]byte{"userData": []byte("#cloud-config\n")}})
+		if err != nil {
+			t.Fatalf("failed to dry-run create machine: %v", err)
+		}
+		if result.VirtualMachine.Name != machineName || result.DataVolume.Name != machineName || result.UserDataSecret.Name != userDataSecretName(machineName) {
+			t.Fatalf("unexpected dry-run result %+v", result)
+		}
+
+		vmList := &kubevirtv1.VirtualMachineList{}
+		if err := fakeClient.List(context.Background(), vmList); err != nil {
+			t.Fatalf("failed to list VirtualMachines: %v", err)
+		}
+		secretList := &corev1.SecretList{}
+		if err := fakeClient.List(context.Background(), secretList); err != nil {
+			t.Fatalf("failed to list secrets: %v", err)
+		}
+		if len(vmList.Items) != 0 || len(secretList.Items) != 0 {
+			t.Fatalf("expected nothing to be created, got %d VirtualMachines and %d secrets", len(vmList.Items), len(secretList.Items))
+		}
+
+		manifests, err := result.Manifests()
+		if err != nil {
+			t.Fatalf("failed to get manifests: %v", err)
+		}
+		for _, kind := range []string{"kind: VirtualMachine", "kind: DataVolume", "kind: Secret"} {
+			if !strings.Contains(string(manifests), kind) {
+				t.Errorf("expected manifests to contain %q", kind)
+			}
+		}
+	})
+}
+
+func TestPluginSPIImpl_CreateMachineWithNetworkPolicy(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("CreateMachineWithNetworkPolicy", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		spec := *providerSpec
+		spec.NetworkPolicy = &api.NetworkPolicySpec{}
+		if _, err := plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{}); err == nil {
+			t.Fatal("expected error for NetworkPolicy without machine class tag")
+		}
+
+		spec.Tags = map[string]string{machineClassLabel: "test-machine-class"}
+		spec.NetworkPolicy = &api.NetworkPolicySpec{
+			ClusterName: "shoot--test--a",
+			Egress:      []networkingv1.NetworkPolicyEgressRule{{To: []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/8"}}}}},
+		}
+		if _, err := plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{}); err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		// a second worker pool of the same shoot
+		otherSpec := spec
+		otherSpec.Tags = map[string]string{machineClassLabel: "test-machine-class-2"}
+		if _, err := plugin.CreateMachine(context.Background(), machineName+"-2", &otherSpec, &corev1.Secret{}); err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		for machineClassName, machineName := range map[string]string{"test-machine-class": machineName, "test-machine-class-2": machineName + "-2"} {
+			networkPolicy := &networkingv1.NetworkPolicy{}
+			if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: machineClassName}, networkPolicy); err != nil {
+				t.Fatalf("failed to get NetworkPolicy: %v", err)
+			}
+			if networkPolicy.Spec.PodSelector.MatchLabels[machineClassLabel] != machineClassName || len(networkPolicy.Spec.Egress) != 2 {
+				t.Fatalf("unexpected NetworkPolicy spec %+v", networkPolicy.Spec)
+			}
+			for _, peers := range [][]networkingv1.NetworkPolicyPeer{networkPolicy.Spec.Ingress[0].From, networkPolicy.Spec.Egress[0].To} {
+				if !reflect.DeepEqual(peers[0].PodSelector.MatchLabels, map[string]string{networkPolicyClusterLabel: "shoot--test--a"}) {
+					t.Fatalf("expected the traffic of all worker pools of the shoot to be allowed, got %+v", peers)
+				}
+			}
+
+			vm, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace)
+			if err != nil {
+				t.Fatalf("failed to get VM: %v", err)
+			}
+			if vm.Spec.Template.ObjectMeta.Labels[machineClassLabel] != machineClassName ||
+				vm.Spec.Template.ObjectMeta.Labels[networkPolicyClusterLabel] != "shoot--test--a" {
+				t.Fatal("expected the virt-launcher pods to be selected by the NetworkPolicies")
+			}
+		}
+		if _, err := plugin.DeleteMachine(context.Background(), machineName+"-2", "", &otherSpec, &corev1.Secret{}); err != nil {
+			t.Fatalf("failed to delete machine: %v", err)
+		}
+
+		networkPolicy := &networkingv1.NetworkPolicy{}
+
+		if _, err := plugin.DeleteMachine(context.Background(), machineName, "", &spec, &corev1.Secret{}); err != nil {
+			t.Fatalf("failed to delete machine: %v", err)
+		}
+		if _, err := plugin.ListMachines(context.Background(), &spec, &corev1.Secret{}); err != nil {
+			t.Fatalf("failed to list machines: %v", err)
+		}
+		if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: "test-machine-class"}, networkPolicy); !kerrors.IsNotFound(err) {
+			t.Fatalf("expected NetworkPolicy of machine class without VMs to be deleted, got %v", err)
+		}
+	})
+}
+
+func TestPluginSPIImpl_CreateMachineWithLabelsAndAnnotations(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("CreateMachineWithLabelsAndAnnotations", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		spec := *providerSpec
+		spec.VMAnnotations = map[string]string{"cost-center": "1234", providerIDFormatAnnotation: "v1"}
+		spec.TemplateLabels = map[string]string{"team": "shoot-workers", "kubevirt.io/vm": "other"}
+		spec.TemplateAnnotations = map[string]string{"prometheus.io/scrape": "true"}
+
+		if _, err := plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{}); err != nil {
+			t.Fatalf("failed to create machine: %v", err)
+		}
+
+		vm, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace)
+		if err != nil {
+			t.Fatalf("failed to get VM: %v", err)
+		}
+		if vm.Annotations["cost-center"] != "1234" || vm.Annotations[providerIDFormatAnnotation] != providerIDFormatV2 {
+			t.Errorf("unexpected VM annotations %v", vm.Annotations)
+		}
+		templateMeta := vm.Spec.Template.ObjectMeta
+		if templateMeta.Labels["team"] != "shoot-workers" || templateMeta.Labels["kubevirt.io/vm"] != machineName {
+			t.Errorf("unexpected VMI template labels %v", templateMeta.Labels)
+		}
+		if templateMeta.Annotations["prometheus.io/scrape"] != "true" {
+			t.Errorf("unexpected VMI template annotations %v", templateMeta.Annotations)
+		}
+	})
+}
+
+func TestPluginSPIImpl_CreateMachineWithPrivateRegistry(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	t.Run("CreateMachineWithPrivateRegistry", func(t *testing.T) {
+		mf := newMockFactory(fakeClient, namespace, serverVersion)
+		plugin, err := NewPluginSPIImpl(mf, mf)
+		if err != nil {
+			t.Fatalf("failed to create plugin: %v", err)
+		}
+
+		spec := *providerSpec
+		spec.SourceURL = "docker://registry.example.com/images/ubuntu:20.04"
+		spec.SourceSecretName = "registry-credentials"
+		spec.AdditionalVolumes = []api.AdditionalVolumeSpec{{
+			Name: "tools",
+			ContainerDisk: &kubevirtv1.ContainerDiskSource{
+				Image:           "registry.example.com/images/tools:1.0",
+				ImagePullSecret: "registry-pull-secret",
+			},
+		}}
+
+		result, err := plugin.DryRunCreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+		if err != nil {
+			t.Fatalf("failed to dry-run create machine: %v", err)
+		}
+
+		source := result.DataVolume.Spec.Source
+		if source.HTTP != nil || source.Registry == nil || source.Registry.URL != spec.SourceURL || source.Registry.SecretRef != spec.SourceSecretName {
+			t.Errorf("unexpected DataVolume source %+v", source)
+		}
+
+		var containerDisk *kubevirtv1.ContainerDiskSource
+		for _, volume := range result.VirtualMachine.Spec.Template.Spec.Volumes {
+			if volume.Name == "tools" {
+				containerDisk = volume.ContainerDisk
+			}
+		}
+		if containerDisk == nil || containerDisk.ImagePullSecret != "registry-pull-secret" {
+			t.Errorf("unexpected containerDisk volume %+v", containerDisk)
+		}
+	})
+}
+
+func TestFaultInjectingClientFactory(t *testing.T) {
+	ctx := context.Background()
+	var fault *Fault
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	cf := NewFaultInjectingClientFactory(ClientFactoryFunc(func(secret *corev1.Secret) (client.Client, string, error) {
+		return fakeClient, "default", nil
+	}), FaultInjectorFunc(func(verb string, obj runtime.Object) *Fault {
+		if verb == "create" {
+			return fault
+		}
+		return nil
+	}))
+	c, _, err := cf.GetClient(&corev1.Secret{})
+	if err != nil {
+		t.Fatalf("failed to get client: %v", err)
+	}
+	newConfigMap := func(name string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+	}
+	exists := func(name string) bool {
+		return c.Get(ctx, types.NamespacedName{Name: name, Namespace: "default"}, &corev1.ConfigMap{}) == nil
+	}
+
+	fault = &Fault{Err: kerrors.NewServiceUnavailable("injected fault")}
+	if err := c.Create(ctx, newConfigMap("failed")); !kerrors.IsServiceUnavailable(err) {
+		t.Errorf("expected the injected error, got %v", err)
+	}
+	if exists("failed") {
+		t.Errorf("expected a failed create not to create the object")
+	}
+
+	fault = &Fault{Err: kerrors.NewServerTimeout(schema.GroupResource{Resource: "configmaps"}, "create", 1), Partial: true}
+	if err := c.Create(ctx, newConfigMap("partial")); !kerrors.IsServerTimeout(err) {
+		t.Errorf("expected the injected error, got %v", err)
+	}
+	if !exists("partial") {
+		t.Errorf("expected a partially failed create to create the object")
+	}
+
+	fault = &Fault{Delay: time.Hour}
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := c.Create(cancelledCtx, newConfigMap("delayed")); err != context.Canceled {
+		t.Errorf("expected a delayed create to be cancelled, got %v", err)
+	}
+
+	fault = &Fault{Delay: time.Millisecond}
+	if err := c.Create(ctx, newConfigMap("delayed")); err != nil || !exists("delayed") {
+		t.Errorf("expected a delayed create to succeed, got %v", err)
+	}
+}
+
+func TestParseFaultInjector(t *testing.T) {
+	injector, err := ParseFaultInjector("errorRate=1,verbs=create|delete,seed=1")
+	if err != nil {
+		t.Fatalf("failed to parse fault injector: %v", err)
+	}
+	for _, verb := range []string{"create", "delete"} {
+		if fault := injector.Inject(verb, &corev1.ConfigMap{}); fault == nil || fault.Err == nil || fault.Partial {
+			t.Errorf("expected an error to be injected into %s, got %+v", verb, fault)
+		}
+	}
+	if fault := injector.Inject("get", &corev1.ConfigMap{}); fault != nil {
+		t.Errorf("expected no fault to be injected into get, got %+v", fault)
+	}
+
+	injector, err = ParseFaultInjector("partialRate=1,delayRate=1,delay=10ms")
+	if err != nil {
+		t.Fatalf("failed to parse fault injector: %v", err)
+	}
+	if fault := injector.Inject("update", &corev1.ConfigMap{}); fault == nil || !fault.Partial || fault.Delay >= 10*time.Millisecond {
+		t.Errorf("expected a delayed partial failure to be injected into update, got %+v", fault)
+	}
+	if fault := injector.Inject("list", &corev1.ConfigMapList{}); fault == nil || fault.Err != nil {
+		t.Errorf("expected only a delay to be injected into list, got %+v", fault)
+	}
+
+	for _, spec := range []string{"errorRate=2", "delay=soon", "unknown=1", "errorRate"} {
+		if _, err := ParseFaultInjector(spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
+
+func TestPluginSPIImpl_CreateWindowsMachine(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	mf := newMockFactory(fakeClient, namespace, serverVersion)
+	plugin, err := NewPluginSPIImpl(mf, mf)
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	spec := *providerSpec
+	spec.SSHKeys = []string{"ssh-rsa AAAA admin@example.com"}
+	spec.Windows = &api.WindowsSpec{
+		Sysprep:   &api.SysprepSpec{ConfigMapName: "sysprep"},
+		Bootstrap: api.WindowsBootstrapSSH,
+	}
+
+	result, err := plugin.DryRunCreateMachine(context.Background(), machineName, &spec, &corev1.Secret{
+		Data: map[string][]byte{"userData": []byte("#ps1_sysnative\nWrite-Host bootstrap")},
+	})
+	if err != nil {
+		t.Fatalf("failed to dry-run create machine: %v", err)
+	}
+
+	vmiSpec := result.VirtualMachine.Spec.Template.Spec
+	if features := vmiSpec.Domain.Features; features == nil || features.Hyperv == nil || features.Hyperv.Spinlocks == nil {
+		t.Errorf("expected Hyper-V enlightenments, got %+v", features)
+	}
+	if clock := vmiSpec.Domain.Clock; clock == nil || clock.UTC == nil || clock.Timer == nil || clock.Timer.Hyperv == nil {
+		t.Errorf("expected a UTC clock with a Hyper-V timer, got %+v", clock)
+	}
+
+	disks := map[string]kubevirtv1.Disk{}
+	for _, disk := range vmiSpec.Domain.Devices.Disks {
+		disks[disk.Name] = disk
+	}
+	if disk := disks["datavolumedisk"]; disk.Disk == nil || disk.Disk.Bus != windowsDiskBus {
+		t.Errorf("expected the root disk on the %s bus, got %+v", windowsDiskBus, disk)
+	}
+	for _, name := range []string{virtioDriversVolumeName, sysprepVolumeName} {
+		if disk, ok := disks[name]; !ok || disk.CDRom == nil {
+			t.Errorf("expected a %s CD-ROM, got %+v", name, disk)
+		}
+	}
+	for _, iface := range vmiSpec.Domain.Devices.Interfaces {
+		if iface.Model != windowsInterfaceModel {
+			t.Errorf("expected interface %s to have model %s, got %q", iface.Name, windowsInterfaceModel, iface.Model)
+		}
+	}
+
+	for _, volume := range vmiSpec.Volumes {
+		switch volume.Name {
+		case "cloudinitdisk":
+			if volume.CloudInitConfigDrive == nil {
+				t.Errorf("expected the userData to be passed via ConfigDrive, got %+v", volume.VolumeSource)
+			}
+		case virtioDriversVolumeName:
+			if volume.ContainerDisk == nil || volume.ContainerDisk.Image != api.DefaultVirtioDriversImage {
+				t.Errorf("unexpected virtio drivers volume %+v", volume.VolumeSource)
+			}
+		case sysprepVolumeName:
+			if volume.ConfigMap == nil || volume.ConfigMap.Name != "sysprep" {
+				t.Errorf("unexpected sysprep volume %+v", volume.VolumeSource)
+			}
+		}
+	}
+
+	userData := string(result.UserDataSecret.Data["userdata"])
+	bootstrap := strings.Index(userData, "Add-WindowsCapability")
+	if bootstrap == -1 || !strings.Contains(userData, spec.SSHKeys[0]) || strings.Contains(userData, "ssh_authorized_keys") {
+		t.Errorf("expected the SSH bootstrap script with the SSH keys in the userData, got %q", userData)
+	}
+	if strings.Index(userData, "Write-Host bootstrap") < bootstrap {
+		t.Errorf("expected the SSH bootstrap script before the userData, got %q", userData)
+	}
+}
+
+func TestPluginSPIImpl_CreateMachineWithFeatures(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	mf := newMockFactory(fakeClient, namespace, serverVersion)
+	plugin, err := NewPluginSPIImpl(mf, mf)
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	spec := *providerSpec
+	spec.Features = &kubevirtv1.Features{
+		APIC: &kubevirtv1.FeatureAPIC{Enabled: utilpointer.BoolPtr(false)},
+		SMM:  &kubevirtv1.FeatureState{Enabled: utilpointer.BoolPtr(true)},
+	}
+
+	result, err := plugin.DryRunCreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+	if err != nil {
+		t.Fatalf("failed to dry-run create machine: %v", err)
+	}
+	features := result.VirtualMachine.Spec.Template.Spec.Domain.Features
+	if !reflect.DeepEqual(features, spec.Features) {
+		t.Errorf("expected features %+v, got %+v", spec.Features, features)
+	}
+
+	spec.Windows = &api.WindowsSpec{}
+	result, err = plugin.DryRunCreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+	if err != nil {
+		t.Fatalf("failed to dry-run create machine: %v", err)
+	}
+	features = result.VirtualMachine.Spec.Template.Spec.Domain.Features
+	if features.APIC == nil || features.APIC.Enabled == nil || *features.APIC.Enabled || features.SMM == nil || features.Hyperv == nil {
+		t.Errorf("expected the features to take precedence over the Windows profile, got %+v", features)
+	}
+	if spec.Features.Hyperv != nil {
+		t.Error("expected the provider spec not to be modified")
+	}
+}
+
+func TestPluginSPIImpl_GetMachineStatusWithPreemption(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	mf := newMockFactory(fakeClient, namespace, serverVersion)
+	plugin, err := NewPluginSPIImpl(mf, mf)
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	spec := *providerSpec
+	spec.Preemptible = true
+
+	providerID, err := plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+	if err != nil {
+		t.Fatalf("failed to create machine: %v", err)
+	}
+
+	vm, err := plugin.getVM(context.Background(), fakeClient, machineName, namespace)
+	if err != nil {
+		t.Fatalf("failed to get VM: %v", err)
+	}
+	if vm.Spec.Template.Spec.PriorityClassName != api.DefaultPreemptiblePriorityClassName || vm.Labels[preemptibleLabel] != "true" {
+		t.Fatalf("expected a preemptible VM, got priority class %q and labels %v", vm.Spec.Template.Spec.PriorityClassName, vm.Labels)
+	}
+
+	virtualMachineInstance := &kubevirtv1.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{Name: machineName, Namespace: namespace, UID: "vmi-1"},
+		Status:     kubevirtv1.VirtualMachineInstanceStatus{Phase: kubevirtv1.Running},
+	}
+	if err := fakeClient.Create(context.Background(), virtualMachineInstance); err != nil {
+		t.Fatalf("failed to create VMI: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := plugin.GetMachineStatus(context.Background(), machineName, providerID, &spec, &corev1.Secret{}); err != nil {
+			t.Fatalf("failed to get machine status: %v", err)
+		}
+	}
+
+	// the VMI is evicted, and recreated by KubeVirt, but cannot be scheduled
+	if err := fakeClient.Delete(context.Background(), virtualMachineInstance); err != nil {
+		t.Fatalf("failed to delete VMI: %v", err)
+	}
+	virtualMachineInstance = &kubevirtv1.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{Name: machineName, Namespace: namespace, UID: "vmi-2"},
+		Status:     kubevirtv1.VirtualMachineInstanceStatus{Phase: kubevirtv1.Pending},
+	}
+	if err := fakeClient.Create(context.Background(), virtualMachineInstance); err != nil {
+		t.Fatalf("failed to create VMI: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := plugin.GetMachineStatus(context.Background(), machineName, providerID, &spec, &corev1.Secret{}); !clouderrors.IsMachinePreemptedError(err) {
+			t.Fatalf("expected a preempted error, got %v", err)
+		}
+	}
+
+	vm, err = plugin.getVM(context.Background(), fakeClient, machineName, namespace)
+	if err != nil {
+		t.Fatalf("failed to get VM: %v", err)
+	}
+	if *vm.Spec.Running || vm.Annotations[statusAnnotation] != vmStatusPreempted {
+		t.Fatalf("preempted machine should be stopped, got running %v and status %q", *vm.Spec.Running, vm.Annotations[statusAnnotation])
+	}
+
+	if _, err := plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{}); !clouderrors.IsMachinePreemptedError(err) {
+		t.Fatalf("expected creating a preempted machine to fail, got %v", err)
+	}
+}
+
+func TestPluginSPIImpl_GetMachineStatusWithPreemptionAndStatusWatcher(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	mf := newMockFactory(fakeClient, namespace, serverVersion)
+	plugin, err := NewPluginSPIImpl(mf, mf)
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	spec := *providerSpec
+	spec.Preemptible = true
+	providerID, err := plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+	if err != nil {
+		t.Fatalf("failed to create machine: %v", err)
+	}
+
+	sync := newVMStatusWatcherSync(t, fakeClient)
+
+	virtualMachineInstance := &kubevirtv1.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{Name: machineName, Namespace: namespace, UID: "vmi-1"},
+		Status:     kubevirtv1.VirtualMachineInstanceStatus{Phase: kubevirtv1.Running},
+	}
+	if err := fakeClient.Create(context.Background(), virtualMachineInstance); err != nil {
+		t.Fatalf("failed to create VMI: %v", err)
+	}
+	if vm := sync(); vm.Annotations[statusAnnotation] != vmStatusRunning || vm.Annotations[runningVMIAnnotation] != "vmi-1" {
+		t.Fatalf("expected the running VMI to be recorded, got annotations %v", vm.Annotations)
+	}
+	if _, err := plugin.GetMachineStatus(context.Background(), machineName, providerID, &spec, &corev1.Secret{}); err != nil {
+		t.Fatalf("failed to get machine status: %v", err)
+	}
+
+	// the VMI is evicted, and the watcher stops the VM and records it as preempted without GetMachineStatus being called
+	if err := fakeClient.Delete(context.Background(), virtualMachineInstance); err != nil {
+		t.Fatalf("failed to delete VMI: %v", err)
+	}
+	if vm := sync(); !isPreemptedVM(vm) {
+		t.Fatalf("expected the watcher to stop the evicted VM as preempted, got running %v and annotations %v", *vm.Spec.Running, vm.Annotations)
+	}
+	if _, err := plugin.GetMachineStatus(context.Background(), machineName, providerID, &spec, &corev1.Secret{}); !clouderrors.IsMachinePreemptedError(err) {
+		t.Fatalf("expected a preempted error, got %v", err)
+	}
+	if vm := sync(); vm.Annotations[statusAnnotation] != vmStatusPreempted {
+		t.Fatalf("expected the watcher to keep the preempted status, got annotations %v", vm.Annotations)
+	}
+
+	// a deliberately started VM is not considered preempted before its new VMI is running
+	if _, err := plugin.StartMachine(context.Background(), machineName, providerID, &spec, &corev1.Secret{}); err != nil {
+		t.Fatalf("failed to start machine: %v", err)
+	}
+	if _, err := plugin.GetMachineStatus(context.Background(), machineName, providerID, &spec, &corev1.Secret{}); err != nil {
+		t.Fatalf("failed to get machine status of started machine: %v", err)
+	}
+}
+
+func TestPluginSPIImpl_CrashLoopRemediationWithStatusWatcher(t *testing.T) {
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	mf := newMockFactory(fakeClient, namespace, serverVersion)
+	plugin, err := NewPluginSPIImpl(mf, mf)
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	spec := *providerSpec
+	spec.CrashLoopRemediation = &api.CrashLoopRemediationSpec{MaxRestarts: 1}
+	if _, err := plugin.CreateMachine(context.Background(), machineName, &spec, &corev1.Secret{}); err != nil {
+		t.Fatalf("failed to create machine: %v", err)
+	}
+	sync := newVMStatusWatcherSync(t, fakeClient)
+
+	// the VMI is recreated by KubeVirt without GetMachineStatus being called
+	var vm *kubevirtv1.VirtualMachine
+	for _, uid := range []types.UID{"first", "second", "third"} {
+		virtualMachineInstance := &kubevirtv1.VirtualMachineInstance{
+			ObjectMeta: metav1.ObjectMeta{Name: machineName, Namespace: namespace, UID: uid, CreationTimestamp: metav1.Now()},
+			Status:     kubevirtv1.VirtualMachineInstanceStatus{Phase: kubevirtv1.Running},
+		}
+		if err := client.IgnoreNotFound(fakeClient.Delete(context.Background(), virtualMachineInstance)); err != nil {
+			t.Fatalf("failed to delete VMI: %v", err)
+		}
+		if err := fakeClient.Create(context.Background(), virtualMachineInstance); err != nil {
+			t.Fatalf("failed to create VMI: %v", err)
+		}
+		vm = sync()
+		if uid == "second" && !*vm.Spec.Running {
+			t.Fatal("machine should not be stopped before exceeding the maximum restarts")
+		}
+	}
+	if *vm.Spec.Running || vm.Annotations[restartsAnnotation] != "2" {
+		t.Fatalf("crash-looping machine should be stopped, got running %v and annotations %v", *vm.Spec.Running, vm.Annotations)
+	}
+}
+
+// newVMStatusWatcherSync returns a function that updates the caches of the informers of a vmStatusWatcher
+// from the given fake client, lets the watcher observe the VM of the test machine and returns the updated VM.
+func newVMStatusWatcherSync(t *testing.T, fakeClient client.Client) func() *kubevirtv1.VirtualMachine {
+	vmInformer := cache.NewSharedIndexInformer(&cache.ListWatch{}, &kubevirtv1.VirtualMachine{}, 0, cache.Indexers{})
+	vmiInformer := cache.NewSharedIndexInformer(&cache.ListWatch{}, &kubevirtv1.VirtualMachineInstance{}, 0, cache.Indexers{})
+	w := newVMStatusWatcher(vmInformer, vmiInformer, func(virtualMachine *kubevirtv1.VirtualMachine, fieldManager string, fields map[string]interface{}) error {
+		return applyVM(context.Background(), applyClient{Client: fakeClient}, virtualMachine, fieldManager, fields)
+	})
+	key := types.NamespacedName{Namespace: namespace, Name: machineName}
+	return func() *kubevirtv1.VirtualMachine {
+		vm := &kubevirtv1.VirtualMachine{}
+		if err := fakeClient.Get(context.Background(), key, vm); err != nil {
+			t.Fatalf("failed to get VM: %v", err)
+		}
+		if err := vmInformer.GetStore().Update(vm); err != nil {
+			t.Fatalf("failed to update VM in cache: %v", err)
+		}
+		vmi := &kubevirtv1.VirtualMachineInstance{}
+		err := fakeClient.Get(context.Background(), key, vmi)
+		if err == nil {
+			err = vmiInformer.GetStore().Update(vmi)
+		} else if kerrors.IsNotFound(err) {
+			err = vmiInformer.GetStore().Delete(&kubevirtv1.VirtualMachineInstance{ObjectMeta: metav1.ObjectMeta{Name: machineName, Namespace: namespace}})
+		}
+		if err != nil {
+			t.Fatalf("failed to update VMI in cache: %v", err)
+		}
+		if err := w.updateStatus(key.String()); err != nil {
+			t.Fatalf("failed to update status: %v", err)
+		}
+		if err := fakeClient.Get(context.Background(), key, vm); err != nil {
+			t.Fatalf("failed to get VM: %v", err)
+		}
+		return vm
+	}
+}
+
+func TestPluginSPIImpl_CreateMachineWithVMTemplate(t *testing.T) {
+	base := &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{Name: "fedora", Namespace: "templates", Labels: map[string]string{"os": "fedora"}},
+		Spec: kubevirtv1.VirtualMachineSpec{
+			Template: &kubevirtv1.VirtualMachineInstanceTemplateSpec{
+				Spec: kubevirtv1.VirtualMachineInstanceSpec{
+					Hostname: "fedora",
+					Domain: kubevirtv1.DomainSpec{
+						Machine: kubevirtv1.Machine{Type: "q35"},
+						Devices: kubevirtv1.Devices{
+							Disks: []kubevirtv1.Disk{
+								{Name: "rootdisk", DiskDevice: kubevirtv1.DiskDevice{Disk: &kubevirtv1.DiskTarget{Bus: "virtio"}}},
+								{Name: "cloudinit", DiskDevice: kubevirtv1.DiskDevice{Disk: &kubevirtv1.DiskTarget{Bus: "virtio"}}},
+								{Name: "scratch", DiskDevice: kubevirtv1.DiskDevice{Disk: &kubevirtv1.DiskTarget{Bus: "virtio"}}},
+							},
+							Rng: &kubevirtv1.Rng{},
+						},
+					},
+					Volumes: []kubevirtv1.Volume{
+						{Name: "rootdisk", VolumeSource: kubevirtv1.VolumeSource{DataVolume: &kubevirtv1.DataVolumeSource{Name: "fedora-rootdisk"}}},
+						{Name: "cloudinit", VolumeSource: kubevirtv1.VolumeSource{CloudInitNoCloud: &kubevirtv1.CloudInitNoCloudSource{UserData: "#cloud-config"}}},
+						{Name: "scratch", VolumeSource: kubevirtv1.VolumeSource{DataVolume: &kubevirtv1.DataVolumeSource{Name: "scratch"}}},
+					},
+				},
+			},
+			DataVolumeTemplates: []cdi.DataVolume{
+				{ObjectMeta: metav1.ObjectMeta{Name: "fedora-rootdisk"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "scratch"}},
+			},
+		},
+	}
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme, base)
+	mf := newMockFactory(fakeClient, namespace, serverVersion)
+	plugin, err := NewPluginSPIImpl(mf, mf)
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	spec := *providerSpec
+	// the base VM is in another namespace, which only the cluster rules allow to read
+	spec.VMTemplate = &api.VMTemplateSpec{Name: "fedora", Namespace: "templates"}
+
+	result, err := plugin.DryRunCreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+	if err != nil {
+		t.Fatalf("failed to dry-run create machine: %v", err)
+	}
+
+	vm := result.VirtualMachine
+	if vm.Labels["os"] != "fedora" || vm.Labels[machineLabel] != machineName {
+		t.Errorf("expected the labels of the base and the provider, got %v", vm.Labels)
+	}
+	vmiSpec := vm.Spec.Template.Spec
+	if vmiSpec.Domain.Machine.Type != "q35" || vmiSpec.Domain.Devices.Rng == nil || vmiSpec.Hostname != "" {
+		t.Errorf("expected the domain of the base without its hostname, got %+v and hostname %q", vmiSpec.Domain, vmiSpec.Hostname)
+	}
+
+	var volumes []string
+	for _, volume := range vmiSpec.Volumes {
+		volumes = append(volumes, volume.Name)
+	}
+	var disks []string
+	for _, disk := range vmiSpec.Domain.Devices.Disks {
+		disks = append(disks, disk.Name)
+	}
+	var dataVolumes []string
+	for _, dataVolumeTemplate := range vm.Spec.DataVolumeTemplates {
+		dataVolumes = append(dataVolumes, dataVolumeTemplate.Name)
+	}
+	if expected := "datavolumedisk,cloudinitdisk,scratch"; strings.Join(volumes, ",") != expected || strings.Join(disks, ",") != expected {
+		t.Errorf("expected volumes and disks %s, got %v and %v", expected, volumes, disks)
+	}
+	if expected := machineName + "," + machineName + "-scratch"; strings.Join(dataVolumes, ",") != expected {
+		t.Errorf("expected DataVolumeTemplates %s, got %v", expected, dataVolumes)
+	}
+}
+
+func TestPluginSPIImpl_CreateMachineWithTemplate(t *testing.T) {
+	template := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "template.openshift.io/v1",
+		"kind":       "Template",
+		"metadata":   map[string]interface{}{"name": "fedora-server-small", "namespace": "openshift"},
+		"objects": []interface{}{
+			map[string]interface{}{
+				"apiVersion": "kubevirt.io/v1alpha3",
+				"kind":       "VirtualMachine",
+				"metadata":   map[string]interface{}{"name": "${NAME}"},
+				"spec": map[string]interface{}{
+					"template": map[string]interface{}{
+						"metadata": map[string]interface{}{"labels": map[string]interface{}{"kubevirt.io/domain": "${NAME}"}},
+						"spec": map[string]interface{}{
+							"hostname": "${NAME}",
+							"domain": map[string]interface{}{
+								"cpu":     map[string]interface{}{"cores": "${{CPU_CORES}}"},
+								"devices": map[string]interface{}{},
+							},
+						},
+					},
+				},
+			},
+		},
+		"parameters": []interface{}{
+			map[string]interface{}{"name": "NAME", "required": true},
+			map[string]interface{}{"name": "CPU_CORES", "value": "1"},
+		},
+	}}
+	fakeClient := fake.NewFakeClientWithScheme(scheme.Scheme)
+	if err := fakeClient.Create(context.Background(), template); err != nil {
+		t.Fatalf("failed to create Template: %v", err)
+	}
+	mf := newMockFactory(fakeClient, namespace, serverVersion)
+	plugin, err := NewPluginSPIImpl(mf, mf)
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	spec := *providerSpec
+	spec.CPU = nil
+	spec.VMTemplate = &api.VMTemplateSpec{
+		Kind:       api.VMTemplateKindTemplate,
+		Name:       "fedora-server-small",
+		Namespace:  "openshift",
+		Parameters: map[string]string{"CPU_CORES": "4"},
+	}
+
+	result, err := plugin.DryRunCreateMachine(context.Background(), machineName, &spec, &corev1.Secret{})
+	if err != nil {
+		t.Fatalf("failed to dry-run create machine: %v", err)
+	}
+	vmiTemplate := result.VirtualMachine.Spec.Template
+	if vmiTemplate.Spec.Hostname != machineName || vmiTemplate.ObjectMeta.Labels["kubevirt.io/domain"] != machineName {
+		t.Errorf("expected the NAME parameter to be the machine name, got hostname %q and labels %v", vmiTemplate.Spec.Hostname, vmiTemplate.ObjectMeta.Labels)
+	}
+	if cpu := vmiTemplate.Spec.Domain.CPU; cpu == nil || cpu.Cores != 4 {
+		t.Errorf("expected 4 CPU cores from the parameters, got %+v", cpu)
+	}
+
+	spec.VMTemplate.Parameters = map[string]string{"UNKNOWN": "value"}
+	if _, err := plugin.DryRunCreateMachine(context.Background(), machineName, &spec, &corev1.Secret{}); err == nil {
+		t.Errorf("expected an error for an unknown parameter")
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// vmiUIDAnnotation is the annotation on VMs that contains the UID of the last observed VMI.
+	vmiUIDAnnotation = "kubevirt.provider.extensions.gardener.cloud/vmi-uid"
+	// restartsAnnotation is the annotation on VMs that counts how often their VMI was recreated unexpectedly.
+	restartsAnnotation = "kubevirt.provider.extensions.gardener.cloud/restarts"
+	// maxRestartsAnnotation is the annotation on VMs with a crash loop remediation that contains its maximum restarts,
+	// so that crash loops are also detected from VM and VMI events, which don't come with the provider spec.
+	maxRestartsAnnotation = "kubevirt.provider.extensions.gardener.cloud/max-restarts"
+	// crashLoopResetPeriod is the duration after which a running VMI is considered stable and the restarts are reset.
+	crashLoopResetPeriod = 10 * time.Minute
+)
+
+// checkCrashLoop counts how often the VMI of the given VM was recreated by KubeVirt, e.g. after guest crashes, and stops
+// the VM once it exceeded the maximum restarts of the given remediation, so that the node of the machine becomes unhealthy
+// and the machine is replaced. It returns an error for stopped crash-looping VMs.
+func (p PluginSPIImpl) checkCrashLoop(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine, remediation *api.CrashLoopRemediationSpec) error {
+	virtualMachineInstance := &kubevirtv1.VirtualMachineInstance{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: virtualMachine.Namespace, Name: virtualMachine.Name}, virtualMachineInstance); err != nil {
+		if !kerrors.IsNotFound(err) {
+			return fmt.Errorf("failed to get VirtualMachineInstance: %w", err)
+		}
+		virtualMachineInstance = nil
+	}
+
+	maxRestarts := strconv.Itoa(int(remediation.MaxRestarts))
+	restarts, changed := countRestarts(virtualMachine, virtualMachineInstance)
+	if changed || virtualMachine.Annotations[maxRestartsAnnotation] != maxRestarts {
+		vmiUID := virtualMachine.Annotations[vmiUIDAnnotation]
+		if virtualMachineInstance != nil {
+			vmiUID = string(virtualMachineInstance.UID)
+		}
+		if err := applyVM(ctx, c, virtualMachine, crashLoopFieldManager, crashLoopFields(vmiUID, restarts, maxRestarts)); err != nil {
+			return fmt.Errorf("failed to update restarts of VirtualMachine %s: %w", virtualMachine.Name, err)
+		}
+	}
+
+	if restarts <= int(remediation.MaxRestarts) {
+		return nil
+	}
+
+	if err := p.setVMStopped(ctx, c, virtualMachine); err != nil {
+		return err
+	}
+	return fmt.Errorf("VirtualMachine %s restarted %d times and exceeded the maximum of %d restarts, it is stopped so that the machine gets replaced",
+		virtualMachine.Name, restarts, remediation.MaxRestarts)
+}
+
+// countRestarts returns the restarts of the given VM with the given VMI, which is nil if it doesn't exist, and whether
+// they or the VMI changed since they were recorded. The restarts are increased if the VMI was recreated, and reset
+// once it has been running for crashLoopResetPeriod.
+func countRestarts(virtualMachine *kubevirtv1.VirtualMachine, virtualMachineInstance *kubevirtv1.VirtualMachineInstance) (int, bool) {
+	restarts, _ := strconv.Atoi(virtualMachine.Annotations[restartsAnnotation])
+	if virtualMachineInstance == nil {
+		return restarts, false
+	}
+
+	switch lastUID := virtualMachine.Annotations[vmiUIDAnnotation]; {
+	case lastUID == string(virtualMachineInstance.UID):
+		if restarts > 0 && virtualMachineInstance.Status.Phase == kubevirtv1.Running &&
+			time.Since(virtualMachineInstance.CreationTimestamp.Time) >= crashLoopResetPeriod {
+			return 0, true
+		}
+		return restarts, false
+	case lastUID != "":
+		logging.Logger{}.V(2).Info("VirtualMachineInstance of VirtualMachine was recreated", "vm", virtualMachine.Name, "restarts", restarts+1)
+		return restarts + 1, true
+	default:
+		return restarts, true
+	}
+}
+
+// exceedsMaxRestarts returns whether the given restarts exceed the maximum restarts recorded on the given VM.
+func exceedsMaxRestarts(virtualMachine *kubevirtv1.VirtualMachine, restarts int) bool {
+	maxRestarts, err := strconv.Atoi(virtualMachine.Annotations[maxRestartsAnnotation])
+	return err == nil && restarts > maxRestarts
+}
+
+// resetCrashLoop resets the restarts of the given VM, e.g. after it was restarted deliberately.
+func (p PluginSPIImpl) resetCrashLoop(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine) error {
+	if virtualMachine.Annotations[vmiUIDAnnotation] == "" {
+		return nil
+	}
+	if err := applyVM(ctx, c, virtualMachine, crashLoopFieldManager, crashLoopFields("", 0, virtualMachine.Annotations[maxRestartsAnnotation])); err != nil {
+		return fmt.Errorf("failed to reset restarts of VirtualMachine %s: %w", virtualMachine.Name, err)
+	}
+	return nil
+}
+
+// crashLoopFields returns the fields of VMs that record the given UID of their last observed VMI, the given restarts
+// and the given maximum restarts in their annotations.
+func crashLoopFields(vmiUID string, restarts int, maxRestarts string) map[string]interface{} {
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				vmiUIDAnnotation:      vmiUID,
+				restartsAnnotation:    strconv.Itoa(restarts),
+				maxRestartsAnnotation: maxRestarts,
+			},
+		},
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// vaultCredentialsSource is the name of the credentials source that fetches kubeconfigs from HashiCorp Vault.
+	vaultCredentialsSource = "vault"
+	// fileCredentialsSource is the name of the credentials source that reads kubeconfigs from a local directory,
+	// e.g. a volume of a secret synced by the external secrets operator or mounted by the secrets store CSI driver.
+	fileCredentialsSource = "file"
+
+	defaultVaultAuthMount               = "kubernetes"
+	defaultVaultServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	vaultRequestTimeout                 = 30 * time.Second
+)
+
+// CredentialsSource fetches the kubeconfigs of provider clusters from outside of the credentials secret.
+type CredentialsSource interface {
+	// GetKubeconfig returns the kubeconfig with the given key from the location referenced by the given credentials secret.
+	GetKubeconfig(ctx context.Context, secret *corev1.Secret, key string) ([]byte, error)
+}
+
+// CredentialsSources are the external credentials sources by the names credentials secrets refer to them with.
+type CredentialsSources map[string]CredentialsSource
+
+// Resolve returns the given credentials secret with the kubeconfig of the provider cluster of the zone of the given
+// provider spec fetched from the credentials source named in the secret. Secrets without a credentials source are
+// returned unchanged.
+func (s CredentialsSources) Resolve(ctx context.Context, secret *corev1.Secret, providerSpec *api.KubeVirtProviderSpec) (*corev1.Secret, error) {
+	if secret == nil {
+		return nil, nil
+	}
+	name, ok := secret.Data[api.CredentialsSourceKey]
+	if !ok {
+		return secret, nil
+	}
+	source, ok := s[string(name)]
+	if !ok {
+		return nil, fmt.Errorf("credentials source %q is not configured", name)
+	}
+
+	key := api.GetKubeconfigKey(providerSpec)
+	kubeconfig, err := source.GetKubeconfig(ctx, secret, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get kubeconfig %s from credentials source %s: %w", key, name, err)
+	}
+	resolved := secret.DeepCopy()
+	resolved.Data[key] = kubeconfig
+	return resolved, nil
+}
+
+// CredentialsOptions are the options of the external sources of the kubeconfigs of provider clusters.
+// Credentials sources whose options are not set are not available.
+type CredentialsOptions struct {
+	// VaultAddress is the address of the Vault server kubeconfigs are fetched from.
+	VaultAddress string
+	// VaultAuthMount is the mount path of the Kubernetes auth method of Vault, "kubernetes" if not set.
+	VaultAuthMount string
+	// VaultServiceAccountTokenFile is the file of the service account token the provider logs in to Vault with,
+	// the token of the service account of the pod if not set.
+	VaultServiceAccountTokenFile string
+	// CredentialsDir is the directory kubeconfigs are read from by the file credentials source.
+	CredentialsDir string
+}
+
+// AddFlags adds the flags of the credentials options to the given flag set.
+func (o *CredentialsOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.VaultAddress, "provider-credentials-vault-address", o.VaultAddress, "Address of the Vault server to fetch the kubeconfigs of provider clusters from, empty to disable the vault credentials source")
+	fs.StringVar(&o.VaultAuthMount, "provider-credentials-vault-auth-mount", o.VaultAuthMount, "Mount path of the Kubernetes auth method of Vault, \""+defaultVaultAuthMount+"\" if not set")
+	fs.StringVar(&o.VaultServiceAccountTokenFile, "provider-credentials-vault-token-file", o.VaultServiceAccountTokenFile, "Service account token file to log in to Vault with, the token of the pod if not set")
+	fs.StringVar(&o.CredentialsDir, "provider-credentials-dir", o.CredentialsDir, "Directory to read the kubeconfigs of provider clusters from, empty to disable the file credentials source")
+}
+
+// Sources returns the credentials sources configured by the options.
+func (o CredentialsOptions) Sources() CredentialsSources {
+	sources := CredentialsSources{}
+	if o.VaultAddress != "" {
+		source := &vaultSource{
+			address:     strings.TrimSuffix(o.VaultAddress, "/"),
+			authMount:   o.VaultAuthMount,
+			tokenFile:   o.VaultServiceAccountTokenFile,
+			httpClient:  &http.Client{Timeout: vaultRequestTimeout},
+			secretCache: map[string]cachedVaultSecret{},
+		}
+		if source.authMount == "" {
+			source.authMount = defaultVaultAuthMount
+		}
+		if source.tokenFile == "" {
+			source.tokenFile = defaultVaultServiceAccountTokenFile
+		}
+		sources[vaultCredentialsSource] = source
+	}
+	if o.CredentialsDir != "" {
+		sources[fileCredentialsSource] = fileSource{dir: o.CredentialsDir}
+	}
+	return sources
+}
+
+// fileSource reads kubeconfigs from files named after their keys in the directory of the credentials path
+// within its directory.
+type fileSource struct {
+	dir string
+}
+
+// GetKubeconfig reads the kubeconfig with the given key from the directory of the credentials path of the given secret.
+func (s fileSource) GetKubeconfig(_ context.Context, secret *corev1.Secret, key string) ([]byte, error) {
+	path := filepath.Join(s.dir, string(secret.Data[api.CredentialsPathKey]), key)
+	if rel, err := filepath.Rel(s.dir, path); err != nil || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("credentials path %q is not located in the credentials directory", secret.Data[api.CredentialsPathKey])
+	}
+	return ioutil.ReadFile(path)
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	cdi "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// DryRunResult contains the objects CreateMachine would create for a machine, as returned by the server-side
+// dry-run creates in the provider cluster.
+type DryRunResult struct {
+	// VirtualMachine is the VM of the machine.
+	VirtualMachine *kubevirtv1.VirtualMachine
+	// DataVolume is the root disk DataVolume created from the DataVolumeTemplate of the VM.
+	DataVolume *cdi.DataVolume
+	// UserDataSecret is the Secret with the userdata of the VM.
+	UserDataSecret *corev1.Secret
+}
+
+// Manifests returns the objects of the result as a multi-document YAML. It contains the userdata in plain text.
+func (r *DryRunResult) Manifests() ([]byte, error) {
+	var manifests bytes.Buffer
+	for _, obj := range []runtime.Object{r.VirtualMachine, r.DataVolume, r.UserDataSecret} {
+		manifest, err := yaml.Marshal(obj)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %s: %w", obj.GetObjectKind().GroupVersionKind().Kind, err)
+		}
+		manifests.WriteString("---\n")
+		manifests.Write(manifest)
+	}
+	return manifests.Bytes(), nil
+}
+
+// DryRunCreateMachine renders the VM, its root disk DataVolume and its userdata Secret for a machine with the given name
+// and the given provider spec like CreateMachine, and validates them with server-side dry-run creates in the provider
+// cluster without persisting anything, so that changes of machine classes can be previewed before they are rolled out.
+// The IP addresses of the result are not reserved, and the creates fail if a machine with the given name already exists.
+func (p PluginSPIImpl) DryRunCreateMachine(ctx context.Context, machineName string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (result *DryRunResult, err error) {
+	err = p.retryOnUnauthorized(ctx, secret, providerSpec, func() error {
+		result, err = p.dryRunCreateMachine(ctx, machineName, providerSpec, secret)
+		return err
+	})
+	return result, err
+}
+
+// dryRunCreateMachine implements DryRunCreateMachine.
+func (p PluginSPIImpl) dryRunCreateMachine(ctx context.Context, machineName string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (*DryRunResult, error) {
+	c, namespace, err := p.getClient(secret, providerSpec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	ctx = withClusterLogger(ctx, namespace, providerSpec)
+	c = dryRunClient{Client: c}
+	// IP addresses allocated for the preview must not be held back from the machines that are actually created
+	p.ipAllocator = NewRangeIPAllocator()
+
+	existing, err := p.findVM(ctx, c, machineName, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		if providerSpec.CapacityCheck {
+			if err := p.checkCapacity(ctx, c, providerSpec); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.checkResourceQuotas(ctx, c, namespace, providerSpec); err != nil {
+			return nil, err
+		}
+	}
+
+	virtualMachine, userData, err := p.buildVM(ctx, c, machineName, namespace, providerSpec, secret, existing)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Create(ctx, virtualMachine); err != nil {
+		return nil, fmt.Errorf("failed to dry-run create VirtualMachine: %w", err)
+	}
+	virtualMachine.SetGroupVersionKind(kubevirtv1.VirtualMachineGroupVersionKind)
+
+	dataVolume := virtualMachine.Spec.DataVolumeTemplates[0].DeepCopy()
+	dataVolume.Namespace = namespace
+	if err := c.Create(ctx, dataVolume); err != nil {
+		return nil, fmt.Errorf("failed to dry-run create DataVolume: %w", err)
+	}
+	dataVolume.SetGroupVersionKind(cdi.SchemeGroupVersion.WithKind("DataVolume"))
+
+	userDataSecret := buildUserDataSecret(virtualMachine, userData)
+	if err := c.Create(ctx, userDataSecret); err != nil {
+		return nil, fmt.Errorf("failed to dry-run create secret for userdata: %w", err)
+	}
+	userDataSecret.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Secret"))
+
+	return &DryRunResult{
+		VirtualMachine: virtualMachine,
+		DataVolume:     dataVolume,
+		UserDataSecret: userDataSecret,
+	}, nil
+}
+
+// dryRunClient is a client that performs all writes as server-side dry-runs, so that nothing is persisted.
+type dryRunClient struct {
+	client.Client
+}
+
+// Create performs a server-side dry-run create of the given object.
+func (c dryRunClient) Create(ctx context.Context, obj runtime.Object, opts ...client.CreateOption) error {
+	return c.Client.Create(ctx, obj, append(opts, client.DryRunAll)...)
+}
+
+// Update performs a server-side dry-run update of the given object.
+func (c dryRunClient) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	return c.Client.Update(ctx, obj, append(opts, client.DryRunAll)...)
+}
+
+// Patch performs a server-side dry-run patch of the given object.
+func (c dryRunClient) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return c.Client.Patch(ctx, obj, patch, append(opts, client.DryRunAll)...)
+}
+
+// Delete performs a server-side dry-run delete of the given object.
+func (c dryRunClient) Delete(ctx context.Context, obj runtime.Object, opts ...client.DeleteOption) error {
+	return c.Client.Delete(ctx, obj, append(opts, client.DryRunAll)...)
+}
+
+// DeleteAllOf doesn't delete anything, as there are no dry-run deletes of collections.
+func (c dryRunClient) DeleteAllOf(context.Context, runtime.Object, ...client.DeleteAllOfOption) error {
+	return nil
+}
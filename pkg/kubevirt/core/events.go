@@ -0,0 +1,95 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// eventSourceComponent is the component reported as source of the Events recorded by the provider.
+const eventSourceComponent = "machine-controller-manager-provider-kubevirt"
+
+// Reasons of the Events recorded on VMs.
+const (
+	eventReasonCreated      = "Created"
+	eventReasonAdopted      = "Adopted"
+	eventReasonRolledBack   = "RolledBack"
+	eventReasonShuttingDown = "ShuttingDown"
+	eventReasonDeleting     = "Deleting"
+	eventReasonImportFailed = "ImportFailed"
+	eventReasonPreempted    = "Preempted"
+)
+
+// recordEvent records an Event with the given type, reason and message on the given VM, so that `kubectl describe`
+// shows the lifecycle of the machine. Repeated Events with the same reason on the same VM are aggregated by
+// increasing their count. Failures are only logged, as Events are informational.
+func (p PluginSPIImpl) recordEvent(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine, eventType, reason, messageFmt string, args ...interface{}) {
+	now := metav1.Now()
+	message := fmt.Sprintf(messageFmt, args...)
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      eventName(virtualMachine, reason),
+			Namespace: virtualMachine.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      kubevirtv1.VirtualMachineGroupVersionKind.GroupVersion().String(),
+			Kind:            kubevirtv1.VirtualMachineGroupVersionKind.Kind,
+			Namespace:       virtualMachine.Namespace,
+			Name:            virtualMachine.Name,
+			UID:             virtualMachine.UID,
+			ResourceVersion: virtualMachine.ResourceVersion,
+		},
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Source:         corev1.EventSource{Component: eventSourceComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	err := c.Create(ctx, event)
+	if kerrors.IsAlreadyExists(err) {
+		existing := &corev1.Event{}
+		if err = c.Get(ctx, types.NamespacedName{Namespace: event.Namespace, Name: event.Name}, existing); err == nil {
+			existing.Count++
+			existing.LastTimestamp = now
+			existing.Message = message
+			err = c.Update(ctx, existing)
+		}
+	}
+	if err != nil {
+		logging.FromContext(ctx).V(2).Info("could not record Event on VirtualMachine", "vm", virtualMachine.Name, "reason", reason, "error", err.Error())
+	}
+}
+
+// eventName returns the name of the Events with the given reason on the given VM, which is unique per VM UID and reason.
+func eventName(virtualMachine *kubevirtv1.VirtualMachine, reason string) string {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(string(virtualMachine.UID) + "/" + reason))
+	return fmt.Sprintf("%s.%s.%x", virtualMachine.Name, strings.ToLower(reason), hash.Sum32())
+}
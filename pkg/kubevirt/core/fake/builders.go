@@ -0,0 +1,156 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fake
+
+import (
+	"encoding/json"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+
+	"github.com/gardener/machine-controller-manager/pkg/apis/machine/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilpointer "k8s.io/utils/pointer"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	cdi "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+)
+
+// machineClassLabel is the label of the VMs of a machine class, which is set by the machine controller as a tag.
+const machineClassLabel = "mcm.gardener.cloud/machineclass"
+
+// Kubeconfig is a syntactically valid kubeconfig of a provider cluster that doesn't exist, for credentials secrets
+// that pass the validation of the driver.
+const Kubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: provider
+  cluster:
+    server: https://provider.example.com:6443
+users:
+- name: provider
+  user:
+    token: fake
+contexts:
+- name: provider
+  context:
+    cluster: provider
+    user: provider
+    namespace: default
+current-context: provider
+`
+
+// NewProviderSpec returns a minimal valid provider spec for VMs of the machine class with the given name.
+func NewProviderSpec(machineClassName string) *api.KubeVirtProviderSpec {
+	return &api.KubeVirtProviderSpec{
+		Region:           "local",
+		Zone:             "local-1",
+		SourceURL:        "http://images.example.com/ubuntu.img",
+		StorageClassName: "standard",
+		PVCSize:          resource.MustParse("10Gi"),
+		Resources: kubevirtv1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("1"),
+				corev1.ResourceMemory: resource.MustParse("4Gi"),
+			},
+		},
+		Tags: map[string]string{
+			machineClassLabel: machineClassName,
+		},
+	}
+}
+
+// NewSecret returns a credentials secret with Kubeconfig and a minimal userData.
+func NewSecret() *corev1.Secret {
+	return &corev1.Secret{
+		Data: map[string][]byte{
+			api.DefaultKubeconfigKey: []byte(Kubeconfig),
+			"userData":               []byte("#cloud-config\n"),
+		},
+	}
+}
+
+// NewMachineClass returns a machine class with the given name and provider spec, as passed to the driver.
+func NewMachineClass(name string, providerSpec *api.KubeVirtProviderSpec) (*v1alpha1.MachineClass, error) {
+	raw, err := json.Marshal(providerSpec)
+	if err != nil {
+		return nil, err
+	}
+	return &v1alpha1.MachineClass{
+		ObjectMeta:   metav1.ObjectMeta{Name: name},
+		ProviderSpec: runtime.RawExtension{Raw: raw},
+		Provider:     core.ProviderName,
+	}, nil
+}
+
+// NewVM returns a running VM with the given name and namespace for the given provider spec, with the tags of the
+// provider spec as labels and its root disk imported from the source URL of the provider spec.
+func NewVM(name, namespace string, providerSpec *api.KubeVirtProviderSpec) *kubevirtv1.VirtualMachine {
+	labels := make(map[string]string, len(providerSpec.Tags))
+	for key, value := range providerSpec.Tags {
+		labels[key] = value
+	}
+
+	return &kubevirtv1.VirtualMachine{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: kubevirtv1.GroupVersion.String(),
+			Kind:       "VirtualMachine",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: kubevirtv1.VirtualMachineSpec{
+			Running: utilpointer.BoolPtr(true),
+			Template: &kubevirtv1.VirtualMachineInstanceTemplateSpec{
+				Spec: kubevirtv1.VirtualMachineInstanceSpec{
+					Domain: kubevirtv1.DomainSpec{
+						Resources: providerSpec.Resources,
+						Devices: kubevirtv1.Devices{
+							Disks: []kubevirtv1.Disk{{
+								Name:       "datavolumedisk",
+								DiskDevice: kubevirtv1.DiskDevice{Disk: &kubevirtv1.DiskTarget{Bus: "virtio"}},
+							}},
+						},
+					},
+					Volumes: []kubevirtv1.Volume{{
+						Name: "datavolumedisk",
+						VolumeSource: kubevirtv1.VolumeSource{
+							DataVolume: &kubevirtv1.DataVolumeSource{Name: name},
+						},
+					}},
+				},
+			},
+			DataVolumeTemplates: []cdi.DataVolume{{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+				Spec: cdi.DataVolumeSpec{
+					PVC: &corev1.PersistentVolumeClaimSpec{
+						StorageClassName: utilpointer.StringPtr(providerSpec.StorageClassName),
+						AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+						Resources: corev1.ResourceRequirements{
+							Requests: corev1.ResourceList{corev1.ResourceStorage: providerSpec.PVCSize},
+						},
+					},
+					Source: cdi.DataVolumeSource{
+						HTTP: &cdi.DataVolumeSourceHTTP{URL: providerSpec.SourceURL},
+					},
+				},
+			}},
+		},
+	}
+}
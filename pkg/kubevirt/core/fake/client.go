@@ -0,0 +1,72 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fake
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// NewClient returns an in-memory client of a provider cluster with the given objects, for running the real
+// PluginSPI without a provider cluster. KubeVirt and CDI types have to be registered in the client-go scheme.
+func NewClient(objs ...runtime.Object) client.Client {
+	return applyClient{Client: fake.NewFakeClientWithScheme(scheme.Scheme, objs...)}
+}
+
+// NewClientFactory returns a factory of clients and server versions of a provider cluster that always returns
+// the given client, the given namespace and the given Kubernetes version.
+func NewClientFactory(c client.Client, namespace, serverVersion string) ClientFactory {
+	return ClientFactory{client: c, namespace: namespace, serverVersion: serverVersion}
+}
+
+// ClientFactory is a ClientFactory and ServerVersionFactory that ignores the credentials secret.
+type ClientFactory struct {
+	client        client.Client
+	namespace     string
+	serverVersion string
+}
+
+// GetClient returns the client and namespace of the factory.
+func (f ClientFactory) GetClient(*corev1.Secret) (client.Client, string, error) {
+	return f.client, f.namespace, nil
+}
+
+// GetServerVersion returns the Kubernetes version of the factory.
+func (f ClientFactory) GetServerVersion(*corev1.Secret) (string, error) {
+	return f.serverVersion, nil
+}
+
+// applyClient emulates server-side applies with merge patches, as the in-memory client doesn't support apply patches.
+// Both are equivalent for the fields the provider applies, except that merge patches replace lists.
+type applyClient struct {
+	client.Client
+}
+
+func (c applyClient) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch.Type() == types.ApplyPatchType {
+		data, err := patch.Data(obj)
+		if err != nil {
+			return err
+		}
+		patch = client.ConstantPatch(types.MergePatchType, data)
+	}
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
@@ -0,0 +1,257 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fake provides an in-memory implementation of the PluginSPI of the driver, and builders of provider specs,
+// secrets, machine classes and VMs, to exercise the driver without a provider cluster.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+	clouderrors "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/errors"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilpointer "k8s.io/utils/pointer"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	cdi "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+)
+
+// PluginSPI is a PluginSPI that keeps the VMs of a provider cluster namespace in memory. Like the real implementation,
+// it creates VMs from provider specs, reports missing VMs as MachineNotFoundError and lists the VMs whose labels
+// match the tags of the provider spec. It is safe for concurrent use.
+type PluginSPI struct {
+	// Namespace is the namespace of the VMs, which is part of their provider IDs.
+	Namespace string
+	// Errors are returned by the methods with the given names, e.g. "CreateMachine", instead of calling them.
+	Errors map[string]error
+	// Addresses are returned by GetMachineAddresses for the machines with the given names.
+	Addresses map[string][]corev1.NodeAddress
+
+	mutex sync.Mutex
+	vms   map[string]*kubevirtv1.VirtualMachine
+	uids  int
+}
+
+// NewPluginSPI returns a PluginSPI without VMs in the given namespace.
+func NewPluginSPI(namespace string) *PluginSPI {
+	return &PluginSPI{
+		Namespace: namespace,
+		Errors:    map[string]error{},
+		Addresses: map[string][]corev1.NodeAddress{},
+		vms:       map[string]*kubevirtv1.VirtualMachine{},
+	}
+}
+
+// AddVM adds a copy of the given VM, e.g. one built by NewVM, and returns its provider ID.
+// VMs without a UID get one assigned.
+func (f *PluginSPI) AddVM(virtualMachine *kubevirtv1.VirtualMachine) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.addVM(virtualMachine.DeepCopy())
+}
+
+// GetVM returns a copy of the VM with the given name, or nil if there is none.
+func (f *PluginSPI) GetVM(machineName string) *kubevirtv1.VirtualMachine {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if virtualMachine, ok := f.vms[machineName]; ok {
+		return virtualMachine.DeepCopy()
+	}
+	return nil
+}
+
+// VMNames returns the sorted names of the VMs.
+func (f *PluginSPI) VMNames() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	names := make([]string, 0, len(f.vms))
+	for name := range f.vms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CreateMachine creates a VM for the given provider spec, unless there is one with the given name already.
+func (f *PluginSPI) CreateMachine(_ context.Context, machineName string, providerSpec *api.KubeVirtProviderSpec, _ *corev1.Secret) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.Errors["CreateMachine"]; err != nil {
+		return "", err
+	}
+	if virtualMachine, ok := f.vms[machineName]; ok {
+		return f.providerID(virtualMachine), nil
+	}
+	return f.addVM(NewVM(machineName, f.Namespace, providerSpec)), nil
+}
+
+// DeleteMachine deletes the VM with the given name. It returns an empty provider ID if there is no such VM.
+func (f *PluginSPI) DeleteMachine(_ context.Context, machineName, _ string, _ *api.KubeVirtProviderSpec, _ *corev1.Secret) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.Errors["DeleteMachine"]; err != nil {
+		return "", err
+	}
+	virtualMachine, ok := f.vms[machineName]
+	if !ok {
+		return "", nil
+	}
+	delete(f.vms, machineName)
+	return f.providerID(virtualMachine), nil
+}
+
+// GetMachineStatus returns the provider ID of the VM with the given name.
+func (f *PluginSPI) GetMachineStatus(_ context.Context, machineName, _ string, _ *api.KubeVirtProviderSpec, _ *corev1.Secret) (string, error) {
+	return f.update("GetMachineStatus", machineName, func(*kubevirtv1.VirtualMachine) {})
+}
+
+// GetMachineAddresses returns the addresses of the machine with the given name from Addresses.
+func (f *PluginSPI) GetMachineAddresses(_ context.Context, machineName, _ string, _ *api.KubeVirtProviderSpec, _ *corev1.Secret) ([]corev1.NodeAddress, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.Errors["GetMachineAddresses"]; err != nil {
+		return nil, err
+	}
+	return f.Addresses[machineName], nil
+}
+
+// ListMachines returns the provider IDs and names of the VMs whose labels match the tags of the given provider spec.
+func (f *PluginSPI) ListMachines(_ context.Context, providerSpec *api.KubeVirtProviderSpec, _ *corev1.Secret) (map[string]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.Errors["ListMachines"]; err != nil {
+		return nil, err
+	}
+	providerIDs := map[string]string{}
+	for name, virtualMachine := range f.vms {
+		if matchesTags(virtualMachine, providerSpec.Tags) {
+			providerIDs[f.providerID(virtualMachine)] = name
+		}
+	}
+	return providerIDs, nil
+}
+
+// ShutDownMachine stops the VM with the given name.
+func (f *PluginSPI) ShutDownMachine(_ context.Context, machineName, _ string, _ *api.KubeVirtProviderSpec, _ *corev1.Secret) (string, error) {
+	return f.update("ShutDownMachine", machineName, func(virtualMachine *kubevirtv1.VirtualMachine) {
+		virtualMachine.Spec.Running = utilpointer.BoolPtr(false)
+	})
+}
+
+// StartMachine starts the VM with the given name.
+func (f *PluginSPI) StartMachine(_ context.Context, machineName, _ string, _ *api.KubeVirtProviderSpec, _ *corev1.Secret) (string, error) {
+	return f.update("StartMachine", machineName, func(virtualMachine *kubevirtv1.VirtualMachine) {
+		virtualMachine.Spec.Running = utilpointer.BoolPtr(true)
+	})
+}
+
+// RestartMachine restarts the VM with the given name, which leaves it running.
+func (f *PluginSPI) RestartMachine(_ context.Context, machineName, _ string, _ *api.KubeVirtProviderSpec, _ *corev1.Secret) (string, error) {
+	return f.update("RestartMachine", machineName, func(virtualMachine *kubevirtv1.VirtualMachine) {
+		virtualMachine.Spec.Running = utilpointer.BoolPtr(true)
+	})
+}
+
+// MigrateMachine migrates the VM with the given name, which doesn't change it.
+func (f *PluginSPI) MigrateMachine(_ context.Context, machineName, _ string, _ *api.KubeVirtProviderSpec, _ *corev1.Secret) (string, error) {
+	return f.update("MigrateMachine", machineName, func(*kubevirtv1.VirtualMachine) {})
+}
+
+// ExpandMachineRootDisk grows the root disk of the VM with the given name to the size in the given provider spec.
+func (f *PluginSPI) ExpandMachineRootDisk(_ context.Context, machineName, _ string, providerSpec *api.KubeVirtProviderSpec, _ *corev1.Secret) (string, error) {
+	return f.update("ExpandMachineRootDisk", machineName, func(virtualMachine *kubevirtv1.VirtualMachine) {
+		for i := range virtualMachine.Spec.DataVolumeTemplates {
+			pvc := virtualMachine.Spec.DataVolumeTemplates[i].Spec.PVC
+			if pvc == nil {
+				continue
+			}
+			if size := pvc.Resources.Requests[corev1.ResourceStorage]; size.Cmp(providerSpec.PVCSize) < 0 {
+				pvc.Resources.Requests[corev1.ResourceStorage] = providerSpec.PVCSize
+			}
+		}
+	})
+}
+
+// DryRunCreateMachine returns the VM CreateMachine would create, its root disk DataVolume and its userdata Secret.
+func (f *PluginSPI) DryRunCreateMachine(_ context.Context, machineName string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (*core.DryRunResult, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.Errors["DryRunCreateMachine"]; err != nil {
+		return nil, err
+	}
+
+	virtualMachine := NewVM(machineName, f.Namespace, providerSpec)
+	dataVolume := virtualMachine.Spec.DataVolumeTemplates[0].DeepCopy()
+	dataVolume.TypeMeta = metav1.TypeMeta{APIVersion: cdi.SchemeGroupVersion.String(), Kind: "DataVolume"}
+	userDataSecret := &corev1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{Name: "userdata-" + machineName, Namespace: f.Namespace},
+	}
+	if secret != nil {
+		userDataSecret.Data = map[string][]byte{"userdata": secret.Data["userData"]}
+	}
+	return &core.DryRunResult{
+		VirtualMachine: virtualMachine,
+		DataVolume:     dataVolume,
+		UserDataSecret: userDataSecret,
+	}, nil
+}
+
+// update calls the given function with the VM with the given name, unless an error is configured for the method
+// with the given name, and returns the provider ID of the VM.
+func (f *PluginSPI) update(method, machineName string, updateVM func(*kubevirtv1.VirtualMachine)) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.Errors[method]; err != nil {
+		return "", err
+	}
+	virtualMachine, ok := f.vms[machineName]
+	if !ok {
+		return "", &clouderrors.MachineNotFoundError{Name: machineName}
+	}
+	updateVM(virtualMachine)
+	return f.providerID(virtualMachine), nil
+}
+
+// addVM adds the given VM, assigning it a UID if it has none, and returns its provider ID.
+func (f *PluginSPI) addVM(virtualMachine *kubevirtv1.VirtualMachine) string {
+	if virtualMachine.UID == "" {
+		f.uids++
+		virtualMachine.UID = types.UID(fmt.Sprintf("00000000-0000-0000-0000-%012d", f.uids))
+	}
+	f.vms[virtualMachine.Name] = virtualMachine
+	return f.providerID(virtualMachine)
+}
+
+// providerID returns the provider ID of the given VM in the format of the provider.
+func (f *PluginSPI) providerID(virtualMachine *kubevirtv1.VirtualMachine) string {
+	return fmt.Sprintf("%s://%s/%s/%s", core.ProviderName, virtualMachine.Namespace, virtualMachine.Name, virtualMachine.UID)
+}
+
+// matchesTags checks whether the labels of the given VM contain all the given tags.
+func matchesTags(virtualMachine *kubevirtv1.VirtualMachine, tags map[string]string) bool {
+	for key, value := range tags {
+		if virtualMachine.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
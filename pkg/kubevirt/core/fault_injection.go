@@ -0,0 +1,295 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// FaultInjectionEnv is the environment variable that configures the faults injected into the clients of the
+// provider clusters, in the format accepted by ParseFaultInjector. It is only honoured by binaries built with
+// the faultinjection build tag.
+const FaultInjectionEnv = "PROVIDER_FAULT_INJECTION"
+
+// Fault is a fault injected into a call of a client of a provider cluster.
+type Fault struct {
+	// Delay is how long the call is delayed before it is performed.
+	Delay time.Duration
+	// Err is the error returned by the call instead of performing it.
+	Err error
+	// Partial performs the call before returning Err, emulating a request that reached the provider cluster
+	// but whose response got lost.
+	Partial bool
+}
+
+// FaultInjector decides which faults are injected into the calls of the clients of the provider clusters,
+// to test the behavior of the machine controller manager under provider flakiness.
+type FaultInjector interface {
+	// Inject returns the fault to inject into a call with the given verb, e.g. "get" or "create",
+	// on the given object, or nil to perform the call unchanged.
+	Inject(verb string, obj runtime.Object) *Fault
+}
+
+// FaultInjectorFunc is a function that implements FaultInjector.
+type FaultInjectorFunc func(verb string, obj runtime.Object) *Fault
+
+// Inject returns the fault to inject into a call with the given verb on the given object.
+func (f FaultInjectorFunc) Inject(verb string, obj runtime.Object) *Fault {
+	return f(verb, obj)
+}
+
+// faultInjectingClientFactory is a ClientFactory that injects the faults of a FaultInjector
+// into the clients created by another ClientFactory.
+type faultInjectingClientFactory struct {
+	cf       ClientFactory
+	injector FaultInjector
+}
+
+// NewFaultInjectingClientFactory returns a ClientFactory that injects the faults decided by the given FaultInjector
+// into the clients created by the given ClientFactory.
+func NewFaultInjectingClientFactory(cf ClientFactory, injector FaultInjector) ClientFactory {
+	return &faultInjectingClientFactory{
+		cf:       cf,
+		injector: injector,
+	}
+}
+
+// GetClient creates a client from the kubeconfig saved in the "kubeconfig" field of the given secret
+// that injects faults into its calls.
+func (f *faultInjectingClientFactory) GetClient(secret *corev1.Secret) (client.Client, string, error) {
+	c, namespace, err := f.cf.GetClient(secret)
+	if err != nil {
+		return nil, "", err
+	}
+	return &faultInjectingClient{Client: c, injector: f.injector}, namespace, nil
+}
+
+// Invalidate drops the cached client for the kubeconfig saved in the "kubeconfig" field of the given secret
+// if the underlying ClientFactory caches clients.
+func (f *faultInjectingClientFactory) Invalidate(secret *corev1.Secret) {
+	if invalidator, ok := f.cf.(cacheInvalidator); ok {
+		invalidator.Invalidate(secret)
+	}
+}
+
+type faultInjectingClient struct {
+	client.Client
+	injector FaultInjector
+}
+
+func (c *faultInjectingClient) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	return injectFault(ctx, c.injector, "get", obj, func() error { return c.Client.Get(ctx, key, obj) })
+}
+
+func (c *faultInjectingClient) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	return injectFault(ctx, c.injector, "list", list, func() error { return c.Client.List(ctx, list, opts...) })
+}
+
+func (c *faultInjectingClient) Create(ctx context.Context, obj runtime.Object, opts ...client.CreateOption) error {
+	return injectFault(ctx, c.injector, "create", obj, func() error { return c.Client.Create(ctx, obj, opts...) })
+}
+
+func (c *faultInjectingClient) Delete(ctx context.Context, obj runtime.Object, opts ...client.DeleteOption) error {
+	return injectFault(ctx, c.injector, "delete", obj, func() error { return c.Client.Delete(ctx, obj, opts...) })
+}
+
+func (c *faultInjectingClient) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	return injectFault(ctx, c.injector, "update", obj, func() error { return c.Client.Update(ctx, obj, opts...) })
+}
+
+func (c *faultInjectingClient) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return injectFault(ctx, c.injector, "patch", obj, func() error { return c.Client.Patch(ctx, obj, patch, opts...) })
+}
+
+func (c *faultInjectingClient) DeleteAllOf(ctx context.Context, obj runtime.Object, opts ...client.DeleteAllOfOption) error {
+	return injectFault(ctx, c.injector, "deletecollection", obj, func() error { return c.Client.DeleteAllOf(ctx, obj, opts...) })
+}
+
+func (c *faultInjectingClient) Status() client.StatusWriter {
+	return &faultInjectingStatusWriter{StatusWriter: c.Client.Status(), injector: c.injector}
+}
+
+type faultInjectingStatusWriter struct {
+	client.StatusWriter
+	injector FaultInjector
+}
+
+func (w *faultInjectingStatusWriter) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	return injectFault(ctx, w.injector, "update", obj, func() error { return w.StatusWriter.Update(ctx, obj, opts...) })
+}
+
+func (w *faultInjectingStatusWriter) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return injectFault(ctx, w.injector, "patch", obj, func() error { return w.StatusWriter.Patch(ctx, obj, patch, opts...) })
+}
+
+// injectFault performs the given call of the given verb on the given object with the fault decided by the given
+// FaultInjector, if any.
+func injectFault(ctx context.Context, injector FaultInjector, verb string, obj runtime.Object, call func() error) error {
+	fault := injector.Inject(verb, obj)
+	if fault == nil {
+		return call()
+	}
+	if fault.Delay > 0 {
+		timer := time.NewTimer(fault.Delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if fault.Err == nil {
+		return call()
+	}
+	if fault.Partial {
+		if err := call(); err != nil {
+			return err
+		}
+	}
+	return fault.Err
+}
+
+// randomFaultInjector is a FaultInjector that injects API errors, delays and partial failures at random
+// into the calls of the given verbs.
+type randomFaultInjector struct {
+	errorRate   float64
+	delayRate   float64
+	delay       time.Duration
+	partialRate float64
+	verbs       map[string]bool
+
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+// ParseFaultInjector returns a FaultInjector that injects faults at random as configured by the given spec,
+// a comma-separated list of the following options:
+//   - errorRate=<0..1>: the rate of calls that fail with a transient API error
+//   - delayRate=<0..1>: the rate of calls that are delayed
+//   - delay=<duration>: the maximum delay of a delayed call, 1s by default
+//   - partialRate=<0..1>: the rate of writes that are performed but fail with a transient API error
+//   - verbs=<verb>|<verb>...: the verbs of the calls to inject faults into, all by default
+//   - seed=<int>: the seed of the random faults, to reproduce a run
+func ParseFaultInjector(spec string) (FaultInjector, error) {
+	injector := &randomFaultInjector{delay: time.Second}
+	seed := time.Now().UnixNano()
+	for _, option := range strings.Split(spec, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid fault injection option %q, expected <name>=<value>", option)
+		}
+		name, value := parts[0], parts[1]
+		var err error
+		switch name {
+		case "errorRate":
+			injector.errorRate, err = parseRate(value)
+		case "delayRate":
+			injector.delayRate, err = parseRate(value)
+		case "partialRate":
+			injector.partialRate, err = parseRate(value)
+		case "delay":
+			injector.delay, err = time.ParseDuration(value)
+		case "verbs":
+			injector.verbs = map[string]bool{}
+			for _, verb := range strings.Split(value, "|") {
+				injector.verbs[verb] = true
+			}
+		case "seed":
+			seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return nil, fmt.Errorf("unknown fault injection option %q", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault injection option %q: %v", option, err)
+		}
+	}
+	injector.rand = rand.New(rand.NewSource(seed))
+	return injector, nil
+}
+
+func parseRate(value string) (float64, error) {
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("rate must be between 0 and 1")
+	}
+	return rate, nil
+}
+
+// Inject returns a random fault for a call with the given verb on the given object.
+func (i *randomFaultInjector) Inject(verb string, obj runtime.Object) *Fault {
+	if i.verbs != nil && !i.verbs[verb] {
+		return nil
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	fault := &Fault{}
+	if i.rand.Float64() < i.delayRate && i.delay > 0 {
+		fault.Delay = time.Duration(i.rand.Int63n(int64(i.delay)))
+	}
+	switch {
+	case i.rand.Float64() < i.errorRate:
+		fault.Err = i.randomError(verb, obj)
+	case isWriteVerb(verb) && i.rand.Float64() < i.partialRate:
+		fault.Err = kerrors.NewServerTimeout(resourceOf(obj), verb, 1)
+		fault.Partial = true
+	}
+	if fault.Delay == 0 && fault.Err == nil {
+		return nil
+	}
+	return fault
+}
+
+func (i *randomFaultInjector) randomError(verb string, obj runtime.Object) error {
+	switch i.rand.Intn(4) {
+	case 0:
+		return kerrors.NewServiceUnavailable("injected fault")
+	case 1:
+		return kerrors.NewTooManyRequests("injected fault", 1)
+	case 2:
+		return kerrors.NewServerTimeout(resourceOf(obj), verb, 1)
+	default:
+		return kerrors.NewInternalError(fmt.Errorf("injected fault"))
+	}
+}
+
+func isWriteVerb(verb string) bool {
+	return verb != "get" && verb != "list"
+}
+
+func resourceOf(obj runtime.Object) schema.GroupResource {
+	gvk := obj.GetObjectKind().GroupVersionKind()
+	return schema.GroupResource{Group: gvk.Group, Resource: strings.ToLower(gvk.Kind)}
+}
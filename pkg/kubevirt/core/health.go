@@ -0,0 +1,174 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// healthCheckTimeout is the timeout of the health check of all provider clusters,
+// which is shorter than the timeout of the readiness probe.
+const healthCheckTimeout = 10 * time.Second
+
+// requiredPermissions are the verbs on resources of provider clusters that the provider needs to manage machines.
+var requiredPermissions = []authorizationv1.ResourceAttributes{
+	{Group: kubevirtv1.GroupName, Resource: "virtualmachines", Verb: "create"},
+	{Group: kubevirtv1.GroupName, Resource: "virtualmachines", Verb: "delete"},
+	{Group: kubevirtv1.GroupName, Resource: "virtualmachines", Verb: "patch"},
+	{Group: "cdi.kubevirt.io", Resource: "datavolumes", Verb: "list"},
+	{Group: "", Resource: "secrets", Verb: "create"},
+}
+
+type observedCluster struct {
+	secret   *corev1.Secret
+	lastUsed time.Time
+}
+
+// HealthChecker is a ClientFactory that remembers the provider clusters it creates clients for, so that their
+// connectivity and the permissions of the provider in them can be checked by readiness probes. It is safe for concurrent use.
+type HealthChecker struct {
+	cf       ClientFactory
+	mutex    sync.Mutex
+	clusters map[[sha256.Size]byte]*observedCluster
+}
+
+// NewHealthChecker returns a HealthChecker that creates clients with the given ClientFactory.
+func NewHealthChecker(cf ClientFactory) *HealthChecker {
+	return &HealthChecker{
+		cf:       cf,
+		clusters: map[[sha256.Size]byte]*observedCluster{},
+	}
+}
+
+// GetClient creates a client from the kubeconfig saved in the "kubeconfig" field of the given secret with the
+// underlying ClientFactory and remembers the provider cluster of the kubeconfig.
+func (h *HealthChecker) GetClient(secret *corev1.Secret) (client.Client, string, error) {
+	h.mutex.Lock()
+	h.clusters[sha256.Sum256(secret.Data["kubeconfig"])] = &observedCluster{secret: secret.DeepCopy(), lastUsed: time.Now()}
+	h.mutex.Unlock()
+	return h.cf.GetClient(secret)
+}
+
+// Invalidate forgets the provider cluster of the kubeconfig saved in the "kubeconfig" field of the given secret,
+// e.g. after it was rotated, and drops its cached client if the underlying ClientFactory caches clients.
+func (h *HealthChecker) Invalidate(secret *corev1.Secret) {
+	h.mutex.Lock()
+	delete(h.clusters, sha256.Sum256(secret.Data["kubeconfig"]))
+	h.mutex.Unlock()
+	if invalidator, ok := h.cf.(cacheInvalidator); ok {
+		invalidator.Invalidate(secret)
+	}
+}
+
+// Check checks that the provider clusters used within the last hour are reachable and that the provider has the
+// permissions it needs in their namespaces. The clusters are checked in parallel within healthCheckTimeout.
+// It succeeds if no provider cluster was used yet.
+func (h *HealthChecker) Check(ctx context.Context) error {
+	now := time.Now()
+	var secrets []*corev1.Secret
+	h.mutex.Lock()
+	for key, cluster := range h.clusters {
+		if now.Sub(cluster.lastUsed) > clientCacheTTL {
+			delete(h.clusters, key)
+			continue
+		}
+		secrets = append(secrets, cluster.secret)
+	}
+	h.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errMutex sync.Mutex
+		errs     []string
+	)
+	for _, secret := range secrets {
+		wg.Add(1)
+		go func(secret *corev1.Secret) {
+			defer wg.Done()
+			if err := h.checkCluster(ctx, secret); err != nil {
+				errMutex.Lock()
+				errs = append(errs, err.Error())
+				errMutex.Unlock()
+			}
+		}(secret)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d provider clusters are not healthy: %s", len(errs), len(secrets), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// checkCluster checks that the provider cluster of the kubeconfig saved in the "kubeconfig" field of the given secret
+// is reachable and that the provider has the required permissions in the namespace of the kubeconfig.
+func (h *HealthChecker) checkCluster(ctx context.Context, secret *corev1.Secret) error {
+	c, namespace, err := h.cf.GetClient(secret)
+	if err != nil {
+		return fmt.Errorf("failed to create client: %w", err)
+	}
+
+	if err := c.List(ctx, &kubevirtv1.VirtualMachineList{}, client.InNamespace(namespace), client.Limit(1)); err != nil {
+		return fmt.Errorf("failed to list VirtualMachines in namespace %s: %w", namespace, err)
+	}
+
+	for _, permission := range requiredPermissions {
+		attributes := permission
+		attributes.Namespace = namespace
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: &attributes},
+		}
+		if err := c.Create(ctx, review); err != nil {
+			return fmt.Errorf("failed to review access in namespace %s: %w", namespace, err)
+		}
+		if !review.Status.Allowed {
+			return fmt.Errorf("not allowed to %s %s in namespace %s", attributes.Verb, attributes.Resource, namespace)
+		}
+	}
+	return nil
+}
+
+// HealthzHandler returns a handler for liveness probes, which succeeds as long as the process serves requests.
+func HealthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+}
+
+// ReadyzHandler returns a handler for readiness probes, which fails if the check of the given HealthChecker fails.
+func ReadyzHandler(h *HealthChecker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := h.Check(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+}
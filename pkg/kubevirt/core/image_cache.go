@@ -0,0 +1,107 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	cdi "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// imageCacheLabel is the label added to the image cache DataVolumes created by the provider.
+const imageCacheLabel = "kubevirt.provider.extensions.gardener.cloud/image-cache"
+
+// getImageCache returns the name of the DataVolume named after the given machine class that root disks
+// should be cloned from, or an empty string if root disks should be imported from the source URL.
+// If image caching is enabled, it also creates the cache DataVolume if it doesn't exist yet,
+// and deletes it if it no longer matches the provider spec so that it is recreated on the next call.
+func (p PluginSPIImpl) getImageCache(ctx context.Context, c client.Client, machineClassName, namespace string, providerSpec *api.KubeVirtProviderSpec) (string, error) {
+	if machineClassName == "" {
+		return "", nil
+	}
+
+	dataVolume := &cdi.DataVolume{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: machineClassName}, dataVolume); err != nil {
+		if !kerrors.IsNotFound(err) {
+			return "", fmt.Errorf("failed to get DataVolume: %w", err)
+		}
+		if providerSpec.CacheSourceImage {
+			if err := p.createImageCache(ctx, c, machineClassName, namespace, providerSpec); err != nil {
+				return "", err
+			}
+		}
+		return "", nil
+	}
+
+	if _, ok := dataVolume.Labels[imageCacheLabel]; ok && !isImageCacheUpToDate(dataVolume, providerSpec) {
+		logging.FromContext(ctx).V(2).Info("image cache DataVolume is outdated, deleting it", "dataVolume", dataVolume.Name)
+		if err := client.IgnoreNotFound(c.Delete(ctx, dataVolume)); err != nil {
+			return "", fmt.Errorf("failed to delete outdated image cache DataVolume %s: %w", dataVolume.Name, err)
+		}
+		return "", nil
+	}
+
+	if dataVolume.Status.Phase != cdi.Succeeded {
+		logging.FromContext(ctx).V(2).Info("image cache DataVolume is not ready, importing root disk from the source URL", "dataVolume", dataVolume.Name, "phase", dataVolume.Status.Phase)
+		return "", nil
+	}
+
+	return dataVolume.Name, nil
+}
+
+// createImageCache creates a DataVolume named after the given machine class that imports the source image.
+func (p PluginSPIImpl) createImageCache(ctx context.Context, c client.Client, machineClassName, namespace string, providerSpec *api.KubeVirtProviderSpec) error {
+	dataVolume := &cdi.DataVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      machineClassName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				machineClassLabel: machineClassName,
+				imageCacheLabel:   "true",
+			},
+		},
+		Spec: buildDataVolumeSpec(providerSpec),
+	}
+
+	if err := c.Create(ctx, dataVolume); err != nil && !kerrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create image cache DataVolume %s: %w", machineClassName, err)
+	}
+	logging.FromContext(ctx).V(2).Info("image cache DataVolume created", "dataVolume", machineClassName)
+
+	return nil
+}
+
+// isImageCacheUpToDate checks whether the given image cache DataVolume still imports the source image
+// of the provider spec, and is not larger than the root disks that are cloned from it.
+func isImageCacheUpToDate(dataVolume *cdi.DataVolume, providerSpec *api.KubeVirtProviderSpec) bool {
+	if !apiequality.Semantic.DeepEqual(dataVolume.Spec.Source, buildDataVolumeSource(providerSpec)) {
+		return false
+	}
+	if dataVolume.Spec.PVC == nil {
+		return false
+	}
+	size := dataVolume.Spec.PVC.Resources.Requests[corev1.ResourceStorage]
+	return size.Cmp(providerSpec.PVCSize) <= 0
+}
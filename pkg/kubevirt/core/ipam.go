@@ -0,0 +1,252 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// ipAddressesAnnotation is the annotation on VMs that contains the static IP addresses allocated for them,
+	// as a JSON object mapping network names to addresses in CIDR notation.
+	ipAddressesAnnotation = "kubevirt.provider.extensions.gardener.cloud/ip-addresses"
+	// ipReservationTTL is how long an allocated IP address is reserved in memory until it is expected
+	// to be visible in the annotation of the created VM.
+	ipReservationTTL = 10 * time.Minute
+)
+
+// IPAllocator allocates static IP addresses for machines.
+type IPAllocator interface {
+	// AllocateIP allocates a free IP address of the given IPAM configuration for the network with the given name
+	// in the given namespace. The given set contains the IP addresses of the network that are already in use.
+	AllocateIP(namespace, networkName string, ipam *api.IPAMSpec, used sets.String) (net.IP, error)
+	// ReleaseIP releases the given IP address allocated for the network with the given name in the given namespace,
+	// e.g. because the VM it was allocated for could not be created.
+	ReleaseIP(namespace, networkName string, ipam *api.IPAMSpec, ip net.IP)
+}
+
+// rangeIPAllocator allocates the first free IP address of the configured range.
+// Allocated addresses are reserved in memory for a while, so that concurrent allocations
+// don't return the same address before it shows up in the annotations of the created VMs.
+type rangeIPAllocator struct {
+	mutex        sync.Mutex
+	reservations map[string]time.Time
+}
+
+// NewRangeIPAllocator creates a new IPAllocator that allocates the first free IP address of the configured range.
+func NewRangeIPAllocator() IPAllocator {
+	return &rangeIPAllocator{
+		reservations: map[string]time.Time{},
+	}
+}
+
+// AllocateIP allocates a free IP address of the given IPAM configuration for the network with the given name
+// in the given namespace.
+func (a *rangeIPAllocator) AllocateIP(namespace, networkName string, ipam *api.IPAMSpec, used sets.String) (net.IP, error) {
+	first, last, err := getIPRange(ipam)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	for key, expiration := range a.reservations {
+		if now.After(expiration) {
+			delete(a.reservations, key)
+		}
+	}
+
+	// The loop ends after checking the last address, as incrementing it overflows for 255.255.255.255
+	for i := ipToUint32(first); ; i++ {
+		ip := uint32ToIP(i)
+		key := ipReservationKey(namespace, networkName, ipam, ip)
+		if !used.Has(ip.String()) && ip.String() != ipam.Gateway {
+			if _, ok := a.reservations[key]; !ok {
+				a.reservations[key] = now.Add(ipReservationTTL)
+				return ip, nil
+			}
+		}
+		if i == ipToUint32(last) {
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("no free IP address left in range %s-%s of network %s", first, last, networkName)
+}
+
+// ReleaseIP releases the given IP address allocated for the network with the given name in the given namespace.
+func (a *rangeIPAllocator) ReleaseIP(namespace, networkName string, ipam *api.IPAMSpec, ip net.IP) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.reservations, ipReservationKey(namespace, networkName, ipam, ip))
+}
+
+// ipReservationKey returns the key of the reservation of the given IP address of the network with the given name
+// and IPAM configuration in the given namespace, as networks with the same name in different namespaces, e.g. of
+// different shoots, or with different CIDRs don't share their addresses.
+func ipReservationKey(namespace, networkName string, ipam *api.IPAMSpec, ip net.IP) string {
+	return fmt.Sprintf("%s/%s/%s/%s", namespace, networkName, ipam.CIDR, ip)
+}
+
+// getIPRange returns the first and last IP address that can be allocated for the given IPAM configuration.
+func getIPRange(ipam *api.IPAMSpec) (net.IP, net.IP, error) {
+	_, subnet, err := net.ParseCIDR(ipam.CIDR)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse CIDR %q: %w", ipam.CIDR, err)
+	}
+	if subnet.IP.To4() == nil {
+		return nil, nil, fmt.Errorf("CIDR %q is not an IPv4 subnet", ipam.CIDR)
+	}
+
+	network := ipToUint32(subnet.IP)
+	broadcast := network | ^binary.BigEndian.Uint32(subnet.Mask)
+	first, last := uint32ToIP(network+1), uint32ToIP(broadcast-1)
+
+	if ipam.RangeStart != "" {
+		if first = net.ParseIP(ipam.RangeStart).To4(); first == nil || !subnet.Contains(first) {
+			return nil, nil, fmt.Errorf("range start %q is not an IP address of subnet %s", ipam.RangeStart, ipam.CIDR)
+		}
+	}
+	if ipam.RangeEnd != "" {
+		if last = net.ParseIP(ipam.RangeEnd).To4(); last == nil || !subnet.Contains(last) {
+			return nil, nil, fmt.Errorf("range end %q is not an IP address of subnet %s", ipam.RangeEnd, ipam.CIDR)
+		}
+	}
+	if ipToUint32(first) > ipToUint32(last) {
+		return nil, nil, fmt.Errorf("range %s-%s of subnet %s is empty", first, last, ipam.CIDR)
+	}
+
+	return first, last, nil
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(i uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, i)
+	return ip
+}
+
+// allocateIPAddresses allocates static IP addresses for all networks of the given network specs that have an IPAM configuration.
+// It returns the allocated addresses in CIDR notation, mapped by network name. The addresses of the given existing VM
+// are returned instead if it has any, so that retried creations of a VM neither allocate nor reserve new addresses.
+func (p PluginSPIImpl) allocateIPAddresses(ctx context.Context, c client.Client, namespace string, networkSpecs []api.NetworkSpec, existing *kubevirtv1.VirtualMachine) (map[string]string, error) {
+	var hasIPAM bool
+	for _, networkSpec := range networkSpecs {
+		if networkSpec.IPAM != nil {
+			hasIPAM = true
+			break
+		}
+	}
+	if !hasIPAM {
+		return nil, nil
+	}
+
+	if existing != nil {
+		if ipAddresses, err := getIPAddresses(existing); err != nil {
+			return nil, err
+		} else if len(ipAddresses) > 0 {
+			return ipAddresses, nil
+		}
+	}
+
+	virtualMachineList, err := p.listVMs(ctx, c, namespace, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ipAddresses := map[string]string{}
+	for _, networkSpec := range networkSpecs {
+		if networkSpec.IPAM == nil {
+			continue
+		}
+
+		used := getUsedIPAddresses(virtualMachineList.Items, networkSpec.Name)
+		ip, err := p.ipAllocator.AllocateIP(namespace, networkSpec.Name, networkSpec.IPAM, used)
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate IP address: %w", err)
+		}
+
+		_, subnet, _ := net.ParseCIDR(networkSpec.IPAM.CIDR)
+		prefixLength, _ := subnet.Mask.Size()
+		ipAddresses[networkSpec.Name] = fmt.Sprintf("%s/%d", ip, prefixLength)
+		logging.FromContext(ctx).V(2).Info("allocated IP address", "ipAddress", ipAddresses[networkSpec.Name], "network", networkSpec.Name)
+	}
+
+	return ipAddresses, nil
+}
+
+// releaseIPAddresses releases the IP addresses allocated for the given VM, which could not be created.
+func (p PluginSPIImpl) releaseIPAddresses(virtualMachine *kubevirtv1.VirtualMachine, networkSpecs []api.NetworkSpec) {
+	ipAddresses, err := getIPAddresses(virtualMachine)
+	if err != nil {
+		return
+	}
+	for _, networkSpec := range networkSpecs {
+		if networkSpec.IPAM == nil {
+			continue
+		}
+		if ip, _, err := net.ParseCIDR(ipAddresses[networkSpec.Name]); err == nil {
+			p.ipAllocator.ReleaseIP(virtualMachine.Namespace, networkSpec.Name, networkSpec.IPAM, ip)
+		}
+	}
+}
+
+// getIPAddresses returns the IP addresses allocated for the given VM in CIDR notation, mapped by network name.
+func getIPAddresses(virtualMachine *kubevirtv1.VirtualMachine) (map[string]string, error) {
+	value, ok := virtualMachine.Annotations[ipAddressesAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	var ipAddresses map[string]string
+	if err := json.Unmarshal([]byte(value), &ipAddresses); err != nil {
+		return nil, fmt.Errorf("could not parse IP addresses of VirtualMachine %s: %w", virtualMachine.Name, err)
+	}
+	return ipAddresses, nil
+}
+
+// getUsedIPAddresses returns the IP addresses allocated for the given VMs on the network with the given name.
+func getUsedIPAddresses(virtualMachines []kubevirtv1.VirtualMachine, networkName string) sets.String {
+	used := sets.NewString()
+	for i := range virtualMachines {
+		ipAddresses, err := getIPAddresses(&virtualMachines[i])
+		if err != nil {
+			logging.Logger{}.Error(err, "could not get IP addresses of VirtualMachine", "vm", virtualMachines[i].Name)
+			continue
+		}
+		if ip, _, err := net.ParseCIDR(ipAddresses[networkName]); err == nil {
+			used.Insert(ip.String())
+		}
+	}
+	return used
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// maintenanceInterval is the minimum interval between runs of each periodic maintenance task of ListMachines per provider
+// cluster and namespace, i.e. the cleanup of orphans, the labelling of legacy VMs and the migration of VMs from cordoned
+// nodes, which list and get many objects from the API server while the VMs themselves are listed from a cache.
+const maintenanceInterval = 5 * time.Minute
+
+// The periodic maintenance tasks of ListMachines.
+const (
+	// maintenanceTaskCleanup is the cleanup of orphans in a namespace.
+	maintenanceTaskCleanup = "cleanup"
+	// maintenanceTaskLegacyVMs is the labelling of the VMs of a machine class created by former versions of the provider.
+	maintenanceTaskLegacyVMs = "legacy-vms"
+	// maintenanceTaskMigration is the migration of the VMs of a machine class away from cordoned nodes.
+	maintenanceTaskMigration = "migration"
+)
+
+// maintenanceKey identifies a maintenance task in a namespace of a provider cluster, by the hash of its kubeconfig.
+type maintenanceKey struct {
+	kubeconfig [sha256.Size]byte
+	namespace  string
+	task       string
+}
+
+// maintenanceLimiter limits how often the periodic maintenance tasks run.
+type maintenanceLimiter struct {
+	interval time.Duration
+
+	mutex    sync.Mutex
+	lastRuns map[maintenanceKey]time.Time
+}
+
+// newMaintenanceLimiter creates a maintenanceLimiter that allows each task once per the given interval.
+func newMaintenanceLimiter(interval time.Duration) *maintenanceLimiter {
+	return &maintenanceLimiter{
+		interval: interval,
+		lastRuns: map[maintenanceKey]time.Time{},
+	}
+}
+
+// allow returns whether the given task may run in the given namespace of the provider cluster of the kubeconfig saved
+// in the "kubeconfig" field of the given secret, and records the run if so.
+func (l *maintenanceLimiter) allow(secret *corev1.Secret, namespace, task string) bool {
+	key := maintenanceKey{kubeconfig: sha256.Sum256(secret.Data["kubeconfig"]), namespace: namespace, task: task}
+	now := time.Now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if lastRun, ok := l.lastRuns[key]; ok && now.Sub(lastRun) < l.interval {
+		return false
+	}
+	l.lastRuns[key] = now
+	return true
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// migrationBackoff is the duration for which VMs are not migrated away from cordoned nodes again after
+// a migration of their VMI failed, as failed migrations are final and would be recreated on every call otherwise.
+const migrationBackoff = 10 * time.Minute
+
+// migrateVM creates a VirtualMachineInstanceMigration for the VMI of the given VM, unless a migration of it is already
+// in progress. It returns whether a migration was created.
+func (p PluginSPIImpl) migrateVM(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine) (bool, error) {
+	migrations, err := listMigrations(ctx, c, virtualMachine.Namespace)
+	if err != nil {
+		return false, err
+	}
+	return p.createMigration(ctx, c, virtualMachine, migrations)
+}
+
+// createMigration creates a VirtualMachineInstanceMigration for the VMI of the given VM, unless one of the given
+// migrations of the namespace of the VM is in progress for it. It returns whether a migration was created.
+func (p PluginSPIImpl) createMigration(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine, migrations []kubevirtv1.VirtualMachineInstanceMigration) (bool, error) {
+	for i := range migrations {
+		if migration := &migrations[i]; migration.Spec.VMIName == virtualMachine.Name && !migration.IsFinal() {
+			logging.FromContext(ctx).V(2).Info("migration of VirtualMachine is already in progress", "migration", migration.Name, "vm", virtualMachine.Name)
+			return false, nil
+		}
+	}
+
+	migration := &kubevirtv1.VirtualMachineInstanceMigration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            fmt.Sprintf("%s-migration-%d", virtualMachine.Name, time.Now().Unix()),
+			Namespace:       virtualMachine.Namespace,
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(virtualMachine, kubevirtv1.VirtualMachineGroupVersionKind)},
+		},
+		Spec: kubevirtv1.VirtualMachineInstanceMigrationSpec{
+			VMIName: virtualMachine.Name,
+		},
+	}
+	if err := c.Create(ctx, migration); err != nil {
+		return false, fmt.Errorf("failed to create VirtualMachineInstanceMigration: %w", err)
+	}
+	return true, nil
+}
+
+// listMigrations lists the VirtualMachineInstanceMigrations in the given namespace.
+func listMigrations(ctx context.Context, c client.Client, namespace string) ([]kubevirtv1.VirtualMachineInstanceMigration, error) {
+	migrationList := &kubevirtv1.VirtualMachineInstanceMigrationList{}
+	if err := c.List(ctx, migrationList, client.InNamespace(namespace)); err != nil {
+		return nil, fmt.Errorf("failed to list VirtualMachineInstanceMigrations: %w", err)
+	}
+	return migrationList.Items, nil
+}
+
+// migrateVMsFromCordonedNodes migrates the running VMIs of the given VMs that are placed on cordoned nodes,
+// e.g. because the nodes are going into maintenance, so that the workers don't get evicted and recreated.
+// VMIs that are not live migratable are skipped, as well as VMIs whose last migration failed recently.
+// Errors of single VMs are logged, so that they don't prevent the migration of the others.
+func (p PluginSPIImpl) migrateVMsFromCordonedNodes(ctx context.Context, c client.Client, virtualMachines []kubevirtv1.VirtualMachine) error {
+	var (
+		nodes      = map[string]*corev1.Node{}
+		migrations []kubevirtv1.VirtualMachineInstanceMigration
+		listed     bool
+	)
+	for i := range virtualMachines {
+		virtualMachine := &virtualMachines[i]
+
+		virtualMachineInstance := &kubevirtv1.VirtualMachineInstance{}
+		if err := c.Get(ctx, types.NamespacedName{Namespace: virtualMachine.Namespace, Name: virtualMachine.Name}, virtualMachineInstance); err != nil {
+			if !kerrors.IsNotFound(err) {
+				logging.FromContext(ctx).Error(err, "could not get VirtualMachineInstance", "vm", virtualMachine.Name)
+			}
+			continue
+		}
+		nodeName := virtualMachineInstance.Status.NodeName
+		if virtualMachineInstance.Status.Phase != kubevirtv1.Running || nodeName == "" {
+			continue
+		}
+
+		node, ok := nodes[nodeName]
+		if !ok {
+			node = &corev1.Node{}
+			if err := c.Get(ctx, types.NamespacedName{Name: nodeName}, node); err != nil {
+				logging.FromContext(ctx).Error(err, "could not get node of VirtualMachineInstance", "vm", virtualMachine.Name, "node", nodeName)
+				continue
+			}
+			nodes[nodeName] = node
+		}
+		if !node.Spec.Unschedulable {
+			continue
+		}
+
+		if !isLiveMigratable(virtualMachineInstance) {
+			logging.FromContext(ctx).V(2).Info("VirtualMachine on cordoned node is not live migratable", "vm", virtualMachine.Name, "node", nodeName)
+			continue
+		}
+
+		if !listed {
+			var err error
+			if migrations, err = listMigrations(ctx, c, virtualMachine.Namespace); err != nil {
+				return err
+			}
+			listed = true
+		}
+		if failed := getLastFailedMigration(migrations, virtualMachine.Name); failed != nil && time.Since(failed.CreationTimestamp.Time) < migrationBackoff {
+			logging.FromContext(ctx).V(2).Info("backing off from migrating VirtualMachine after failed migration", "vm", virtualMachine.Name, "migration", failed.Name)
+			continue
+		}
+
+		migrated, err := p.createMigration(ctx, c, virtualMachine, migrations)
+		if err != nil {
+			logging.FromContext(ctx).Error(err, "could not migrate VirtualMachine away from cordoned node", "vm", virtualMachine.Name, "node", nodeName)
+			continue
+		}
+		if migrated {
+			logging.FromContext(ctx).V(2).Info("migrating VirtualMachine away from cordoned node", "vm", virtualMachine.Name, "node", nodeName)
+		}
+	}
+	return nil
+}
+
+// isLiveMigratable returns whether the given VMI has the LiveMigratable condition, without which KubeVirt rejects
+// its migrations.
+func isLiveMigratable(virtualMachineInstance *kubevirtv1.VirtualMachineInstance) bool {
+	for _, condition := range virtualMachineInstance.Status.Conditions {
+		if condition.Type == kubevirtv1.VirtualMachineInstanceIsMigratable {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// getLastFailedMigration returns the most recently created of the given migrations that failed for the VMI with
+// the given name, or nil if there is none.
+func getLastFailedMigration(migrations []kubevirtv1.VirtualMachineInstanceMigration, vmiName string) *kubevirtv1.VirtualMachineInstanceMigration {
+	var last *kubevirtv1.VirtualMachineInstanceMigration
+	for i := range migrations {
+		migration := &migrations[i]
+		if migration.Spec.VMIName != vmiName || migration.Status.Phase != kubevirtv1.MigrationFailed {
+			continue
+		}
+		if last == nil || last.CreationTimestamp.Before(&migration.CreationTimestamp) {
+			last = migration
+		}
+	}
+	return last
+}
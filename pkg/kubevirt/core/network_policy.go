@@ -0,0 +1,123 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// networkPolicyLabel is the label of the NetworkPolicies created by the provider, with the machine class as value.
+	networkPolicyLabel = "kubevirt.provider.extensions.gardener.cloud/network-policy"
+	// networkPolicyClusterLabel is the label of the virt-launcher pods of VMs with a NetworkPolicy,
+	// with the cluster name of the NetworkPolicy as value.
+	networkPolicyClusterLabel = "kubevirt.provider.extensions.gardener.cloud/cluster"
+	// networkPolicyCleanupDelay is the minimum age of NetworkPolicies of machine classes without VMs before they are
+	// deleted, so that NetworkPolicies created right before the first VM of a machine class are kept.
+	networkPolicyCleanupDelay = 10 * time.Minute
+)
+
+// buildNetworkPolicy builds the NetworkPolicy of the given machine class that selects the virt-launcher pods of its VMs
+// and allows the traffic from and to the virt-launcher pods of all machine classes of the same cluster, so that
+// the worker pools of a shoot can reach each other, as well as the traffic matching the rules of the given spec.
+func buildNetworkPolicy(machineClassName, namespace string, spec *api.NetworkPolicySpec) *networkingv1.NetworkPolicy {
+	clusterPods := []networkingv1.NetworkPolicyPeer{
+		{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{networkPolicyClusterLabel: spec.ClusterName}}},
+	}
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      machineClassName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				networkPolicyLabel: machineClassName,
+			},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{machineClassLabel: machineClassName}},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+			Ingress:     append([]networkingv1.NetworkPolicyIngressRule{{From: clusterPods}}, spec.Ingress...),
+			Egress:      append([]networkingv1.NetworkPolicyEgressRule{{To: clusterPods}}, spec.Egress...),
+		},
+	}
+}
+
+// ensureNetworkPolicy creates the NetworkPolicy of the given machine class, or updates it if its rules changed.
+func (p PluginSPIImpl) ensureNetworkPolicy(ctx context.Context, c client.Client, machineClassName, namespace string, spec *api.NetworkPolicySpec) error {
+	networkPolicy := buildNetworkPolicy(machineClassName, namespace, spec)
+
+	existing := &networkingv1.NetworkPolicy{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: machineClassName}, existing); err != nil {
+		if !kerrors.IsNotFound(err) {
+			return fmt.Errorf("failed to get NetworkPolicy %s: %w", machineClassName, err)
+		}
+		if err := c.Create(ctx, networkPolicy); err != nil && !kerrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create NetworkPolicy %s: %w", machineClassName, err)
+		}
+		return nil
+	}
+
+	if _, ok := existing.Labels[networkPolicyLabel]; !ok {
+		return fmt.Errorf("NetworkPolicy %s already exists and isn't managed by the provider", machineClassName)
+	}
+	if equality.Semantic.DeepEqual(existing.Spec, networkPolicy.Spec) {
+		return nil
+	}
+	existing.Spec = networkPolicy.Spec
+	if err := c.Update(ctx, existing); err != nil {
+		return fmt.Errorf("failed to update NetworkPolicy %s: %w", machineClassName, err)
+	}
+	logging.FromContext(ctx).V(2).Info("updated NetworkPolicy", "networkPolicy", machineClassName)
+	return nil
+}
+
+// cleanupNetworkPolicies deletes the NetworkPolicies created by the provider in the given namespace whose machine
+// classes have no VMs anymore.
+func (p PluginSPIImpl) cleanupNetworkPolicies(ctx context.Context, c client.Client, namespace string, machineClassNames sets.String) error {
+	hasNetworkPolicyLabel, err := hasLabel(networkPolicyLabel)
+	if err != nil {
+		return err
+	}
+
+	networkPolicyList := &networkingv1.NetworkPolicyList{}
+	if err := c.List(ctx, networkPolicyList, client.InNamespace(namespace), hasNetworkPolicyLabel); err != nil {
+		return fmt.Errorf("failed to list NetworkPolicies: %w", err)
+	}
+	for i := range networkPolicyList.Items {
+		networkPolicy := &networkPolicyList.Items[i]
+		if machineClassNames.Has(networkPolicy.Labels[networkPolicyLabel]) || time.Since(networkPolicy.CreationTimestamp.Time) < networkPolicyCleanupDelay {
+			continue
+		}
+
+		logging.FromContext(ctx).V(2).Info("deleting NetworkPolicy of machine class without VMs", "networkPolicy", networkPolicy.Name)
+		if err := client.IgnoreNotFound(c.Delete(ctx, networkPolicy)); err != nil {
+			return fmt.Errorf("failed to delete NetworkPolicy %s: %w", networkPolicy.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// gpuResourceName is the extended resource advertised by nodes with NVIDIA GPUs.
+const gpuResourceName corev1.ResourceName = "nvidia.com/gpu"
+
+// BuildNodeTemplate returns the node template of machines created from the given provider spec. The CPU capacity is
+// the number of vCPUs of the guest, the memory capacity its guest memory and the ephemeral storage the root disk size.
+func BuildNodeTemplate(providerSpec *api.KubeVirtProviderSpec) *api.NodeTemplate {
+	capacity := corev1.ResourceList{
+		corev1.ResourceCPU:              getGuestCPUs(providerSpec),
+		corev1.ResourceMemory:           getGuestMemory(providerSpec),
+		corev1.ResourceEphemeralStorage: providerSpec.PVCSize,
+	}
+
+	if len(providerSpec.ExtendedResources) > 0 {
+		for name, quantity := range providerSpec.ExtendedResources {
+			capacity[name] = quantity
+		}
+	} else if len(providerSpec.GPUs) > 0 {
+		capacity[gpuResourceName] = *resource.NewQuantity(int64(len(providerSpec.GPUs)), resource.DecimalSI)
+	}
+
+	return &api.NodeTemplate{
+		Capacity: capacity,
+		Region:   providerSpec.Region,
+		Zone:     providerSpec.Zone,
+	}
+}
+
+// getGuestCPUs returns the number of vCPUs of the guest, which is given by the CPU topology if specified
+// and by the CPU limit or request, rounded up, otherwise.
+func getGuestCPUs(providerSpec *api.KubeVirtProviderSpec) resource.Quantity {
+	if cpu := providerSpec.CPU; cpu != nil && cpu.Cores > 0 {
+		vcpus := int64(cpu.Cores)
+		if cpu.Sockets > 0 {
+			vcpus *= int64(cpu.Sockets)
+		}
+		if cpu.Threads > 0 {
+			vcpus *= int64(cpu.Threads)
+		}
+		return *resource.NewQuantity(vcpus, resource.DecimalSI)
+	}
+
+	quantity, ok := providerSpec.Resources.Limits[corev1.ResourceCPU]
+	if !ok {
+		quantity = providerSpec.Resources.Requests[corev1.ResourceCPU]
+	}
+	return *resource.NewQuantity((quantity.MilliValue()+999)/1000, resource.DecimalSI)
+}
+
+// getGuestMemory returns the memory of the guest, which is given by the guest memory if specified
+// and by the memory limit or request otherwise.
+func getGuestMemory(providerSpec *api.KubeVirtProviderSpec) resource.Quantity {
+	if providerSpec.Memory != nil && providerSpec.Memory.Guest != nil {
+		return *providerSpec.Memory.Guest
+	}
+	if quantity, ok := providerSpec.Resources.Limits[corev1.ResourceMemory]; ok {
+		return quantity
+	}
+	return providerSpec.Resources.Requests[corev1.ResourceMemory]
+}
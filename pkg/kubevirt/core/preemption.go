@@ -0,0 +1,126 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+
+	clouderrors "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/errors"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// preemptibleLabel is the label on preemptible VMs and their VMIs.
+	preemptibleLabel = "kubevirt.provider.extensions.gardener.cloud/preemptible"
+	// runningVMIAnnotation is the annotation on preemptible VMs that contains the UID of their VMI last observed running.
+	// Unlike the status annotation, it is kept while the VMI is evicted and recreated by KubeVirt, and it is only reset
+	// when the provider starts or restarts the VM.
+	runningVMIAnnotation = "kubevirt.provider.extensions.gardener.cloud/running-vmi"
+)
+
+// checkPreemption checks whether the VMI of the given preemptible VM failed or was evicted. If so, the VM is stopped, so that
+// it isn't restarted with a stale node once capacity frees up, and its status is recorded as preempted. It returns
+// a MachinePreemptedError for preempted VMs.
+func (p PluginSPIImpl) checkPreemption(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine) error {
+	if isPreemptedVM(virtualMachine) {
+		return &clouderrors.MachinePreemptedError{Name: virtualMachine.Name, Reason: virtualMachine.Annotations[statusMessageAnnotation]}
+	}
+
+	virtualMachineInstance := &kubevirtv1.VirtualMachineInstance{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: virtualMachine.Namespace, Name: virtualMachine.Name}, virtualMachineInstance); err != nil {
+		if !kerrors.IsNotFound(err) {
+			return fmt.Errorf("failed to get VirtualMachineInstance: %w", err)
+		}
+		virtualMachineInstance = nil
+	}
+
+	reason := getPreemptionReason(virtualMachine, virtualMachineInstance)
+	if reason == "" {
+		if uid := getRunningVMIToRecord(virtualMachine, virtualMachineInstance); uid != "" {
+			if err := applyVM(ctx, c, virtualMachine, runningVMIFieldManager, runningVMIFields(uid)); err != nil {
+				return fmt.Errorf("failed to record running VirtualMachineInstance of VirtualMachine %s: %w", virtualMachine.Name, err)
+			}
+		}
+		return nil
+	}
+	logging.FromContext(ctx).Info("VirtualMachine was preempted, stopping it", "vm", virtualMachine.Name, "reason", reason)
+
+	if err := applyVM(ctx, c, virtualMachine, runningFieldManager, runningFields(false)); err != nil {
+		return fmt.Errorf("failed to stop preempted VirtualMachine %s: %w", virtualMachine.Name, err)
+	}
+	if err := applyVM(ctx, c, virtualMachine, statusFieldManager, statusFields(vmStatusPreempted, reason)); err != nil {
+		return fmt.Errorf("failed to record status of VirtualMachine %s: %w", virtualMachine.Name, err)
+	}
+	p.recordEvent(ctx, c, virtualMachine, corev1.EventTypeWarning, eventReasonPreempted, "Stopped preempted VirtualMachine: %s", reason)
+	return &clouderrors.MachinePreemptedError{Name: virtualMachine.Name, Reason: reason}
+}
+
+// getPreemptionReason returns why the given VM was preempted, based on its VMI, which is nil if it doesn't exist,
+// or an empty string if it wasn't. A VM is preempted if its VMI failed, or if its VMI was observed running before
+// and was deleted or replaced by another VMI since without the VM being stopped, as KubeVirt recreates the VMIs
+// of running VMs after evictions.
+func getPreemptionReason(virtualMachine *kubevirtv1.VirtualMachine, virtualMachineInstance *kubevirtv1.VirtualMachineInstance) string {
+	if virtualMachineInstance != nil && virtualMachineInstance.Status.Phase == kubevirtv1.Failed {
+		return "VirtualMachineInstance failed"
+	}
+	running := virtualMachine.Spec.Running != nil && *virtualMachine.Spec.Running
+	runningVMI := virtualMachine.Annotations[runningVMIAnnotation]
+	if !running || runningVMI == "" {
+		return ""
+	}
+	if virtualMachineInstance == nil {
+		return "VirtualMachineInstance was deleted"
+	}
+	if string(virtualMachineInstance.UID) != runningVMI {
+		return "VirtualMachineInstance was evicted and recreated"
+	}
+	return ""
+}
+
+// getRunningVMIToRecord returns the UID of the given VMI if it is running and is the first running VMI of the given
+// preemptible VM since the VM was started, or an empty string otherwise.
+func getRunningVMIToRecord(virtualMachine *kubevirtv1.VirtualMachine, virtualMachineInstance *kubevirtv1.VirtualMachineInstance) string {
+	if _, ok := virtualMachine.Labels[preemptibleLabel]; !ok || virtualMachine.Annotations[runningVMIAnnotation] != "" {
+		return ""
+	}
+	if virtualMachineInstance == nil || virtualMachineInstance.DeletionTimestamp != nil || virtualMachineInstance.Status.Phase != kubevirtv1.Running {
+		return ""
+	}
+	return string(virtualMachineInstance.UID)
+}
+
+// resetRunningVMI resets the running VMI recorded for the given VM, before the provider starts or restarts it deliberately.
+func resetRunningVMI(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine) error {
+	if virtualMachine.Annotations[runningVMIAnnotation] == "" {
+		return nil
+	}
+	if err := applyVM(ctx, c, virtualMachine, runningVMIFieldManager, runningVMIFields("")); err != nil {
+		return fmt.Errorf("failed to reset running VirtualMachineInstance of VirtualMachine %s: %w", virtualMachine.Name, err)
+	}
+	return nil
+}
+
+// isPreemptedVM returns whether the given VM was stopped because it was preempted.
+func isPreemptedVM(virtualMachine *kubevirtv1.VirtualMachine) bool {
+	return virtualMachine.Annotations[statusAnnotation] == vmStatusPreempted &&
+		(virtualMachine.Spec.Running == nil || !*virtualMachine.Spec.Running)
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	clouderrors "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/errors"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// checkResourceQuotas checks whether creating a VM for the given provider spec and the resources belonging to it would exceed
+// any ResourceQuota of the given namespace, and returns a QuotaExceededError if so. The usage of the virt-launcher pod
+// doesn't include the overhead added by KubeVirt, hence only quotas that are certainly exceeded are detected.
+// The check is skipped if listing ResourceQuotas is forbidden.
+func (p PluginSPIImpl) checkResourceQuotas(ctx context.Context, c client.Client, namespace string, providerSpec *api.KubeVirtProviderSpec) error {
+	resourceQuotaList := &corev1.ResourceQuotaList{}
+	if err := c.List(ctx, resourceQuotaList, client.InNamespace(namespace)); err != nil {
+		if kerrors.IsForbidden(err) {
+			logging.FromContext(ctx).Error(err, "skipping ResourceQuota check, listing ResourceQuotas is forbidden")
+			return nil
+		}
+		return fmt.Errorf("failed to list ResourceQuotas: %w", err)
+	}
+
+	usage := buildQuotaUsage(providerSpec)
+	for _, resourceQuota := range resourceQuotaList.Items {
+		names := make([]string, 0, len(resourceQuota.Status.Hard))
+		for name := range resourceQuota.Status.Hard {
+			names = append(names, string(name))
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			requested, ok := usage[corev1.ResourceName(name)]
+			if !ok {
+				continue
+			}
+			hard := resourceQuota.Status.Hard[corev1.ResourceName(name)]
+			used := resourceQuota.Status.Used[corev1.ResourceName(name)]
+			total := used.DeepCopy()
+			total.Add(requested)
+			if total.Cmp(hard) > 0 {
+				return &clouderrors.QuotaExceededError{
+					Quota:     resourceQuota.Name,
+					Resource:  name,
+					Requested: requested.String(),
+					Used:      used.String(),
+					Hard:      hard.String(),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// buildQuotaUsage returns the quota usage of a VM created from the given provider spec,
+// i.e. of the VM, its root disk DataVolume and PVC, its userdata secret, its SSH service and its virt-launcher pod.
+func buildQuotaUsage(providerSpec *api.KubeVirtProviderSpec) corev1.ResourceList {
+	one := resource.MustParse("1")
+	usage := corev1.ResourceList{
+		"count/virtualmachines.kubevirt.io":   one,
+		"count/datavolumes.cdi.kubevirt.io":   one,
+		corev1.ResourcePods:                   one,
+		corev1.ResourceSecrets:                one,
+		corev1.ResourcePersistentVolumeClaims: one,
+		corev1.ResourceRequestsStorage:        providerSpec.PVCSize,
+		corev1.ResourceName(providerSpec.StorageClassName + ".storageclass.storage.k8s.io/persistentvolumeclaims"): one,
+		corev1.ResourceName(providerSpec.StorageClassName + ".storageclass.storage.k8s.io/requests.storage"):       providerSpec.PVCSize,
+	}
+	if providerSpec.SSHService != nil {
+		usage[corev1.ResourceServices] = one
+	}
+
+	resources := buildResources(providerSpec)
+	for name, quantity := range resources.Requests {
+		usage[corev1.ResourceName("requests."+string(name))] = quantity
+		if name == corev1.ResourceCPU || name == corev1.ResourceMemory {
+			usage[name] = quantity
+		}
+	}
+	for name, quantity := range resources.Limits {
+		usage[corev1.ResourceName("limits."+string(name))] = quantity
+	}
+	return usage
+}
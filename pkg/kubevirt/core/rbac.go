@@ -0,0 +1,140 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+//go:generate go run ../../../cmd/rbac-generator --output ../../../kubernetes/provider-cluster-rbac.yaml
+
+import (
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+)
+
+// ProviderClusterRules are the permissions the provider needs in the namespace of the VMs in provider clusters.
+// They have to cover all client calls of the provider, which the tests verify.
+var ProviderClusterRules = []rbacv1.PolicyRule{
+	{
+		APIGroups: []string{kubevirtv1.GroupName},
+		Resources: []string{"virtualmachines"},
+		Verbs:     []string{"get", "list", "watch", "create", "update", "patch", "delete"},
+	},
+	{
+		APIGroups: []string{kubevirtv1.GroupName},
+		Resources: []string{"virtualmachineinstances"},
+		Verbs:     []string{"get", "list", "watch", "delete"},
+	},
+	{
+		APIGroups: []string{kubevirtv1.GroupName},
+		Resources: []string{"virtualmachineinstancemigrations"},
+		Verbs:     []string{"list", "create"},
+	},
+	{
+		APIGroups: []string{"cdi.kubevirt.io"},
+		Resources: []string{"datavolumes"},
+		Verbs:     []string{"get", "list", "create", "delete"},
+	},
+	{
+		APIGroups: []string{""},
+		Resources: []string{"secrets"},
+		Verbs:     []string{"get", "list", "create", "update", "delete"},
+	},
+	{
+		APIGroups: []string{""},
+		Resources: []string{"persistentvolumeclaims"},
+		Verbs:     []string{"get", "update"},
+	},
+	{
+		APIGroups: []string{""},
+		Resources: []string{"services"},
+		Verbs:     []string{"get", "create"},
+	},
+	{
+		APIGroups: []string{""},
+		Resources: []string{"events"},
+		Verbs:     []string{"get", "create", "update"},
+	},
+	{
+		APIGroups: []string{"networking.k8s.io"},
+		Resources: []string{"networkpolicies"},
+		Verbs:     []string{"get", "list", "create", "update", "delete"},
+	},
+	{
+		APIGroups: []string{""},
+		Resources: []string{"configmaps"},
+		Verbs:     []string{"get"},
+	},
+	{
+		APIGroups: []string{""},
+		Resources: []string{"resourcequotas"},
+		Verbs:     []string{"list"},
+	},
+}
+
+// ProviderClusterClusterRules are the cluster-scoped permissions the provider needs in provider clusters. Nodes are
+// only read by capacity checks and migrations from cordoned nodes, access reviews are only created by readiness probes,
+// and Templates and VirtualMachines are only read as VM templates, which may be in other namespaces than the VMs,
+// e.g. the openshift namespace of the common-templates.
+var ProviderClusterClusterRules = []rbacv1.PolicyRule{
+	{
+		APIGroups: []string{""},
+		Resources: []string{"nodes"},
+		Verbs:     []string{"get", "list"},
+	},
+	{
+		APIGroups: []string{"authorization.k8s.io"},
+		Resources: []string{"selfsubjectaccessreviews"},
+		Verbs:     []string{"create"},
+	},
+	{
+		APIGroups: []string{"template.openshift.io"},
+		Resources: []string{"templates"},
+		Verbs:     []string{"get"},
+	},
+	{
+		APIGroups: []string{kubevirtv1.GroupName},
+		Resources: []string{"virtualmachines"},
+		Verbs:     []string{"get"},
+	},
+}
+
+// ProviderClusterRBAC returns a Role and RoleBinding in the given namespace and a ClusterRole and ClusterRoleBinding,
+// all with the given name, that grant the given subject the permissions the provider needs in a provider cluster.
+func ProviderClusterRBAC(name, namespace string, subject rbacv1.Subject) []runtime.Object {
+	return []runtime.Object{
+		&rbacv1.Role{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "Role"},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Rules:      ProviderClusterRules,
+		},
+		&rbacv1.RoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "RoleBinding"},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: name},
+			Subjects:   []rbacv1.Subject{subject},
+		},
+		&rbacv1.ClusterRole{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRole"},
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Rules:      ProviderClusterClusterRules,
+		},
+		&rbacv1.ClusterRoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRoleBinding"},
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: name},
+			Subjects:   []rbacv1.Subject{subject},
+		},
+	}
+}
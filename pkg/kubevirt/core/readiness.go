@@ -0,0 +1,89 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	cdi "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// pollInterval is the interval in which the state of VMs is checked while waiting for them to be ready or deleted.
+const pollInterval = 5 * time.Second
+
+// waitForVMReady waits until the root disk DataVolume of the given VM has been imported and its VMI is running.
+// It fails early if the import or the VMI failed, and after the given timeout otherwise.
+func (p PluginSPIImpl) waitForVMReady(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine, timeout time.Duration) error {
+	key := types.NamespacedName{Namespace: virtualMachine.Namespace, Name: virtualMachine.Name}
+
+	var dataVolumePhase cdi.DataVolumePhase
+	var vmiPhase kubevirtv1.VirtualMachineInstancePhase
+	err := wait.PollImmediate(pollInterval, timeout, func() (bool, error) {
+		dataVolumeStatus, err := p.getRootDiskStatus(ctx, c, virtualMachine)
+		if err != nil {
+			return false, err
+		}
+		dataVolumePhase = dataVolumeStatus.Phase
+
+		virtualMachineInstance := &kubevirtv1.VirtualMachineInstance{}
+		if err := c.Get(ctx, key, virtualMachineInstance); err != nil {
+			if kerrors.IsNotFound(err) {
+				return false, nil
+			}
+			return false, fmt.Errorf("failed to get VirtualMachineInstance: %w", err)
+		}
+		vmiPhase = virtualMachineInstance.Status.Phase
+		if vmiPhase == kubevirtv1.Failed {
+			return false, fmt.Errorf("VirtualMachineInstance %s failed", virtualMachine.Name)
+		}
+
+		logging.FromContext(ctx).V(3).Info("waiting for VirtualMachine to be ready",
+			"vm", virtualMachine.Name, "dataVolumePhase", dataVolumePhase, "vmiPhase", vmiPhase)
+		return dataVolumePhase == cdi.Succeeded && vmiPhase == kubevirtv1.Running, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return fmt.Errorf("VirtualMachine %s is not ready after %s, DataVolume phase: %q, VirtualMachineInstance phase: %q",
+			virtualMachine.Name, timeout, dataVolumePhase, vmiPhase)
+	}
+	return err
+}
+
+// getRootDiskStatus returns the status of the root disk DataVolume of the given VM, which is empty if the DataVolume
+// doesn't exist yet. It returns an error if the import of the root disk failed terminally.
+func (p PluginSPIImpl) getRootDiskStatus(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine) (cdi.DataVolumeStatus, error) {
+	dataVolume := &cdi.DataVolume{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: virtualMachine.Namespace, Name: virtualMachine.Name}, dataVolume); err != nil {
+		if kerrors.IsNotFound(err) {
+			return cdi.DataVolumeStatus{}, nil
+		}
+		return cdi.DataVolumeStatus{}, fmt.Errorf("failed to get DataVolume: %w", err)
+	}
+
+	if dataVolume.Status.Phase == cdi.Failed {
+		p.recordEvent(ctx, c, virtualMachine, corev1.EventTypeWarning, eventReasonImportFailed, "Import of root disk DataVolume %s failed", dataVolume.Name)
+		return dataVolume.Status, fmt.Errorf("import of DataVolume %s failed, check the events of the DataVolume and its importer pod", virtualMachine.Name)
+	}
+	return dataVolume.Status, nil
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const sshPort = 22
+
+// sshServiceName returns the name of the Service that exposes SSH of the VM with the given name.
+func sshServiceName(machineName string) string {
+	return fmt.Sprintf("%s-ssh", machineName)
+}
+
+// createSSHService creates a Service owned by the given VM that exposes SSH of its virt-launcher pod.
+func (p PluginSPIImpl) createSSHService(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine, sshServiceSpec *api.SSHServiceSpec) error {
+	serviceType := sshServiceSpec.Type
+	if serviceType == "" {
+		serviceType = corev1.ServiceTypeClusterIP
+	}
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            sshServiceName(virtualMachine.Name),
+			Namespace:       virtualMachine.Namespace,
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(virtualMachine, kubevirtv1.VirtualMachineGroupVersionKind)},
+		},
+		Spec: corev1.ServiceSpec{
+			Type: serviceType,
+			Selector: map[string]string{
+				"kubevirt.io/vm": virtualMachine.Name,
+			},
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "ssh",
+					Protocol:   corev1.ProtocolTCP,
+					Port:       sshPort,
+					TargetPort: intstr.FromInt(sshPort),
+				},
+			},
+		},
+	}
+
+	if err := c.Create(ctx, service); err != nil && !kerrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create SSH Service: %w", err)
+	}
+	return nil
+}
+
+// getSSHServiceAddress returns the address at which SSH of the given VM is exposed by its Service,
+// or an empty string if the address is not known yet. For NodePort Services, the host part is omitted
+// since the port is opened on every node of the provider cluster.
+func (p PluginSPIImpl) getSSHServiceAddress(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine) (string, error) {
+	service := &corev1.Service{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: virtualMachine.Namespace, Name: sshServiceName(virtualMachine.Name)}, service); err != nil {
+		if kerrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get SSH Service: %w", err)
+	}
+
+	switch service.Spec.Type {
+	case corev1.ServiceTypeLoadBalancer:
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				return net.JoinHostPort(ingress.IP, strconv.Itoa(sshPort)), nil
+			}
+			if ingress.Hostname != "" {
+				return net.JoinHostPort(ingress.Hostname, strconv.Itoa(sshPort)), nil
+			}
+		}
+		return "", nil
+	case corev1.ServiceTypeNodePort:
+		if len(service.Spec.Ports) == 0 || service.Spec.Ports[0].NodePort == 0 {
+			return "", nil
+		}
+		return net.JoinHostPort("", strconv.Itoa(int(service.Spec.Ports[0].NodePort))), nil
+	default:
+		if service.Spec.ClusterIP == "" || service.Spec.ClusterIP == corev1.ClusterIPNone {
+			return "", nil
+		}
+		return net.JoinHostPort(service.Spec.ClusterIP, strconv.Itoa(sshPort)), nil
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/metrics"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	cdi "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// statusAnnotation is the annotation on VMs that contains their status as last observed by the provider.
+	statusAnnotation = "kubevirt.provider.extensions.gardener.cloud/status"
+	// statusMessageAnnotation is the annotation on VMs that contains details about their status.
+	statusMessageAnnotation = "kubevirt.provider.extensions.gardener.cloud/status-message"
+)
+
+// Statuses of VMs, derived from the VM, its VMI and its root disk DataVolume.
+const (
+	vmStatusProvisioning  = "Provisioning"
+	vmStatusStarting      = "Starting"
+	vmStatusUnschedulable = "Unschedulable"
+	vmStatusRunning       = "Running"
+	vmStatusPaused        = "Paused"
+	vmStatusStopped       = "Stopped"
+	vmStatusFailed        = "Failed"
+	vmStatusPreempted     = "Preempted"
+	// vmStatusUnknown is the status of VMs whose status was not recorded yet.
+	vmStatusUnknown = "Unknown"
+)
+
+var vmStatuses = []string{vmStatusProvisioning, vmStatusStarting, vmStatusUnschedulable, vmStatusRunning, vmStatusPaused, vmStatusStopped, vmStatusFailed, vmStatusPreempted, vmStatusUnknown}
+
+// getVMStatus returns the status of the given VM and a message with details, based on its VMI, which is nil
+// if it doesn't exist, and the status of its root disk DataVolume.
+func getVMStatus(virtualMachine *kubevirtv1.VirtualMachine, virtualMachineInstance *kubevirtv1.VirtualMachineInstance, dataVolumeStatus cdi.DataVolumeStatus) (string, string) {
+	if isPreemptedVM(virtualMachine) {
+		return vmStatusPreempted, virtualMachine.Annotations[statusMessageAnnotation]
+	}
+
+	if dataVolumeStatus.Phase != "" && dataVolumeStatus.Phase != cdi.Succeeded {
+		return vmStatusProvisioning, fmt.Sprintf("root disk is in phase %s, progress %s", dataVolumeStatus.Phase, dataVolumeStatus.Progress)
+	}
+
+	if virtualMachineInstance == nil {
+		for _, condition := range virtualMachine.Status.Conditions {
+			if condition.Type == kubevirtv1.VirtualMachineFailure && condition.Status == corev1.ConditionTrue {
+				return vmStatusFailed, condition.Message
+			}
+		}
+		if virtualMachine.Spec.Running == nil || !*virtualMachine.Spec.Running {
+			return vmStatusStopped, ""
+		}
+		return vmStatusStarting, "VirtualMachineInstance is not created yet"
+	}
+
+	for _, condition := range virtualMachineInstance.Status.Conditions {
+		switch {
+		case condition.Type == kubevirtv1.VirtualMachineInstancePaused && condition.Status == corev1.ConditionTrue:
+			return vmStatusPaused, condition.Message
+		case condition.Type == kubevirtv1.VirtualMachineInstanceConditionType(corev1.PodScheduled) &&
+			condition.Status == corev1.ConditionFalse && condition.Reason == corev1.PodReasonUnschedulable:
+			return vmStatusUnschedulable, condition.Message
+		}
+	}
+
+	switch virtualMachineInstance.Status.Phase {
+	case kubevirtv1.Running:
+		return vmStatusRunning, ""
+	case kubevirtv1.Succeeded:
+		return vmStatusStopped, ""
+	case kubevirtv1.Failed:
+		return vmStatusFailed, "VirtualMachineInstance failed"
+	default:
+		return vmStatusStarting, fmt.Sprintf("VirtualMachineInstance is in phase %s", virtualMachineInstance.Status.Phase)
+	}
+}
+
+// recordVMStatus determines the status of the given VM and records it in annotations of the VM if it changed,
+// so that it is visible to operators of the provider cluster. It returns the status and the message.
+func (p PluginSPIImpl) recordVMStatus(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine, dataVolumeStatus cdi.DataVolumeStatus) (string, string, error) {
+	virtualMachineInstance := &kubevirtv1.VirtualMachineInstance{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: virtualMachine.Namespace, Name: virtualMachine.Name}, virtualMachineInstance); err != nil {
+		if !kerrors.IsNotFound(err) {
+			return "", "", fmt.Errorf("failed to get VirtualMachineInstance: %w", err)
+		}
+		virtualMachineInstance = nil
+	}
+
+	status, message := getVMStatus(virtualMachine, virtualMachineInstance, dataVolumeStatus)
+	observeRootDiskImport(virtualMachine, status)
+	if virtualMachine.Annotations[statusAnnotation] == status && virtualMachine.Annotations[statusMessageAnnotation] == message {
+		return status, message, nil
+	}
+
+	if err := applyVM(ctx, c, virtualMachine, statusFieldManager, statusFields(status, message)); err != nil {
+		return "", "", fmt.Errorf("failed to record status of VirtualMachine %s: %w", virtualMachine.Name, err)
+	}
+	return status, message, nil
+}
+
+// observeRootDiskImport records the duration from the creation of the given VM until its root disk was imported
+// if its recorded status is provisioning and the given new status isn't.
+func observeRootDiskImport(virtualMachine *kubevirtv1.VirtualMachine, status string) {
+	if virtualMachine.Annotations[statusAnnotation] == vmStatusProvisioning && status != vmStatusProvisioning {
+		metrics.DataVolumeImportDuration.Observe(time.Since(virtualMachine.CreationTimestamp.Time).Seconds())
+	}
+}
+
+// recordVMStatusMetrics records the number of the given VMs of the given machine class by their recorded status.
+func recordVMStatusMetrics(machineClassName string, virtualMachines []kubevirtv1.VirtualMachine) {
+	counts := map[string]int{}
+	for _, virtualMachine := range virtualMachines {
+		status := virtualMachine.Annotations[statusAnnotation]
+		if status == "" {
+			status = vmStatusUnknown
+		}
+		counts[status]++
+	}
+	for _, status := range vmStatuses {
+		metrics.VirtualMachines.WithLabelValues(machineClassName, status).Set(float64(counts[status]))
+	}
+}
@@ -15,61 +15,66 @@
 package core
 
 import (
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"net"
 	"strings"
 
 	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
 
 	"github.com/Masterminds/semver"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/client-go/kubernetes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/clientcmd"
+	utilpointer "k8s.io/utils/pointer"
 	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	cdi "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 // GetClient creates a client from the kubeconfig saved in the "kubeconfig" field of the given secret.
 // It also returns the namespace of the kubeconfig's current context.
 func GetClient(secret *corev1.Secret) (client.Client, string, error) {
-	clientConfig, err := getClientConfig(secret)
-	if err != nil {
-		return nil, "", err
-	}
-	config, err := clientConfig.ClientConfig()
-	if err != nil {
-		return nil, "", fmt.Errorf("could not get REST config from client config: %v", err)
-	}
-	c, err := client.New(config, client.Options{})
-	if err != nil {
-		return nil, "", fmt.Errorf("could not create client from REST config: %v", err)
-	}
-	namespace, _, err := clientConfig.Namespace()
-	if err != nil {
-		return nil, "", fmt.Errorf("could not get namespace from client config: %v", err)
-	}
-	return c, namespace, nil
+	return ClientOptions{}.GetClient(secret)
 }
 
 // GetServerVersion gets the server version from the kubeconfig saved in the "kubeconfig" field of the given secret.
 func GetServerVersion(secret *corev1.Secret) (string, error) {
-	clientConfig, err := getClientConfig(secret)
-	if err != nil {
-		return "", err
-	}
-	config, err := clientConfig.ClientConfig()
-	if err != nil {
-		return "", fmt.Errorf("could not get REST config from client config: %v", err)
+	return ClientOptions{}.GetServerVersion(secret)
+}
+
+// withClusterLogger returns a context whose logger adds the given namespace and the provider cluster of the given
+// provider spec, identified by the key of its kubeconfig in the secret, to all messages.
+func withClusterLogger(ctx context.Context, namespace string, providerSpec *api.KubeVirtProviderSpec) context.Context {
+	logger := logging.FromContext(ctx).WithValues("namespace", namespace, "cluster", api.GetKubeconfigKey(providerSpec))
+	return logging.NewContext(ctx, logger)
+}
+
+// getClusterSecret returns the given secret with the kubeconfig of the provider cluster of the zone of the given provider
+// spec in its kubeconfig field, so that clients and server versions are created for that provider cluster. If the secret
+// contains bearer token credentials instead of a kubeconfig, the kubeconfig built from them is used.
+func getClusterSecret(secret *corev1.Secret, providerSpec *api.KubeVirtProviderSpec) *corev1.Secret {
+	key := api.GetKubeconfigKey(providerSpec)
+	if _, ok := secret.Data[key]; ok && key == api.DefaultKubeconfigKey {
+		return secret
 	}
-	cs, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return "", fmt.Errorf("could not create clientset from REST config: %v", err)
+
+	clusterSecret := secret.DeepCopy()
+	if clusterSecret.Data == nil {
+		clusterSecret.Data = map[string][]byte{}
 	}
-	versionInfo, err := cs.ServerVersion()
+	kubeconfig, err := api.GetKubeconfig(secret.Data, providerSpec)
 	if err != nil {
-		return "", fmt.Errorf("could not get server version: %v", err)
+		// creating clients fails with a missing kubeconfig rather than falling back to another provider cluster
+		delete(clusterSecret.Data, api.DefaultKubeconfigKey)
+		return clusterSecret
 	}
-	return versionInfo.GitVersion, nil
+	clusterSecret.Data[api.DefaultKubeconfigKey] = kubeconfig
+	return clusterSecret
 }
 
 func getClientConfig(secret *corev1.Secret) (clientcmd.ClientConfig, error) {
@@ -79,21 +84,120 @@ func getClientConfig(secret *corev1.Secret) (clientcmd.ClientConfig, error) {
 	}
 	clientConfig, err := clientcmd.NewClientConfigFromBytes(kubeconfig)
 	if err != nil {
-		return nil, fmt.Errorf("could not create client config from kubeconfig: %v", err)
+		return nil, fmt.Errorf("could not create client config from kubeconfig: %w", err)
 	}
 	return clientConfig, nil
 }
 
-func encodeProviderID(machineName string) string {
+// encodeProviderID returns the provider ID of the VM with the given namespace, name and UID, which distinguishes
+// VMs with the same name in different namespaces as well as recreated VMs.
+func encodeProviderID(namespace, machineName string, uid types.UID) string {
+	if machineName == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s://%s/%s/%s", ProviderName, namespace, machineName, uid)
+}
+
+// encodeLegacyProviderID returns the provider ID of the VM with the given name used by former versions of the provider.
+func encodeLegacyProviderID(machineName string) string {
 	if machineName == "" {
 		return ""
 	}
 	return fmt.Sprintf("%s://%s", ProviderName, machineName)
 }
 
-func buildNetworks(networkSpecs []api.NetworkSpec) ([]kubevirtv1.Interface, []kubevirtv1.Network, string) {
-	// If no network specs, return empty lists
-	if len(networkSpecs) == 0 {
+// getProviderID returns the provider ID of the given VM. VMs created by former versions of the provider, which lack
+// the provider ID format annotation, keep their legacy provider ID consisting of the name only.
+func getProviderID(virtualMachine *kubevirtv1.VirtualMachine) string {
+	if virtualMachine.Annotations[providerIDFormatAnnotation] == providerIDFormatV2 {
+		return encodeProviderID(virtualMachine.Namespace, virtualMachine.Name, virtualMachine.UID)
+	}
+	return encodeLegacyProviderID(virtualMachine.Name)
+}
+
+// decodeProviderID returns the namespace, name and UID of the VM with the given provider ID.
+// The namespace and UID are empty for legacy provider IDs.
+func decodeProviderID(providerID string) (string, string, types.UID, error) {
+	prefix := ProviderName + "://"
+	if !strings.HasPrefix(providerID, prefix) {
+		return "", "", "", fmt.Errorf("invalid provider ID %q", providerID)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(providerID, prefix), "/")
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		return "", parts[0], "", nil
+	case len(parts) == 3 && parts[0] != "" && parts[1] != "":
+		return parts[0], parts[1], types.UID(parts[2]), nil
+	default:
+		return "", "", "", fmt.Errorf("invalid provider ID %q", providerID)
+	}
+}
+
+// buildResources builds the resource requirements of the VMI of the given provider spec. With GuaranteedQoS,
+// the CPU and memory requests equal the limits, which default to the requests.
+func buildResources(providerSpec *api.KubeVirtProviderSpec) kubevirtv1.ResourceRequirements {
+	resources := *providerSpec.Resources.DeepCopy()
+	if !providerSpec.GuaranteedQoS {
+		return resources
+	}
+
+	if resources.Requests == nil {
+		resources.Requests = corev1.ResourceList{}
+	}
+	if resources.Limits == nil {
+		resources.Limits = corev1.ResourceList{}
+	}
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+		if limit, ok := resources.Limits[name]; ok {
+			resources.Requests[name] = limit
+		} else if request, ok := resources.Requests[name]; ok {
+			resources.Limits[name] = request
+		}
+	}
+	return resources
+}
+
+// buildDataVolumeSpec builds the spec of a DataVolume that imports the source image of the given provider spec.
+func buildDataVolumeSpec(providerSpec *api.KubeVirtProviderSpec) cdi.DataVolumeSpec {
+	return cdi.DataVolumeSpec{
+		PVC: &corev1.PersistentVolumeClaimSpec{
+			StorageClassName: utilpointer.StringPtr(providerSpec.StorageClassName),
+			AccessModes: []corev1.PersistentVolumeAccessMode{
+				"ReadWriteOnce",
+			},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: providerSpec.PVCSize,
+				},
+			},
+		},
+		Source: buildDataVolumeSource(providerSpec),
+	}
+}
+
+// buildDataVolumeSource builds the CDI source of the image of the given provider spec, which is a registry source
+// for docker:// URLs and an HTTP source otherwise.
+func buildDataVolumeSource(providerSpec *api.KubeVirtProviderSpec) cdi.DataVolumeSource {
+	if strings.HasPrefix(providerSpec.SourceURL, api.RegistrySourcePrefix) {
+		return cdi.DataVolumeSource{
+			Registry: &cdi.DataVolumeSourceRegistry{
+				URL:       providerSpec.SourceURL,
+				SecretRef: providerSpec.SourceSecretName,
+			},
+		}
+	}
+	return cdi.DataVolumeSource{
+		HTTP: &cdi.DataVolumeSourceHTTP{
+			URL:       providerSpec.SourceURL,
+			SecretRef: providerSpec.SourceSecretName,
+		},
+	}
+}
+
+func buildNetworks(networkSpecs []api.NetworkSpec, podNetworkSpec *api.PodNetworkSpec) ([]kubevirtv1.Interface, []kubevirtv1.Network, string) {
+	// If no network specs and no pod network spec, return empty lists
+	if len(networkSpecs) == 0 && podNetworkSpec == nil {
 		return nil, nil, ""
 	}
 
@@ -114,12 +218,7 @@ func buildNetworks(networkSpecs []api.NetworkSpec) ([]kubevirtv1.Interface, []ku
 	var networks []kubevirtv1.Network
 	if !hasDefault {
 		// Append an interface and a network for the pod network
-		interfaces = append(interfaces, kubevirtv1.Interface{
-			Name: "default",
-			InterfaceBindingMethod: kubevirtv1.InterfaceBindingMethod{
-				Bridge: &kubevirtv1.InterfaceBridge{},
-			},
-		})
+		interfaces = append(interfaces, buildPodNetworkInterface(podNetworkSpec))
 		networks = append(networks, kubevirtv1.Network{
 			Name: "default",
 			NetworkSource: kubevirtv1.NetworkSource{
@@ -137,12 +236,14 @@ func buildNetworks(networkSpecs []api.NetworkSpec) ([]kubevirtv1.Interface, []ku
 		name := fmt.Sprintf("net%d", count)
 
 		// Append an interface and a network for this network spec
-		interfaces = append(interfaces, kubevirtv1.Interface{
+		iface := kubevirtv1.Interface{
 			Name: name,
 			InterfaceBindingMethod: kubevirtv1.InterfaceBindingMethod{
 				Bridge: &kubevirtv1.InterfaceBridge{},
 			},
-		})
+		}
+		applyInterfaceSpec(&iface, &networkSpec.InterfaceSpec)
+		interfaces = append(interfaces, iface)
 		networks = append(networks, kubevirtv1.Network{
 			Name: name,
 			NetworkSource: kubevirtv1.NetworkSource{
@@ -169,6 +270,139 @@ ethernets:
 	return interfaces, networks, networkData
 }
 
+func buildAdditionalVolumes(volumeSpecs []api.AdditionalVolumeSpec) ([]kubevirtv1.Disk, []kubevirtv1.Volume) {
+	var disks []kubevirtv1.Disk
+	var volumes []kubevirtv1.Volume
+	for _, volumeSpec := range volumeSpecs {
+		diskDevice := kubevirtv1.DiskDevice{Disk: &kubevirtv1.DiskTarget{Bus: "virtio"}}
+		if volumeSpec.Device != nil {
+			diskDevice = *volumeSpec.Device
+		}
+
+		disks = append(disks, kubevirtv1.Disk{
+			Name:              volumeSpec.Name,
+			DiskDevice:        diskDevice,
+			Serial:            volumeSpec.Serial,
+			DedicatedIOThread: volumeSpec.DedicatedIOThread,
+		})
+		volumes = append(volumes, kubevirtv1.Volume{
+			Name: volumeSpec.Name,
+			VolumeSource: kubevirtv1.VolumeSource{
+				ConfigMap:             volumeSpec.ConfigMap,
+				Secret:                volumeSpec.Secret,
+				ServiceAccount:        volumeSpec.ServiceAccount,
+				HostDisk:              volumeSpec.HostDisk,
+				PersistentVolumeClaim: volumeSpec.PersistentVolumeClaim,
+				ContainerDisk:         volumeSpec.ContainerDisk,
+			},
+		})
+	}
+	return disks, volumes
+}
+
+func buildPodNetworkInterface(podNetworkSpec *api.PodNetworkSpec) kubevirtv1.Interface {
+	iface := kubevirtv1.Interface{
+		Name: "default",
+		InterfaceBindingMethod: kubevirtv1.InterfaceBindingMethod{
+			Bridge: &kubevirtv1.InterfaceBridge{},
+		},
+	}
+	if podNetworkSpec == nil {
+		return iface
+	}
+
+	if podNetworkSpec.Masquerade {
+		iface.InterfaceBindingMethod = kubevirtv1.InterfaceBindingMethod{
+			Masquerade: &kubevirtv1.InterfaceMasquerade{},
+		}
+		iface.Ports = podNetworkSpec.Ports
+	}
+	applyInterfaceSpec(&iface, &podNetworkSpec.InterfaceSpec)
+
+	return iface
+}
+
+// generateMacAddress generates a locally administered unicast MAC address that is stable for the given machine and interface.
+func generateMacAddress(machineName, interfaceName string) string {
+	sum := sha256.Sum256([]byte(machineName + "/" + interfaceName))
+	return net.HardwareAddr{0x02, sum[0], sum[1], sum[2], sum[3], sum[4]}.String()
+}
+
+// buildCloudInitVolumeSource builds the source of the cloud-init volume for the given datasource,
+// providing the userData of the given secret and the given network data.
+func buildCloudInitVolumeSource(dataSource api.CloudInitDataSource, userdataSecretName, networkData string) kubevirtv1.VolumeSource {
+	if dataSource == api.CloudInitDataSourceConfigDrive {
+		return kubevirtv1.VolumeSource{
+			CloudInitConfigDrive: &kubevirtv1.CloudInitConfigDriveSource{
+				UserDataSecretRef: &corev1.LocalObjectReference{
+					Name: userdataSecretName,
+				},
+				NetworkData: networkData,
+			},
+		}
+	}
+
+	return kubevirtv1.VolumeSource{
+		CloudInitNoCloud: &kubevirtv1.CloudInitNoCloudSource{
+			UserDataSecretRef: &corev1.LocalObjectReference{
+				Name: userdataSecretName,
+			},
+			NetworkData: networkData,
+		},
+	}
+}
+
+// buildStaticNetworkData builds cloud-init network data that configures the given static IP addresses, mapped by network name,
+// on the interfaces attached to these networks, and DHCP on all other interfaces.
+// Interfaces are matched by MAC address, so a stable MAC address is generated for each interface that doesn't have one.
+func buildStaticNetworkData(machineName string, interfaces []kubevirtv1.Interface, networks []kubevirtv1.Network,
+	networkSpecs []api.NetworkSpec, ipAddresses map[string]string) string {
+	ipamSpecs := map[string]*api.IPAMSpec{}
+	for _, networkSpec := range networkSpecs {
+		ipamSpecs[networkSpec.Name] = networkSpec.IPAM
+	}
+
+	var networkData strings.Builder
+	networkData.WriteString("version: 2\nethernets:\n")
+	for i := range interfaces {
+		if interfaces[i].MacAddress == "" {
+			interfaces[i].MacAddress = generateMacAddress(machineName, interfaces[i].Name)
+		}
+
+		fmt.Fprintf(&networkData, "  id%d:\n    match:\n      macaddress: %q\n", i, interfaces[i].MacAddress)
+
+		var networkName string
+		if networks[i].Multus != nil {
+			networkName = networks[i].Multus.NetworkName
+		}
+		ipAddress, ok := ipAddresses[networkName]
+		if !ok {
+			networkData.WriteString("    dhcp4: true\n")
+			continue
+		}
+
+		fmt.Fprintf(&networkData, "    addresses:\n    - %s\n", ipAddress)
+		ipam := ipamSpecs[networkName]
+		if ipam.Gateway != "" {
+			fmt.Fprintf(&networkData, "    gateway4: %s\n", ipam.Gateway)
+		}
+		if len(ipam.Nameservers) > 0 {
+			networkData.WriteString("    nameservers:\n      addresses:\n")
+			for _, nameserver := range ipam.Nameservers {
+				fmt.Fprintf(&networkData, "      - %s\n", nameserver)
+			}
+		}
+	}
+
+	return networkData.String()
+}
+
+func applyInterfaceSpec(iface *kubevirtv1.Interface, interfaceSpec *api.InterfaceSpec) {
+	iface.DHCPOptions = interfaceSpec.DHCPOptions
+	iface.Model = interfaceSpec.Model
+	iface.PciAddress = interfaceSpec.PciAddress
+}
+
 const (
 	// defaultRegion is the name of the default region.
 	// VMs using this region are scheduled on nodes for which a region failure domain is not specified.
@@ -178,12 +412,9 @@ const (
 	defaultZone = "default"
 )
 
-func buildAffinity(region, zone, k8sVersion string) *corev1.Affinity {
+func buildAffinity(region, zone, regionLabel, zoneLabel string) *corev1.Affinity {
 	var affinity *corev1.Affinity
 	if region != "" {
-		// Get region and zone labels
-		regionLabel, zoneLabel := getRegionAndZoneLabels(k8sVersion)
-
 		// Add match expression for the region label
 		var matchExpressions []corev1.NodeSelectorRequirement
 		if region != defaultRegion {
@@ -231,12 +462,75 @@ func buildAffinity(region, zone, k8sVersion string) *corev1.Affinity {
 	return affinity
 }
 
-func getRegionAndZoneLabels(k8sVersion string) (string, string) {
+// mergeAffinity merges the given user affinity with the generated one, or returns the user affinity
+// if replace is true. As node selector terms are ORed, the generated match expressions are added to every term.
+func mergeAffinity(generated, user *corev1.Affinity, replace bool) *corev1.Affinity {
+	if user == nil {
+		return generated
+	}
+	affinity := user.DeepCopy()
+	if replace || generated == nil || generated.NodeAffinity == nil {
+		return affinity
+	}
+
+	if affinity.NodeAffinity == nil {
+		affinity.NodeAffinity = generated.NodeAffinity.DeepCopy()
+		return affinity
+	}
+	required := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if required == nil || len(required.NodeSelectorTerms) == 0 {
+		affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = generated.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.DeepCopy()
+		return affinity
+	}
+	for i := range required.NodeSelectorTerms {
+		for _, term := range generated.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+			required.NodeSelectorTerms[i].MatchExpressions = append(required.NodeSelectorTerms[i].MatchExpressions, term.MatchExpressions...)
+		}
+	}
+	return affinity
+}
+
+// addPoolAntiAffinity adds a preferred pod anti-affinity to the given affinity, so that VMs of the given
+// machine class are preferably scheduled on different nodes.
+func addPoolAntiAffinity(affinity *corev1.Affinity, machineClassName string) *corev1.Affinity {
+	if affinity == nil {
+		affinity = &corev1.Affinity{}
+	} else {
+		affinity = affinity.DeepCopy()
+	}
+	if affinity.PodAntiAffinity == nil {
+		affinity.PodAntiAffinity = &corev1.PodAntiAffinity{}
+	}
+	affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution, corev1.WeightedPodAffinityTerm{
+		Weight: 100,
+		PodAffinityTerm: corev1.PodAffinityTerm{
+			LabelSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					machineClassLabel: machineClassName,
+				},
+			},
+			TopologyKey: corev1.LabelHostname,
+		},
+	})
+	return affinity
+}
+
+// getRegionAndZoneLabels returns the region and zone label keys of the given provider spec,
+// defaulting to the standard labels of the given Kubernetes version.
+func getRegionAndZoneLabels(providerSpec *api.KubeVirtProviderSpec, k8sVersion string) (string, string) {
+	regionLabel, zoneLabel := "topology.kubernetes.io/region", "topology.kubernetes.io/zone"
 	c, _ := semver.NewConstraint("< 1.17")
 	if c.Check(semver.MustParse(normalizeVersion(k8sVersion))) {
-		return corev1.LabelZoneRegion, corev1.LabelZoneFailureDomain
+		regionLabel, zoneLabel = corev1.LabelZoneRegion, corev1.LabelZoneFailureDomain
+	}
+
+	if providerSpec.RegionLabelKey != "" {
+		regionLabel = providerSpec.RegionLabelKey
+	}
+	if providerSpec.ZoneLabelKey != "" {
+		zoneLabel = providerSpec.ZoneLabelKey
 	}
-	return "topology.kubernetes.io/region", "topology.kubernetes.io/zone"
+	return regionLabel, zoneLabel
 }
 
 func normalizeVersion(version string) string {
@@ -263,3 +557,31 @@ func addUserSSHKeysToUserData(userData string, sshKeys []string) (string, error)
 
 	return userDataBuilder.String(), nil
 }
+
+// buildNodeAddresses returns the IP addresses of the interfaces of the given virtual machine instance as internal IPs,
+// followed by its hostname, which cloud-init sets to the name of the virtual machine instance unless specified otherwise.
+func buildNodeAddresses(virtualMachineInstance *kubevirtv1.VirtualMachineInstance) []corev1.NodeAddress {
+	var (
+		addresses []corev1.NodeAddress
+		seen      = map[string]bool{}
+	)
+	for _, iface := range virtualMachineInstance.Status.Interfaces {
+		ips := iface.IPs
+		if len(ips) == 0 && iface.IP != "" {
+			ips = []string{iface.IP}
+		}
+		for _, ip := range ips {
+			if seen[ip] {
+				continue
+			}
+			seen[ip] = true
+			addresses = append(addresses, corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: ip})
+		}
+	}
+
+	hostname := virtualMachineInstance.Spec.Hostname
+	if hostname == "" {
+		hostname = virtualMachineInstance.Name
+	}
+	return append(addresses, corev1.NodeAddress{Type: corev1.NodeHostName, Address: hostname})
+}
@@ -1,8 +1,41 @@
 package core
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	clouderrors "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/errors"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/metrics"
+
+	dto "github.com/prometheus/client_model/go"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/cache"
+	utilpointer "k8s.io/utils/pointer"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	cdi "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 func TestAddUserSSHKeysToUserData(t *testing.T) {
@@ -48,3 +81,907 @@ func TestAddUserSSHKeysToUserData(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildAdditionalVolumes(t *testing.T) {
+	volumeSpecs := []api.AdditionalVolumeSpec{
+		{
+			Name:              "ca-bundle",
+			DedicatedIOThread: utilpointer.BoolPtr(true),
+			ConfigMap:         &kubevirtv1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "registry-ca"}},
+		},
+		{
+			Name:   "credentials",
+			Serial: "CREDS01",
+			Secret: &kubevirtv1.SecretVolumeSource{SecretName: "registry-credentials"},
+		},
+		{
+			Name:           "agent-token",
+			ServiceAccount: &kubevirtv1.ServiceAccountVolumeSource{ServiceAccountName: "guest-agent"},
+		},
+		{
+			Name:                  "shared-data",
+			Device:                &kubevirtv1.DiskDevice{LUN: &kubevirtv1.LunTarget{Bus: "scsi"}},
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "shared-data"},
+		},
+	}
+
+	disks, volumes := buildAdditionalVolumes(volumeSpecs)
+	if len(disks) != len(volumeSpecs) || len(volumes) != len(volumeSpecs) {
+		t.Fatalf("expected %d disks and volumes, got %d disks and %d volumes", len(volumeSpecs), len(disks), len(volumes))
+	}
+
+	for i, volumeSpec := range volumeSpecs {
+		if disks[i].Name != volumeSpec.Name || volumes[i].Name != volumeSpec.Name {
+			t.Fatalf("disk %q and volume %q don't match the volume spec %q", disks[i].Name, volumes[i].Name, volumeSpec.Name)
+		}
+		if volumeSpec.Device == nil && (disks[i].Disk == nil || disks[i].Disk.Bus != "virtio") {
+			t.Fatalf("expected disk %q to be a virtio disk", disks[i].Name)
+		}
+	}
+
+	if disks[0].DedicatedIOThread == nil || !*disks[0].DedicatedIOThread {
+		t.Fatal("expected disk to have a dedicated IO thread")
+	}
+	if volumes[0].ConfigMap == nil || volumes[0].ConfigMap.Name != "registry-ca" {
+		t.Fatal("expected a ConfigMap volume source")
+	}
+	if disks[1].Serial != "CREDS01" {
+		t.Fatalf("expected disk serial %q, got %q", "CREDS01", disks[1].Serial)
+	}
+	if volumes[1].Secret == nil || volumes[1].Secret.SecretName != "registry-credentials" {
+		t.Fatal("expected a Secret volume source")
+	}
+	if volumes[2].ServiceAccount == nil || volumes[2].ServiceAccount.ServiceAccountName != "guest-agent" {
+		t.Fatal("expected a ServiceAccount volume source")
+	}
+	if disks[3].LUN == nil || disks[3].LUN.Bus != "scsi" || disks[3].Disk != nil {
+		t.Fatal("expected a scsi LUN device")
+	}
+	if volumes[3].PersistentVolumeClaim == nil || volumes[3].PersistentVolumeClaim.ClaimName != "shared-data" {
+		t.Fatal("expected a PersistentVolumeClaim volume source")
+	}
+}
+
+func TestBuildResources(t *testing.T) {
+	providerSpec := &api.KubeVirtProviderSpec{
+		Resources: kubevirtv1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("2"),
+				corev1.ResourceMemory: resource.MustParse("4Gi"),
+			},
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU: resource.MustParse("4"),
+			},
+		},
+	}
+
+	resources := buildResources(providerSpec)
+	if _, ok := resources.Limits[corev1.ResourceMemory]; ok {
+		t.Fatal("expected no memory limit without guaranteedQoS")
+	}
+
+	providerSpec.GuaranteedQoS = true
+	resources = buildResources(providerSpec)
+	for name, expected := range map[corev1.ResourceName]string{corev1.ResourceCPU: "4", corev1.ResourceMemory: "4Gi"} {
+		request, limit := resources.Requests[name], resources.Limits[name]
+		if request.Cmp(resource.MustParse(expected)) != 0 || limit.Cmp(request) != 0 {
+			t.Fatalf("expected %s request and limit %s, got %s and %s", name, expected, request.String(), limit.String())
+		}
+	}
+	if _, ok := providerSpec.Resources.Limits[corev1.ResourceMemory]; ok {
+		t.Fatal("expected the provider spec not to be modified")
+	}
+}
+
+func TestBuildNetworksWithMasquerade(t *testing.T) {
+	podNetworkSpec := &api.PodNetworkSpec{
+		Masquerade: true,
+		Ports: []kubevirtv1.Port{
+			{Name: "ssh", Protocol: "TCP", Port: 22},
+		},
+		InterfaceSpec: api.InterfaceSpec{
+			DHCPOptions: &kubevirtv1.DHCPOptions{NTPServers: []string{"10.0.0.123"}},
+			Model:       "e1000e",
+		},
+	}
+
+	interfaces, networks, networkData := buildNetworks(nil, podNetworkSpec)
+	if len(interfaces) != 1 || len(networks) != 1 {
+		t.Fatalf("expected 1 interface and network, got %d interfaces and %d networks", len(interfaces), len(networks))
+	}
+	if networks[0].Pod == nil {
+		t.Fatal("expected the pod network")
+	}
+	if interfaces[0].Masquerade == nil || interfaces[0].Bridge != nil {
+		t.Fatal("expected a masquerade interface")
+	}
+	if len(interfaces[0].Ports) != 1 || interfaces[0].Ports[0].Port != 22 {
+		t.Fatalf("unexpected interface ports: %v", interfaces[0].Ports)
+	}
+	if interfaces[0].DHCPOptions == nil || len(interfaces[0].DHCPOptions.NTPServers) != 1 {
+		t.Fatal("expected DHCP options with an NTP server")
+	}
+	if interfaces[0].Model != "e1000e" {
+		t.Fatalf("unexpected interface model %q", interfaces[0].Model)
+	}
+	if networkData == "" {
+		t.Fatal("expected network data")
+	}
+}
+
+func TestBuildStaticNetworkData(t *testing.T) {
+	networkSpecs := []api.NetworkSpec{
+		{
+			Name: "static-net",
+			IPAM: &api.IPAMSpec{
+				CIDR:        "10.0.0.0/24",
+				Gateway:     "10.0.0.1",
+				Nameservers: []string{"10.0.0.53"},
+			},
+		},
+	}
+	interfaces, networks, _ := buildNetworks(networkSpecs, nil)
+
+	networkData := buildStaticNetworkData("machine", interfaces, networks, networkSpecs, map[string]string{"static-net": "10.0.0.2/24"})
+	expectedNetworkData := fmt.Sprintf(`version: 2
+ethernets:
+  id0:
+    match:
+      macaddress: %q
+    dhcp4: true
+  id1:
+    match:
+      macaddress: %q
+    addresses:
+    - 10.0.0.2/24
+    gateway4: 10.0.0.1
+    nameservers:
+      addresses:
+      - 10.0.0.53
+`, generateMacAddress("machine", "default"), generateMacAddress("machine", "net1"))
+
+	if networkData != expectedNetworkData {
+		t.Fatalf("expected network data:\n%s\ngot:\n%s", expectedNetworkData, networkData)
+	}
+	if interfaces[1].MacAddress != generateMacAddress("machine", "net1") {
+		t.Fatal("expected a generated MAC address on the interface")
+	}
+	if generateMacAddress("machine", "net1") == generateMacAddress("other-machine", "net1") {
+		t.Fatal("expected different MAC addresses for different machines")
+	}
+}
+
+func TestRangeIPAllocator(t *testing.T) {
+	allocator := NewRangeIPAllocator()
+	ipam := &api.IPAMSpec{CIDR: "10.0.0.0/24", Gateway: "10.0.0.1"}
+
+	allocate := func(namespace string, ipam *api.IPAMSpec) string {
+		ip, err := allocator.AllocateIP(namespace, "static-net", ipam, sets.NewString())
+		if err != nil {
+			t.Fatalf("failed to allocate IP address: %v", err)
+		}
+		return ip.String()
+	}
+
+	if ip := allocate("shoot-a", ipam); ip != "10.0.0.2" {
+		t.Fatalf("expected 10.0.0.2, got %s", ip)
+	}
+	if ip := allocate("shoot-a", ipam); ip != "10.0.0.3" {
+		t.Fatalf("expected reserved address to be skipped, got %s", ip)
+	}
+	if ip := allocate("shoot-b", ipam); ip != "10.0.0.2" {
+		t.Fatalf("expected reservations of another namespace to be ignored, got %s", ip)
+	}
+	if ip := allocate("shoot-a", &api.IPAMSpec{CIDR: "10.1.0.0/24"}); ip != "10.1.0.1" {
+		t.Fatalf("expected reservations of another CIDR to be ignored, got %s", ip)
+	}
+
+	allocator.ReleaseIP("shoot-a", "static-net", ipam, net.ParseIP("10.0.0.2"))
+	if ip := allocate("shoot-a", ipam); ip != "10.0.0.2" {
+		t.Fatalf("expected released address to be allocated again, got %s", ip)
+	}
+
+	// the range ends with the last IPv4 address, which must not make the allocation loop forever
+	lastRange := &api.IPAMSpec{CIDR: "0.0.0.0/0", RangeStart: "255.255.255.254", RangeEnd: "255.255.255.255"}
+	if ip := allocate("shoot-a", lastRange); ip != "255.255.255.254" {
+		t.Fatalf("expected 255.255.255.254, got %s", ip)
+	}
+	if ip := allocate("shoot-a", lastRange); ip != "255.255.255.255" {
+		t.Fatalf("expected 255.255.255.255, got %s", ip)
+	}
+	if _, err := allocator.AllocateIP("shoot-a", "static-net", lastRange, sets.NewString()); err == nil {
+		t.Fatal("expected the range to be exhausted")
+	}
+	if _, err := allocator.AllocateIP("shoot-a", "static-net", &api.IPAMSpec{CIDR: "10.0.0.0/24", RangeStart: "10.0.0.20", RangeEnd: "10.0.0.10"}, sets.NewString()); err == nil {
+		t.Fatal("expected an empty range to be rejected")
+	}
+}
+
+func TestBuildCloudInitVolumeSource(t *testing.T) {
+	volumeSource := buildCloudInitVolumeSource(api.CloudInitDataSourceConfigDrive, "userdata", "network-data")
+	if volumeSource.CloudInitNoCloud != nil || volumeSource.CloudInitConfigDrive == nil {
+		t.Fatal("expected a ConfigDrive cloud-init volume")
+	}
+	if volumeSource.CloudInitConfigDrive.UserDataSecretRef.Name != "userdata" || volumeSource.CloudInitConfigDrive.NetworkData != "network-data" {
+		t.Fatal("ConfigDrive cloud-init volume doesn't provide the userData and network data")
+	}
+
+	volumeSource = buildCloudInitVolumeSource("", "userdata", "network-data")
+	if volumeSource.CloudInitConfigDrive != nil || volumeSource.CloudInitNoCloud == nil {
+		t.Fatal("expected a NoCloud cloud-init volume by default")
+	}
+}
+
+func TestMergeCloudInitSnippets(t *testing.T) {
+	userData := "#cloud-config\nruncmd:\n- echo userdata\n"
+	snippets := []string{"#!/bin/bash\necho snippet\n"}
+
+	merged, err := mergeCloudInitSnippets(userData, snippets)
+	if err != nil {
+		t.Fatalf("failed to merge cloud-init snippets: %v", err)
+	}
+
+	parts := strings.SplitN(merged, "\n\n", 2)
+	contentTypeHeader := strings.SplitN(parts[0], "\n", 2)[0]
+	_, params, err := mime.ParseMediaType(strings.TrimPrefix(contentTypeHeader, "Content-Type: "))
+	if err != nil {
+		t.Fatalf("failed to parse content type: %v", err)
+	}
+
+	reader := multipart.NewReader(strings.NewReader(parts[1]), params["boundary"])
+	for i, expected := range []struct{ contentType, content string }{
+		{"text/cloud-config", userData},
+		{"text/x-shellscript", snippets[0]},
+	} {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("failed to read part %d: %v", i, err)
+		}
+		if contentType := part.Header.Get("Content-Type"); !strings.HasPrefix(contentType, expected.contentType) {
+			t.Fatalf("expected content type %s of part %d, got %s", expected.contentType, i, contentType)
+		}
+		content, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatalf("failed to read part %d: %v", i, err)
+		}
+		if string(content) != expected.content {
+			t.Fatalf("expected content %q of part %d, got %q", expected.content, i, string(content))
+		}
+	}
+}
+
+func TestRenderUserDataTemplate(t *testing.T) {
+	spec := &api.KubeVirtProviderSpec{
+		Region: "local",
+		Zone:   "local-1",
+		Tags:   map[string]string{machineClassLabel: "class"},
+	}
+
+	rendered, err := renderUserDataTemplate("#cloud-config\nhostname: {{ .MachineName }}.{{ .Zone }}.{{ .MachineClass }}\n", "machine", "default", spec)
+	if err != nil {
+		t.Fatalf("failed to render userData template: %v", err)
+	}
+	if expected := "#cloud-config\nhostname: machine.local-1.class\n"; rendered != expected {
+		t.Fatalf("expected rendered userData %q, got %q", expected, rendered)
+	}
+
+	if _, err := renderUserDataTemplate("hostname: {{ .Unknown }}", "machine", "default", spec); err == nil {
+		t.Fatal("expected an error for unknown template fields")
+	}
+}
+
+func TestPrepareUserData(t *testing.T) {
+	userData := "#cloud-config\n"
+	prepared, err := prepareUserData(userData)
+	if err != nil {
+		t.Fatalf("failed to prepare userData: %v", err)
+	}
+	if string(prepared) != userData {
+		t.Fatal("small userData should not be compressed")
+	}
+
+	userData = "#cloud-config\n" + strings.Repeat("# padding\n", userDataCompressionThreshold)
+	prepared, err = prepareUserData(userData)
+	if err != nil {
+		t.Fatalf("failed to prepare userData: %v", err)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(prepared))
+	if err != nil {
+		t.Fatalf("large userData should be gzipped: %v", err)
+	}
+	decompressed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to decompress userData: %v", err)
+	}
+	if string(decompressed) != userData {
+		t.Fatal("decompressed userData doesn't match the original userData")
+	}
+
+	incompressible := make([]byte, 2*maxUserDataSize)
+	rand.New(rand.NewSource(0)).Read(incompressible)
+	if _, err := prepareUserData(string(incompressible)); !clouderrors.IsUserDataTooLargeError(err) {
+		t.Fatalf("expected UserDataTooLargeError, got %v", err)
+	}
+}
+
+func TestBuildNodeLabelsCloudConfig(t *testing.T) {
+	cloudConfig := buildNodeLabelsCloudConfig(map[string]string{"gpu": "nvidia", "example.com/rack": "r1"})
+	expectedEnvironment := `Environment="KUBELET_EXTRA_ARGS=--node-labels=example.com/rack=r1,gpu=nvidia"`
+	if !strings.HasPrefix(cloudConfig, "#cloud-config\n") || !strings.Contains(cloudConfig, expectedEnvironment) {
+		t.Fatalf("expected cloud-config with %s, got:\n%s", expectedEnvironment, cloudConfig)
+	}
+}
+
+func TestBuildNodeAddresses(t *testing.T) {
+	virtualMachineInstance := &kubevirtv1.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{Name: "machine"},
+		Status: kubevirtv1.VirtualMachineInstanceStatus{
+			Interfaces: []kubevirtv1.VirtualMachineInstanceNetworkInterface{
+				{Name: "default", IP: "10.0.0.2", IPs: []string{"10.0.0.2", "fd00::2"}},
+				{Name: "secondary", IP: "192.168.0.2"},
+			},
+		},
+	}
+
+	addresses := buildNodeAddresses(virtualMachineInstance)
+	expectedAddresses := []corev1.NodeAddress{
+		{Type: corev1.NodeInternalIP, Address: "10.0.0.2"},
+		{Type: corev1.NodeInternalIP, Address: "fd00::2"},
+		{Type: corev1.NodeInternalIP, Address: "192.168.0.2"},
+		{Type: corev1.NodeHostName, Address: "machine"},
+	}
+	if !reflect.DeepEqual(addresses, expectedAddresses) {
+		t.Fatalf("expected addresses %v, got %v", expectedAddresses, addresses)
+	}
+}
+
+func TestMergeAffinity(t *testing.T) {
+	generated := buildAffinity("region", "zone", "topology.kubernetes.io/region", "topology.kubernetes.io/zone")
+	user := &corev1.Affinity{
+		NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+				NodeSelectorTerms: []corev1.NodeSelectorTerm{
+					{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "gpu", Operator: corev1.NodeSelectorOpExists}}},
+					{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "nvme", Operator: corev1.NodeSelectorOpExists}}},
+				},
+			},
+		},
+	}
+
+	if affinity := mergeAffinity(generated, nil, false); affinity != generated {
+		t.Fatalf("expected generated affinity, got %v", affinity)
+	}
+	if affinity := mergeAffinity(generated, user, true); !reflect.DeepEqual(affinity, user) {
+		t.Fatalf("expected user affinity %v, got %v", user, affinity)
+	}
+
+	affinity := mergeAffinity(generated, user, false)
+	for _, term := range affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		if len(term.MatchExpressions) != 3 {
+			t.Fatalf("expected user and generated match expressions, got %v", term.MatchExpressions)
+		}
+	}
+	if len(user.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions) != 1 {
+		t.Fatal("expected user affinity not to be modified")
+	}
+}
+
+func TestAddPoolAntiAffinity(t *testing.T) {
+	generated := buildAffinity("region", "zone", "topology.kubernetes.io/region", "topology.kubernetes.io/zone")
+
+	affinity := addPoolAntiAffinity(generated, "test-machine-class")
+	if affinity.NodeAffinity == nil {
+		t.Fatal("expected node affinity to be kept")
+	}
+	terms := affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+	if len(terms) != 1 || terms[0].PodAffinityTerm.LabelSelector.MatchLabels[machineClassLabel] != "test-machine-class" || terms[0].PodAffinityTerm.TopologyKey != corev1.LabelHostname {
+		t.Fatalf("expected preferred pod anti-affinity for the machine class, got %v", terms)
+	}
+	if generated.PodAntiAffinity != nil {
+		t.Fatal("expected generated affinity not to be modified")
+	}
+}
+
+func TestGetRegionAndZoneLabels(t *testing.T) {
+	tests := []struct {
+		name                string
+		providerSpec        *api.KubeVirtProviderSpec
+		k8sVersion          string
+		expectedRegionLabel string
+		expectedZoneLabel   string
+	}{
+		{"legacy", &api.KubeVirtProviderSpec{}, "v1.16.4", corev1.LabelZoneRegion, corev1.LabelZoneFailureDomain},
+		{"topology", &api.KubeVirtProviderSpec{}, "v1.18.0", "topology.kubernetes.io/region", "topology.kubernetes.io/zone"},
+		{"custom", &api.KubeVirtProviderSpec{RegionLabelKey: "example.com/region", ZoneLabelKey: "example.com/zone"}, "v1.18.0", "example.com/region", "example.com/zone"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			regionLabel, zoneLabel := getRegionAndZoneLabels(test.providerSpec, test.k8sVersion)
+			if regionLabel != test.expectedRegionLabel || zoneLabel != test.expectedZoneLabel {
+				t.Fatalf("expected labels %s and %s, got %s and %s", test.expectedRegionLabel, test.expectedZoneLabel, regionLabel, zoneLabel)
+			}
+		})
+	}
+}
+
+func TestGetVMStatus(t *testing.T) {
+	running := &kubevirtv1.VirtualMachine{Spec: kubevirtv1.VirtualMachineSpec{Running: utilpointer.BoolPtr(true)}}
+	stopped := &kubevirtv1.VirtualMachine{Spec: kubevirtv1.VirtualMachineSpec{Running: utilpointer.BoolPtr(false)}}
+	newVMI := func(phase kubevirtv1.VirtualMachineInstancePhase, conditions ...kubevirtv1.VirtualMachineInstanceCondition) *kubevirtv1.VirtualMachineInstance {
+		return &kubevirtv1.VirtualMachineInstance{Status: kubevirtv1.VirtualMachineInstanceStatus{Phase: phase, Conditions: conditions}}
+	}
+
+	tests := []struct {
+		name                   string
+		virtualMachine         *kubevirtv1.VirtualMachine
+		virtualMachineInstance *kubevirtv1.VirtualMachineInstance
+		dataVolumeStatus       cdi.DataVolumeStatus
+		expectedStatus         string
+	}{
+		{"provisioning", running, nil, cdi.DataVolumeStatus{Phase: cdi.ImportInProgress, Progress: "42%"}, vmStatusProvisioning},
+		{"starting", running, nil, cdi.DataVolumeStatus{Phase: cdi.Succeeded}, vmStatusStarting},
+		{"stopped", stopped, nil, cdi.DataVolumeStatus{}, vmStatusStopped},
+		{"unschedulable", running, newVMI(kubevirtv1.Scheduling, kubevirtv1.VirtualMachineInstanceCondition{
+			Type: kubevirtv1.VirtualMachineInstanceConditionType(corev1.PodScheduled), Status: corev1.ConditionFalse, Reason: corev1.PodReasonUnschedulable,
+		}), cdi.DataVolumeStatus{}, vmStatusUnschedulable},
+		{"running", running, newVMI(kubevirtv1.Running), cdi.DataVolumeStatus{}, vmStatusRunning},
+		{"paused", running, newVMI(kubevirtv1.Running, kubevirtv1.VirtualMachineInstanceCondition{
+			Type: kubevirtv1.VirtualMachineInstancePaused, Status: corev1.ConditionTrue,
+		}), cdi.DataVolumeStatus{}, vmStatusPaused},
+		{"failed", running, newVMI(kubevirtv1.Failed), cdi.DataVolumeStatus{}, vmStatusFailed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status, _ := getVMStatus(test.virtualMachine, test.virtualMachineInstance, test.dataVolumeStatus); status != test.expectedStatus {
+				t.Fatalf("expected status %s, got %s", test.expectedStatus, status)
+			}
+		})
+	}
+}
+
+func TestBuildNodeTemplate(t *testing.T) {
+	providerSpec := &api.KubeVirtProviderSpec{
+		Resources: kubevirtv1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("1500m"),
+				corev1.ResourceMemory: resource.MustParse("4Gi"),
+			},
+		},
+		PVCSize: resource.MustParse("20Gi"),
+		GPUs:    []kubevirtv1.GPU{{Name: "gpu1", DeviceName: "nvidia.com/GP102GL_Tesla_P40"}},
+		Region:  "region",
+		Zone:    "zone",
+	}
+
+	nodeTemplate := BuildNodeTemplate(providerSpec)
+	expectedCapacity := corev1.ResourceList{
+		corev1.ResourceCPU:              resource.MustParse("2"),
+		corev1.ResourceMemory:           resource.MustParse("4Gi"),
+		corev1.ResourceEphemeralStorage: resource.MustParse("20Gi"),
+		gpuResourceName:                 resource.MustParse("1"),
+	}
+	for name, expected := range expectedCapacity {
+		if quantity := nodeTemplate.Capacity[name]; quantity.Cmp(expected) != 0 {
+			t.Fatalf("expected %s capacity %s, got %s", name, expected.String(), quantity.String())
+		}
+	}
+	if len(nodeTemplate.Capacity) != len(expectedCapacity) || nodeTemplate.Region != "region" || nodeTemplate.Zone != "zone" {
+		t.Fatalf("unexpected node template %v", nodeTemplate)
+	}
+
+	providerSpec.CPU = &kubevirtv1.CPU{Cores: 2, Sockets: 2}
+	providerSpec.Memory = &kubevirtv1.Memory{Guest: resourcePtr(resource.MustParse("8Gi"))}
+	nodeTemplate = BuildNodeTemplate(providerSpec)
+	if cpu := nodeTemplate.Capacity[corev1.ResourceCPU]; cpu.Value() != 4 {
+		t.Fatalf("expected 4 vCPUs, got %s", cpu.String())
+	}
+	if memory := nodeTemplate.Capacity[corev1.ResourceMemory]; memory.Cmp(resource.MustParse("8Gi")) != 0 {
+		t.Fatalf("expected 8Gi guest memory, got %s", memory.String())
+	}
+}
+
+func resourcePtr(quantity resource.Quantity) *resource.Quantity {
+	return &quantity
+}
+
+func TestProviderID(t *testing.T) {
+	virtualMachine := &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{Name: "machine", Namespace: "shoot--foo--bar", UID: "1234"},
+	}
+	if providerID := getProviderID(virtualMachine); providerID != ProviderName+"://machine" {
+		t.Fatalf("expected legacy provider ID, got %s", providerID)
+	}
+
+	virtualMachine.Annotations = map[string]string{providerIDFormatAnnotation: providerIDFormatV2}
+	providerID := getProviderID(virtualMachine)
+	if providerID != ProviderName+"://shoot--foo--bar/machine/1234" {
+		t.Fatalf("unexpected provider ID %s", providerID)
+	}
+
+	namespace, name, uid, err := decodeProviderID(providerID)
+	if err != nil || namespace != "shoot--foo--bar" || name != "machine" || uid != "1234" {
+		t.Fatalf("unexpected decoded provider ID %s, %s, %s, %v", namespace, name, uid, err)
+	}
+	namespace, name, uid, err = decodeProviderID(ProviderName + "://machine")
+	if err != nil || namespace != "" || name != "machine" || uid != "" {
+		t.Fatalf("unexpected decoded legacy provider ID %s, %s, %s, %v", namespace, name, uid, err)
+	}
+	for _, invalid := range []string{"", "aws://machine", ProviderName + "://", ProviderName + "://a/b"} {
+		if _, _, _, err := decodeProviderID(invalid); err == nil {
+			t.Fatalf("expected error for provider ID %q", invalid)
+		}
+	}
+}
+
+func TestGetClusterSecret(t *testing.T) {
+	secret := &corev1.Secret{
+		Data: map[string][]byte{
+			"kubeconfig":        []byte("default"),
+			"kubeconfig-zone-b": []byte("zone-b"),
+		},
+	}
+	providerSpec := &api.KubeVirtProviderSpec{
+		Zone:               "zone-a",
+		ZoneKubeconfigKeys: map[string]string{"zone-b": "kubeconfig-zone-b"},
+	}
+
+	if clusterSecret := getClusterSecret(secret, providerSpec); string(clusterSecret.Data["kubeconfig"]) != "default" {
+		t.Fatalf("expected default kubeconfig, got %s", clusterSecret.Data["kubeconfig"])
+	}
+
+	providerSpec.Zone = "zone-b"
+	if clusterSecret := getClusterSecret(secret, providerSpec); string(clusterSecret.Data["kubeconfig"]) != "zone-b" {
+		t.Fatalf("expected kubeconfig of zone-b, got %s", clusterSecret.Data["kubeconfig"])
+	}
+	if string(secret.Data["kubeconfig"]) != "default" {
+		t.Fatal("expected secret not to be modified")
+	}
+}
+
+func TestGetClusterSecretFromToken(t *testing.T) {
+	secret := &corev1.Secret{
+		Data: map[string][]byte{
+			api.ServerKey:    []byte("https://provider:6443"),
+			api.TokenKey:     []byte("token"),
+			api.NamespaceKey: []byte("shoot"),
+		},
+	}
+	providerSpec := &api.KubeVirtProviderSpec{}
+
+	config, namespace, err := ClientOptions{}.getRESTConfig(getClusterSecret(secret, providerSpec))
+	if err != nil {
+		t.Fatalf("failed to get REST config: %v", err)
+	}
+	if config.Host != "https://provider:6443" || config.BearerToken != "token" || namespace != "shoot" {
+		t.Errorf("expected REST config of the token credentials, got host %s, token %s, namespace %s", config.Host, config.BearerToken, namespace)
+	}
+	if _, ok := secret.Data["kubeconfig"]; ok {
+		t.Fatal("expected secret not to be modified")
+	}
+
+	delete(secret.Data, api.TokenKey)
+	if _, _, err := (ClientOptions{}).getRESTConfig(getClusterSecret(secret, providerSpec)); err == nil {
+		t.Fatal("expected error for missing token")
+	}
+}
+
+func TestCachingClientFactory(t *testing.T) {
+	calls := 0
+	cf := NewCachingClientFactory(ClientFactoryFunc(func(secret *corev1.Secret) (client.Client, string, error) {
+		calls++
+		return nil, string(secret.Data["kubeconfig"]), nil
+	}))
+
+	for _, kubeconfig := range []string{"a", "a", "b", "a"} {
+		_, namespace, err := cf.GetClient(&corev1.Secret{Data: map[string][]byte{"kubeconfig": []byte(kubeconfig)}})
+		if err != nil || namespace != kubeconfig {
+			t.Fatalf("unexpected namespace %s or error %v", namespace, err)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 clients to be created, got %d", calls)
+	}
+}
+
+func TestCachingServerVersionFactory(t *testing.T) {
+	calls := 0
+	svf := NewCachingServerVersionFactory(ServerVersionFactoryFunc(func(secret *corev1.Secret) (string, error) {
+		calls++
+		return "1.18", nil
+	}))
+	secret := &corev1.Secret{Data: map[string][]byte{"kubeconfig": []byte("a")}}
+
+	for i := 0; i < 3; i++ {
+		if serverVersion, err := svf.GetServerVersion(secret); err != nil || serverVersion != "1.18" {
+			t.Fatalf("unexpected server version %s or error %v", serverVersion, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected the server version to be got once, got %d", calls)
+	}
+
+	invalidateOnUnauthorized(fmt.Errorf("failed to create VM: %w", kerrors.NewForbidden(kubevirtv1.Resource("virtualmachines"), "vm", nil)), secret, svf)
+	if _, err := svf.GetServerVersion(secret); err != nil || calls != 1 {
+		t.Fatalf("expected the server version to stay cached on other errors, got %d calls, error %v", calls, err)
+	}
+
+	invalidateOnUnauthorized(fmt.Errorf("failed to create VM: %w", kerrors.NewUnauthorized("token expired")), secret, svf)
+	if _, err := svf.GetServerVersion(secret); err != nil || calls != 2 {
+		t.Fatalf("expected the server version to be got again after an Unauthorized error, got %d calls, error %v", calls, err)
+	}
+}
+
+func TestVMStatusWatcher(t *testing.T) {
+	vmInformer := cache.NewSharedIndexInformer(&cache.ListWatch{}, &kubevirtv1.VirtualMachine{}, 0, cache.Indexers{})
+	vmiInformer := cache.NewSharedIndexInformer(&cache.ListWatch{}, &kubevirtv1.VirtualMachineInstance{}, 0, cache.Indexers{})
+	var recorded []string
+	w := newVMStatusWatcher(vmInformer, vmiInformer, func(virtualMachine *kubevirtv1.VirtualMachine, fieldManager string, fields map[string]interface{}) error {
+		if fieldManager == statusFieldManager {
+			annotations := fields["metadata"].(map[string]interface{})["annotations"].(map[string]string)
+			recorded = append(recorded, annotations[statusAnnotation])
+		}
+		return nil
+	})
+
+	objectMeta := metav1.ObjectMeta{Name: "vm", Namespace: "default"}
+	unmanaged := &kubevirtv1.VirtualMachine{ObjectMeta: objectMeta}
+	if err := vmInformer.GetStore().Add(unmanaged); err != nil {
+		t.Fatalf("failed to add VirtualMachine: %v", err)
+	}
+	if err := w.updateStatus("default/vm"); err != nil || len(recorded) != 0 {
+		t.Fatalf("expected no status to be recorded for unmanaged VirtualMachines, got %v, %v", recorded, err)
+	}
+
+	managed := unmanaged.DeepCopy()
+	managed.Labels = map[string]string{machineLabel: "vm"}
+	managed.Annotations = map[string]string{statusAnnotation: vmStatusProvisioning}
+	managed.Spec.Running = utilpointer.BoolPtr(true)
+	if err := vmInformer.GetStore().Update(managed); err != nil {
+		t.Fatalf("failed to update VirtualMachine: %v", err)
+	}
+	if err := w.updateStatus("default/vm"); err != nil || len(recorded) != 0 {
+		t.Fatalf("expected the provisioning status not to be overwritten, got %v, %v", recorded, err)
+	}
+
+	virtualMachineInstance := &kubevirtv1.VirtualMachineInstance{ObjectMeta: objectMeta}
+	virtualMachineInstance.Status.Phase = kubevirtv1.Running
+	if err := vmiInformer.GetStore().Add(virtualMachineInstance); err != nil {
+		t.Fatalf("failed to add VirtualMachineInstance: %v", err)
+	}
+	if err := w.updateStatus("default/vm"); err != nil || len(recorded) != 1 || recorded[0] != vmStatusRunning {
+		t.Fatalf("expected status %s to be recorded, got %v, %v", vmStatusRunning, recorded, err)
+	}
+
+	if err := vmInformer.GetStore().Delete(managed); err != nil {
+		t.Fatalf("failed to delete VirtualMachine: %v", err)
+	}
+	if err := w.updateStatus("default/vm"); err != nil || len(w.statuses) != 0 {
+		t.Fatalf("expected deleted VirtualMachine to be forgotten, got %v, %v", w.statuses, err)
+	}
+}
+
+func TestMaintenanceLimiter(t *testing.T) {
+	l := newMaintenanceLimiter(time.Hour)
+	secret := &corev1.Secret{Data: map[string][]byte{"kubeconfig": []byte("a")}}
+	otherSecret := &corev1.Secret{Data: map[string][]byte{"kubeconfig": []byte("b")}}
+
+	if !l.allow(secret, "default", maintenanceTaskCleanup) {
+		t.Fatal("expected the first run to be allowed")
+	}
+	if l.allow(secret, "default", maintenanceTaskCleanup) {
+		t.Fatal("expected the second run within the interval not to be allowed")
+	}
+	if !l.allow(secret, "default", maintenanceTaskMigration) || !l.allow(secret, "other", maintenanceTaskCleanup) || !l.allow(otherSecret, "default", maintenanceTaskCleanup) {
+		t.Fatal("expected other tasks, namespaces and provider clusters to be allowed")
+	}
+
+	l.lastRuns[maintenanceKey{kubeconfig: sha256.Sum256(secret.Data["kubeconfig"]), namespace: "default", task: maintenanceTaskCleanup}] = time.Now().Add(-time.Hour)
+	if !l.allow(secret, "default", maintenanceTaskCleanup) {
+		t.Fatal("expected the run after the interval to be allowed")
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	kubeconfig := `apiVersion: v1
+kind: Config
+clusters:
+- name: provider
+  cluster:
+    server: https://provider:6443
+contexts:
+- name: provider
+  context:
+    cluster: provider
+    namespace: shoot
+current-context: provider
+`
+	secret := &corev1.Secret{Data: map[string][]byte{"kubeconfig": []byte(kubeconfig)}}
+	clientOptions := ClientOptions{QPS: 50, Burst: 100, Timeout: 30 * time.Second}
+
+	config, namespace, err := clientOptions.getRESTConfig(secret)
+	if err != nil {
+		t.Fatalf("failed to get REST config: %v", err)
+	}
+	if namespace != "shoot" {
+		t.Errorf("expected namespace shoot, got %s", namespace)
+	}
+	if config.QPS != 50 || config.Burst != 100 || config.Timeout != 30*time.Second {
+		t.Errorf("expected client options to be applied, got QPS %v, burst %d, timeout %v", config.QPS, config.Burst, config.Timeout)
+	}
+
+	config, _, err = ClientOptions{}.getRESTConfig(secret)
+	if err != nil {
+		t.Fatalf("failed to get REST config: %v", err)
+	}
+	if config.QPS != 0 || config.Burst != 0 || config.Timeout != 0 {
+		t.Errorf("expected client-go defaults to be kept, got QPS %v, burst %d, timeout %v", config.QPS, config.Burst, config.Timeout)
+	}
+}
+
+func TestExecPluginLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec-plugins")
+	if err != nil {
+		t.Fatalf("failed to create exec plugin directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	plugin := filepath.Join(dir, "token-helper")
+	if err := ioutil.WriteFile(plugin, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("failed to write exec plugin: %v", err)
+	}
+
+	kubeconfig := `apiVersion: v1
+kind: Config
+clusters:
+- name: provider
+  cluster:
+    server: https://provider:6443
+users:
+- name: provider
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: %s
+contexts:
+- name: provider
+  context:
+    cluster: provider
+    user: provider
+current-context: provider
+`
+	testCases := []struct {
+		name            string
+		command         string
+		execPluginDirs  []string
+		expectedCommand string
+		expectedError   bool
+	}{
+		{name: "PATH lookup without exec plugin directories", command: "token-helper", expectedCommand: "token-helper"},
+		{name: "command name in exec plugin directory", command: "token-helper", execPluginDirs: []string{"/nonexistent", dir}, expectedCommand: plugin},
+		{name: "absolute path in exec plugin directory", command: plugin, execPluginDirs: []string{dir}, expectedCommand: plugin},
+		{name: "command name not in exec plugin directories", command: "other-helper", execPluginDirs: []string{dir}, expectedError: true},
+		{name: "absolute path outside of exec plugin directories", command: "/bin/sh", execPluginDirs: []string{dir}, expectedError: true},
+		{name: "relative path", command: "../token-helper", execPluginDirs: []string{dir}, expectedError: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			secret := &corev1.Secret{Data: map[string][]byte{"kubeconfig": []byte(fmt.Sprintf(kubeconfig, tc.command))}}
+			config, _, err := ClientOptions{ExecPluginDirs: tc.execPluginDirs}.getRESTConfig(secret)
+			if tc.expectedError {
+				if err == nil {
+					t.Fatalf("expected error, got command %s", config.ExecProvider.Command)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to get REST config: %v", err)
+			}
+			if config.ExecProvider == nil || config.ExecProvider.Command != tc.expectedCommand {
+				t.Errorf("expected exec auth plugin %s, got %+v", tc.expectedCommand, config.ExecProvider)
+			}
+		})
+	}
+}
+
+func TestRecordVMStatusMetrics(t *testing.T) {
+	virtualMachines := []kubevirtv1.VirtualMachine{
+		{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{statusAnnotation: vmStatusRunning}}},
+		{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{statusAnnotation: vmStatusRunning}}},
+		{},
+	}
+	recordVMStatusMetrics("class", virtualMachines)
+
+	for status, expected := range map[string]float64{vmStatusRunning: 2, vmStatusUnknown: 1, vmStatusFailed: 0} {
+		metric := &dto.Metric{}
+		if err := metrics.VirtualMachines.WithLabelValues("class", status).Write(metric); err != nil {
+			t.Fatalf("failed to read metric: %v", err)
+		}
+		if value := metric.GetGauge().GetValue(); value != expected {
+			t.Errorf("expected %v VMs with status %s, got %v", expected, status, value)
+		}
+	}
+}
+
+func TestCredentialsSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatalf("failed to create credentials directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "seed-1"), 0755); err != nil {
+		t.Fatalf("failed to create credentials path: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "seed-1", api.DefaultKubeconfigKey), []byte("file-kubeconfig"), 0600); err != nil {
+		t.Fatalf("failed to write kubeconfig: %v", err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("service-account-token\n"), 0600); err != nil {
+		t.Fatalf("failed to write service account token: %v", err)
+	}
+
+	reads := 0
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/kubernetes/login":
+			var login map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&login); err != nil || login["role"] != "provider" || login["jwt"] != "service-account-token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, `{"auth":{"client_token":"login-token"}}`)
+		case "/v1/secret/data/seed-1":
+			if token := r.Header.Get("X-Vault-Token"); token != "login-token" && token != "static-token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			reads++
+			fmt.Fprint(w, `{"data":{"data":{"kubeconfig":"vault-kubeconfig"},"metadata":{"version":1}}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+
+	sources := CredentialsOptions{
+		VaultAddress:                 vault.URL,
+		VaultServiceAccountTokenFile: tokenFile,
+		CredentialsDir:               dir,
+	}.Sources()
+
+	testCases := []struct {
+		name               string
+		data               map[string][]byte
+		expectedKubeconfig string
+		expectedError      bool
+	}{
+		{name: "kubeconfig in secret", data: map[string][]byte{api.DefaultKubeconfigKey: []byte("secret-kubeconfig")}, expectedKubeconfig: "secret-kubeconfig"},
+		{name: "vault with kubernetes auth", data: map[string][]byte{api.CredentialsSourceKey: []byte("vault"), api.CredentialsPathKey: []byte("secret/data/seed-1"), "vaultRole": []byte("provider")}, expectedKubeconfig: "vault-kubeconfig"},
+		{name: "vault with token", data: map[string][]byte{api.CredentialsSourceKey: []byte("vault"), api.CredentialsPathKey: []byte("secret/data/seed-1"), "vaultToken": []byte("static-token")}, expectedKubeconfig: "vault-kubeconfig"},
+		{name: "vault with wrong role", data: map[string][]byte{api.CredentialsSourceKey: []byte("vault"), api.CredentialsPathKey: []byte("secret/data/seed-1"), "vaultRole": []byte("other")}, expectedError: true},
+		{name: "file", data: map[string][]byte{api.CredentialsSourceKey: []byte("file"), api.CredentialsPathKey: []byte("seed-1")}, expectedKubeconfig: "file-kubeconfig"},
+		{name: "file outside of credentials directory", data: map[string][]byte{api.CredentialsSourceKey: []byte("file"), api.CredentialsPathKey: []byte("../seed-1")}, expectedError: true},
+		{name: "unknown credentials source", data: map[string][]byte{api.CredentialsSourceKey: []byte("external")}, expectedError: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			secret, err := sources.Resolve(context.Background(), &corev1.Secret{Data: tc.data}, &api.KubeVirtProviderSpec{})
+			if tc.expectedError {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to resolve credentials: %v", err)
+			}
+			if kubeconfig := string(secret.Data[api.DefaultKubeconfigKey]); kubeconfig != tc.expectedKubeconfig {
+				t.Errorf("expected kubeconfig %q, got %q", tc.expectedKubeconfig, kubeconfig)
+			}
+		})
+	}
+
+	if reads != 2 {
+		t.Errorf("expected the vault secret to be read once per token, got %d reads", reads)
+	}
+}
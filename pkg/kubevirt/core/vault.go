@@ -0,0 +1,181 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// vaultTokenKey is the optional key of the credentials secret that contains the Vault token to fetch kubeconfigs with.
+	vaultTokenKey = "vaultToken"
+	// vaultRoleKey is the key of the credentials secret that contains the role the provider logs in to Vault with
+	// via the Kubernetes auth method, if the secret doesn't contain a Vault token.
+	vaultRoleKey = "vaultRole"
+	// vaultCacheTTL is how long secrets fetched from Vault are reused, so that not every call of the provider
+	// hits Vault. Rotated kubeconfigs are picked up after at most this duration.
+	vaultCacheTTL = time.Minute
+)
+
+type cachedVaultSecret struct {
+	data    map[string]interface{}
+	fetched time.Time
+}
+
+// vaultSource fetches kubeconfigs from the key/value secrets engine of Vault, version 1 or 2. The credentials path
+// of credentials secrets is the API path of the Vault secret, e.g. secret/data/provider-clusters/seed-1, and its fields
+// are named after the kubeconfig keys.
+type vaultSource struct {
+	address    string
+	authMount  string
+	tokenFile  string
+	httpClient *http.Client
+
+	mutex       sync.Mutex
+	secretCache map[string]cachedVaultSecret
+}
+
+// GetKubeconfig fetches the Vault secret at the credentials path of the given secret and returns its field with the
+// given key. It authenticates with the Vault token of the secret, or logs in with the Vault role of the secret.
+func (s *vaultSource) GetKubeconfig(ctx context.Context, secret *corev1.Secret, key string) ([]byte, error) {
+	path := strings.Trim(string(secret.Data[api.CredentialsPathKey]), "/")
+	if path == "" {
+		return nil, fmt.Errorf("secret %s is required field", api.CredentialsPathKey)
+	}
+
+	cacheKey := fmt.Sprintf("%x", sha256.Sum256([]byte(path+"\x00"+string(secret.Data[vaultTokenKey])+"\x00"+string(secret.Data[vaultRoleKey]))))
+	data, err := s.getSecret(ctx, cacheKey, path, secret)
+	if err != nil {
+		return nil, err
+	}
+	kubeconfig, ok := data[key].(string)
+	if !ok {
+		return nil, fmt.Errorf("vault secret %s has no field %s", path, key)
+	}
+	return []byte(kubeconfig), nil
+}
+
+// getSecret returns the data of the Vault secret at the given path from the cache, or fetches it if it isn't cached
+// or expired.
+func (s *vaultSource) getSecret(ctx context.Context, cacheKey, path string, secret *corev1.Secret) (map[string]interface{}, error) {
+	now := time.Now()
+	s.mutex.Lock()
+	cached, ok := s.secretCache[cacheKey]
+	s.mutex.Unlock()
+	if ok && now.Sub(cached.fetched) <= vaultCacheTTL {
+		return cached.data, nil
+	}
+
+	token := string(secret.Data[vaultTokenKey])
+	if token == "" {
+		role := string(secret.Data[vaultRoleKey])
+		if role == "" {
+			return nil, fmt.Errorf("secret %s or %s is required field", vaultTokenKey, vaultRoleKey)
+		}
+		var err error
+		if token, err = s.login(ctx, role); err != nil {
+			return nil, err
+		}
+	}
+
+	var response struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := s.do(ctx, http.MethodGet, path, token, nil, &response); err != nil {
+		return nil, fmt.Errorf("failed to read vault secret %s: %w", path, err)
+	}
+	data := response.Data
+	// secrets of the key/value secrets engine version 2 wrap the fields into data and add metadata
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for k, cached := range s.secretCache {
+		if now.Sub(cached.fetched) > vaultCacheTTL {
+			delete(s.secretCache, k)
+		}
+	}
+	s.secretCache[cacheKey] = cachedVaultSecret{data: data, fetched: now}
+	return data, nil
+}
+
+// login logs in to Vault with the given role and the service account token of the provider via the Kubernetes
+// auth method and returns the client token.
+func (s *vaultSource) login(ctx context.Context, role string) (string, error) {
+	jwt, err := ioutil.ReadFile(s.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read service account token: %w", err)
+	}
+	body, err := json.Marshal(map[string]string{"role": role, "jwt": strings.TrimSpace(string(jwt))})
+	if err != nil {
+		return "", err
+	}
+
+	var response struct {
+		Auth *struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := s.do(ctx, http.MethodPost, "auth/"+strings.Trim(s.authMount, "/")+"/login", "", body, &response); err != nil {
+		return "", fmt.Errorf("failed to log in to vault with role %s: %w", role, err)
+	}
+	if response.Auth == nil || response.Auth.ClientToken == "" {
+		return "", errors.New("vault login returned no client token")
+	}
+	return response.Auth.ClientToken, nil
+}
+
+// do sends a request to the given path of the Vault API and decodes the JSON response into the given value.
+func (s *vaultSource) do(ctx context.Context, method, path, token string, body []byte, v interface{}) error {
+	req, err := http.NewRequest(method, s.address+"/v1/"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+)
+
+type vmInformer struct {
+	informer    cache.SharedIndexInformer
+	vmiInformer cache.SharedIndexInformer
+	stopCh      chan struct{}
+	lastUsed    time.Time
+}
+
+// ListVMs lists the VMs matching the given selector from the informer's cache.
+// It returns an error if the cache is not synced yet.
+func (i *vmInformer) ListVMs(selector labels.Selector) ([]kubevirtv1.VirtualMachine, error) {
+	if !i.informer.HasSynced() {
+		return nil, fmt.Errorf("VirtualMachine cache is not synced yet")
+	}
+
+	var virtualMachines []kubevirtv1.VirtualMachine
+	for _, obj := range i.informer.GetStore().List() {
+		virtualMachine, ok := obj.(*kubevirtv1.VirtualMachine)
+		if !ok || !selector.Matches(labels.Set(virtualMachine.Labels)) {
+			continue
+		}
+		virtualMachines = append(virtualMachines, *virtualMachine.DeepCopy())
+	}
+	return virtualMachines, nil
+}
+
+// informerVMListerFactory is a VMListerFactory that runs shared informers on the VMs and VMIs of each provider cluster,
+// keyed by a hash of the kubeconfig, so that listing VMs doesn't require a LIST request to the API server.
+type informerVMListerFactory struct {
+	clientOptions ClientOptions
+	mutex         sync.Mutex
+	informers     map[[sha256.Size]byte]*vmInformer
+}
+
+// NewInformerVMListerFactory returns a VMListerFactory that lists VMs from shared informers, one per kubeconfig,
+// which are started on first use and stopped once they were not used for an hour. It is safe for concurrent use.
+func NewInformerVMListerFactory(clientOptions ClientOptions) VMListerFactory {
+	return &informerVMListerFactory{
+		clientOptions: clientOptions,
+		informers:     map[[sha256.Size]byte]*vmInformer{},
+	}
+}
+
+// GetVMLister returns the VMLister for the kubeconfig saved in the "kubeconfig" field of the given secret,
+// or starts an informer for the namespace of the kubeconfig's current context if there is none.
+func (f *informerVMListerFactory) GetVMLister(secret *corev1.Secret) (VMLister, error) {
+	key := sha256.Sum256(secret.Data["kubeconfig"])
+	now := time.Now()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for k, informer := range f.informers {
+		if now.Sub(informer.lastUsed) > clientCacheTTL {
+			close(informer.stopCh)
+			delete(f.informers, k)
+		}
+	}
+
+	if informer, ok := f.informers[key]; ok {
+		informer.lastUsed = now
+		return informer, nil
+	}
+
+	informer, err := f.newVMInformer(secret)
+	if err != nil {
+		return nil, err
+	}
+	informer.lastUsed = now
+	f.informers[key] = informer
+	return informer, nil
+}
+
+// newVMInformer creates and starts informers on the VMs and VMIs in the namespace of the current context of
+// the kubeconfig saved in the "kubeconfig" field of the given secret. Status changes of the managed VMs
+// are recorded as soon as they are observed.
+func (f *informerVMListerFactory) newVMInformer(secret *corev1.Secret) (*vmInformer, error) {
+	config, namespace, err := f.clientOptions.getRESTConfig(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	// the request timeout would cut off watches, which are closed by the API server after a while anyway
+	config.Timeout = 0
+	config.GroupVersion = &kubevirtv1.GroupVersion
+	config.APIPath = "/apis"
+	config.NegotiatedSerializer = scheme.Codecs.WithoutConversion()
+	restClient, err := rest.RESTClientFor(config)
+	if err != nil {
+		return nil, fmt.Errorf("could not create REST client from REST config: %w", err)
+	}
+
+	vmListWatch := cache.NewListWatchFromClient(restClient, "virtualmachines", namespace, fields.Everything())
+	vmiListWatch := cache.NewListWatchFromClient(restClient, "virtualmachineinstances", namespace, fields.Everything())
+	informer := &vmInformer{
+		informer:    cache.NewSharedIndexInformer(vmListWatch, &kubevirtv1.VirtualMachine{}, 0, cache.Indexers{}),
+		vmiInformer: cache.NewSharedIndexInformer(vmiListWatch, &kubevirtv1.VirtualMachineInstance{}, 0, cache.Indexers{}),
+		stopCh:      make(chan struct{}),
+	}
+	newVMStatusWatcher(informer.informer, informer.vmiInformer, applyVMPatch(restClient))
+
+	logging.Logger{}.V(2).Info("starting VirtualMachine and VirtualMachineInstance informers", "namespace", namespace)
+	go informer.informer.Run(informer.stopCh)
+	go informer.vmiInformer.Run(informer.stopCh)
+	return informer, nil
+}
+
+// Invalidate stops and drops the informers for the kubeconfig saved in the "kubeconfig" field of the given secret.
+func (f *informerVMListerFactory) Invalidate(secret *corev1.Secret) {
+	key := sha256.Sum256(secret.Data["kubeconfig"])
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if informer, ok := f.informers[key]; ok {
+		close(informer.stopCh)
+		delete(f.informers, key)
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// templateNameParameter is the parameter of OpenShift Templates that is set to the machine name.
+const templateNameParameter = "NAME"
+
+var (
+	// templateGVK is the GroupVersionKind of OpenShift Templates.
+	templateGVK = schema.GroupVersionKind{Group: "template.openshift.io", Version: "v1", Kind: "Template"}
+
+	// templateParameterRegexp matches references to parameters in string values of OpenShift Templates.
+	templateParameterRegexp = regexp.MustCompile(`\$\{([a-zA-Z0-9_]+)\}`)
+	// templateNonStringParameterRegexp matches references to parameters of OpenShift Templates whose values
+	// replace whole JSON strings, e.g. numbers or booleans.
+	templateNonStringParameterRegexp = regexp.MustCompile(`"\$\{\{([a-zA-Z0-9_]+)\}\}"`)
+)
+
+// getVMTemplate returns the base VM for the machine with the given name from the given VM template.
+// VirtualMachines are cloned, i.e. the per-VM identities of the base are cleared and its DataVolumeTemplates are prefixed
+// with the machine name, while Templates are processed with their parameters.
+func (p PluginSPIImpl) getVMTemplate(ctx context.Context, c client.Client, machineName, namespace string, vmTemplate *api.VMTemplateSpec) (*kubevirtv1.VirtualMachine, error) {
+	if vmTemplate.Namespace != "" {
+		namespace = vmTemplate.Namespace
+	}
+	key := types.NamespacedName{Namespace: namespace, Name: vmTemplate.Name}
+
+	if vmTemplate.Kind == api.VMTemplateKindTemplate {
+		template := &unstructured.Unstructured{}
+		template.SetGroupVersionKind(templateGVK)
+		if err := c.Get(ctx, key, template); err != nil {
+			return nil, fmt.Errorf("failed to get Template %s: %w", key, err)
+		}
+		return processTemplate(template, machineName, vmTemplate.Parameters)
+	}
+
+	base := &kubevirtv1.VirtualMachine{}
+	if err := c.Get(ctx, key, base); err != nil {
+		return nil, fmt.Errorf("failed to get VirtualMachine template %s: %w", key, err)
+	}
+	cloneVMTemplate(base, machineName)
+	return base, nil
+}
+
+// cloneVMTemplate clears the identities of the given base VM that must be unique per VM, i.e. its hostname, firmware UUID
+// and serial and the MAC addresses of its interfaces, and prefixes the names of its DataVolumeTemplates, and the
+// volumes referring to them, with the given machine name.
+func cloneVMTemplate(base *kubevirtv1.VirtualMachine, machineName string) {
+	if base.Spec.Template == nil {
+		return
+	}
+	spec := &base.Spec.Template.Spec
+	spec.Hostname = ""
+	if spec.Domain.Firmware != nil {
+		spec.Domain.Firmware.UUID = ""
+		spec.Domain.Firmware.Serial = ""
+	}
+	for i := range spec.Domain.Devices.Interfaces {
+		spec.Domain.Devices.Interfaces[i].MacAddress = ""
+	}
+
+	for i := range base.Spec.DataVolumeTemplates {
+		dataVolumeTemplate := &base.Spec.DataVolumeTemplates[i]
+		name := fmt.Sprintf("%s-%s", machineName, dataVolumeTemplate.Name)
+		for j := range spec.Volumes {
+			volume := &spec.Volumes[j]
+			if volume.DataVolume != nil && volume.DataVolume.Name == dataVolumeTemplate.Name {
+				volume.DataVolume.Name = name
+			}
+			if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == dataVolumeTemplate.Name {
+				volume.PersistentVolumeClaim.ClaimName = name
+			}
+		}
+		dataVolumeTemplate.Name = name
+	}
+}
+
+// processTemplate returns the VirtualMachine object of the given OpenShift Template, with the references to the parameters
+// of the Template replaced by their values. The given values take precedence over the values of the Template,
+// and the NAME parameter is set to the given machine name.
+func processTemplate(template *unstructured.Unstructured, machineName string, values map[string]string) (*kubevirtv1.VirtualMachine, error) {
+	parameters, _, err := unstructured.NestedSlice(template.Object, "parameters")
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameters of Template %s: %w", template.GetName(), err)
+	}
+	resolved := map[string]string{}
+	for _, parameter := range parameters {
+		parameter, ok := parameter.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid parameter of Template %s", template.GetName())
+		}
+		name, _ := parameter["name"].(string)
+		value, _ := parameter["value"].(string)
+		if v, ok := values[name]; ok {
+			value = v
+		}
+		if name == templateNameParameter {
+			value = machineName
+		}
+		if required, _ := parameter["required"].(bool); required && value == "" {
+			return nil, fmt.Errorf("parameter %s of Template %s is required", name, template.GetName())
+		}
+		resolved[name] = value
+	}
+	for name := range values {
+		if _, ok := resolved[name]; !ok {
+			return nil, fmt.Errorf("template %s has no parameter %s", template.GetName(), name)
+		}
+	}
+
+	objects, _, err := unstructured.NestedSlice(template.Object, "objects")
+	if err != nil {
+		return nil, fmt.Errorf("invalid objects of Template %s: %w", template.GetName(), err)
+	}
+	var base *kubevirtv1.VirtualMachine
+	for _, object := range objects {
+		object, ok := object.(map[string]interface{})
+		if !ok || object["kind"] != "VirtualMachine" {
+			continue
+		}
+		if base != nil {
+			return nil, fmt.Errorf("template %s contains more than one VirtualMachine", template.GetName())
+		}
+		data, err := json.Marshal(object)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VirtualMachine of Template %s: %w", template.GetName(), err)
+		}
+		base = &kubevirtv1.VirtualMachine{}
+		if err := json.Unmarshal(substituteTemplateParameters(data, resolved), base); err != nil {
+			return nil, fmt.Errorf("invalid VirtualMachine of Template %s: %w", template.GetName(), err)
+		}
+	}
+	if base == nil {
+		return nil, fmt.Errorf("template %s contains no VirtualMachine", template.GetName())
+	}
+	return base, nil
+}
+
+// substituteTemplateParameters replaces the references to the given parameters in the given JSON, i.e. ${PARAMETER}
+// in strings with the value and "${{PARAMETER}}" with the value as JSON literal if it is valid JSON.
+// References to unknown parameters are kept.
+func substituteTemplateParameters(data []byte, parameters map[string]string) []byte {
+	data = templateNonStringParameterRegexp.ReplaceAllFunc(data, func(reference []byte) []byte {
+		value, ok := parameters[string(templateNonStringParameterRegexp.FindSubmatch(reference)[1])]
+		if !ok {
+			return reference
+		}
+		if json.Valid([]byte(value)) {
+			return []byte(value)
+		}
+		quoted, _ := json.Marshal(value)
+		return quoted
+	})
+	return templateParameterRegexp.ReplaceAllFunc(data, func(reference []byte) []byte {
+		value, ok := parameters[string(templateParameterRegexp.FindSubmatch(reference)[1])]
+		if !ok {
+			return reference
+		}
+		quoted, _ := json.Marshal(value)
+		return quoted[1 : len(quoted)-1]
+	})
+}
+
+// applyVMTemplate merges the given base VM into the given VM built from the provider spec, whose settings take precedence.
+// The volumes of the VM replace the volumes of the base with the same name, the volume of the base with the given root disk
+// name and the cloud-init volumes of the base, along with their disks. DataVolumeTemplates of the base that are no longer
+// referenced are dropped. The interfaces and networks of the base are kept if the given useBaseNetworks is true.
+func applyVMTemplate(virtualMachine, base *kubevirtv1.VirtualMachine, rootDiskName string, useBaseNetworks bool) error {
+	virtualMachine.Labels = mergeStringMaps(base.Labels, virtualMachine.Labels)
+	virtualMachine.Annotations = mergeStringMaps(base.Annotations, virtualMachine.Annotations)
+	if base.Spec.Template == nil {
+		return nil
+	}
+
+	template := virtualMachine.Spec.Template
+	template.ObjectMeta.Labels = mergeStringMaps(base.Spec.Template.ObjectMeta.Labels, template.ObjectMeta.Labels)
+	template.ObjectMeta.Annotations = mergeStringMaps(base.Spec.Template.ObjectMeta.Annotations, template.ObjectMeta.Annotations)
+
+	spec, baseSpec := &template.Spec, base.Spec.Template.Spec
+	domain, baseDomain := &spec.Domain, baseSpec.Domain
+	if domain.CPU == nil {
+		domain.CPU = baseDomain.CPU
+	}
+	if domain.Memory == nil {
+		domain.Memory = baseDomain.Memory
+	}
+	if domain.Machine.Type == "" {
+		domain.Machine = baseDomain.Machine
+	}
+	if domain.Firmware == nil {
+		domain.Firmware = baseDomain.Firmware
+	}
+	if domain.Clock == nil {
+		domain.Clock = baseDomain.Clock
+	}
+	if domain.Features == nil {
+		domain.Features = baseDomain.Features
+	}
+	if domain.IOThreadsPolicy == nil {
+		domain.IOThreadsPolicy = baseDomain.IOThreadsPolicy
+	}
+	if domain.Chassis == nil {
+		domain.Chassis = baseDomain.Chassis
+	}
+
+	devices := baseDomain.Devices
+	if len(domain.Devices.GPUs) > 0 {
+		devices.GPUs = domain.Devices.GPUs
+	}
+	if !useBaseNetworks || len(baseSpec.Networks) == 0 {
+		devices.Interfaces = domain.Devices.Interfaces
+		devices.AutoattachPodInterface = domain.Devices.AutoattachPodInterface
+	} else {
+		spec.Networks = baseSpec.Networks
+	}
+
+	replaced := sets.NewString(rootDiskName)
+	for _, volume := range spec.Volumes {
+		replaced.Insert(volume.Name)
+	}
+	for _, volume := range baseSpec.Volumes {
+		if volume.CloudInitNoCloud != nil || volume.CloudInitConfigDrive != nil {
+			replaced.Insert(volume.Name)
+		}
+	}
+	referenced := sets.NewString()
+	for _, volume := range baseSpec.Volumes {
+		if replaced.Has(volume.Name) {
+			continue
+		}
+		spec.Volumes = append(spec.Volumes, volume)
+		if volume.DataVolume != nil {
+			referenced.Insert(volume.DataVolume.Name)
+		}
+		if volume.PersistentVolumeClaim != nil {
+			referenced.Insert(volume.PersistentVolumeClaim.ClaimName)
+		}
+	}
+	disks := domain.Devices.Disks
+	for _, disk := range baseDomain.Devices.Disks {
+		if !replaced.Has(disk.Name) {
+			disks = append(disks, disk)
+		}
+	}
+	devices.Disks = disks
+	domain.Devices = devices
+
+	existing := sets.NewString()
+	for _, dataVolumeTemplate := range virtualMachine.Spec.DataVolumeTemplates {
+		existing.Insert(dataVolumeTemplate.Name)
+	}
+	for _, dataVolumeTemplate := range base.Spec.DataVolumeTemplates {
+		if !referenced.Has(dataVolumeTemplate.Name) {
+			continue
+		}
+		if existing.Has(dataVolumeTemplate.Name) {
+			return fmt.Errorf("DataVolumeTemplate %s of the VM template conflicts with the root disk, set rootDiskName to replace it", dataVolumeTemplate.Name)
+		}
+		dataVolumeTemplate.Namespace = virtualMachine.Namespace
+		virtualMachine.Spec.DataVolumeTemplates = append(virtualMachine.Spec.DataVolumeTemplates, dataVolumeTemplate)
+	}
+
+	if len(baseSpec.NodeSelector) > 0 {
+		spec.NodeSelector = mergeStringMaps(baseSpec.NodeSelector, spec.NodeSelector)
+	}
+	spec.Tolerations = append(baseSpec.Tolerations, spec.Tolerations...)
+	if spec.PriorityClassName == "" {
+		spec.PriorityClassName = baseSpec.PriorityClassName
+	}
+	if spec.EvictionStrategy == nil {
+		spec.EvictionStrategy = baseSpec.EvictionStrategy
+	}
+	if spec.LivenessProbe == nil {
+		spec.LivenessProbe = baseSpec.LivenessProbe
+	}
+	if spec.ReadinessProbe == nil {
+		spec.ReadinessProbe = baseSpec.ReadinessProbe
+	}
+	if spec.Hostname == "" {
+		spec.Hostname = baseSpec.Hostname
+	}
+	if spec.Subdomain == "" {
+		spec.Subdomain = baseSpec.Subdomain
+	}
+	if spec.DNSPolicy == "" {
+		spec.DNSPolicy = baseSpec.DNSPolicy
+	}
+	if spec.DNSConfig == nil {
+		spec.DNSConfig = baseSpec.DNSConfig
+	}
+	return nil
+}
+
+// mergeStringMaps returns a map with the entries of both given maps, where the entries of the override take precedence.
+func mergeStringMaps(base, override map[string]string) map[string]string {
+	if len(base) == 0 {
+		return override
+	}
+	merged := map[string]string{}
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range override {
+		merged[k] = v
+	}
+	return merged
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	cdi "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+)
+
+// vmStatusWatcher observes the managed VMs and their VMIs through informers and records status changes
+// in the status annotations of the VMs as soon as they happen, instead of only when GetMachineStatus is called.
+// It also records the running VMIs of preemptible VMs and the restarts of VMs with a crash loop remediation, and stops
+// preemptible VMs as soon as their VMIs failed or were evicted as well as crash-looping VMs, as the machine controller
+// rarely checks the status of running machines.
+type vmStatusWatcher struct {
+	vmInformer  cache.SharedIndexInformer
+	vmiInformer cache.SharedIndexInformer
+	// apply applies the given fields of the given VM as the given field manager.
+	apply func(virtualMachine *kubevirtv1.VirtualMachine, fieldManager string, fields map[string]interface{}) error
+
+	mutex    sync.Mutex
+	statuses map[string]string
+}
+
+// newVMStatusWatcher creates a vmStatusWatcher and registers its event handlers on the given informers.
+func newVMStatusWatcher(vmInformer, vmiInformer cache.SharedIndexInformer, apply func(*kubevirtv1.VirtualMachine, string, map[string]interface{}) error) *vmStatusWatcher {
+	w := &vmStatusWatcher{
+		vmInformer:  vmInformer,
+		vmiInformer: vmiInformer,
+		apply:       apply,
+		statuses:    map[string]string{},
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    w.onChange,
+		UpdateFunc: func(_, obj interface{}) { w.onChange(obj) },
+		DeleteFunc: w.onChange,
+	}
+	vmInformer.AddEventHandler(handler)
+	vmiInformer.AddEventHandler(handler)
+	return w
+}
+
+func (w *vmStatusWatcher) onChange(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		logging.Logger{}.Error(err, "could not get key of object")
+		return
+	}
+	if err := w.updateStatus(key); err != nil {
+		logging.Logger{}.Error(err, "could not update status of VirtualMachine", "vm", key)
+	}
+}
+
+// updateStatus determines the status of the managed VM with the given key from the informer caches,
+// and records it if it changed since it was last observed.
+func (w *vmStatusWatcher) updateStatus(key string) error {
+	obj, exists, err := w.vmInformer.GetStore().GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		w.mutex.Lock()
+		_, managed := w.statuses[key]
+		delete(w.statuses, key)
+		w.mutex.Unlock()
+		if managed {
+			logging.Logger{}.Info("VirtualMachine was deleted", "vm", key)
+		}
+		return nil
+	}
+	virtualMachine := obj.(*kubevirtv1.VirtualMachine)
+	if _, ok := virtualMachine.Labels[machineLabel]; !ok {
+		return nil
+	}
+
+	var virtualMachineInstance *kubevirtv1.VirtualMachineInstance
+	if obj, exists, err := w.vmiInformer.GetStore().GetByKey(key); err != nil {
+		return err
+	} else if exists {
+		virtualMachineInstance = obj.(*kubevirtv1.VirtualMachineInstance)
+	}
+
+	if _, ok := virtualMachine.Labels[preemptibleLabel]; ok && !isPreemptedVM(virtualMachine) {
+		if reason := getPreemptionReason(virtualMachine, virtualMachineInstance); reason != "" {
+			logging.Logger{}.Info("VirtualMachine was preempted, stopping it", "vm", key, "reason", reason)
+			if err := w.apply(virtualMachine.DeepCopy(), runningFieldManager, runningFields(false)); err != nil {
+				return err
+			}
+			return w.apply(virtualMachine.DeepCopy(), statusFieldManager, statusFields(vmStatusPreempted, reason))
+		}
+	}
+
+	if uid := getRunningVMIToRecord(virtualMachine, virtualMachineInstance); uid != "" {
+		if err := w.apply(virtualMachine.DeepCopy(), runningVMIFieldManager, runningVMIFields(uid)); err != nil {
+			return err
+		}
+	}
+
+	if maxRestarts, ok := virtualMachine.Annotations[maxRestartsAnnotation]; ok {
+		restarts, changed := countRestarts(virtualMachine, virtualMachineInstance)
+		if changed {
+			if err := w.apply(virtualMachine.DeepCopy(), crashLoopFieldManager, crashLoopFields(string(virtualMachineInstance.UID), restarts, maxRestarts)); err != nil {
+				return err
+			}
+		}
+		running := virtualMachine.Spec.Running != nil && *virtualMachine.Spec.Running
+		if running && exceedsMaxRestarts(virtualMachine, restarts) {
+			logging.Logger{}.Info("VirtualMachine exceeded the maximum restarts, stopping it so that the machine gets replaced", "vm", key, "restarts", restarts)
+			if err := w.apply(virtualMachine.DeepCopy(), runningFieldManager, runningFields(false)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the root disk DataVolume is not watched, hence the VM is reported as starting while it is provisioned,
+	// which must not overwrite the status recorded by GetMachineStatus
+	status, message := getVMStatus(virtualMachine, virtualMachineInstance, cdi.DataVolumeStatus{})
+	current := virtualMachine.Annotations[statusAnnotation]
+	if status == vmStatusStarting && current == vmStatusProvisioning {
+		return nil
+	}
+
+	w.mutex.Lock()
+	previous, observed := w.statuses[key]
+	w.statuses[key] = status
+	w.mutex.Unlock()
+	if !observed || previous != status {
+		logging.Logger{}.Info("VirtualMachine status changed", "vm", key, "status", status)
+	}
+
+	if current == status && virtualMachine.Annotations[statusMessageAnnotation] == message {
+		return nil
+	}
+	observeRootDiskImport(virtualMachine, status)
+	return w.apply(virtualMachine.DeepCopy(), statusFieldManager, statusFields(status, message))
+}
+
+// applyVMPatch returns a function that applies fields of VMs with server-side applies through the given REST client.
+func applyVMPatch(restClient rest.Interface) func(*kubevirtv1.VirtualMachine, string, map[string]interface{}) error {
+	return func(virtualMachine *kubevirtv1.VirtualMachine, fieldManager string, fields map[string]interface{}) error {
+		patch, err := vmApplyPatch(virtualMachine, fields)
+		if err != nil {
+			return err
+		}
+		if err := restClient.Patch(types.ApplyPatchType).
+			Namespace(virtualMachine.Namespace).
+			Resource("virtualmachines").
+			Name(virtualMachine.Name).
+			Param("fieldManager", fieldManager).
+			Param("force", "true").
+			Body(patch).
+			Do().
+			Error(); err != nil {
+			return fmt.Errorf("failed to apply VirtualMachine %s as %s: %w", virtualMachine.Name, fieldManager, err)
+		}
+		return nil
+	}
+}
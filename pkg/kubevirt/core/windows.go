@@ -0,0 +1,159 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+
+	corev1 "k8s.io/api/core/v1"
+	utilpointer "k8s.io/utils/pointer"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+)
+
+const (
+	// windowsDiskBus is the default bus of the disks of Windows VMs, which Windows supports without virtio drivers.
+	windowsDiskBus = "sata"
+	// windowsInterfaceModel is the default model of the network interfaces of Windows VMs,
+	// which Windows supports without virtio drivers.
+	windowsInterfaceModel = "e1000"
+	// windowsSpinlockRetries is the number of retries of the Hyper-V spinlock enlightenment recommended for Windows.
+	windowsSpinlockRetries = uint32(8191)
+	// winRMHTTPSPort is the port of the WinRM HTTPS listener of Windows VMs.
+	winRMHTTPSPort = 5986
+
+	// virtioDriversVolumeName is the name of the CD-ROM volume with the virtio-win drivers of Windows VMs.
+	virtioDriversVolumeName = "virtiodrivers"
+	// sysprepVolumeName is the name of the CD-ROM volume with the sysprep answer file of Windows VMs.
+	sysprepVolumeName = "sysprep"
+)
+
+// applyWindowsProfile configures the given VMI spec to run Windows as specified by the given Windows spec,
+// i.e. sets the APIC and Hyper-V enlightenments unless given by the features of the provider spec, the clock, the buses of the root and cloud-init disks, the models of the
+// network interfaces that don't specify one, and attaches the virtio drivers and the sysprep answer file as CD-ROMs.
+func applyWindowsProfile(vmiSpec *kubevirtv1.VirtualMachineInstanceSpec, windows *api.WindowsSpec) {
+	domain := &vmiSpec.Domain
+	spinlockRetries := windowsSpinlockRetries
+
+	if domain.Features == nil {
+		domain.Features = &kubevirtv1.Features{}
+	}
+	if domain.Features.APIC == nil {
+		domain.Features.APIC = &kubevirtv1.FeatureAPIC{}
+	}
+	if domain.Features.Hyperv == nil {
+		domain.Features.Hyperv = &kubevirtv1.FeatureHyperv{
+			Relaxed:   &kubevirtv1.FeatureState{},
+			VAPIC:     &kubevirtv1.FeatureState{},
+			Spinlocks: &kubevirtv1.FeatureSpinlocks{Retries: &spinlockRetries},
+		}
+	}
+	domain.Clock = &kubevirtv1.Clock{
+		ClockOffset: kubevirtv1.ClockOffset{UTC: &kubevirtv1.ClockOffsetUTC{}},
+		Timer: &kubevirtv1.Timer{
+			HPET:   &kubevirtv1.HPETTimer{Enabled: utilpointer.BoolPtr(false)},
+			PIT:    &kubevirtv1.PITTimer{TickPolicy: kubevirtv1.PITTickPolicyDelay},
+			RTC:    &kubevirtv1.RTCTimer{TickPolicy: kubevirtv1.RTCTickPolicyCatchup},
+			Hyperv: &kubevirtv1.HypervTimer{},
+		},
+	}
+
+	bus := windows.DiskBus
+	if bus == "" {
+		bus = windowsDiskBus
+	}
+	for i := range domain.Devices.Disks {
+		disk := &domain.Devices.Disks[i]
+		if (disk.Name == "datavolumedisk" || disk.Name == "cloudinitdisk") && disk.Disk != nil {
+			disk.Disk.Bus = bus
+		}
+	}
+
+	model := windows.InterfaceModel
+	if model == "" {
+		model = windowsInterfaceModel
+	}
+	for i := range domain.Devices.Interfaces {
+		if domain.Devices.Interfaces[i].Model == "" {
+			domain.Devices.Interfaces[i].Model = model
+		}
+	}
+
+	image := windows.VirtioDriversImage
+	if image == "" {
+		image = api.DefaultVirtioDriversImage
+	}
+	addCDRom(vmiSpec, virtioDriversVolumeName, kubevirtv1.VolumeSource{
+		ContainerDisk: &kubevirtv1.ContainerDiskSource{Image: image},
+	})
+
+	if sysprep := windows.Sysprep; sysprep != nil {
+		source := kubevirtv1.VolumeSource{}
+		if sysprep.ConfigMapName != "" {
+			source.ConfigMap = &kubevirtv1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: sysprep.ConfigMapName},
+			}
+		} else {
+			source.Secret = &kubevirtv1.SecretVolumeSource{SecretName: sysprep.SecretName}
+		}
+		addCDRom(vmiSpec, sysprepVolumeName, source)
+	}
+}
+
+// addCDRom attaches a volume with the given name and source to the given VMI spec as a SATA CD-ROM.
+func addCDRom(vmiSpec *kubevirtv1.VirtualMachineInstanceSpec, name string, source kubevirtv1.VolumeSource) {
+	vmiSpec.Domain.Devices.Disks = append(vmiSpec.Domain.Devices.Disks, kubevirtv1.Disk{
+		Name:       name,
+		DiskDevice: kubevirtv1.DiskDevice{CDRom: &kubevirtv1.CDRomTarget{Bus: "sata"}},
+	})
+	vmiSpec.Volumes = append(vmiSpec.Volumes, kubevirtv1.Volume{
+		Name:         name,
+		VolumeSource: source,
+	})
+}
+
+// buildWindowsBootstrapScript builds a PowerShell script for cloudbase-init that enables the given remote management path.
+// With SSH, the given SSH keys are authorized for the administrators.
+func buildWindowsBootstrapScript(bootstrap api.WindowsBootstrap, sshKeys []string) string {
+	var script strings.Builder
+	script.WriteString("#ps1_sysnative\n")
+	script.WriteString("$ErrorActionPreference = 'Stop'\n")
+
+	if bootstrap == api.WindowsBootstrapSSH {
+		script.WriteString("Add-WindowsCapability -Online -Name OpenSSH.Server~~~~0.0.1.0\n")
+		script.WriteString("Set-Service -Name sshd -StartupType Automatic\n")
+		script.WriteString("Start-Service sshd\n")
+		script.WriteString("New-NetFirewallRule -Name sshd -DisplayName 'OpenSSH Server' -Direction Inbound -Protocol TCP -LocalPort 22 -Action Allow\n")
+		if len(sshKeys) > 0 {
+			script.WriteString("$authorizedKeys = \"$env:ProgramData\\ssh\\administrators_authorized_keys\"\n")
+			script.WriteString("Set-Content -Path $authorizedKeys -Value @'\n")
+			for _, key := range sshKeys {
+				script.WriteString(key)
+				script.WriteString("\n")
+			}
+			script.WriteString("'@\n")
+			script.WriteString("icacls.exe $authorizedKeys /inheritance:r /grant 'Administrators:F' /grant 'SYSTEM:F'\n")
+		}
+		return script.String()
+	}
+
+	script.WriteString("Enable-PSRemoting -SkipNetworkProfileCheck -Force\n")
+	script.WriteString("$cert = New-SelfSignedCertificate -DnsName $env:COMPUTERNAME -CertStoreLocation Cert:\\LocalMachine\\My\n")
+	script.WriteString("New-Item -Path WSMan:\\localhost\\Listener -Transport HTTPS -Address * -CertificateThumbPrint $cert.Thumbprint -Force\n")
+	script.WriteString(fmt.Sprintf("New-NetFirewallRule -Name winrm-https -DisplayName 'WinRM HTTPS' -Direction Inbound -Protocol TCP -LocalPort %d -Action Allow\n", winRMHTTPSPort))
+	return script.String()
+}
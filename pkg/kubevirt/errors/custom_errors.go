@@ -40,3 +40,102 @@ func IsMachineNotFoundError(err error) bool {
 		return false
 	}
 }
+
+// UserDataTooLargeError is used to indicate that the userData of a machine exceeds the size that can be passed to the VM,
+// even after compression.
+type UserDataTooLargeError struct {
+	// Size is the size of the compressed userData in bytes
+	Size int
+	// Limit is the maximum size of the userData in bytes
+	Limit int
+}
+
+// Error returns the UserDataTooLargeError message with the userData size and limit.
+func (e *UserDataTooLargeError) Error() string {
+	return fmt.Sprintf("userData size of %d bytes after compression exceeds the limit of %d bytes", e.Size, e.Limit)
+}
+
+// IsUserDataTooLargeError identifies UserDataTooLargeError and returns true if it is and false if not.
+func IsUserDataTooLargeError(err error) bool {
+	switch err.(type) {
+	case *UserDataTooLargeError:
+		return true
+	default:
+		return false
+	}
+}
+
+// InsufficientCapacityError is used to indicate that no node of the provider cluster has enough allocatable resources
+// for a machine.
+type InsufficientCapacityError struct {
+	// Requests are the resource requests of the machine
+	Requests string
+}
+
+// Error returns the InsufficientCapacityError message with the resource requests.
+func (e *InsufficientCapacityError) Error() string {
+	return fmt.Sprintf("no schedulable node has enough allocatable resources for requests %s", e.Requests)
+}
+
+// IsInsufficientCapacityError identifies InsufficientCapacityError and returns true if it is and false if not.
+func IsInsufficientCapacityError(err error) bool {
+	switch err.(type) {
+	case *InsufficientCapacityError:
+		return true
+	default:
+		return false
+	}
+}
+
+// QuotaExceededError is used to indicate that creating a machine would exceed a ResourceQuota of the provider cluster.
+type QuotaExceededError struct {
+	// Quota is the name of the exceeded ResourceQuota
+	Quota string
+	// Resource is the name of the exceeded resource
+	Resource string
+	// Requested is the quantity of the resource requested by the machine
+	Requested string
+	// Used is the quantity of the resource already used
+	Used string
+	// Hard is the quantity of the resource allowed by the ResourceQuota
+	Hard string
+}
+
+// Error returns the QuotaExceededError message with the exceeded resource and its quantities.
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("exceeded quota %s for %s: requested %s, used %s, limited %s", e.Quota, e.Resource, e.Requested, e.Used, e.Hard)
+}
+
+// IsQuotaExceededError identifies QuotaExceededError and returns true if it is and false if not.
+func IsQuotaExceededError(err error) bool {
+	switch err.(type) {
+	case *QuotaExceededError:
+		return true
+	default:
+		return false
+	}
+}
+
+// MachinePreemptedError is used to indicate that the VM of a preemptible machine was preempted, e.g. evicted
+// in favor of VMs with a higher priority, and stopped so that the machine gets replaced.
+type MachinePreemptedError struct {
+	// Name is the machine name
+	Name string
+	// Reason describes how the VM was preempted
+	Reason string
+}
+
+// Error returns the MachinePreemptedError message with the machine name and reason.
+func (e *MachinePreemptedError) Error() string {
+	return fmt.Sprintf("machine %s was preempted: %s", e.Name, e.Reason)
+}
+
+// IsMachinePreemptedError identifies MachinePreemptedError and returns true if it is and false if not.
+func IsMachinePreemptedError(err error) bool {
+	switch err.(type) {
+	case *MachinePreemptedError:
+		return true
+	default:
+		return false
+	}
+}
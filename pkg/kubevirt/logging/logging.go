@@ -0,0 +1,178 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging provides structured logging with key/value pairs on top of klog.
+// Its Logger follows the API of logr, so that it can be replaced by logr once it is available.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"k8s.io/klog"
+)
+
+// Format is the format of log messages.
+type Format string
+
+const (
+	// FormatText formats log messages as the message followed by key="value" pairs.
+	FormatText Format = "text"
+	// FormatJSON formats log messages as JSON objects with the message in the "msg" field.
+	FormatJSON Format = "json"
+)
+
+var format = FormatText
+
+// String returns the format.
+func (f *Format) String() string {
+	return string(*f)
+}
+
+// Set sets the format to the given value, which must be text or json.
+func (f *Format) Set(value string) error {
+	switch Format(value) {
+	case FormatText, FormatJSON:
+		*f = Format(value)
+		return nil
+	default:
+		return fmt.Errorf("unsupported log format %q, must be %s or %s", value, FormatText, FormatJSON)
+	}
+}
+
+// Type returns the type of the format flag.
+func (f *Format) Type() string {
+	return "string"
+}
+
+// AddFlags adds the flag of the log format to the given flag set.
+func AddFlags(fs *pflag.FlagSet) {
+	fs.Var(&format, "log-format", "Format of log messages, text or json. Combine json with --skip-headers to get plain JSON lines")
+}
+
+// Logger logs structured messages with key/value pairs through klog. The zero value logs without any key/value pairs.
+type Logger struct {
+	level  klog.Level
+	values []interface{}
+}
+
+// WithValues returns a logger that adds the given key/value pairs to all messages.
+func (l Logger) WithValues(keysAndValues ...interface{}) Logger {
+	values := make([]interface{}, 0, len(l.values)+len(keysAndValues))
+	l.values = append(append(values, l.values...), keysAndValues...)
+	return l
+}
+
+// V returns a logger that only logs if klog's verbosity is at least the given level.
+func (l Logger) V(level klog.Level) Logger {
+	l.level = level
+	return l
+}
+
+// Enabled returns whether the logger logs at its level.
+func (l Logger) Enabled() bool {
+	return bool(klog.V(l.level))
+}
+
+// Info logs the given message with the given key/value pairs if the logger is enabled.
+func (l Logger) Info(msg string, keysAndValues ...interface{}) {
+	if l.Enabled() {
+		klog.InfoDepth(1, l.format(msg, nil, keysAndValues))
+	}
+}
+
+// Error logs the given error and message with the given key/value pairs, regardless of the level of the logger.
+func (l Logger) Error(err error, msg string, keysAndValues ...interface{}) {
+	klog.ErrorDepth(1, l.format(msg, err, keysAndValues))
+}
+
+func (l Logger) format(msg string, err error, keysAndValues []interface{}) string {
+	values := append(append([]interface{}{}, l.values...), keysAndValues...)
+	if err != nil {
+		values = append(values, "error", err.Error())
+	}
+	if len(values)%2 != 0 {
+		values = append(values, "(MISSING)")
+	}
+	msg = Redact(msg)
+	for i := 1; i < len(values); i += 2 {
+		values[i] = redactValue(values[i])
+	}
+
+	if format == FormatJSON {
+		buf := &bytes.Buffer{}
+		buf.WriteString(`{"msg":`)
+		writeJSON(buf, msg)
+		for i := 0; i < len(values); i += 2 {
+			buf.WriteByte(',')
+			writeJSON(buf, fmt.Sprint(values[i]))
+			buf.WriteByte(':')
+			writeJSON(buf, values[i+1])
+		}
+		buf.WriteByte('}')
+		return buf.String()
+	}
+
+	b := &strings.Builder{}
+	b.WriteString(msg)
+	for i := 0; i < len(values); i += 2 {
+		fmt.Fprintf(b, " %s=%q", values[i], fmt.Sprint(values[i+1]))
+	}
+	return b.String()
+}
+
+// redactValue returns the given value with sensitive values redacted. Numbers and booleans are returned unchanged,
+// all other values as redacted strings.
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return v
+	case error:
+		return Redact(v.Error())
+	case []byte:
+		return Redact(string(v))
+	default:
+		return Redact(fmt.Sprint(v))
+	}
+}
+
+func writeJSON(buf *bytes.Buffer, value interface{}) {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(data)
+}
+
+type contextKey struct{}
+
+// NewContext returns a context derived from the given one that carries the given logger.
+func NewContext(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger carried by the given context, or a logger without key/value pairs if there is none.
+func FromContext(ctx context.Context) Logger {
+	if logger, ok := ctx.Value(contextKey{}).(Logger); ok {
+		return logger
+	}
+	return Logger{}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"regexp"
+	"strings"
+)
+
+// redacted replaces sensitive values in log messages and errors.
+const redacted = "[REDACTED]"
+
+var (
+	// pemBlockPattern matches PEM encoded certificates and keys.
+	pemBlockPattern = regexp.MustCompile(`(?s)-----BEGIN [A-Z0-9 ]+-----.*?(-----END [A-Z0-9 ]+-----|$)`)
+	// credentialFieldPattern matches the values of credential fields of kubeconfigs and similar YAML or JSON documents.
+	credentialFieldPattern = regexp.MustCompile(`(?i)((?:token|password|client-key-data|client-certificate-data|certificate-authority-data|userdata)["']?\s*[:=]\s*["']?)[^\s"',}]+`)
+	// bearerTokenPattern matches bearer tokens of Authorization headers.
+	bearerTokenPattern = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9\-._~+/]+=*`)
+	// jwtPattern matches JSON web tokens, e.g. service account tokens.
+	jwtPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	// sshKeyPattern matches SSH public keys, which identify the users that have access to machines.
+	sshKeyPattern = regexp.MustCompile(`((?:ssh-(?:rsa|dss|ed25519)|ecdsa-sha2-nistp\d+|sk-[a-z0-9-]+@openssh\.com)\s+)AAAA[A-Za-z0-9+/]+=*`)
+	// cloudConfigPattern matches cloud-init userData up to the end of the string.
+	cloudConfigPattern = regexp.MustCompile(`(?s)#cloud-config.*`)
+	// base64Pattern matches long base64 strings, e.g. encoded userData or kubeconfigs.
+	base64Pattern = regexp.MustCompile(`[A-Za-z0-9+/]{64,}={0,2}`)
+	// hexPattern matches hexadecimal strings, e.g. digests, which are not redacted.
+	hexPattern = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+)
+
+// Redact returns the given string with the contents of certificates and keys, credentials of kubeconfigs, tokens,
+// SSH keys, userData and long base64 encoded values replaced, so that they are never included in logs and errors.
+func Redact(s string) string {
+	s = cloudConfigPattern.ReplaceAllString(s, "#cloud-config "+redacted)
+	s = pemBlockPattern.ReplaceAllString(s, redacted)
+	s = credentialFieldPattern.ReplaceAllString(s, "${1}"+redacted)
+	s = bearerTokenPattern.ReplaceAllString(s, "${1}"+redacted)
+	s = jwtPattern.ReplaceAllString(s, redacted)
+	s = sshKeyPattern.ReplaceAllString(s, "${1}"+redacted)
+	return base64Pattern.ReplaceAllStringFunc(s, func(match string) string {
+		if hexPattern.MatchString(strings.TrimRight(match, "=")) {
+			return match
+		}
+		return redacted
+	})
+}
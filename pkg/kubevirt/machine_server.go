@@ -18,11 +18,12 @@ package kubevirt
 import (
 	"context"
 	"fmt"
+	"time"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/metrics"
 
 	"github.com/gardener/machine-controller-manager/pkg/util/provider/driver"
-	"github.com/gardener/machine-controller-manager/pkg/util/provider/machinecodes/codes"
-	"github.com/gardener/machine-controller-manager/pkg/util/provider/machinecodes/status"
-	"k8s.io/klog"
 )
 
 // CreateMachine handles a machine creation request
@@ -47,22 +48,26 @@ import (
 // These could be done using tag(s)/resource-groups etc.
 // This logic is used by safety controller to delete orphan VMs which are not backed by any machine CRD
 //
-func (p *MachinePlugin) CreateMachine(ctx context.Context, req *driver.CreateMachineRequest) (*driver.CreateMachineResponse, error) {
+func (p *MachinePlugin) CreateMachine(ctx context.Context, req *driver.CreateMachineRequest) (response *driver.CreateMachineResponse, err error) {
+	defer func(start time.Time) { metrics.ObserveOperation("CreateMachine", start, err) }(time.Now())
+
 	// Log messages to track request
-	klog.V(2).Infof("CreateMachine request has been received for %q", req.Machine.Name)
-	defer klog.V(2).Infof("CreateMachine request has been processed for %q", req.Machine.Name)
+	logger := logging.FromContext(ctx).WithValues("machine", req.Machine.Name, "machineclass", req.MachineClass.Name)
+	ctx = logging.NewContext(ctx, logger)
+	logger.V(2).Info("CreateMachine request has been received")
+	defer logger.V(2).Info("CreateMachine request has been processed")
 
-	providerSpec, err := decodeProviderSpecAndSecret(req.MachineClass, req.Secret)
+	providerSpec, secret, err := p.decodeProviderSpecAndSecret(ctx, req.MachineClass, req.Secret)
 	if err != nil {
 		return nil, err
 	}
 
-	providerID, err := p.SPI.CreateMachine(ctx, req.Machine.Name, providerSpec, req.Secret)
+	providerID, err := p.SPI.CreateMachine(ctx, req.Machine.Name, providerSpec, secret)
 	if err != nil {
-		return nil, prepareErrorf(err, "could not create machine %q", req.Machine.Name)
+		return nil, prepareErrorf(ctx, err, "could not create machine %q", req.Machine.Name)
 	}
 
-	response := &driver.CreateMachineResponse{
+	response = &driver.CreateMachineResponse{
 		ProviderID:     providerID,
 		NodeName:       req.Machine.Name,
 		LastKnownState: fmt.Sprintf("Created %s", providerID),
@@ -81,22 +86,26 @@ func (p *MachinePlugin) CreateMachine(ctx context.Context, req *driver.CreateMac
 // LastKnownState        bytes(blob)              (Optional) Last known state of VM during the current operation.
 //                                                Could be helpful to continue operations in future requests.
 //
-func (p *MachinePlugin) DeleteMachine(ctx context.Context, req *driver.DeleteMachineRequest) (*driver.DeleteMachineResponse, error) {
+func (p *MachinePlugin) DeleteMachine(ctx context.Context, req *driver.DeleteMachineRequest) (response *driver.DeleteMachineResponse, err error) {
+	defer func(start time.Time) { metrics.ObserveOperation("DeleteMachine", start, err) }(time.Now())
+
 	// Log messages to track delete request
-	klog.V(2).Infof("DeleteMachine request has been received for %q", req.Machine.Name)
-	defer klog.V(2).Infof("DeleteMachine request has been processed for %q", req.Machine.Name)
+	logger := logging.FromContext(ctx).WithValues("machine", req.Machine.Name, "machineclass", req.MachineClass.Name)
+	ctx = logging.NewContext(ctx, logger)
+	logger.V(2).Info("DeleteMachine request has been received")
+	defer logger.V(2).Info("DeleteMachine request has been processed")
 
-	providerSpec, err := decodeProviderSpecAndSecret(req.MachineClass, req.Secret)
+	providerSpec, secret, err := p.decodeProviderSpecAndSecret(ctx, req.MachineClass, req.Secret)
 	if err != nil {
 		return nil, err
 	}
 
-	providerID, err := p.SPI.DeleteMachine(ctx, req.Machine.Name, req.Machine.Spec.ProviderID, providerSpec, req.Secret)
+	providerID, err := p.SPI.DeleteMachine(ctx, req.Machine.Name, req.Machine.Spec.ProviderID, providerSpec, secret)
 	if err != nil {
-		return nil, prepareErrorf(err, "could not delete machine %q", req.Machine.Name)
+		return nil, prepareErrorf(ctx, err, "could not delete machine %q", req.Machine.Name)
 	}
 
-	response := &driver.DeleteMachineResponse{
+	response = &driver.DeleteMachineResponse{
 		LastKnownState: fmt.Sprintf("Deleted %s", providerID),
 	}
 	return response, nil
@@ -118,27 +127,41 @@ func (p *MachinePlugin) DeleteMachine(ctx context.Context, req *driver.DeleteMac
 //                                                This could be different from req.MachineName as well
 //
 // The request should return a NOT_FOUND (5) status errors code if the machine is not existing
-func (p *MachinePlugin) GetMachineStatus(ctx context.Context, req *driver.GetMachineStatusRequest) (*driver.GetMachineStatusResponse, error) {
+func (p *MachinePlugin) GetMachineStatus(ctx context.Context, req *driver.GetMachineStatusRequest) (response *driver.GetMachineStatusResponse, err error) {
+	defer func(start time.Time) { metrics.ObserveOperation("GetMachineStatus", start, err) }(time.Now())
+
 	// Log messages to track start and end of request
-	klog.V(2).Infof("GetMachineStatus request has been received for %q", req.Machine.Name)
-	defer klog.V(2).Infof("GetMachineStatus request has been processed for %q", req.Machine.Name)
+	logger := logging.FromContext(ctx).WithValues("machine", req.Machine.Name, "machineclass", req.MachineClass.Name)
+	ctx = logging.NewContext(ctx, logger)
+	logger.V(2).Info("GetMachineStatus request has been received")
+	defer logger.V(2).Info("GetMachineStatus request has been processed")
 
-	providerSpec, err := decodeProviderSpecAndSecret(req.MachineClass, req.Secret)
+	providerSpec, secret, err := p.decodeProviderSpecAndSecret(ctx, req.MachineClass, req.Secret)
 	if err != nil {
 		return nil, err
 	}
 
-	providerID, err := p.SPI.GetMachineStatus(ctx, req.Machine.Name, req.Machine.Spec.ProviderID, providerSpec, req.Secret)
+	providerID, err := p.SPI.GetMachineStatus(ctx, req.Machine.Name, req.Machine.Spec.ProviderID, providerSpec, secret)
 	if err != nil {
-		return nil, prepareErrorf(err, "could not get status of machine %q", req.Machine.Name)
+		return nil, prepareErrorf(ctx, err, "could not get status of machine %q", req.Machine.Name)
 	}
 
-	response := &driver.GetMachineStatusResponse{
+	response = &driver.GetMachineStatusResponse{
 		ProviderID: providerID,
 		NodeName:   req.Machine.Name,
 	}
 
-	klog.V(2).Infof("Found machine with provider ID %q for %q", response.ProviderID, req.Machine.Name)
+	logger.V(2).Info("Found machine", "providerID", response.ProviderID)
+
+	// The response can't carry node addresses, hence they are only got and logged for debugging
+	if logger.V(2).Enabled() {
+		addresses, err := p.SPI.GetMachineAddresses(ctx, req.Machine.Name, req.Machine.Spec.ProviderID, providerSpec, secret)
+		if err != nil {
+			logger.Error(err, "could not get addresses of machine")
+		} else if len(addresses) > 0 {
+			logger.V(2).Info("Found addresses", "addresses", addresses)
+		}
+	}
 
 	return response, nil
 }
@@ -156,22 +179,26 @@ func (p *MachinePlugin) GetMachineStatus(ctx context.Context, req *driver.GetMac
 // MachineList           map<string,string>  A map containing the keys as the MachineID and value as the MachineName
 //                                           for all machine's who where possibilly created by this ProviderSpec
 //
-func (p *MachinePlugin) ListMachines(ctx context.Context, req *driver.ListMachinesRequest) (*driver.ListMachinesResponse, error) {
+func (p *MachinePlugin) ListMachines(ctx context.Context, req *driver.ListMachinesRequest) (response *driver.ListMachinesResponse, err error) {
+	defer func(start time.Time) { metrics.ObserveOperation("ListMachines", start, err) }(time.Now())
+
 	// Log messages to track start and end of request
-	klog.V(2).Infof("ListMachines request has been received for %q", req.MachineClass.Name)
-	defer klog.V(2).Infof("ListMachines request has been processed for %q", req.MachineClass.Name)
+	logger := logging.FromContext(ctx).WithValues("machineclass", req.MachineClass.Name)
+	ctx = logging.NewContext(ctx, logger)
+	logger.V(2).Info("ListMachines request has been received")
+	defer logger.V(2).Info("ListMachines request has been processed")
 
-	providerSpec, err := decodeProviderSpecAndSecret(req.MachineClass, req.Secret)
+	providerSpec, secret, err := p.decodeProviderSpecAndSecret(ctx, req.MachineClass, req.Secret)
 	if err != nil {
 		return nil, err
 	}
 
-	machineList, err := p.SPI.ListMachines(ctx, providerSpec, req.Secret)
+	machineList, err := p.SPI.ListMachines(ctx, providerSpec, secret)
 	if err != nil {
-		return nil, prepareErrorf(err, "could not list machines")
+		return nil, prepareErrorf(ctx, err, "could not list machines")
 	}
 
-	klog.V(2).Infof("Found %d machines for %q", len(machineList), req.MachineClass.Name)
+	logger.V(2).Info("Found machines", "count", len(machineList))
 
 	return &driver.ListMachinesResponse{
 		MachineList: machineList,
@@ -188,8 +215,15 @@ func (p *MachinePlugin) ListMachines(ctx context.Context, req *driver.ListMachin
 //
 func (p *MachinePlugin) GetVolumeIDs(ctx context.Context, req *driver.GetVolumeIDsRequest) (*driver.GetVolumeIDsResponse, error) {
 	// Log messages to track start and end of request
-	klog.V(2).Infof("GetVolumeIDs request has been received for %q", req.PVSpecs)
-	defer klog.V(2).Infof("GetVolumeIDs request has been processed for %q", req.PVSpecs)
+	logger := logging.FromContext(ctx)
+	logger.V(2).Info("GetVolumeIDs request has been received", "pvSpecs", req.PVSpecs)
+	defer logger.V(2).Info("GetVolumeIDs request has been processed", "pvSpecs", req.PVSpecs)
+
+	volumeIDs := getVolumeIDs(req.PVSpecs)
 
-	return &driver.GetVolumeIDsResponse{}, status.Error(codes.Unimplemented, "")
+	logger.V(2).Info("Found volume IDs", "count", len(volumeIDs), "pvSpecCount", len(req.PVSpecs))
+
+	return &driver.GetVolumeIDsResponse{
+		VolumeIDs: volumeIDs,
+	}, nil
 }
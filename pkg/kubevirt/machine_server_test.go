@@ -0,0 +1,180 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubevirt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core/fake"
+
+	"github.com/gardener/machine-controller-manager/pkg/apis/machine/v1alpha1"
+	"github.com/gardener/machine-controller-manager/pkg/util/provider/driver"
+	"github.com/gardener/machine-controller-manager/pkg/util/provider/machinecodes/codes"
+	"github.com/gardener/machine-controller-manager/pkg/util/provider/machinecodes/status"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ PluginSPI = &fake.PluginSPI{}
+
+func TestMachinePlugin(t *testing.T) {
+	spi := fake.NewPluginSPI("default")
+	plugin := &MachinePlugin{SPI: spi}
+	machineClass, err := fake.NewMachineClass("test-class", fake.NewProviderSpec("test-class"))
+	if err != nil {
+		t.Fatalf("failed to create machine class: %v", err)
+	}
+	machine := &v1alpha1.Machine{ObjectMeta: metav1.ObjectMeta{Name: "test-machine"}}
+	secret := fake.NewSecret()
+
+	created, err := plugin.CreateMachine(context.Background(), &driver.CreateMachineRequest{Machine: machine, MachineClass: machineClass, Secret: secret})
+	if err != nil {
+		t.Fatalf("failed to create machine: %v", err)
+	}
+	if created.NodeName != machine.Name || created.ProviderID == "" {
+		t.Fatalf("unexpected create machine response %+v", created)
+	}
+
+	listed, err := plugin.ListMachines(context.Background(), &driver.ListMachinesRequest{MachineClass: machineClass, Secret: secret})
+	if err != nil {
+		t.Fatalf("failed to list machines: %v", err)
+	}
+	if len(listed.MachineList) != 1 || listed.MachineList[created.ProviderID] != machine.Name {
+		t.Fatalf("unexpected machine list %v", listed.MachineList)
+	}
+
+	spi.Errors["GetMachineStatus"] = errors.New("provider cluster is unreachable")
+	if _, err := plugin.GetMachineStatus(context.Background(), &driver.GetMachineStatusRequest{Machine: machine, MachineClass: machineClass, Secret: secret}); codeOf(err) != codes.Internal {
+		t.Fatalf("expected an internal error, got %v", err)
+	}
+
+	// a missing secondary object, e.g. the PVC of a backup, must not be mistaken for a missing VM
+	pvcNotFound := fmt.Errorf("could not get PersistentVolumeClaim: %w", kerrors.NewNotFound(corev1.Resource("persistentvolumeclaims"), "test-machine"))
+	spi.Errors["GetMachineStatus"] = pvcNotFound
+	if _, err := plugin.GetMachineStatus(context.Background(), &driver.GetMachineStatusRequest{Machine: machine, MachineClass: machineClass, Secret: secret}); codeOf(err) != codes.Internal {
+		t.Fatalf("expected an internal error, got %v", err)
+	}
+	delete(spi.Errors, "GetMachineStatus")
+	spi.Errors["DeleteMachine"] = pvcNotFound
+	if _, err := plugin.DeleteMachine(context.Background(), &driver.DeleteMachineRequest{Machine: machine, MachineClass: machineClass, Secret: secret}); codeOf(err) != codes.Internal {
+		t.Fatalf("expected an internal error, got %v", err)
+	}
+	delete(spi.Errors, "DeleteMachine")
+	if names := spi.VMNames(); len(names) != 1 {
+		t.Fatalf("expected the VM to be kept, got %v", names)
+	}
+
+	if _, err := plugin.DeleteMachine(context.Background(), &driver.DeleteMachineRequest{Machine: machine, MachineClass: machineClass, Secret: secret}); err != nil {
+		t.Fatalf("failed to delete machine: %v", err)
+	}
+	if _, err := plugin.GetMachineStatus(context.Background(), &driver.GetMachineStatusRequest{Machine: machine, MachineClass: machineClass, Secret: secret}); codeOf(err) != codes.NotFound {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+
+	delete(secret.Data, "userData")
+	if _, err := plugin.CreateMachine(context.Background(), &driver.CreateMachineRequest{Machine: machine, MachineClass: machineClass, Secret: secret}); codeOf(err) != codes.Internal {
+		t.Fatalf("expected an invalid secret to be rejected, got %v", err)
+	}
+	if names := spi.VMNames(); len(names) != 0 {
+		t.Fatalf("expected no VMs, got %v", names)
+	}
+}
+
+func TestDecodeProviderSpec(t *testing.T) {
+	v1alpha1ProviderSpec := `{"sourceURL":"http://image.example.com/image.qcow2","storageClassName":"standard","pvcSize":"10Gi","region":"local"}`
+	v1alpha2ProviderSpec := `{"apiVersion":"kubevirt.provider.extensions.gardener.cloud/v1alpha2","rootDisk":{"sourceURL":"http://image.example.com/image.qcow2","storageClassName":"standard","size":"10Gi"},"region":"local"}`
+
+	var decoded []*api.KubeVirtProviderSpec
+	for _, raw := range []string{v1alpha1ProviderSpec, v1alpha2ProviderSpec} {
+		providerSpec, err := DecodeProviderSpec([]byte(raw))
+		if err != nil {
+			t.Fatalf("failed to decode provider spec %s: %v", raw, err)
+		}
+		decoded = append(decoded, providerSpec)
+	}
+	if decoded[0].SourceURL != "http://image.example.com/image.qcow2" || decoded[0].PVCSize.String() != "10Gi" ||
+		decoded[0].CloudInitDataSource != api.CloudInitDataSourceNoCloud {
+		t.Fatalf("unexpected provider spec %+v", decoded[0])
+	}
+	if !reflect.DeepEqual(decoded[0], decoded[1]) {
+		t.Fatalf("expected the versions to decode to the same provider spec, got %+v and %+v", decoded[0], decoded[1])
+	}
+
+	if _, err := DecodeProviderSpec([]byte(`{"apiVersion":"kubevirt.provider.extensions.gardener.cloud/v1alpha2","sourceURL":"http://image.example.com/image.qcow2"}`)); err == nil {
+		t.Fatal("expected root disk settings at the top level of v1alpha2 to be rejected")
+	}
+	if _, err := DecodeProviderSpec([]byte(`{"apiVersion":"kubevirt.provider.extensions.gardener.cloud/v1"}`)); err == nil {
+		t.Fatal("expected an unsupported apiVersion to be rejected")
+	}
+}
+
+func TestGetVolumeIDs(t *testing.T) {
+	csiSpec := func(driver, volumeHandle string) *corev1.PersistentVolumeSpec {
+		return &corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+			CSI: &corev1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: volumeHandle},
+		}}
+	}
+
+	tests := []struct {
+		name     string
+		pvSpecs  []*corev1.PersistentVolumeSpec
+		expected []string
+	}{
+		{
+			name: "no volumes",
+		},
+		{
+			name:     "DataVolumes of the KubeVirt CSI driver",
+			pvSpecs:  []*corev1.PersistentVolumeSpec{csiSpec(kubevirtCSIDriverName, "pvc-1"), csiSpec(kubevirtCSIDriverName, "pvc-2")},
+			expected: []string{"pvc-1", "pvc-2"},
+		},
+		{
+			name:     "volumes of other CSI drivers",
+			pvSpecs:  []*corev1.PersistentVolumeSpec{csiSpec("ebs.csi.aws.com", "vol-1"), csiSpec(kubevirtCSIDriverName, "pvc-1")},
+			expected: []string{"pvc-1"},
+		},
+		{
+			name: "volumes without CSI source",
+			pvSpecs: []*corev1.PersistentVolumeSpec{{PersistentVolumeSource: corev1.PersistentVolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{Path: "/mnt/data"},
+			}}},
+		},
+		{
+			name:    "volumes without volume handle",
+			pvSpecs: []*corev1.PersistentVolumeSpec{csiSpec(kubevirtCSIDriverName, "")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if volumeIDs := getVolumeIDs(test.pvSpecs); !reflect.DeepEqual(volumeIDs, test.expected) {
+				t.Fatalf("expected volume IDs %v, got %v", test.expected, volumeIDs)
+			}
+		})
+	}
+}
+
+func codeOf(err error) codes.Code {
+	if s, ok := status.FromError(err); ok {
+		return s.Code()
+	}
+	return codes.Unknown
+}
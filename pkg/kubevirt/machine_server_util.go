@@ -1,11 +1,16 @@
 package kubevirt
 
 import (
+	"context"
 	"encoding/json"
+	stderrors "errors"
 	"fmt"
+	"strings"
 
 	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis/v1alpha2"
 	clouderrors "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/errors"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
 	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/validation"
 
 	"github.com/gardener/machine-controller-manager/pkg/apis/machine/v1alpha1"
@@ -13,40 +18,95 @@ import (
 	"github.com/gardener/machine-controller-manager/pkg/util/provider/machinecodes/status"
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/klog"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// decodeProviderSpecAndSecret converts request parameters to api.ProviderSpec
-func decodeProviderSpecAndSecret(machineClass *v1alpha1.MachineClass, secret *corev1.Secret) (*api.KubeVirtProviderSpec, error) {
-	var (
-		providerSpec *api.KubeVirtProviderSpec
-	)
-
+// decodeProviderSpecAndSecret converts request parameters to api.ProviderSpec, and returns the secret with the kubeconfig
+// fetched from its credentials source if it refers to one.
+func (p *MachinePlugin) decodeProviderSpecAndSecret(ctx context.Context, machineClass *v1alpha1.MachineClass, secret *corev1.Secret) (*api.KubeVirtProviderSpec, *corev1.Secret, error) {
 	// Extract providerSpec
-	err := json.Unmarshal(machineClass.ProviderSpec.Raw, &providerSpec)
+	providerSpec, err := DecodeProviderSpec(machineClass.ProviderSpec.Raw)
 	if err != nil {
-		wrapped := errors.Wrap(err, "could not unmarshal provider spec from JSON")
-		klog.V(2).Infof(wrapped.Error())
-		return nil, status.Error(codes.Internal, wrapped.Error())
+		wrapped := errors.Wrap(err, "could not decode provider spec")
+		logging.FromContext(ctx).V(2).Info(wrapped.Error())
+		return nil, nil, statusError(codes.Internal, wrapped.Error())
 	}
 
 	if errs := validation.ValidateKubevirtProviderSpec(providerSpec); len(errs) > 0 {
 		err = fmt.Errorf("could not validate provider spec: %v", errs)
-		klog.V(2).Infof(err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		logging.FromContext(ctx).V(2).Info(err.Error())
+		return nil, nil, statusError(codes.Internal, err.Error())
+	}
+
+	secret, err = p.CredentialsSources.Resolve(ctx, secret, providerSpec)
+	if err != nil {
+		wrapped := errors.Wrap(err, "could not resolve provider credentials")
+		logging.FromContext(ctx).V(2).Info(wrapped.Error())
+		return nil, nil, statusError(codes.Internal, wrapped.Error())
 	}
 
-	if errs := validation.ValidateKubevirtProviderSecrets(secret); len(errs) > 0 {
+	if errs := validation.ValidateKubevirtProviderSecrets(secret, providerSpec); len(errs) > 0 {
 		err = fmt.Errorf("could not validate provider secrets: %v", errs)
-		klog.V(2).Infof(err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		logging.FromContext(ctx).V(2).Info(err.Error())
+		return nil, nil, statusError(codes.Internal, err.Error())
 	}
 
-	return providerSpec, nil
+	return providerSpec, secret, nil
+}
+
+// DecodeProviderSpec decodes the given provider spec JSON of any supported version, based on its apiVersion,
+// and converts it to the provider spec used by the provider. Provider specs without an apiVersion are v1alpha1.
+// v1alpha1 provider specs are converted to v1alpha2 first, so that the defaults of all versions are the same.
+func DecodeProviderSpec(raw []byte) (*api.KubeVirtProviderSpec, error) {
+	var typeMeta metav1.TypeMeta
+	if err := json.Unmarshal(raw, &typeMeta); err != nil {
+		return nil, err
+	}
+
+	var providerSpec *v1alpha2.KubeVirtProviderSpec
+	switch typeMeta.APIVersion {
+	case "", api.SchemeGroupVersion.String():
+		var v1alpha1ProviderSpec *api.KubeVirtProviderSpec
+		if err := json.Unmarshal(raw, &v1alpha1ProviderSpec); err != nil {
+			return nil, err
+		}
+		if v1alpha1ProviderSpec != nil {
+			providerSpec = v1alpha2.ConvertFromV1alpha1(v1alpha1ProviderSpec)
+		}
+	case v1alpha2.SchemeGroupVersion.String():
+		if err := json.Unmarshal(raw, &providerSpec); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported apiVersion %q", typeMeta.APIVersion)
+	}
+	if providerSpec == nil {
+		return nil, nil
+	}
+
+	v1alpha2.SetDefaults(providerSpec)
+	return v1alpha2.ConvertToInternal(providerSpec)
+}
+
+// kubevirtCSIDriverName is the name of the KubeVirt CSI driver that provisions volumes of shoot clusters as
+// DataVolumes in the provider cluster and hotplugs them into the VMs.
+const kubevirtCSIDriverName = "csi.kubevirt.io"
+
+// getVolumeIDs returns the volume handles of the given PV specs of the KubeVirt CSI driver,
+// which are the names of the DataVolumes backing them in the provider cluster.
+func getVolumeIDs(pvSpecs []*corev1.PersistentVolumeSpec) []string {
+	var volumeIDs []string
+	for _, pvSpec := range pvSpecs {
+		if pvSpec.CSI != nil && pvSpec.CSI.Driver == kubevirtCSIDriverName && pvSpec.CSI.VolumeHandle != "" {
+			volumeIDs = append(volumeIDs, pvSpec.CSI.VolumeHandle)
+		}
+	}
+	return volumeIDs
 }
 
 // prepareErrorf preapre, format and wrap an error on the machine server level.
-func prepareErrorf(err error, format string, args ...interface{}) error {
+func prepareErrorf(ctx context.Context, err error, format string, args ...interface{}) error {
 	var (
 		code    codes.Code
 		wrapped error
@@ -55,10 +115,55 @@ func prepareErrorf(err error, format string, args ...interface{}) error {
 	case *clouderrors.MachineNotFoundError:
 		code = codes.NotFound
 		wrapped = err
+	case *clouderrors.MachinePreemptedError:
+		// the machine controller creates machines that are not found, which fails for preempted ones, marking them failed
+		code = codes.NotFound
+		wrapped = errors.Wrapf(err, format, args...)
+	case *clouderrors.UserDataTooLargeError:
+		code = codes.InvalidArgument
+		wrapped = errors.Wrapf(err, format, args...)
+	case *clouderrors.InsufficientCapacityError, *clouderrors.QuotaExceededError:
+		code = codes.ResourceExhausted
+		wrapped = errors.Wrapf(err, format, args...)
 	default:
-		code = codes.Internal
+		code = apiErrorCode(err)
 		wrapped = errors.Wrapf(err, format, args...)
 	}
-	klog.V(2).Infof(wrapped.Error())
-	return status.Error(code, wrapped.Error())
+	logging.FromContext(ctx).V(2).Info(wrapped.Error(), "code", code)
+	return statusError(code, wrapped.Error())
+}
+
+// statusError returns an error with the given code and message, with sensitive values like userData, SSH keys and
+// kubeconfig contents redacted from the message, as the message ends up in the status of the machine.
+func statusError(code codes.Code, msg string) error {
+	return status.Error(code, logging.Redact(msg))
+}
+
+// apiErrorCode maps the Kubernetes API error wrapped by the given error to the machine code that
+// lets the machine controller back off and retry accordingly. It returns codes.Internal for other errors.
+// Objects that are not found map to codes.Internal as well, as codes.NotFound makes the machine controller
+// consider the VM gone, which is only reported by a MachineNotFoundError.
+func apiErrorCode(err error) codes.Code {
+	var apiStatus kerrors.APIStatus
+	if !stderrors.As(err, &apiStatus) {
+		return codes.Internal
+	}
+	statusErr := &kerrors.StatusError{ErrStatus: apiStatus.Status()}
+
+	switch {
+	case kerrors.IsAlreadyExists(statusErr):
+		return codes.AlreadyExists
+	case kerrors.IsForbidden(statusErr) && strings.Contains(statusErr.ErrStatus.Message, "exceeded quota"):
+		return codes.ResourceExhausted
+	case kerrors.IsForbidden(statusErr):
+		return codes.PermissionDenied
+	case kerrors.IsUnauthorized(statusErr):
+		return codes.Unauthenticated
+	case kerrors.IsInvalid(statusErr), kerrors.IsBadRequest(statusErr):
+		return codes.InvalidArgument
+	case kerrors.IsTimeout(statusErr), kerrors.IsServerTimeout(statusErr), kerrors.IsServiceUnavailable(statusErr), kerrors.IsTooManyRequests(statusErr):
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
 }
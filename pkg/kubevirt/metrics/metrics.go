@@ -0,0 +1,71 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"time"
+
+	"github.com/gardener/machine-controller-manager/pkg/util/provider/machinecodes/status"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "mcm_provider_kubevirt"
+
+var (
+	// OperationDuration is the duration of the driver operations by operation and result code.
+	OperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of the driver operations by operation and result code.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"operation", "code"})
+
+	// OperationErrors is the number of failed driver operations by operation and error code.
+	OperationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "operation_errors_total",
+		Help:      "Number of failed driver operations by operation and error code.",
+	}, []string{"operation", "code"})
+
+	// DataVolumeImportDuration is the duration from the creation of VMs until their root disk DataVolumes were imported.
+	DataVolumeImportDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "datavolume_import_duration_seconds",
+		Help:      "Duration from the creation of VMs until their root disk DataVolumes were imported.",
+		Buckets:   prometheus.ExponentialBuckets(15, 2, 8),
+	})
+
+	// VirtualMachines is the number of VMs by machine class and status, as of the last ListMachines call for the machine class.
+	VirtualMachines = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "virtual_machines",
+		Help:      "Number of VMs by machine class and status, as of the last ListMachines call for the machine class.",
+	}, []string{"machine_class", "status"})
+)
+
+func init() {
+	prometheus.MustRegister(OperationDuration, OperationErrors, DataVolumeImportDuration, VirtualMachines)
+}
+
+// ObserveOperation records the duration since the given start and the result of the given driver operation,
+// whose error, if any, is expected to be a machine codes status error.
+func ObserveOperation(operation string, start time.Time, err error) {
+	s, _ := status.FromError(err)
+	code := s.Code().String()
+	OperationDuration.WithLabelValues(operation, code).Observe(time.Since(start).Seconds())
+	if err != nil {
+		OperationErrors.WithLabelValues(operation, code).Inc()
+	}
+}
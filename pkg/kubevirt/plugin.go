@@ -19,10 +19,10 @@ import (
 
 	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
 	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
 
 	"github.com/gardener/machine-controller-manager/pkg/util/provider/driver"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/klog"
 )
 
 // PluginSPI provides an interface to deal with cloud provider session
@@ -35,10 +35,22 @@ type PluginSPI interface {
 	DeleteMachine(ctx context.Context, machineName, providerID string, providerSpec *api.KubeVirtProviderSpec, secrets *corev1.Secret) (foundProviderID string, err error)
 	// GetMachineStatus handles a machine get status request
 	GetMachineStatus(ctx context.Context, machineName, providerID string, providerSpec *api.KubeVirtProviderSpec, secrets *corev1.Secret) (foundProviderID string, err error)
+	// GetMachineAddresses returns the node addresses of a machine
+	GetMachineAddresses(ctx context.Context, machineName, providerID string, providerSpec *api.KubeVirtProviderSpec, secrets *corev1.Secret) (addresses []corev1.NodeAddress, err error)
 	// ListMachines lists all the machines possibly created by a providerSpec
 	ListMachines(ctx context.Context, providerSpec *api.KubeVirtProviderSpec, secrets *corev1.Secret) (providerIDList map[string]string, err error)
 	// ShutDownMachine shuts down a machine by name
 	ShutDownMachine(ctx context.Context, machineName, providerID string, providerSpec *api.KubeVirtProviderSpec, secrets *corev1.Secret) (foundProviderID string, err error)
+	// StartMachine starts a shut down machine by name
+	StartMachine(ctx context.Context, machineName, providerID string, providerSpec *api.KubeVirtProviderSpec, secrets *corev1.Secret) (foundProviderID string, err error)
+	// RestartMachine restarts a machine by name without deleting its disks
+	RestartMachine(ctx context.Context, machineName, providerID string, providerSpec *api.KubeVirtProviderSpec, secrets *corev1.Secret) (foundProviderID string, err error)
+	// MigrateMachine live migrates a machine by name to another node
+	MigrateMachine(ctx context.Context, machineName, providerID string, providerSpec *api.KubeVirtProviderSpec, secrets *corev1.Secret) (foundProviderID string, err error)
+	// ExpandMachineRootDisk grows the root disk of a machine to the size in the providerSpec
+	ExpandMachineRootDisk(ctx context.Context, machineName, providerID string, providerSpec *api.KubeVirtProviderSpec, secrets *corev1.Secret) (foundProviderID string, err error)
+	// DryRunCreateMachine renders the objects of a machine creation request and validates them without creating them
+	DryRunCreateMachine(ctx context.Context, machineName string, providerSpec *api.KubeVirtProviderSpec, secrets *corev1.Secret) (*core.DryRunResult, error)
 }
 
 // MachinePlugin implements the cmi.MachineServer
@@ -46,17 +58,24 @@ type PluginSPI interface {
 type MachinePlugin struct {
 	// SPI provides an interface to deal with cloud provider session.
 	SPI PluginSPI
+	// CredentialsSources are the external sources the kubeconfigs of provider clusters are fetched from
+	// for credentials secrets that refer to one of them.
+	CredentialsSources core.CredentialsSources
 }
 
-// NewKubevirtPlugin returns a new Kubevirt cloud provider driver.
-func NewKubevirtPlugin() driver.Driver {
-	plugin, err := core.NewPluginSPIImpl(core.ClientFactoryFunc(core.GetClient), core.ServerVersionFactoryFunc(core.GetServerVersion))
+// NewKubevirtPlugin returns a new Kubevirt cloud provider driver that creates clients of provider clusters with the given
+// ClientFactory. Server versions and VM informers use the given client options, and kubeconfigs that are not stored
+// in the credentials secrets are fetched from the credentials sources of the given credentials options.
+func NewKubevirtPlugin(cf core.ClientFactory, clientOptions core.ClientOptions, credentialsOptions core.CredentialsOptions) driver.Driver {
+	plugin, err := core.NewPluginSPIImpl(cf, core.NewCachingServerVersionFactory(clientOptions))
 	if err != nil {
-		klog.Errorf("failed to create Kubevirt plugin")
+		logging.Logger{}.Error(err, "failed to create Kubevirt plugin")
 		return nil
 	}
+	plugin.SetVMListerFactory(core.NewInformerVMListerFactory(clientOptions))
 
 	return &MachinePlugin{
-		SPI: plugin,
+		SPI:                plugin,
+		CredentialsSources: credentialsOptions.Sources(),
 	}
 }
@@ -16,14 +16,23 @@
 package validation
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"net"
+	"regexp"
+	"time"
 
 	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
 
 	corev1 "k8s.io/api/core/v1"
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/util/sets"
+	utilvalidation "k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/client-go/tools/clientcmd"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
 )
 
 // ValidateKubevirtProviderSpec validates kubevirt spec to check if all fields are present and valid
@@ -38,9 +47,39 @@ func ValidateKubevirtProviderSpec(spec *api.KubeVirtProviderSpec) field.ErrorLis
 		errs = append(errs, field.Required(requestsPath.Child("cpu"), "cannot be zero"))
 	}
 
+	limitsPath := field.NewPath("resources").Child("limits")
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+		limit, ok := spec.Resources.Limits[name]
+		if request := spec.Resources.Requests[name]; ok && limit.Cmp(request) < 0 {
+			errs = append(errs, field.Invalid(limitsPath.Child(string(name)), limit.String(), "must be greater than or equal to the request"))
+		}
+	}
+	if spec.GuaranteedQoS && spec.Resources.OvercommitGuestOverhead {
+		errs = append(errs, field.Forbidden(field.NewPath("resources").Child("overcommitGuestOverhead"), "cannot be used with guaranteedQoS"))
+	}
+	if spec.Memory != nil && spec.Memory.Guest != nil {
+		guestPath := field.NewPath("memory").Child("guest")
+		if spec.Memory.Guest.Sign() <= 0 {
+			errs = append(errs, field.Invalid(guestPath, spec.Memory.Guest.String(), "must be greater than zero"))
+		}
+		if limit, ok := spec.Resources.Limits[corev1.ResourceMemory]; ok && spec.Memory.Guest.Cmp(limit) > 0 {
+			errs = append(errs, field.Invalid(guestPath, spec.Memory.Guest.String(), "must be less than or equal to the memory limit"))
+		}
+	}
+
+	if spec.Features != nil && spec.Features.APIC != nil && spec.Features.APIC.EndOfInterrupt &&
+		spec.Features.APIC.Enabled != nil && !*spec.Features.APIC.Enabled {
+		errs = append(errs, field.Forbidden(field.NewPath("features").Child("apic").Child("endOfInterrupt"), "requires APIC to be enabled"))
+	}
+
 	if spec.SourceURL == "" {
 		errs = append(errs, field.Required(field.NewPath("sourceURL"), "cannot be empty"))
 	}
+	if spec.SourceSecretName != "" {
+		for _, msg := range apivalidation.NameIsDNSSubdomain(spec.SourceSecretName, false) {
+			errs = append(errs, field.Invalid(field.NewPath("sourceSecretName"), spec.SourceSecretName, msg))
+		}
+	}
 
 	if spec.StorageClassName == "" {
 		errs = append(errs, field.Required(field.NewPath("storageClassName"), "cannot be empty"))
@@ -58,6 +97,19 @@ func ValidateKubevirtProviderSpec(spec *api.KubeVirtProviderSpec) field.ErrorLis
 		errs = append(errs, field.Required(field.NewPath("zone"), "cannot be empty"))
 	}
 
+	for zone, key := range spec.ZoneKubeconfigKeys {
+		for _, msg := range utilvalidation.IsConfigMapKey(key) {
+			errs = append(errs, field.Invalid(field.NewPath("zoneKubeconfigKeys").Key(zone), key, msg))
+		}
+	}
+
+	if spec.RegionLabelKey != "" {
+		errs = append(errs, metav1validation.ValidateLabelName(spec.RegionLabelKey, field.NewPath("regionLabelKey"))...)
+	}
+	if spec.ZoneLabelKey != "" {
+		errs = append(errs, metav1validation.ValidateLabelName(spec.ZoneLabelKey, field.NewPath("zoneLabelKey"))...)
+	}
+
 	if spec.DNSPolicy != "" {
 		dnsPolicyPath := field.NewPath("dnsPolicy")
 		dnsConfigPath := field.NewPath("dnsConfig")
@@ -82,21 +134,515 @@ func ValidateKubevirtProviderSpec(spec *api.KubeVirtProviderSpec) field.ErrorLis
 		}
 	}
 
+	errs = append(errs, validatePciAddress(spec.RootDiskPciAddress, field.NewPath("rootDiskPciAddress"))...)
+
+	gpusPath := field.NewPath("gpus")
+	for i, gpu := range spec.GPUs {
+		if gpu.Name == "" {
+			errs = append(errs, field.Required(gpusPath.Index(i).Child("name"), "cannot be empty"))
+		}
+		if gpu.DeviceName == "" {
+			errs = append(errs, field.Required(gpusPath.Index(i).Child("deviceName"), "cannot be empty"))
+		}
+	}
+
+	if spec.PriorityClassName != "" {
+		for _, msg := range apivalidation.NameIsDNSSubdomain(spec.PriorityClassName, false) {
+			errs = append(errs, field.Invalid(field.NewPath("priorityClassName"), spec.PriorityClassName, msg))
+		}
+	}
+
+	errs = append(errs, metav1validation.ValidateLabels(spec.NodeSelector, field.NewPath("nodeSelector"))...)
+	if spec.ReplaceAffinity && spec.Affinity == nil {
+		errs = append(errs, field.Required(field.NewPath("affinity"), "cannot be empty when replaceAffinity is true"))
+	}
+	errs = append(errs, metav1validation.ValidateLabels(spec.NodeLabels, field.NewPath("nodeLabels"))...)
+
+	if spec.Adoption != nil {
+		errs = append(errs, metav1validation.ValidateLabels(spec.Adoption.Selector, field.NewPath("adoption", "selector"))...)
+	}
+
+	errs = append(errs, apivalidation.ValidateAnnotations(spec.VMAnnotations, field.NewPath("vmAnnotations"))...)
+	errs = append(errs, metav1validation.ValidateLabels(spec.TemplateLabels, field.NewPath("templateLabels"))...)
+	errs = append(errs, apivalidation.ValidateAnnotations(spec.TemplateAnnotations, field.NewPath("templateAnnotations"))...)
+
+	switch spec.CloudInitDataSource {
+	case "", api.CloudInitDataSourceNoCloud, api.CloudInitDataSourceConfigDrive:
+	default:
+		errs = append(errs, field.NotSupported(field.NewPath("cloudInitDataSource"), spec.CloudInitDataSource, []string{
+			string(api.CloudInitDataSourceNoCloud), string(api.CloudInitDataSourceConfigDrive),
+		}))
+	}
+
+	sshKeysSecretRefsPath := field.NewPath("sshKeysSecretRefs")
+	for i, secretRef := range spec.SSHKeysSecretRefs {
+		if secretRef.Name == "" {
+			errs = append(errs, field.Required(sshKeysSecretRefsPath.Index(i).Child("name"), "cannot be empty"))
+		}
+		if secretRef.Key == "" {
+			errs = append(errs, field.Required(sshKeysSecretRefsPath.Index(i).Child("key"), "cannot be empty"))
+		}
+	}
+
+	cloudInitSnippetsPath := field.NewPath("cloudInitSnippets")
+	for i, snippet := range spec.CloudInitSnippets {
+		if snippet.Name == "" {
+			errs = append(errs, field.Required(cloudInitSnippetsPath.Index(i).Child("name"), "cannot be empty"))
+		}
+		if snippet.Key == "" {
+			errs = append(errs, field.Required(cloudInitSnippetsPath.Index(i).Child("key"), "cannot be empty"))
+		}
+	}
+
+	networksPath := field.NewPath("networks")
+	for i, network := range spec.Networks {
+		errs = append(errs, validateInterface(&network.InterfaceSpec, networksPath.Index(i))...)
+		if network.IPAM != nil {
+			errs = append(errs, validateIPAM(network.IPAM, networksPath.Index(i).Child("ipam"))...)
+		}
+	}
+
+	if spec.PodNetwork != nil {
+		errs = append(errs, validatePodNetwork(spec.PodNetwork, field.NewPath("podNetwork"))...)
+	}
+
+	if spec.ReadinessTimeout != nil && spec.ReadinessTimeout.Duration <= 0 {
+		errs = append(errs, field.Invalid(field.NewPath("readinessTimeout"), spec.ReadinessTimeout.Duration.String(), "must be positive"))
+	}
+
+	if spec.DeletionTimeout != nil && spec.DeletionTimeout.Duration <= 0 {
+		errs = append(errs, field.Invalid(field.NewPath("deletionTimeout"), spec.DeletionTimeout.Duration.String(), "must be positive"))
+	}
+
+	if spec.GracefulShutdownTimeout != nil && spec.GracefulShutdownTimeout.Duration < time.Second {
+		errs = append(errs, field.Invalid(field.NewPath("gracefulShutdownTimeout"), spec.GracefulShutdownTimeout.Duration.String(), "must be at least 1s"))
+	}
+
+	if spec.ShutdownTimeout != nil {
+		shutdownTimeoutPath := field.NewPath("shutdownTimeout")
+		if spec.GracefulShutdownTimeout == nil {
+			errs = append(errs, field.Forbidden(shutdownTimeoutPath, "requires gracefulShutdownTimeout"))
+		}
+		if spec.ShutdownTimeout.Duration <= 0 {
+			errs = append(errs, field.Invalid(shutdownTimeoutPath, spec.ShutdownTimeout.Duration.String(), "must be positive"))
+		}
+	}
+
+	if spec.BackupPolicy != nil && spec.BackupPolicy.TTL.Duration <= 0 {
+		errs = append(errs, field.Invalid(field.NewPath("backupPolicy", "ttl"), spec.BackupPolicy.TTL.Duration.String(), "must be positive"))
+	}
+
+	if spec.CrashLoopRemediation != nil && spec.CrashLoopRemediation.MaxRestarts < 0 {
+		errs = append(errs, field.Invalid(field.NewPath("crashLoopRemediation", "maxRestarts"), spec.CrashLoopRemediation.MaxRestarts, "cannot be negative"))
+	}
+
+	if spec.EvictionStrategy != nil && *spec.EvictionStrategy != kubevirtv1.EvictionStrategyLiveMigrate {
+		errs = append(errs, field.NotSupported(field.NewPath("evictionStrategy"), *spec.EvictionStrategy, []string{
+			string(kubevirtv1.EvictionStrategyLiveMigrate),
+		}))
+	}
+
+	if spec.Preemptible {
+		if spec.EvictionStrategy != nil {
+			errs = append(errs, field.Forbidden(field.NewPath("evictionStrategy"), "preemptible VMs cannot be live migrated"))
+		}
+		if spec.MigrateFromCordonedNodes {
+			errs = append(errs, field.Forbidden(field.NewPath("migrateFromCordonedNodes"), "preemptible VMs cannot be live migrated"))
+		}
+	}
+
+	if spec.SSHService != nil {
+		switch spec.SSHService.Type {
+		case "", corev1.ServiceTypeClusterIP, corev1.ServiceTypeNodePort, corev1.ServiceTypeLoadBalancer:
+		default:
+			errs = append(errs, field.NotSupported(field.NewPath("sshService", "type"), spec.SSHService.Type, []string{
+				string(corev1.ServiceTypeClusterIP), string(corev1.ServiceTypeNodePort), string(corev1.ServiceTypeLoadBalancer),
+			}))
+		}
+	}
+
+	if spec.NetworkPolicy != nil {
+		clusterNamePath := field.NewPath("networkPolicy", "clusterName")
+		if spec.NetworkPolicy.ClusterName == "" {
+			errs = append(errs, field.Required(clusterNamePath, "cluster name is required"))
+		}
+		for _, msg := range utilvalidation.IsValidLabelValue(spec.NetworkPolicy.ClusterName) {
+			errs = append(errs, field.Invalid(clusterNamePath, spec.NetworkPolicy.ClusterName, msg))
+		}
+	}
+
+	errs = append(errs, validateAdditionalVolumes(spec.AdditionalVolumes, field.NewPath("additionalVolumes"))...)
+
+	if spec.Windows != nil {
+		errs = append(errs, validateWindows(spec, field.NewPath("windows"))...)
+	}
+
+	if spec.VMTemplate != nil {
+		errs = append(errs, validateVMTemplate(spec.VMTemplate, field.NewPath("vmTemplate"))...)
+	}
+
+	return errs
+}
+
+func validateVMTemplate(vmTemplate *api.VMTemplateSpec, fldPath *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+
+	switch vmTemplate.Kind {
+	case "", api.VMTemplateKindVirtualMachine:
+		if len(vmTemplate.Parameters) > 0 {
+			errs = append(errs, field.Forbidden(fldPath.Child("parameters"), "are only supported for Templates"))
+		}
+	case api.VMTemplateKindTemplate:
+	default:
+		errs = append(errs, field.NotSupported(fldPath.Child("kind"), vmTemplate.Kind, []string{
+			string(api.VMTemplateKindVirtualMachine), string(api.VMTemplateKindTemplate),
+		}))
+	}
+
+	if vmTemplate.Name == "" {
+		errs = append(errs, field.Required(fldPath.Child("name"), "cannot be empty"))
+	} else {
+		for _, msg := range apivalidation.NameIsDNSSubdomain(vmTemplate.Name, false) {
+			errs = append(errs, field.Invalid(fldPath.Child("name"), vmTemplate.Name, msg))
+		}
+	}
+	if vmTemplate.Namespace != "" {
+		for _, msg := range apivalidation.ValidateNamespaceName(vmTemplate.Namespace, false) {
+			errs = append(errs, field.Invalid(fldPath.Child("namespace"), vmTemplate.Namespace, msg))
+		}
+	}
+
+	return errs
+}
+
+func validateWindows(spec *api.KubeVirtProviderSpec, fldPath *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	windows := spec.Windows
+
+	if windows.Sysprep != nil {
+		sysprepPath := fldPath.Child("sysprep")
+		if (windows.Sysprep.ConfigMapName == "") == (windows.Sysprep.SecretName == "") {
+			errs = append(errs, field.Invalid(sysprepPath, windows.Sysprep, "exactly one of configMapName or secretName must be specified"))
+		}
+		for _, name := range []struct {
+			field string
+			value string
+		}{
+			{"configMapName", windows.Sysprep.ConfigMapName},
+			{"secretName", windows.Sysprep.SecretName},
+		} {
+			if name.value == "" {
+				continue
+			}
+			for _, msg := range apivalidation.NameIsDNSSubdomain(name.value, false) {
+				errs = append(errs, field.Invalid(sysprepPath.Child(name.field), name.value, msg))
+			}
+		}
+	}
+
+	if windows.DiskBus != "" && !windowsDiskBuses.Has(windows.DiskBus) {
+		errs = append(errs, field.NotSupported(fldPath.Child("diskBus"), windows.DiskBus, windowsDiskBuses.List()))
+	}
+	if spec.RootDiskPciAddress != "" && windows.DiskBus != "virtio" {
+		errs = append(errs, field.Forbidden(field.NewPath("rootDiskPciAddress"), "requires the virtio disk bus for Windows VMs"))
+	}
+
+	if spec.Features != nil && spec.Features.ACPI.Enabled != nil && !*spec.Features.ACPI.Enabled {
+		errs = append(errs, field.Forbidden(field.NewPath("features").Child("acpi").Child("enabled"), "ACPI cannot be disabled for Windows VMs"))
+	}
+
+	if windows.InterfaceModel != "" && !interfaceModels.Has(windows.InterfaceModel) {
+		errs = append(errs, field.NotSupported(fldPath.Child("interfaceModel"), windows.InterfaceModel, interfaceModels.List()))
+	}
+
+	switch windows.Bootstrap {
+	case "", api.WindowsBootstrapWinRM:
+		if len(spec.SSHKeys) > 0 || len(spec.SSHKeysSecretRefs) > 0 {
+			errs = append(errs, field.Forbidden(fldPath.Child("bootstrap"), "SSH keys require the SSH bootstrap for Windows VMs"))
+		}
+	case api.WindowsBootstrapSSH:
+	default:
+		errs = append(errs, field.NotSupported(fldPath.Child("bootstrap"), windows.Bootstrap, []string{
+			string(api.WindowsBootstrapWinRM), string(api.WindowsBootstrapSSH),
+		}))
+	}
+
+	if spec.CloudInitDataSource == api.CloudInitDataSourceNoCloud {
+		errs = append(errs, field.Forbidden(field.NewPath("cloudInitDataSource"), "Windows VMs use the ConfigDrive datasource of cloudbase-init"))
+	}
+	if len(spec.NodeLabels) > 0 {
+		errs = append(errs, field.Forbidden(field.NewPath("nodeLabels"), "is not supported for Windows VMs, set the node labels in the userData"))
+	}
+
+	return errs
+}
+
+func validatePodNetwork(podNetwork *api.PodNetworkSpec, fldPath *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+
+	portsPath := fldPath.Child("ports")
+	if len(podNetwork.Ports) > 0 && !podNetwork.Masquerade {
+		errs = append(errs, field.Forbidden(portsPath, "can only be specified if masquerade is used"))
+	}
+	for i, port := range podNetwork.Ports {
+		idxPath := portsPath.Index(i)
+		if port.Port < 1 || port.Port > 65535 {
+			errs = append(errs, field.Invalid(idxPath.Child("port"), port.Port, "must be between 1 and 65535"))
+		}
+		switch corev1.Protocol(port.Protocol) {
+		case "", corev1.ProtocolTCP, corev1.ProtocolUDP:
+		default:
+			errs = append(errs, field.NotSupported(idxPath.Child("protocol"), port.Protocol,
+				[]string{string(corev1.ProtocolTCP), string(corev1.ProtocolUDP)}))
+		}
+	}
+
+	errs = append(errs, validateInterface(&podNetwork.InterfaceSpec, fldPath)...)
+
+	return errs
+}
+
+func validateInterface(iface *api.InterfaceSpec, fldPath *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+
+	errs = append(errs, validatePciAddress(iface.PciAddress, fldPath.Child("pciAddress"))...)
+
+	if iface.Model != "" && !interfaceModels.Has(iface.Model) {
+		errs = append(errs, field.NotSupported(fldPath.Child("model"), iface.Model, interfaceModels.List()))
+	}
+
+	if iface.DHCPOptions != nil {
+		dhcpOptionsPath := fldPath.Child("dhcpOptions")
+		for i, ntpServer := range iface.DHCPOptions.NTPServers {
+			if net.ParseIP(ntpServer).To4() == nil {
+				errs = append(errs, field.Invalid(dhcpOptionsPath.Child("ntpServers").Index(i), ntpServer, "must be an IPv4 address"))
+			}
+		}
+		for i, privateOption := range iface.DHCPOptions.PrivateOptions {
+			if privateOption.Option < 224 || privateOption.Option > 254 {
+				errs = append(errs, field.Invalid(dhcpOptionsPath.Child("privateOptions").Index(i).Child("option"),
+					privateOption.Option, "must be between 224 and 254"))
+			}
+		}
+	}
+
+	return errs
+}
+
+func validateIPAM(ipam *api.IPAMSpec, fldPath *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+
+	_, subnet, err := net.ParseCIDR(ipam.CIDR)
+	if err != nil || subnet.IP.To4() == nil {
+		return append(errs, field.Invalid(fldPath.Child("cidr"), ipam.CIDR, "must be an IPv4 subnet in CIDR notation"))
+	}
+
+	for _, address := range []struct{ name, value string }{
+		{"rangeStart", ipam.RangeStart},
+		{"rangeEnd", ipam.RangeEnd},
+		{"gateway", ipam.Gateway},
+	} {
+		if address.value == "" {
+			continue
+		}
+		if ip := net.ParseIP(address.value).To4(); ip == nil || !subnet.Contains(ip) {
+			errs = append(errs, field.Invalid(fldPath.Child(address.name), address.value,
+				fmt.Sprintf("must be an IP address of subnet %s", ipam.CIDR)))
+		}
+	}
+
+	if len(errs) == 0 && ipam.RangeStart != "" && ipam.RangeEnd != "" &&
+		bytes.Compare(net.ParseIP(ipam.RangeStart).To4(), net.ParseIP(ipam.RangeEnd).To4()) > 0 {
+		errs = append(errs, field.Invalid(fldPath.Child("rangeEnd"), ipam.RangeEnd,
+			fmt.Sprintf("must not be before rangeStart %s", ipam.RangeStart)))
+	}
+
+	for i, nameserver := range ipam.Nameservers {
+		if net.ParseIP(nameserver) == nil {
+			errs = append(errs, field.Invalid(fldPath.Child("nameservers").Index(i), nameserver, "must be an IP address"))
+		}
+	}
+
+	return errs
+}
+
+var (
+	// reservedVolumeNames are the names of the volumes that are added to the VM by the provider.
+	reservedVolumeNames = sets.NewString("datavolumedisk", "cloudinitdisk", "virtiodrivers", "sysprep")
+	// interfaceModels are the network interface models supported by KubeVirt.
+	interfaceModels = sets.NewString("e1000", "e1000e", "ne2k_pci", "pcnet", "rtl8139", "virtio")
+	// windowsDiskBuses are the disk buses supported for the root disks of Windows VMs.
+	windowsDiskBuses = sets.NewString("sata", "scsi", "virtio")
+	// diskSerialRegexp matches the disk serial numbers accepted by KubeVirt.
+	diskSerialRegexp = regexp.MustCompile(`^[A-Za-z0-9_.+-]+$`)
+	// pciAddressRegexp matches the PCI addresses accepted by KubeVirt, in the form domain:bus:slot.function.
+	pciAddressRegexp = regexp.MustCompile(`^[0-9a-fA-F]{4}:[0-9a-fA-F]{2}:[0-9a-fA-F]{2}\.[0-7]$`)
+)
+
+func validateAdditionalVolumes(volumes []api.AdditionalVolumeSpec, fldPath *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+
+	names := sets.NewString()
+	serviceAccounts := 0
+	for i, volume := range volumes {
+		idxPath := fldPath.Index(i)
+
+		switch {
+		case volume.Name == "":
+			errs = append(errs, field.Required(idxPath.Child("name"), "cannot be empty"))
+		case reservedVolumeNames.Has(volume.Name):
+			errs = append(errs, field.Invalid(idxPath.Child("name"), volume.Name, "name is reserved"))
+		case names.Has(volume.Name):
+			errs = append(errs, field.Duplicate(idxPath.Child("name"), volume.Name))
+		}
+		names.Insert(volume.Name)
+
+		if volume.Serial != "" && !diskSerialRegexp.MatchString(volume.Serial) {
+			errs = append(errs, field.Invalid(idxPath.Child("serial"), volume.Serial,
+				fmt.Sprintf("must match the regular expression %q", diskSerialRegexp.String())))
+		}
+
+		sources := 0
+		if volume.ConfigMap != nil {
+			sources++
+			if volume.ConfigMap.Name == "" {
+				errs = append(errs, field.Required(idxPath.Child("configMap", "name"), "cannot be empty"))
+			}
+		}
+		if volume.Secret != nil {
+			sources++
+			if volume.Secret.SecretName == "" {
+				errs = append(errs, field.Required(idxPath.Child("secret", "secretName"), "cannot be empty"))
+			}
+		}
+		if volume.ServiceAccount != nil {
+			sources++
+			serviceAccounts++
+			if volume.ServiceAccount.ServiceAccountName == "" {
+				errs = append(errs, field.Required(idxPath.Child("serviceAccount", "serviceAccountName"), "cannot be empty"))
+			}
+			if serviceAccounts > 1 {
+				errs = append(errs, field.Forbidden(idxPath.Child("serviceAccount"), "only one serviceAccount volume is allowed"))
+			}
+		}
+		if volume.HostDisk != nil {
+			sources++
+			errs = append(errs, validateHostDisk(volume.HostDisk, idxPath.Child("hostDisk"))...)
+		}
+		if volume.PersistentVolumeClaim != nil {
+			sources++
+			if volume.PersistentVolumeClaim.ClaimName == "" {
+				errs = append(errs, field.Required(idxPath.Child("persistentVolumeClaim", "claimName"), "cannot be empty"))
+			}
+		}
+		if volume.ContainerDisk != nil {
+			sources++
+			if volume.ContainerDisk.Image == "" {
+				errs = append(errs, field.Required(idxPath.Child("containerDisk", "image"), "cannot be empty"))
+			}
+			if secretName := volume.ContainerDisk.ImagePullSecret; secretName != "" {
+				for _, msg := range apivalidation.NameIsDNSSubdomain(secretName, false) {
+					errs = append(errs, field.Invalid(idxPath.Child("containerDisk", "imagePullSecret"), secretName, msg))
+				}
+			}
+		}
+		if sources != 1 {
+			errs = append(errs, field.Invalid(idxPath, volume.Name, "exactly one volume source must be specified"))
+		}
+
+		if volume.Device != nil {
+			errs = append(errs, validateDiskDevice(volume.Device, volume.PersistentVolumeClaim != nil, idxPath.Child("device"))...)
+		}
+
+		if volume.DedicatedIOThread != nil && *volume.DedicatedIOThread && !isVirtioDisk(volume.Device) {
+			errs = append(errs, field.Forbidden(idxPath.Child("dedicatedIOThread"), "is only supported for virtio disks"))
+		}
+	}
+
+	return errs
+}
+
+func validateDiskDevice(device *kubevirtv1.DiskDevice, isPVC bool, fldPath *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+
+	devices := 0
+	if device.Disk != nil {
+		devices++
+		errs = append(errs, validatePciAddress(device.Disk.PciAddress, fldPath.Child("disk", "pciAddress"))...)
+	}
+	if device.LUN != nil {
+		devices++
+		if !isPVC {
+			errs = append(errs, field.Forbidden(fldPath.Child("lun"), "is only supported for persistentVolumeClaim volumes"))
+		}
+	}
+	if device.CDRom != nil {
+		devices++
+	}
+	if device.Floppy != nil {
+		devices++
+	}
+	if devices != 1 {
+		errs = append(errs, field.Invalid(fldPath, device, "exactly one of disk, lun, cdrom or floppy must be specified"))
+	}
+
+	return errs
+}
+
+func validatePciAddress(pciAddress string, fldPath *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+
+	if pciAddress != "" && !pciAddressRegexp.MatchString(pciAddress) {
+		errs = append(errs, field.Invalid(fldPath, pciAddress,
+			fmt.Sprintf("must match the regular expression %q", pciAddressRegexp.String())))
+	}
+
+	return errs
+}
+
+// isVirtioDisk checks whether the given disk device is a virtio disk, which is the default if no device is specified.
+func isVirtioDisk(device *kubevirtv1.DiskDevice) bool {
+	if device == nil {
+		return true
+	}
+	return device.Disk != nil && (device.Disk.Bus == "" || device.Disk.Bus == "virtio")
+}
+
+func validateHostDisk(hostDisk *kubevirtv1.HostDisk, fldPath *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+
+	if hostDisk.Path == "" {
+		errs = append(errs, field.Required(fldPath.Child("path"), "cannot be empty"))
+	}
+
+	switch hostDisk.Type {
+	case kubevirtv1.HostDiskExists:
+	case kubevirtv1.HostDiskExistsOrCreate:
+		if hostDisk.Capacity.IsZero() {
+			errs = append(errs, field.Required(fldPath.Child("capacity"),
+				fmt.Sprintf("cannot be zero when type is %s", kubevirtv1.HostDiskExistsOrCreate)))
+		}
+	default:
+		errs = append(errs, field.NotSupported(fldPath.Child("type"), hostDisk.Type,
+			[]string{string(kubevirtv1.HostDiskExists), string(kubevirtv1.HostDiskExistsOrCreate)}))
+	}
+
 	return errs
 }
 
-// ValidateKubevirtProviderSecrets validates kubevirt secrets
-func ValidateKubevirtProviderSecrets(secret *corev1.Secret) []error {
+// ValidateKubevirtProviderSecrets validates kubevirt secrets, including the kubeconfig of the provider cluster
+// of the zone of the given provider spec or the bearer token credentials it is built from
+func ValidateKubevirtProviderSecrets(secret *corev1.Secret, spec *api.KubeVirtProviderSpec) []error {
 	var errs []error
 
 	if secret == nil {
 		errs = append(errs, errors.New("secret object passed by the MCM is nil"))
 	} else {
-		kubeconfig, kubevirtKubeconifgCheck := secret.Data["kubeconfig"]
+		kubeconfig, err := api.GetKubeconfig(secret.Data, spec)
 		_, userdataCheck := secret.Data["userData"]
 
-		if !kubevirtKubeconifgCheck {
-			errs = append(errs, fmt.Errorf("secret kubeconfig is required field"))
+		if err != nil {
+			errs = append(errs, err)
 		} else {
 			_, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
 			if err != nil {
@@ -0,0 +1,66 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validation
+
+import (
+	"testing"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestValidateIPAM(t *testing.T) {
+	tests := []struct {
+		name  string
+		ipam  api.IPAMSpec
+		valid bool
+	}{
+		{
+			name:  "subnet",
+			ipam:  api.IPAMSpec{CIDR: "10.0.0.0/24", Gateway: "10.0.0.1"},
+			valid: true,
+		},
+		{
+			name:  "range",
+			ipam:  api.IPAMSpec{CIDR: "10.0.0.0/24", RangeStart: "10.0.0.10", RangeEnd: "10.0.0.20"},
+			valid: true,
+		},
+		{
+			name: "range outside of subnet",
+			ipam: api.IPAMSpec{CIDR: "10.0.0.0/24", RangeStart: "10.0.1.10"},
+		},
+		{
+			name: "range start after range end",
+			ipam: api.IPAMSpec{CIDR: "10.0.0.0/24", RangeStart: "10.0.0.20", RangeEnd: "10.0.0.10"},
+		},
+		{
+			name: "IPv6 subnet",
+			ipam: api.IPAMSpec{CIDR: "fd00::/64"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errs := validateIPAM(&test.ipam, field.NewPath("ipam"))
+			if test.valid && len(errs) > 0 {
+				t.Fatalf("expected IPAM to be valid, got %v", errs)
+			}
+			if !test.valid && len(errs) == 0 {
+				t.Fatal("expected IPAM to be invalid")
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+//go:build e2e
+// +build e2e
+
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package e2e contains the end-to-end tests of the provider, which run the machine flows against a provider cluster
+// with KubeVirt and CDI, e.g. one set up by hack/e2e/cluster-up.sh. They only run with the e2e build tag.
+package e2e
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+	clouderrors "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/errors"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/validation"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	clientcmdlatest "k8s.io/client-go/tools/clientcmd/api/latest"
+	clientcmdv1 "k8s.io/client-go/tools/clientcmd/api/v1"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	cdi "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	machineClassName = "e2e"
+	machineName      = "e2e-machine"
+	pollInterval     = 5 * time.Second
+)
+
+// config is the configuration of the e2e tests, read from environment variables.
+type config struct {
+	kubeconfig       string
+	namespace        string
+	sourceURL        string
+	storageClassName string
+	timeout          time.Duration
+}
+
+func getConfig(t *testing.T) config {
+	cfg := config{
+		kubeconfig:       os.Getenv("E2E_KUBECONFIG"),
+		namespace:        getEnv("E2E_NAMESPACE", "mcm-provider-kubevirt-e2e"),
+		sourceURL:        getEnv("E2E_SOURCE_URL", "https://download.cirros-cloud.net/0.5.1/cirros-0.5.1-x86_64-disk.img"),
+		storageClassName: getEnv("E2E_STORAGE_CLASS", "standard"),
+		timeout:          15 * time.Minute,
+	}
+	if cfg.kubeconfig == "" {
+		t.Skip("E2E_KUBECONFIG is not set")
+	}
+	if timeout := os.Getenv("E2E_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			t.Fatalf("invalid E2E_TIMEOUT: %v", err)
+		}
+		cfg.timeout = d
+	}
+	return cfg
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// newSecret returns a credentials secret with the given kubeconfig, with the namespace of its current context
+// replaced by the given namespace.
+func newSecret(kubeconfigPath, namespace string) (*corev1.Secret, error) {
+	config, err := clientcmd.LoadFromFile(kubeconfigPath)
+	if err != nil {
+		return nil, err
+	}
+	kubeContext, ok := config.Contexts[config.CurrentContext]
+	if !ok {
+		return nil, fmt.Errorf("kubeconfig %s has no current context", kubeconfigPath)
+	}
+	kubeContext.Namespace = namespace
+	if err := clientcmdapi.FlattenConfig(config); err != nil {
+		return nil, err
+	}
+
+	v1Config := &clientcmdv1.Config{}
+	if err := clientcmdlatest.Scheme.Convert(config, v1Config, nil); err != nil {
+		return nil, err
+	}
+	kubeconfig, err := json.Marshal(v1Config)
+	if err != nil {
+		return nil, err
+	}
+	return &corev1.Secret{
+		Data: map[string][]byte{
+			api.DefaultKubeconfigKey: kubeconfig,
+			"userData":               []byte("#cloud-config\n"),
+		},
+	}, nil
+}
+
+func newProviderSpec(cfg config) *api.KubeVirtProviderSpec {
+	return &api.KubeVirtProviderSpec{
+		Region:           "e2e",
+		Zone:             "e2e-1",
+		SourceURL:        cfg.sourceURL,
+		StorageClassName: cfg.storageClassName,
+		PVCSize:          resource.MustParse("1Gi"),
+		Resources: kubevirtv1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("100m"),
+				corev1.ResourceMemory: resource.MustParse("128Mi"),
+			},
+		},
+		Tags: map[string]string{
+			"mcm.gardener.cloud/machineclass": machineClassName,
+		},
+	}
+}
+
+// TestMachineLifecycle creates a machine, waits for its VM to run, shuts it down, starts it again and deletes it.
+func TestMachineLifecycle(t *testing.T) {
+	cfg := getConfig(t)
+	if err := cdi.AddToScheme(scheme.Scheme); err != nil {
+		t.Fatalf("failed to add CDI to scheme: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout)
+	defer cancel()
+
+	secret, err := newSecret(cfg.kubeconfig, cfg.namespace)
+	if err != nil {
+		t.Fatalf("failed to build credentials secret: %v", err)
+	}
+	providerSpec := newProviderSpec(cfg)
+	if errs := validation.ValidateKubevirtProviderSpec(providerSpec); len(errs) > 0 {
+		t.Fatalf("invalid provider spec: %v", errs)
+	}
+	if errs := validation.ValidateKubevirtProviderSecrets(secret, providerSpec); len(errs) > 0 {
+		t.Fatalf("invalid credentials secret: %v", errs)
+	}
+
+	clientOptions := core.ClientOptions{}
+	c, _, err := clientOptions.GetClient(secret)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: cfg.namespace}}
+	if err := c.Create(ctx, namespace); err != nil && !kerrors.IsAlreadyExists(err) {
+		t.Fatalf("failed to create namespace: %v", err)
+	}
+	defer func() {
+		if err := c.Delete(context.Background(), namespace); err != nil {
+			t.Logf("failed to delete namespace: %v", err)
+		}
+	}()
+
+	plugin, err := core.NewPluginSPIImpl(clientOptions, clientOptions)
+	if err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	providerID, err := plugin.CreateMachine(ctx, machineName, providerSpec, secret)
+	if err != nil {
+		t.Fatalf("failed to create machine: %v", err)
+	}
+	t.Logf("created machine with provider ID %s", providerID)
+	defer func() {
+		if _, err := plugin.DeleteMachine(context.Background(), machineName, providerID, providerSpec, secret); err != nil {
+			t.Logf("failed to delete machine: %v", err)
+		}
+	}()
+
+	waitForVMIPhase(ctx, t, c, cfg.namespace, kubevirtv1.Running)
+	if foundProviderID, err := plugin.GetMachineStatus(ctx, machineName, providerID, providerSpec, secret); err != nil || foundProviderID != providerID {
+		t.Fatalf("unexpected machine status: provider ID %q, error %v", foundProviderID, err)
+	}
+	providerIDs, err := plugin.ListMachines(ctx, providerSpec, secret)
+	if err != nil {
+		t.Fatalf("failed to list machines: %v", err)
+	}
+	if providerIDs[providerID] != machineName {
+		t.Fatalf("machine is not listed: %v", providerIDs)
+	}
+
+	if _, err := plugin.ShutDownMachine(ctx, machineName, providerID, providerSpec, secret); err != nil {
+		t.Fatalf("failed to shut down machine: %v", err)
+	}
+	waitForVMIPhase(ctx, t, c, cfg.namespace, "")
+
+	if _, err := plugin.StartMachine(ctx, machineName, providerID, providerSpec, secret); err != nil {
+		t.Fatalf("failed to start machine: %v", err)
+	}
+	waitForVMIPhase(ctx, t, c, cfg.namespace, kubevirtv1.Running)
+
+	if _, err := plugin.DeleteMachine(ctx, machineName, providerID, providerSpec, secret); err != nil {
+		t.Fatalf("failed to delete machine: %v", err)
+	}
+	if err := wait.PollImmediateUntil(pollInterval, func() (bool, error) {
+		err := c.Get(ctx, types.NamespacedName{Namespace: cfg.namespace, Name: machineName}, &kubevirtv1.VirtualMachine{})
+		if kerrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}, ctx.Done()); err != nil {
+		t.Fatalf("VirtualMachine was not deleted: %v", err)
+	}
+	if _, err := plugin.GetMachineStatus(ctx, machineName, providerID, providerSpec, secret); !clouderrors.IsMachineNotFoundError(err) {
+		t.Fatalf("expected machine not found error after deletion, got %v", err)
+	}
+}
+
+// waitForVMIPhase waits until the VMI of the machine is in the given phase, or doesn't exist for an empty phase.
+func waitForVMIPhase(ctx context.Context, t *testing.T, c client.Client, namespace string, phase kubevirtv1.VirtualMachineInstancePhase) {
+	t.Helper()
+	var lastPhase kubevirtv1.VirtualMachineInstancePhase
+	err := wait.PollImmediateUntil(pollInterval, func() (bool, error) {
+		vmi := &kubevirtv1.VirtualMachineInstance{}
+		if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: machineName}, vmi); err != nil {
+			if kerrors.IsNotFound(err) {
+				return phase == "", nil
+			}
+			return false, err
+		}
+		lastPhase = vmi.Status.Phase
+		return phase != "" && vmi.Status.Phase == phase, nil
+	}, ctx.Done())
+	if err != nil {
+		t.Fatalf("VirtualMachineInstance did not reach phase %q, last phase %q: %v", phase, lastPhase, err)
+	}
+}